@@ -0,0 +1,725 @@
+// Package assetindex provides an index for the Remote Asset API, which
+// maps URIs and qualifiers to content that is stored in the CAS.
+package assetindex
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind describes the kind of content that an index entry refers to.
+type Kind int
+
+const (
+	// Blob entries refer to a single CAS blob.
+	Blob Kind = iota
+
+	// Directory entries refer to the root Directory of a tree in the CAS.
+	Directory
+
+	// Metadata entries record information about a CAS blob, eg its
+	// content type, or its hash with another digest function. They are
+	// keyed by one of the blob's hashes instead of a URI.
+	Metadata
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Directory:
+		return "directory"
+	case Metadata:
+		return "metadata"
+	}
+	return "blob"
+}
+
+// Entry is the value stored in the index.
+type Entry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+
+	// The name of the digest function used for Hash, eg "SHA256".
+	DigestFunction string `json:"digest_function"`
+
+	// When the entry was added, or when the content was fetched.
+	Timestamp time.Time `json:"timestamp"`
+
+	// The entry is not returned after this time. The zero value means
+	// that the entry does not expire.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// The Content-Type reported by the upstream server, if known.
+	ContentType string `json:"content_type,omitempty"`
+
+	// The ETag and Last-Modified headers reported by the upstream
+	// server, if known.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// Key returns the index key for content of the given kind, identified by
+// uri and qualifiers. The order of the qualifiers does not matter.
+func Key(kind Kind, uri string, qualifiers map[string]string) string {
+	names := make([]string, 0, len(qualifiers))
+	for name := range qualifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(kind.String())
+	b.WriteByte(0)
+	b.WriteString(uri)
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(qualifiers[name])
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+const entryFileSuffix = ".json"
+
+// The suffix of temporary files, which are renamed to entry files once
+// they have been written.
+const tempFileSuffix = ".tmp"
+
+// An element of the LRU list.
+type item struct {
+	key   string
+	entry Entry
+
+	// The number of bytes that the entry uses on disk.
+	size int64
+}
+
+// Index maps keys (see Key) to Entries. If it was created with a
+// directory, entries are also stored there so that they persist across
+// restarts. When the total size of the entries exceeds the index's
+// maximum size, the least recently used entries are evicted. It is safe
+// for concurrent use.
+type Index struct {
+	dir     string
+	maxSize int64
+
+	// If flushInterval is non-zero, changes are written to dir in
+	// batches by a background goroutine, see WithFlushInterval.
+	flushInterval    time.Duration
+	flushBatchSize   int
+	flushParallelism int
+
+	mu sync.Mutex
+
+	// Changes which have not been written to dir yet, keyed by entry
+	// key. A nil value means that the entry's file should be removed.
+	pending map[string][]byte
+
+	// Used to ask the background goroutine to flush before the next
+	// interval, and to stop it.
+	flushNow chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	closed   bool
+
+	// The result of the last Flush which had changes to write.
+	flushErr error
+
+	// Serializes writes to dir.
+	flushMu sync.Mutex
+
+	// Map from keys to elements of ll, whose values are *item. Most
+	// recently used elements are at the front of ll.
+	entries map[string]*list.Element
+	ll      *list.List
+	size    int64
+
+	// Keys of removed entries whose files are being deleted, without
+	// holding mu, mapped to channels which are closed once they have
+	// been. Only used if changes are not flushed in batches.
+	removing map[string]chan struct{}
+
+	// Replaceable for tests.
+	now func() time.Time
+}
+
+// NewInMemory returns an Index which does not persist its entries. If
+// maxSize is greater than zero, it limits the total size of the entries
+// in bytes, as they would be stored on disk.
+func NewInMemory(maxSize int64) *Index {
+	return &Index{
+		maxSize:  maxSize,
+		entries:  make(map[string]*list.Element),
+		ll:       list.New(),
+		removing: make(map[string]chan struct{}),
+		now:      time.Now,
+	}
+}
+
+// Option configures an Index created by New.
+type Option func(*Index) error
+
+// WithFlushInterval makes the index write changes to its directory in
+// batches, at least every `interval`, instead of writing each change
+// before Put returns. This improves throughput when there are many
+// changes, but changes made within `interval` of a crash are lost.
+// Call Close to write the remaining changes before exiting.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(i *Index) error {
+		if interval <= 0 {
+			return fmt.Errorf("Invalid asset index flush interval: %v", interval)
+		}
+
+		i.flushInterval = interval
+		return nil
+	}
+}
+
+// WithFlushBatchSize makes the index write changes as soon as there are
+// `size` unwritten changes, without waiting for the flush interval. The
+// default is 1000. It has no effect without WithFlushInterval.
+func WithFlushBatchSize(size int) Option {
+	return func(i *Index) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid asset index flush batch size: %d", size)
+		}
+
+		i.flushBatchSize = size
+		return nil
+	}
+}
+
+// WithFlushParallelism sets the number of files that are written at the
+// same time when changes are flushed. The default is 4. It has no effect
+// without WithFlushInterval.
+func WithFlushParallelism(parallelism int) Option {
+	return func(i *Index) error {
+		if parallelism <= 0 {
+			return fmt.Errorf("Invalid asset index flush parallelism: %d", parallelism)
+		}
+
+		i.flushParallelism = parallelism
+		return nil
+	}
+}
+
+const (
+	defaultFlushBatchSize   = 1000
+	defaultFlushParallelism = 4
+)
+
+// New returns an Index which stores its entries in dir, which is created
+// if it does not exist. Entries which were previously stored there are
+// loaded, except for those which have expired, and temporary files left
+// behind by an interrupted write are removed. If maxSize is greater than
+// zero, it limits the total size of the entries in bytes.
+func New(dir string, maxSize int64, opts ...Option) (*Index, error) {
+	idx := NewInMemory(maxSize)
+	idx.dir = dir
+	idx.flushBatchSize = defaultFlushBatchSize
+	idx.flushParallelism = defaultFlushParallelism
+
+	for _, o := range opts {
+		err := o(idx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create asset index directory: %w", err)
+	}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read asset index directory: %w", err)
+	}
+
+	var items []*item
+	now := idx.now()
+	for _, de := range des {
+		if de.IsDir() {
+			continue
+		}
+
+		filename := filepath.Join(dir, de.Name())
+		if strings.HasSuffix(de.Name(), tempFileSuffix) {
+			_ = os.Remove(filename)
+			continue
+		}
+
+		key, found := strings.CutSuffix(de.Name(), entryFileSuffix)
+		if !found {
+			continue
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read asset index entry: %w", err)
+		}
+
+		var e Entry
+		err = json.Unmarshal(data, &e)
+		if err != nil || e.expired(now) {
+			// Corrupt entries are treated like expired ones.
+			_ = os.Remove(filename)
+			continue
+		}
+
+		items = append(items, &item{key: key, entry: e, size: int64(len(data))})
+	}
+
+	// Treat the most recently added entries as the most recently used.
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].entry.Timestamp.Before(items[j].entry.Timestamp)
+	})
+	for _, it := range items {
+		idx.add(it)
+	}
+	idx.removeFiles(idx.evict())
+
+	if idx.flushInterval > 0 {
+		idx.pending = make(map[string][]byte)
+		idx.flushNow = make(chan struct{}, 1)
+		idx.done = make(chan struct{})
+		idx.stopped = make(chan struct{})
+		go idx.flushPeriodically()
+	}
+
+	return idx, nil
+}
+
+// Get returns the entry for key, and true if it was found and has not
+// expired.
+func (i *Index) Get(key string) (Entry, bool) {
+	i.mu.Lock()
+
+	elem, found := i.entries[key]
+	if !found {
+		i.mu.Unlock()
+		return Entry{}, false
+	}
+
+	it := elem.Value.(*item)
+	if it.entry.expired(i.now()) {
+		removed := i.remove(elem)
+		i.mu.Unlock()
+		i.removeFiles(removed)
+		return Entry{}, false
+	}
+
+	i.ll.MoveToFront(elem)
+	i.mu.Unlock()
+	return it.entry, true
+}
+
+// Put adds or replaces the entry for key. If e.Timestamp is zero, it is
+// set to the current time.
+func (i *Index) Put(key string, e Entry) error {
+	_, err := i.put(key, e, false, "")
+	return err
+}
+
+// CompareAndPut adds or replaces the entry for key like Put, but only if
+// the current entry refers to the content with hash expectedHash, or if
+// expectedHash is "" and there is no current entry. Expired entries are
+// treated as missing. It returns true if e was stored. Concurrent updates
+// of an entry can read it with Get, then call CompareAndPut with its hash
+// and try again if that returns false, so that updates are not lost.
+func (i *Index) CompareAndPut(key string, expectedHash string, e Entry) (bool, error) {
+	return i.put(key, e, true, expectedHash)
+}
+
+// Implements Put, and CompareAndPut if compare is true.
+func (i *Index) put(key string, e Entry, compare bool, expectedHash string) (bool, error) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = i.now()
+	}
+
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return false, err
+	}
+
+	// Without batching, write and sync the entry before taking the lock,
+	// so that lookups don't wait for the disk. It is only renamed into
+	// place while holding the lock, to keep the files in the same order
+	// as the entries in memory.
+	var tmpName string
+	if i.flushInterval == 0 && i.dir != "" {
+		tmpName, err = i.writeTemp(key, data)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	i.mu.Lock()
+
+	// The file of a removed entry must be deleted before the file of a
+	// new entry with the same key is renamed into place.
+	for tmpName != "" {
+		done, found := i.removing[key]
+		if !found {
+			break
+		}
+		i.mu.Unlock()
+		<-done
+		i.mu.Lock()
+	}
+
+	elem, found := i.entries[key]
+
+	if compare {
+		currentHash := ""
+		if found && !elem.Value.(*item).entry.expired(i.now()) {
+			currentHash = elem.Value.(*item).entry.Hash
+		}
+		if currentHash != expectedHash {
+			i.mu.Unlock()
+			if tmpName != "" {
+				_ = os.Remove(tmpName)
+			}
+			return false, nil
+		}
+	}
+
+	if i.pending != nil {
+		i.queue(key, data)
+	} else if tmpName != "" {
+		err = i.rename(key, tmpName)
+		if err != nil {
+			i.mu.Unlock()
+			return false, err
+		}
+	}
+
+	if found {
+		i.size -= elem.Value.(*item).size
+		i.ll.Remove(elem)
+	}
+
+	i.add(&item{key: key, entry: e, size: int64(len(data))})
+	removed := i.evict()
+	i.mu.Unlock()
+
+	i.removeFiles(removed)
+	return true, nil
+}
+
+// Evict removes the entry for key, if there is one.
+func (i *Index) Evict(key string) {
+	i.mu.Lock()
+
+	var removed []string
+	elem, found := i.entries[key]
+	if found {
+		removed = i.remove(elem)
+	}
+	i.mu.Unlock()
+
+	i.removeFiles(removed)
+}
+
+// EvictIfHash removes the entry for key if it still refers to the content
+// with the given hash, and returns true if it was removed.
+func (i *Index) EvictIfHash(key string, hash string) bool {
+	i.mu.Lock()
+
+	elem, found := i.entries[key]
+	if !found || elem.Value.(*item).entry.Hash != hash {
+		i.mu.Unlock()
+		return false
+	}
+
+	removed := i.remove(elem)
+	i.mu.Unlock()
+
+	i.removeFiles(removed)
+	return true
+}
+
+// Stats returns the number of entries in the index, including expired
+// entries which have not been removed yet, and their total size in bytes
+// as they would be stored on disk.
+func (i *Index) Stats() (numEntries int, size int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return len(i.entries), i.size
+}
+
+// Add an item as the most recently used. Must be called with i.mu held,
+// or before the index is shared.
+func (i *Index) add(it *item) {
+	i.entries[it.key] = i.ll.PushFront(it)
+	i.size += it.size
+}
+
+// Remove the least recently used entries until the index is no larger
+// than its maximum size, and return the keys of the files to delete, like
+// remove. Must be called with i.mu held, or before the index is shared.
+func (i *Index) evict() []string {
+	if i.maxSize <= 0 {
+		return nil
+	}
+
+	var removed []string
+	for i.size > i.maxSize && i.ll.Len() > 0 {
+		removed = append(removed, i.remove(i.ll.Back())...)
+	}
+	return removed
+}
+
+// Remove an entry, and return the keys of the files which the caller
+// must delete with removeFiles once i.mu is released, so that other
+// calls don't wait for the disk. Must be called with i.mu held.
+func (i *Index) remove(elem *list.Element) []string {
+	it := elem.Value.(*item)
+	i.ll.Remove(elem)
+	delete(i.entries, it.key)
+	i.size -= it.size
+
+	if i.pending != nil {
+		i.queue(it.key, nil)
+	} else if i.dir != "" {
+		i.removing[it.key] = make(chan struct{})
+		return []string{it.key}
+	}
+	return nil
+}
+
+// Delete the files of removed entries, from remove or evict. Must be
+// called without i.mu held.
+func (i *Index) removeFiles(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	for _, key := range keys {
+		_ = os.Remove(filepath.Join(i.dir, key+entryFileSuffix))
+	}
+
+	i.mu.Lock()
+	for _, key := range keys {
+		close(i.removing[key])
+		delete(i.removing, key)
+	}
+	i.mu.Unlock()
+}
+
+// Record a change to be written by the next flush, and trigger a flush
+// if there are enough changes. Must be called with i.mu held.
+func (i *Index) queue(key string, data []byte) {
+	i.pending[key] = data
+
+	if len(i.pending) >= i.flushBatchSize {
+		select {
+		case i.flushNow <- struct{}{}:
+		default:
+			// A flush has already been requested.
+		}
+	}
+}
+
+// Flush changes every i.flushInterval, or sooner if enough changes are
+// queued, until Close is called.
+func (i *Index) flushPeriodically() {
+	defer close(i.stopped)
+
+	ticker := time.NewTicker(i.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.done:
+			return
+		case <-ticker.C:
+		case <-i.flushNow:
+		}
+
+		// Failed changes are retried by the next flush.
+		_ = i.Flush()
+	}
+}
+
+// Flush writes changes which have not been written to the index's
+// directory yet. It is only needed if WithFlushInterval was used.
+// Changes which fail to be written are kept, to be retried by the next
+// flush, and the first error is returned.
+func (i *Index) Flush() error {
+	i.flushMu.Lock()
+	defer i.flushMu.Unlock()
+
+	i.mu.Lock()
+	batch := i.pending
+	if len(batch) == 0 {
+		i.mu.Unlock()
+		return nil
+	}
+	i.pending = make(map[string][]byte)
+	i.mu.Unlock()
+
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	var failed []string
+
+	for n := 0; n < i.flushParallelism; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				var err error
+				data := batch[key]
+				if data == nil {
+					err = os.Remove(filepath.Join(i.dir, key+entryFileSuffix))
+					if os.IsNotExist(err) {
+						err = nil
+					}
+				} else {
+					err = i.write(key, data)
+				}
+
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed = append(failed, key)
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for key := range batch {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	i.mu.Lock()
+	for _, key := range failed {
+		if _, found := i.pending[key]; !found {
+			// Not superseded by a later change.
+			i.pending[key] = batch[key]
+		}
+	}
+	i.flushErr = firstErr
+	i.mu.Unlock()
+
+	return firstErr
+}
+
+// CheckHealth returns a non-nil error if the index can't currently store
+// changes: if its background flushes were stopped by Close, if its
+// directory is missing, or if the last flush failed.
+func (i *Index) CheckHealth(ctx context.Context) error {
+	i.mu.Lock()
+	closed := i.closed
+	flushErr := i.flushErr
+	i.mu.Unlock()
+
+	if closed {
+		return errors.New("the asset index is closed")
+	}
+
+	if i.dir == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(i.dir)
+	if err != nil {
+		return fmt.Errorf("the asset index directory is unavailable: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("the asset index directory %s is not a directory", i.dir)
+	}
+
+	return flushErr
+}
+
+// Close stops the background flushes, if there are any, and writes the
+// remaining changes. The index can still be used afterwards, but changes
+// are only written by calls to Flush.
+func (i *Index) Close() error {
+	i.mu.Lock()
+	if i.pending == nil || i.closed {
+		i.mu.Unlock()
+		return nil
+	}
+	i.closed = true
+	i.mu.Unlock()
+
+	close(i.done)
+	<-i.stopped
+
+	return i.Flush()
+}
+
+// Atomically write the file for an entry. Must be called with i.mu held,
+// or with i.flushMu held if changes are flushed in batches.
+func (i *Index) write(key string, data []byte) error {
+	tmpName, err := i.writeTemp(key, data)
+	if err != nil {
+		return err
+	}
+
+	return i.rename(key, tmpName)
+}
+
+// Writes and syncs data to a temporary file in i.dir, and returns its
+// name.
+func (i *Index) writeTemp(key string, data []byte) (string, error) {
+	f, err := os.CreateTemp(i.dir, key+".*"+tempFileSuffix)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write asset index entry: %w", err)
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return "", fmt.Errorf("Failed to write asset index entry: %w", err)
+	}
+
+	return tmpName, nil
+}
+
+// Renames the temporary file tmpName, from writeTemp, to the file for
+// key.
+func (i *Index) rename(key string, tmpName string) error {
+	err := os.Rename(tmpName, filepath.Join(i.dir, key+entryFileSuffix))
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("Failed to write asset index entry: %w", err)
+	}
+
+	return nil
+}
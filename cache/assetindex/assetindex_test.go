@@ -0,0 +1,659 @@
+package assetindex
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/buchgr/bazel-remote/v2/utils"
+)
+
+func TestKey(t *testing.T) {
+	uri := "https://example.com/foo.tar.gz"
+
+	k1 := Key(Blob, uri, map[string]string{"a": "1", "b": "2"})
+	k2 := Key(Blob, uri, map[string]string{"b": "2", "a": "1"})
+	if k1 != k2 {
+		t.Error("expected the order of qualifiers to not matter")
+	}
+
+	different := []string{
+		Key(Directory, uri, map[string]string{"a": "1", "b": "2"}),
+		Key(Metadata, uri, map[string]string{"a": "1", "b": "2"}),
+		Key(Blob, uri+"x", map[string]string{"a": "1", "b": "2"}),
+		Key(Blob, uri, map[string]string{"a": "1"}),
+		Key(Blob, uri, map[string]string{"a": "1", "b": "3"}),
+		Key(Blob, uri, map[string]string{"a": "1b=2"}),
+	}
+	for i, k := range different {
+		if k == k1 {
+			t.Errorf("expected key %d to differ", i)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	idx.now = func() time.Time { return now }
+
+	permanent := Entry{Hash: "aaaa", Size: 1, ContentType: "application/gzip", ETag: `"abc"`}
+	expiring := Entry{Hash: "bbbb", Size: 2, ExpiresAt: now.Add(time.Hour)}
+
+	for key, e := range map[string]Entry{"permanent": permanent, "expiring": expiring} {
+		err = idx.Put(key, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, found := idx.Get("missing")
+	if found {
+		t.Error("expected missing key to not be found")
+	}
+
+	e, found := idx.Get("expiring")
+	if !found || e.Hash != expiring.Hash || e.Size != expiring.Size {
+		t.Errorf("expected to find %v, got %v (found: %v)", expiring, e, found)
+	}
+
+	// Entries should persist across restarts.
+	idx, err = New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.now = func() time.Time { return now }
+
+	e, found = idx.Get("permanent")
+	if !found || e.Hash != permanent.Hash || e.ContentType != permanent.ContentType || e.ETag != permanent.ETag {
+		t.Errorf("expected to find %v after reloading, got %v (found: %v)", permanent, e, found)
+	}
+	e, found = idx.Get("expiring")
+	if !found || !e.ExpiresAt.Equal(expiring.ExpiresAt) {
+		t.Errorf("expected to find %v after reloading, got %v (found: %v)", expiring, e, found)
+	}
+
+	// Expired entries are not returned, and are removed.
+	idx.now = func() time.Time { return now.Add(2 * time.Hour) }
+	_, found = idx.Get("expiring")
+	if found {
+		t.Error("expected expired entry to not be found")
+	}
+	_, err = os.Stat(dir + "/expiring" + entryFileSuffix)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected expired entry file to be removed, got: %v", err)
+	}
+
+	_, found = idx.Get("permanent")
+	if !found {
+		t.Error("expected entry without an expiry time to be found")
+	}
+}
+
+func TestInMemoryIndex(t *testing.T) {
+	idx := NewInMemory(0)
+
+	err := idx.Put("key", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, found := idx.Get("key")
+	if !found || e.Hash != "aaaa" {
+		t.Errorf("expected to find entry, got %v (found: %v)", e, found)
+	}
+
+	numEntries, size := idx.Stats()
+	if numEntries != 1 || size <= 0 {
+		t.Errorf("expected 1 entry with a positive size, got %d entries of %d bytes", numEntries, size)
+	}
+}
+
+func TestIndexEvict(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.Put("key", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx.Evict("key")
+	idx.Evict("missing")
+
+	_, found := idx.Get("key")
+	if found {
+		t.Error("expected evicted entry to not be found")
+	}
+
+	idx, err = New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found = idx.Get("key")
+	if found {
+		t.Error("expected evicted entry to not be found after reloading")
+	}
+}
+
+func TestIndexEvictIfHash(t *testing.T) {
+	idx := NewInMemory(0)
+
+	err := idx.Put("key", Entry{Hash: "bbbb", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if idx.EvictIfHash("key", "aaaa") {
+		t.Error("expected an entry with a different hash not to be evicted")
+	}
+	if idx.EvictIfHash("missing", "bbbb") {
+		t.Error("expected a missing entry not to be evicted")
+	}
+	_, found := idx.Get("key")
+	if !found {
+		t.Fatal("expected entry to be found")
+	}
+
+	if !idx.EvictIfHash("key", "bbbb") {
+		t.Error("expected the entry to be evicted")
+	}
+	_, found = idx.Get("key")
+	if found {
+		t.Error("expected evicted entry to not be found")
+	}
+}
+
+func TestIndexCompareAndPut(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := idx.CompareAndPut("key", "aaaa", Entry{Hash: "bbbb", Size: 1})
+	if err != nil || ok {
+		t.Fatalf("expected a missing entry not to match, got %v %v", ok, err)
+	}
+	ok, err = idx.CompareAndPut("key", "", Entry{Hash: "bbbb", Size: 1})
+	if err != nil || !ok {
+		t.Fatalf("expected the entry to be added, got %v %v", ok, err)
+	}
+
+	ok, err = idx.CompareAndPut("key", "", Entry{Hash: "cccc", Size: 1})
+	if err != nil || ok {
+		t.Fatalf("expected an existing entry not to match, got %v %v", ok, err)
+	}
+	ok, err = idx.CompareAndPut("key", "aaaa", Entry{Hash: "cccc", Size: 1})
+	if err != nil || ok {
+		t.Fatalf("expected a different hash not to match, got %v %v", ok, err)
+	}
+	ok, err = idx.CompareAndPut("key", "bbbb", Entry{Hash: "cccc", Size: 1})
+	if err != nil || !ok {
+		t.Fatalf("expected the entry to be replaced, got %v %v", ok, err)
+	}
+
+	// Expired entries are treated as missing.
+	ok, err = idx.CompareAndPut("key", "cccc", Entry{Hash: "dddd", Size: 1, ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil || !ok {
+		t.Fatalf("expected the entry to be replaced, got %v %v", ok, err)
+	}
+	ok, err = idx.CompareAndPut("key", "dddd", Entry{Hash: "eeee", Size: 1})
+	if err != nil || ok {
+		t.Fatalf("expected an expired entry not to match, got %v %v", ok, err)
+	}
+	ok, err = idx.CompareAndPut("key", "", Entry{Hash: "eeee", Size: 1})
+	if err != nil || !ok {
+		t.Fatalf("expected the entry to be replaced, got %v %v", ok, err)
+	}
+
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Fatalf("expected no temporary files, found %v", tmpFiles)
+	}
+
+	reloaded, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, found := reloaded.Get("key")
+	if !found || e.Hash != "eeee" {
+		t.Fatalf("expected eeee on disk, got %v (found: %v)", e.Hash, found)
+	}
+}
+
+func TestIndexCompareAndPutConcurrentUse(t *testing.T) {
+	idx := NewInMemory(0)
+
+	// Each goroutine increments a counter stored in the entry's size, by
+	// retrying until its update is based on the current entry. No
+	// increments should be lost.
+	const goroutines = 8
+	const increments = 100
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; n++ {
+				for {
+					current, _ := idx.Get("counter")
+					next := Entry{Size: current.Size + 1}
+					next.Hash = fmt.Sprintf("%04d", next.Size)
+
+					ok, err := idx.CompareAndPut("counter", current.Hash, next)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	e, _ := idx.Get("counter")
+	if e.Size != goroutines*increments {
+		t.Fatalf("expected %d increments, got %d", goroutines*increments, e.Size)
+	}
+}
+
+func TestIndexLRU(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Find the size of a single entry.
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	idx.now = func() time.Time { return now }
+	err = idx.Put("probe", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySize := idx.size
+	idx.Evict("probe")
+
+	// Room for three entries.
+	idx, err = New(dir, 3*entrySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		now = now.Add(time.Second)
+		err = idx.Put(key, Entry{Hash: "aaaa", Size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make "a" the most recently used, then add another entry which
+	// should evict "b".
+	_, found := idx.Get("a")
+	if !found {
+		t.Fatal("expected to find a")
+	}
+	now = now.Add(time.Second)
+	err = idx.Put("d", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		_, found = idx.Get(key)
+		if found != expected {
+			t.Errorf("expected found: %v for %s, got %v", expected, key, found)
+		}
+	}
+
+	// The limit also applies when loading, and the most recently added
+	// entries are kept.
+	idx, err = New(dir, 2*entrySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{"a": false, "c": true, "d": true} {
+		_, found = idx.Get(key)
+		if found != expected {
+			t.Errorf("expected found: %v for %s after reloading, got %v", expected, key, found)
+		}
+	}
+}
+
+func TestIndexConcurrentUse(t *testing.T) {
+	idx := NewInMemory(4096)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				key := fmt.Sprintf("%d-%d", g, n%10)
+				err := idx.Put(key, Entry{Hash: "aaaa", Size: int64(n)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				idx.Get(key)
+				if n%7 == 0 {
+					idx.Evict(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if idx.size > idx.maxSize {
+		t.Fatalf("expected size <= %d, got %d", idx.maxSize, idx.size)
+	}
+}
+
+func TestIndexConcurrentPutOnDisk(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entry files are written outside the lock, but the files must still
+	// end up matching the entries in memory.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				key := fmt.Sprintf("key-%d", n%5)
+				err := idx.Put(key, Entry{Hash: "aaaa", Size: int64(g*1000 + n)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n%11 == 0 {
+					idx.Evict(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := countEntryFiles(t, dir); n != len(idx.entries) {
+		t.Fatalf("expected %d entry files, found %d", len(idx.entries), n)
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Fatalf("expected no temporary files, found %v", tmpFiles)
+	}
+
+	reloaded, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range idx.entries {
+		expected, _ := idx.Get(key)
+		found, ok := reloaded.Get(key)
+		if !ok || found.Size != expected.Size {
+			t.Fatalf("%s: expected size %d on disk, got %d (found: %v)", key, expected.Size, found.Size, ok)
+		}
+	}
+}
+
+func TestIndexStaleTempFiles(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Put("key", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A temporary file left behind by a write which was interrupted.
+	stale := filepath.Join(dir, "other.123"+tempFileSuffix)
+	err = os.WriteFile(stale, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(stale)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got: %v", stale, err)
+	}
+	_, found := idx.Get("key")
+	if !found {
+		t.Error("expected the entry to be loaded")
+	}
+}
+
+// Returns the number of entry files in dir.
+func countEntryFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entryFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestIndexFlushInterval(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	const interval = 50 * time.Millisecond
+	idx, err := New(dir, 0, WithFlushInterval(interval), WithFlushParallelism(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numEntries = 500
+	var wg sync.WaitGroup
+	for g := 0; g < 5; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < numEntries/5; n++ {
+				key := fmt.Sprintf("%d-%d", g, n)
+				err := idx.Put(key, Entry{Hash: "aaaa", Size: int64(n)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// The entries should be written by the background goroutine, without
+	// calling Flush or Close.
+	deadline := time.Now().Add(20 * interval)
+	for countEntryFiles(t, dir) < numEntries {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d entries to be written within %v, found %d",
+				numEntries, 20*interval, countEntryFiles(t, dir))
+		}
+		time.Sleep(interval / 5)
+	}
+
+	reopened, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for g := 0; g < 5; g++ {
+		for n := 0; n < numEntries/5; n++ {
+			key := fmt.Sprintf("%d-%d", g, n)
+			e, found := reopened.Get(key)
+			if !found || e.Size != int64(n) {
+				t.Fatalf("expected to find %q with size %d, got %v (found: %v)",
+					key, n, e, found)
+			}
+		}
+	}
+
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexFlushBatchSizeAndClose(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Long enough that only the batch size or Close cause writes.
+	idx, err := New(dir, 0, WithFlushInterval(time.Hour), WithFlushBatchSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 10; n++ {
+		err = idx.Put(fmt.Sprintf("batch-%d", n), Entry{Hash: "aaaa", Size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for countEntryFiles(t, dir) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a full batch to be written, found %d entries",
+				countEntryFiles(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Fewer than a batch, which are only written by Close.
+	err = idx.Put("unbatched", Entry{Hash: "bbbb", Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Evict("batch-0")
+
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found := idx.Get("unbatched")
+	if !found {
+		t.Error("expected unflushed entry to be written by Close")
+	}
+
+	_, found = idx.Get("batch-0")
+	if found {
+		t.Error("expected evicted entry to be removed by Close")
+	}
+
+	_, found = idx.Get("batch-9")
+	if !found {
+		t.Error("expected batched entry to persist")
+	}
+}
+
+func TestIndexCheckHealth(t *testing.T) {
+	ctx := context.Background()
+
+	err := NewInMemory(0).CheckHealth(ctx)
+	if err != nil {
+		t.Fatalf("expected an in-memory index to be healthy, got %v", err)
+	}
+
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	idx, err := New(dir, 0, WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.CheckHealth(ctx)
+	if err != nil {
+		t.Fatalf("expected an open index to be healthy, got %v", err)
+	}
+
+	// A flush which fails.
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Put("key", Entry{Hash: "aaaa", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Flush() == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if idx.CheckHealth(ctx) == nil {
+		t.Fatal("expected an index without its directory to be unhealthy")
+	}
+
+	// Once the directory is back, the next flush succeeds.
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.CheckHealth(ctx)
+	if err != nil {
+		t.Fatalf("expected the index to be healthy after a successful flush, got %v", err)
+	}
+
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.CheckHealth(ctx) == nil {
+		t.Fatal("expected a closed index to be unhealthy")
+	}
+}
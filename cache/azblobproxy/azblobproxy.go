@@ -142,6 +142,36 @@ func (c *azBlobCache) Contains(ctx context.Context, kind cache.EntryKind, hash s
 	return exists, size
 }
 
+// Delete implements cache.Deleter.
+func (c *azBlobCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	key := c.objectKey(hash, kind)
+	if c.prefix != "" {
+		key = c.prefix + "/" + key
+	}
+
+	client, err := c.containerClient.NewBlobClient(key)
+	if err != nil {
+		logResponse(c.accessLogger, "DELETE", c.storageAccount, c.container, key, err)
+		return err
+	}
+
+	_, err = client.Delete(ctx, nil)
+	var stgErr *azblob.StorageError
+	if errors.As(err, &stgErr) && stgErr.ErrorCode == azblob.StorageErrorCodeBlobNotFound {
+		err = nil
+	}
+
+	logResponse(c.accessLogger, "DELETE", c.storageAccount, c.container, key, err)
+
+	return err
+}
+
+// CheckHealth implements cache.HealthChecker.
+func (c *azBlobCache) CheckHealth(ctx context.Context) error {
+	_, err := c.containerClient.GetProperties(ctx, nil)
+	return err
+}
+
 func New(
 	storageAccount string,
 	containerName string,
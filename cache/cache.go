@@ -85,6 +85,53 @@ type Proxy interface {
 	Contains(ctx context.Context, kind EntryKind, hash string, size int64) (bool, int64)
 }
 
+// Deleter is an optional interface that Proxy implementations can satisfy
+// if they are able to remove cache items from the backend, eg so that a
+// corrupt item isn't returned again.
+type Deleter interface {
+	// Delete makes a reasonable effort to remove the cache item identified
+	// by `hash` from the proxy backend. Deleting an item which does not
+	// exist is not an error.
+	Delete(ctx context.Context, kind EntryKind, hash string) error
+}
+
+// HealthChecker is an optional interface that Proxy implementations can
+// satisfy if they are able to report whether or not the backend is
+// currently reachable.
+type HealthChecker interface {
+	// CheckHealth returns a non-nil error if the backend can't be reached.
+	CheckHealth(ctx context.Context) error
+}
+
+// Stater is an optional interface that Proxy implementations can satisfy
+// if they are able to report both the logical size and the stored size of
+// a cache item, without reading all of its content. Use the Stat function
+// to call it on any Proxy.
+type Stater interface {
+	// Stat returns whether or not the cache item identified by `hash`
+	// exists on the remote end, its logical size, and its size in the
+	// format used by the disk.Cache instance (eg including the casblob
+	// header and compression), and an error if something went wrong.
+	// Sizes are -1 if unknown. A missing item is not an error.
+	Stat(ctx context.Context, kind EntryKind, hash string) (exists bool, logicalSize int64, sizeOnDisk int64, err error)
+}
+
+// Stat returns the result of p.Stat if p implements Stater. Otherwise
+// it falls back to p.Contains, which only returns the logical size, if
+// known, and the size on disk is reported as unknown.
+func Stat(ctx context.Context, p Proxy, kind EntryKind, hash string) (exists bool, logicalSize int64, sizeOnDisk int64, err error) {
+	if s, ok := p.(Stater); ok {
+		return s.Stat(ctx, kind, hash)
+	}
+
+	exists, logicalSize = p.Contains(ctx, kind, hash, -1)
+	if !exists {
+		return false, -1, -1, nil
+	}
+
+	return true, logicalSize, -1, nil
+}
+
 // TransformActionCacheKey takes an ActionCache key and an instance name
 // and returns a new ActionCache key to use instead. If the instance name
 // is empty, then the original key is returned unchanged.
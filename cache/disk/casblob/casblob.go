@@ -80,9 +80,6 @@ var errWrongMagicNum = errors.New("expected magic number not found")
 
 // Read the header and leave f at the start of the data.
 func readHeader(f *os.File) (*header, error) {
-	var err error
-	var h header
-
 	fileInfo, err := f.Stat()
 	if err != nil {
 		return nil, err
@@ -94,8 +91,28 @@ func readHeader(f *os.File) (*header, error) {
 			foundFileSize, (chunkTableOffset + 16))
 	}
 
+	h, err := decodeHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	finalOffset := h.chunkOffsets[len(h.chunkOffsets)-1]
+	if finalOffset != foundFileSize {
+		return nil,
+			fmt.Errorf("final offset in chunk table %d should be file size %d",
+				finalOffset, foundFileSize)
+	}
+
+	return h, nil
+}
+
+// Read the header from r, and leave r at the start of the data.
+func decodeHeader(r io.Reader) (*header, error) {
+	var err error
+	var h header
+
 	var magicNumber uint32
-	err = binary.Read(f, binary.LittleEndian, &magicNumber)
+	err = binary.Read(r, binary.LittleEndian, &magicNumber)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read magic number: %w", err)
 	}
@@ -104,28 +121,28 @@ func readHeader(f *os.File) (*header, error) {
 	}
 
 	var frameSize uint32
-	err = binary.Read(f, binary.LittleEndian, &frameSize)
+	err = binary.Read(r, binary.LittleEndian, &frameSize)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read frameSize: %w", err)
 	}
 
-	err = binary.Read(f, binary.LittleEndian, &h.uncompressedSize)
+	err = binary.Read(r, binary.LittleEndian, &h.uncompressedSize)
 	if err != nil {
 		return nil, err
 	}
 
-	err = binary.Read(f, binary.LittleEndian, &h.compression)
+	err = binary.Read(r, binary.LittleEndian, &h.compression)
 	if err != nil {
 		return nil, err
 	}
 
-	err = binary.Read(f, binary.LittleEndian, &h.chunkSize)
+	err = binary.Read(r, binary.LittleEndian, &h.chunkSize)
 	if err != nil {
 		return nil, err
 	}
 
 	var numOffsets int64
-	err = binary.Read(f, binary.LittleEndian, &numOffsets)
+	err = binary.Read(r, binary.LittleEndian, &numOffsets)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +160,7 @@ func readHeader(f *os.File) (*header, error) {
 	}
 
 	h.chunkOffsets = make([]int64, numOffsets)
-	err = binary.Read(f, binary.LittleEndian, h.chunkOffsets)
+	err = binary.Read(r, binary.LittleEndian, h.chunkOffsets)
 	if err != nil {
 		return nil, err
 	}
@@ -158,30 +175,27 @@ func readHeader(f *os.File) (*header, error) {
 		prevOffset = h.chunkOffsets[i]
 	}
 
-	if prevOffset != foundFileSize {
-		return nil,
-			fmt.Errorf("final offset in chunk table %d should be file size %d",
-				prevOffset, foundFileSize)
-	}
-
 	return &h, nil
 }
 
+// The number of bytes at the start of a v2 cas blob which contain its
+// logical size: magic number (4 bytes), frame size (4 bytes),
+// uncompressed size (8 bytes).
+const LogicalSizeHeaderSize = 16
+
 // Extract the logical size of a v2 cas blob from rc, and return that
 // size along with an equivalent io.ReadCloser to rc.
 func ExtractLogicalSize(rc io.ReadCloser) (io.ReadCloser, int64, error) {
 
-	// Read the first part of the header: magic number (4 bytes),
-	// frame size (4 bytes), uncompressed size (8 bytes).
-	interesting := 16
-	earlyHeader := make([]byte, interesting)
+	// Read the first part of the header.
+	earlyHeader := make([]byte, LogicalSizeHeaderSize)
 
 	n, err := io.ReadFull(rc, earlyHeader)
 	if err != nil {
 		return nil, -1, err
 	}
-	if n != 16 {
-		return nil, -1, fmt.Errorf("Tried to read 16 header bytes, only read %d", n)
+	if n != LogicalSizeHeaderSize {
+		return nil, -1, fmt.Errorf("Tried to read %d header bytes, only read %d", LogicalSizeHeaderSize, n)
 	}
 
 	var uncompressedSize int64
@@ -311,6 +325,29 @@ func GetUncompressedReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize
 	}, nil
 }
 
+// Returns an io.ReadCloser that provides the uncompressed data of the cas
+// blob read from r, eg while it is being copied somewhere else. Unlike
+// GetUncompressedReadCloser, this doesn't need to seek, but it can't
+// check the chunk table against the size of the blob. The caller must
+// close the returned io.ReadCloser if it is non-nil, this does not close
+// r.
+func GetStreamingUncompressedReadCloser(zstd zstdimpl.ZstdImpl, r io.Reader) (io.ReadCloser, error) {
+	h, err := decodeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch h.compression {
+	case Identity:
+		return io.NopCloser(io.LimitReader(r, h.uncompressedSize)), nil
+	case Zstandard:
+		return zstd.GetDecoder(io.NopCloser(r))
+	}
+
+	return nil, fmt.Errorf("internal error: unsupported compression type %d",
+		h.compression)
+}
+
 // Returns an io.ReadCloser that provides zstandard compressed data. The
 // caller must close the returned io.ReadCloser if it is non-nil. Doing so
 // will automatically close f. If there is an error f will be closed, the caller
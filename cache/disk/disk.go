@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -75,8 +76,20 @@ type diskCache struct {
 	zstd             zstdimpl.ZstdImpl
 	maxBlobSize      int64
 	maxProxyBlobSize int64
-	accessLogger     *log.Logger
-	containsQueue    chan proxyCheck
+
+	// Optional per-kind limits, applied in addition to maxBlobSize.
+	maxBlobSizeByKind map[cache.EntryKind]int64
+
+	// Optional per-kind minimum sizes of blobs that are uploaded to the
+	// proxy, smaller blobs are only stored locally.
+	minProxyPutSizeByKind map[cache.EntryKind]int64
+
+	// What to do when a CAS blob is found locally, but the proxy
+	// reports a different size for it.
+	proxySizeMismatchPolicy sizeMismatchPolicy
+
+	accessLogger  *log.Logger
+	containsQueue chan proxyCheck
 
 	// Limit the number of simultaneous file removals.
 	fileRemovalSem *semaphore.Weighted
@@ -85,8 +98,23 @@ type diskCache struct {
 	lru SizedLRU
 
 	gaugeCacheAge prometheus.Gauge
+
+	proxyPutMetrics *proxyPutMetrics
 }
 
+// How to handle CAS blobs whose local size differs from the size reported
+// by the proxy backend, see WithProxySizeMismatchPolicy.
+type sizeMismatchPolicy int
+
+const (
+	// The proxy backend is not checked.
+	sizeMismatchUnchecked sizeMismatchPolicy = iota
+
+	sizeMismatchPreferLocal
+	sizeMismatchPreferProxy
+	sizeMismatchError
+)
+
 const sha256HashStrSize = sha256.Size * 2 // Two hex characters per byte.
 const emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
 
@@ -109,6 +137,7 @@ func (c *diskCache) RegisterMetrics() {
 	c.lru.RegisterMetrics()
 
 	prometheus.MustRegister(c.gaugeCacheAge)
+	c.proxyPutMetrics.register()
 
 	// Update the cache age metric on a static interval
 	// Note: this could be modeled as a GuageFunc that updates as needed
@@ -215,7 +244,9 @@ func (c *diskCache) FileLocation(kind cache.EntryKind, legacy bool, hash string,
 // Put stores a stream of `size` bytes from `r` into the cache.
 // If `hash` is not the empty string, and the contents don't match it,
 // a non-nil error is returned. All data will be read from `r` before
-// this function returns.
+// this function returns. If `r` ends before `size` bytes have been read,
+// a non-nil error is returned and nothing is stored, so callers should
+// treat any non-nil error as a failure.
 func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) (rErr error) {
 	defer func() {
 		if r != nil {
@@ -231,6 +262,12 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 		return badReqErr("Blob size %d too large, max blob size is %d", size, c.maxBlobSize)
 	}
 
+	maxKindSize, ok := c.maxBlobSizeByKind[kind]
+	if ok && size > maxKindSize {
+		return badReqErr("%s blob size %d too large, max %s blob size is %d",
+			kind, size, kind, maxKindSize)
+	}
+
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
 	if len(hash) != sha256HashStrSize {
@@ -323,13 +360,14 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 
 	r = nil // We read all the data from r.
 
-	if c.proxy != nil {
+	if c.proxy != nil && size >= c.minProxyPutSizeByKind[kind] {
 		rc, err := os.Open(blobFile)
 		if err != nil {
 			log.Println("Failed to proxy Put:", err)
 		} else {
 			// Doesn't block, should be fast.
 			c.proxy.Put(ctx, kind, hash, size, sizeOnDisk, rc)
+			c.proxyPutMetrics.observe(kind, size, sizeOnDisk)
 		}
 	}
 
@@ -537,13 +575,17 @@ var errOnlyCompressedCAS = &cache.Error{
 // item is not found, the io.ReadCloser will be nil. If some error occurred
 // when processing the request, then it is returned. Callers should provide
 // the `size` of the item to be retrieved, or -1 if unknown.
+//
+// Items which are stored uncompressed are returned as *os.Files, so that
+// io.Copy can use sendfile(2) when writing them to a network connection.
 func (c *diskCache) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64, offset int64) (rc io.ReadCloser, s int64, rErr error) {
 	return c.get(ctx, kind, hash, size, offset, false)
 }
 
 // GetZstd is just like Get, except the data available from rc is zstandard
 // compressed. Note that the returned `s` value still refers to the amount
-// of data once it has been decompressed.
+// of data once it has been decompressed. Compressed blobs read from the
+// start are returned as *os.Files, like uncompressed blobs from Get.
 func (c *diskCache) GetZstd(ctx context.Context, hash string, size int64, offset int64) (rc io.ReadCloser, s int64, rErr error) {
 	return c.get(ctx, cache.CAS, hash, size, offset, true)
 }
@@ -574,7 +616,11 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 		return nil, -1, badReqErr("Invalid offset: %d for size %d", offset, size)
 	}
 
-	var err error
+	err := c.checkProxySize(ctx, kind, hash)
+	if err != nil {
+		return nil, -1, internalErr(err)
+	}
+
 	key := cache.LookupKey(kind, hash)
 
 	var tf *os.File // Tempfile we will write to.
@@ -654,12 +700,35 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 	blobFile = tf.Name()
 
 	var sizeOnDisk int64
-	sizeOnDisk, err = io.Copy(tf, r)
+	var foundHash string
+	if kind == cache.CAS {
+		sizeOnDisk, foundHash, err = c.copyCASBlob(tf, r, legacy)
+	} else {
+		sizeOnDisk, err = io.Copy(tf, r)
+	}
 	tf.Close()
 	if err != nil {
 		return nil, -1, internalErr(err)
 	}
 
+	if kind == cache.CAS && foundHash != hash {
+		log.Printf("Warning: the proxy backend returned a corrupt %s blob, expected hash %s, found %s",
+			kind, hash, foundHash)
+
+		// Stop it from being returned again, if the proxy backend
+		// supports that.
+		d, ok := c.proxy.(cache.Deleter)
+		if ok {
+			err = d.Delete(ctx, kind, hash)
+			if err != nil {
+				log.Printf("Warning: failed to delete corrupt %s blob %s from the proxy backend: %v",
+					kind, hash, err)
+			}
+		}
+
+		return nil, -1, nil
+	}
+
 	rcf, err := os.Open(blobFile)
 	if err != nil {
 		return nil, -1, internalErr(err)
@@ -699,6 +768,45 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 	return rc, foundSize, nil
 }
 
+// Copies a CAS blob in the on-disk format from r to f, and returns the
+// number of bytes written and the sha256 hash of the blob's uncompressed
+// content, which is calculated while copying.
+func (c *diskCache) copyCASBlob(f *os.File, r io.Reader, legacy bool) (int64, string, error) {
+	tr := io.TeeReader(r, f)
+	hasher := sha256.New()
+
+	if legacy {
+		// The data is uncompressed, without a casblob header.
+		_, err := io.Copy(hasher, tr)
+		if err != nil {
+			return -1, "", err
+		}
+	} else {
+		rc, err := casblob.GetStreamingUncompressedReadCloser(c.zstd, tr)
+		if err != nil {
+			return -1, "", err
+		}
+		_, err = io.Copy(hasher, rc)
+		rc.Close()
+		if err != nil {
+			return -1, "", err
+		}
+
+		// Copy anything that the decoder didn't need to read.
+		_, err = io.Copy(io.Discard, tr)
+		if err != nil {
+			return -1, "", err
+		}
+	}
+
+	sizeOnDisk, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return sizeOnDisk, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // Contains returns true if the `hash` key exists in the cache, and
 // the size if known (or -1 if unknown).
 //
@@ -717,6 +825,10 @@ func (c *diskCache) Contains(ctx context.Context, kind cache.EntryKind, hash str
 		return true, 0
 	}
 
+	if c.checkProxySize(ctx, kind, hash) != nil {
+		return false, -1
+	}
+
 	foundSize := int64(-1)
 	key := cache.LookupKey(kind, hash)
 
@@ -741,6 +853,65 @@ func (c *diskCache) Contains(ctx context.Context, kind cache.EntryKind, hash str
 	return false, -1
 }
 
+// If `hash` is a CAS blob which is found locally, and the proxy backend
+// reports a different size for it, apply c.proxySizeMismatchPolicy. This
+// returns an error if the blob should be reported as missing. With the
+// "proxy" policy the local copy is removed, so that the caller falls
+// back to the proxy backend.
+func (c *diskCache) checkProxySize(ctx context.Context, kind cache.EntryKind, hash string) error {
+	// AC entries can be replaced, so only CAS blobs have a fixed size.
+	if c.proxySizeMismatchPolicy == sizeMismatchUnchecked || c.proxy == nil || kind != cache.CAS {
+		return nil
+	}
+
+	key := cache.LookupKey(kind, hash)
+
+	c.mu.Lock()
+	item, found := c.lru.Get(key)
+	c.mu.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	// Contains usually can't report the logical size of compressed CAS
+	// blobs, but cache.Stat can if the proxy backend supports it.
+	exists, proxySize, _, err := cache.Stat(ctx, c.proxy, kind, hash)
+	if err != nil {
+		log.Printf("Warning: failed to check the proxy backend's size for %s blob %s: %v",
+			kind, hash, err)
+		return nil
+	}
+	if !exists || proxySize < 0 || proxySize == item.size {
+		return nil
+	}
+
+	switch c.proxySizeMismatchPolicy {
+	case sizeMismatchPreferLocal:
+		log.Printf("Warning: the proxy backend reports size %d for %s blob %s, but the local copy has size %d, using the local copy",
+			proxySize, kind, hash, item.size)
+	case sizeMismatchPreferProxy:
+		log.Printf("Warning: the proxy backend reports size %d for %s blob %s, but the local copy has size %d, removing the local copy",
+			proxySize, kind, hash, item.size)
+
+		c.mu.Lock()
+		current, found := c.lru.Get(key)
+		if found && current.random == item.random {
+			// Unless it was replaced in the meantime.
+			c.lru.Remove(key)
+		}
+		c.mu.Unlock()
+	case sizeMismatchError:
+		log.Printf("Warning: the proxy backend reports size %d for %s blob %s, but the local copy has size %d",
+			proxySize, kind, hash, item.size)
+
+		return fmt.Errorf("the proxy backend reports size %d for %s blob %s, but the local copy has size %d",
+			proxySize, kind, hash, item.size)
+	}
+
+	return nil
+}
+
 // MaxSize returns the maximum cache size in bytes.
 func (c *diskCache) MaxSize() int64 {
 	// The underlying value is never modified, no need to lock.
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -277,6 +278,149 @@ func (d proxyStub) Contains(ctx context.Context, kind cache.EntryKind, hash stri
 	return true, contentsLength
 }
 
+// corruptProxyStub implements the cache.Proxy interface, returning the
+// content of proxyStub's blob for every CAS blob, and remembering which
+// blobs were deleted.
+type corruptProxyStub struct {
+	storageMode string
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (d *corruptProxyStub) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+}
+
+func (d *corruptProxyStub) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64) (io.ReadCloser, int64, error) {
+	if kind != cache.CAS {
+		return nil, -1, nil
+	}
+
+	if d.storageMode == "uncompressed" {
+		return io.NopCloser(strings.NewReader(contents)), contentsLength, nil
+	}
+
+	return proxyStub{}.Get(ctx, kind, contentsHash, size)
+}
+
+func (d *corruptProxyStub) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+	return kind == cache.CAS, contentsLength
+}
+
+func (d *corruptProxyStub) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deleted = append(d.deleted, hash)
+	return nil
+}
+
+func TestCacheGetCorruptProxyBlob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, mode := range []string{"zstd", "uncompressed"} {
+		t.Run(mode, func(t *testing.T) {
+			cacheDir := tempDir(t)
+			defer os.RemoveAll(cacheDir)
+
+			proxy := &corruptProxyStub{storageMode: mode}
+			testCacheI, err := New(cacheDir, BlockSize,
+				WithStorageMode(mode),
+				WithProxyBackend(proxy),
+				WithAccessLogger(testutils.NewSilentLogger()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testCache := testCacheI.(*diskCache)
+
+			corruptHash := hashStr("foo")
+			rdr, _, err := testCache.Get(ctx, cache.CAS, corruptHash, contentsLength, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rdr != nil {
+				rdr.Close()
+				t.Fatal("Expected the corrupt blob to not be found")
+			}
+
+			if len(proxy.deleted) != 1 || proxy.deleted[0] != corruptHash {
+				t.Fatalf("Expected the corrupt blob to be deleted from the proxy, deleted: %v",
+					proxy.deleted)
+			}
+
+			if testCache.lru.Len() != 0 {
+				t.Fatalf("Expected the corrupt blob to not be cached, found %d items",
+					testCache.lru.Len())
+			}
+
+			// The proxy's content is valid for this hash.
+			rdr, size, err := testCache.Get(ctx, cache.CAS, contentsHash, contentsLength, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = expectContentEquals(rdr, size, []byte(contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr.Close()
+
+			if len(proxy.deleted) != 1 {
+				t.Fatalf("Expected a valid blob to not be deleted from the proxy, deleted: %v",
+					proxy.deleted)
+			}
+		})
+	}
+}
+
+// A cache.Proxy which hides the cache.Deleter implementation of the one
+// it wraps.
+type nonDeletingProxy struct {
+	proxy cache.Proxy
+}
+
+func (p nonDeletingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	p.proxy.Put(ctx, kind, hash, logicalSize, sizeOnDisk, rc)
+}
+
+func (p nonDeletingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64) (io.ReadCloser, int64, error) {
+	return p.proxy.Get(ctx, kind, hash, size)
+}
+
+func (p nonDeletingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
+	return p.proxy.Contains(ctx, kind, hash, size)
+}
+
+func TestCacheGetCorruptProxyBlobWithoutDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	proxy := &corruptProxyStub{storageMode: "zstd"}
+	testCacheI, err := New(cacheDir, BlockSize,
+		WithProxyBackend(nonDeletingProxy{proxy: proxy}),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	rdr, _, err := testCache.Get(ctx, cache.CAS, hashStr("foo"), contentsLength, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rdr != nil {
+		rdr.Close()
+		t.Fatal("Expected the corrupt blob to not be found")
+	}
+	if testCache.lru.Len() != 0 {
+		t.Fatalf("Expected the corrupt blob to not be cached, found %d items",
+			testCache.lru.Len())
+	}
+}
+
 func expectContentEquals(rdr io.ReadCloser, sizeBytes int64, expectedContent []byte) error {
 	if rdr == nil {
 		return fmt.Errorf("expected the item to exist")
@@ -529,6 +673,46 @@ func TestCacheBlobTooLarge(t *testing.T) {
 	}
 }
 
+// Make sure that per-kind size limits reject large AC entries, without
+// affecting CAS blobs.
+func TestCacheBlobTooLargeForKind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+	testCache, err := New(cacheDir, 1024*1024,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithMaxBlobSizeForKind(cache.AC, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acData, acHash := testutils.RandomDataAndHash(200)
+	err = testCache.Put(ctx, cache.AC, acHash, int64(len(acData)), bytes.NewReader(acData))
+	if err == nil {
+		t.Fatal("Expected an error for an oversized AC entry")
+	}
+	cerr, ok := err.(*cache.Error)
+	if !ok {
+		t.Fatalf("Expected error to be of type Error, got %T: %v", err, err)
+	}
+	if cerr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected error code %d but received %d", http.StatusBadRequest, cerr.Code)
+	}
+
+	casData, casHash := testutils.RandomDataAndHash(200)
+	err = testCache.Put(ctx, cache.CAS, casHash, int64(len(casData)), bytes.NewReader(casData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _ := testCache.Contains(ctx, cache.CAS, casHash, int64(len(casData)))
+	if !found {
+		t.Fatal("Expected the CAS blob to be stored")
+	}
+}
+
 // Make sure that Cache rejects an upload whose hashsum doesn't match
 func TestCacheCorruptedCASBlob(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1251,12 +1435,152 @@ func TestGetWithOffset(t *testing.T) {
 	}
 }
 
+func TestGetReturnsFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const blobSize = 4096
+	data, hash := testutils.RandomDataAndHash(blobSize)
+
+	for _, mode := range []string{"uncompressed", "zstd"} {
+		cacheDir := testutils.TempDir(t)
+		defer os.RemoveAll(cacheDir)
+
+		testCache, err := New(cacheDir, blobSize*10,
+			WithStorageMode(mode),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, kind := range []cache.EntryKind{cache.CAS, cache.RAW} {
+			err = testCache.Put(ctx, kind, hash, blobSize, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Blobs which can be streamed straight from disk must be
+		// *os.Files, so that the HTTP server can use sendfile(2).
+		getters := map[string]func() (io.ReadCloser, int64, error){
+			"RAW": func() (io.ReadCloser, int64, error) {
+				return testCache.Get(ctx, cache.RAW, hash, blobSize, 0)
+			},
+		}
+		if mode == "uncompressed" {
+			getters["CAS"] = func() (io.ReadCloser, int64, error) {
+				return testCache.Get(ctx, cache.CAS, hash, blobSize, 0)
+			}
+		} else {
+			getters["compressed CAS"] = func() (io.ReadCloser, int64, error) {
+				return testCache.GetZstd(ctx, hash, blobSize, 0)
+			}
+		}
+
+		for name, get := range getters {
+			rc, _, err := get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rc == nil {
+				t.Fatalf("%s mode: expected a %s hit", mode, name)
+			}
+			_, ok := rc.(*os.File)
+			rc.Close()
+			if !ok {
+				t.Errorf("%s mode: expected %s blob to be an *os.File, got %T", mode, name, rc)
+			}
+		}
+	}
+}
+
 func count(counter *prometheus.CounterVec, kind string, status string) float64 {
 	gets := testutil.ToFloat64(counter.With(prometheus.Labels{"method": getMethod, "kind": kind, "status": status}))
 	contains := testutil.ToFloat64(counter.With(prometheus.Labels{"method": containsMethod, "kind": kind, "status": status}))
 	return gets + contains
 }
 
+func TestReadSeeker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const blobSize = 2048 + 256
+
+	for _, mode := range []string{"zstd", "uncompressed"} {
+		cacheDir := testutils.TempDir(t)
+		defer os.RemoveAll(cacheDir)
+
+		testCache, err := New(cacheDir, blobSize*2,
+			WithStorageMode(mode),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, hash := testutils.RandomDataAndHash(blobSize)
+		err = testCache.Put(ctx, cache.CAS, hash, blobSize, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := NewReadSeeker(ctx, testCache, cache.CAS, hash, blobSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs == nil {
+			t.Fatalf("%s: expected to find the blob", mode)
+		}
+
+		// Read from the middle of the blob.
+		pos, err := rs.Seek(1024, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != 1024 {
+			t.Fatalf("%s: expected offset 1024, got %d", mode, pos)
+		}
+		buf := make([]byte, 100)
+		_, err = io.ReadFull(rs, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[1024:1124]) {
+			t.Fatalf("%s: got unexpected data after seeking to the middle", mode)
+		}
+
+		// Seek backwards, relative to the current position.
+		_, err = rs.Seek(-200, io.SeekCurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadFull(rs, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[924:1024]) {
+			t.Fatalf("%s: got unexpected data after seeking backwards", mode)
+		}
+
+		// Read the end of the blob.
+		_, err = rs.Seek(-10, io.SeekEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := io.ReadAll(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tail, data[blobSize-10:]) {
+			t.Fatalf("%s: got unexpected data at the end of the blob", mode)
+		}
+
+		err = rs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestMetricsUnvalidatedAC(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
@@ -1444,6 +1768,326 @@ func TestMetricsValidatedAC(t *testing.T) {
 	}
 }
 
+func TestProxyPutCompressionRatio(t *testing.T) {
+	ctx := context.Background()
+
+	compressible := bytes.Repeat([]byte("bazel-remote "), 10000)
+	incompressible, _ := testutils.RandomDataAndHash(128 * 1024)
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		minRatio float64
+		maxRatio float64
+	}{
+		{"compressible", compressible, 10, math.MaxFloat64},
+		{"incompressible", incompressible, 0.9, 1.1},
+	}
+
+	for _, tc := range testCases {
+		cacheDir := tempDir(t)
+		defer os.RemoveAll(cacheDir)
+
+		testCacheI, err := New(cacheDir, 10*1024*1024,
+			WithStorageMode("zstd"),
+			WithProxyBackend(proxyStub{}),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCache := testCacheI.(*diskCache)
+
+		hashBytes := sha256.Sum256(tc.data)
+		hash := hex.EncodeToString(hashBytes[:])
+
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(tc.data)), bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lbls := prometheus.Labels{"kind": "cas"}
+
+		logical := testutil.ToFloat64(testCache.proxyPutMetrics.logicalBytes.With(lbls))
+		if logical != float64(len(tc.data)) {
+			t.Errorf("%s: expected %d logical bytes, got %f", tc.name, len(tc.data), logical)
+		}
+
+		ratio := testutil.ToFloat64(testCache.proxyPutMetrics.ratio.With(lbls))
+		if ratio < tc.minRatio || ratio > tc.maxRatio {
+			t.Errorf("%s: expected compression ratio between %f and %f, got %f",
+				tc.name, tc.minRatio, tc.maxRatio, ratio)
+		}
+	}
+}
+
+// putRecordingProxy is a cache.Proxy which records the blobs uploaded to
+// it, and has no blobs.
+type putRecordingProxy struct {
+	mu   sync.Mutex
+	puts []string
+}
+
+func (p *putRecordingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+
+	p.mu.Lock()
+	p.puts = append(p.puts, fmt.Sprintf("%s/%d", kind, logicalSize))
+	p.mu.Unlock()
+}
+
+func (p *putRecordingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (p *putRecordingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+	return false, -1
+}
+
+func TestProxyMinBlobSizeForKind(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	proxy := &putRecordingProxy{}
+	testCache, err := New(cacheDir, 10*1024*1024,
+		WithProxyBackend(proxy),
+		WithProxyMinBlobSizeForKind(cache.AC, 100),
+		WithProxyMinBlobSizeForKind(cache.CAS, 10),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := []struct {
+		kind cache.EntryKind
+		size int
+	}{
+		{cache.AC, 99},
+		{cache.AC, 100},
+		{cache.CAS, 9},
+		{cache.CAS, 10},
+		// There is no limit for RAW blobs.
+		{cache.RAW, 1},
+	}
+
+	for _, b := range blobs {
+		data, hash := testutils.RandomDataAndHash(int64(b.size))
+		err = testCache.Put(ctx, b.kind, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	expected := []string{"ac/100", "cas/10", "raw/1"}
+	if strings.Join(proxy.puts, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected only blobs at least the minimum size to be uploaded %v, got %v",
+			expected, proxy.puts)
+	}
+
+	_, err = New(cacheDir, 10*1024*1024, WithProxyMinBlobSizeForKind(cache.AC, -1))
+	if err == nil {
+		t.Fatal("expected an error for a negative minimum size")
+	}
+}
+
+// sizeReportingProxy is a cache.Proxy which reports that every blob exists
+// with a fixed size, but has no content.
+type sizeReportingProxy struct {
+	size int64
+
+	mu    sync.Mutex
+	stats int
+}
+
+func (p *sizeReportingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+}
+
+func (p *sizeReportingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (p *sizeReportingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+	// Like the real proxy backends in v2 mode, the logical size of CAS
+	// blobs is only available from Stat.
+	return true, -1
+}
+
+func (p *sizeReportingProxy) Stat(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, int64, error) {
+	p.mu.Lock()
+	p.stats++
+	p.mu.Unlock()
+
+	return true, p.size, -1, nil
+}
+
+func TestProxySizeMismatchPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	data, hash := testutils.RandomDataAndHash(100)
+
+	testCases := []struct {
+		policy string
+
+		// The expected results of Contains.
+		exists bool
+		size   int64
+
+		// Whether the local copy is expected to be kept.
+		kept bool
+
+		// Whether Get is expected to fail.
+		getErr bool
+	}{
+		{policy: "", exists: true, size: 100, kept: true},
+		{policy: "local", exists: true, size: 100, kept: true},
+		{policy: "proxy", exists: true, size: -1, kept: false},
+		{policy: "error", exists: false, size: -1, kept: true, getErr: true},
+	}
+
+	for _, tc := range testCases {
+		cacheDir := tempDir(t)
+		defer os.RemoveAll(cacheDir)
+
+		proxy := &sizeReportingProxy{size: 123}
+		opts := []Option{
+			WithProxyBackend(proxy),
+			WithAccessLogger(testutils.NewSilentLogger()),
+		}
+		if tc.policy != "" {
+			opts = append(opts, WithProxySizeMismatchPolicy(tc.policy))
+		}
+
+		testCacheI, err := New(cacheDir, 10*1024*1024, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCache := testCacheI.(*diskCache)
+
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exists, size := testCache.Contains(ctx, cache.CAS, hash, -1)
+		if exists != tc.exists || size != tc.size {
+			t.Fatalf("policy %q: expected Contains to return %v, %d, got %v, %d",
+				tc.policy, tc.exists, tc.size, exists, size)
+		}
+
+		testCache.mu.Lock()
+		_, kept := testCache.lru.Get(cache.LookupKey(cache.CAS, hash))
+		testCache.mu.Unlock()
+		if kept != tc.kept {
+			t.Fatalf("policy %q: expected the local copy to be kept: %v, got %v",
+				tc.policy, tc.kept, kept)
+		}
+
+		rc, _, err := testCache.Get(ctx, cache.CAS, hash, -1, 0)
+		if tc.getErr {
+			if err == nil {
+				t.Fatalf("policy %q: expected Get to fail", tc.policy)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("policy %q: %v", tc.policy, err)
+			}
+			if (rc != nil) != tc.kept {
+				t.Fatalf("policy %q: expected Get to find the blob: %v", tc.policy, tc.kept)
+			}
+		}
+		if rc != nil {
+			rc.Close()
+		}
+
+		proxy.mu.Lock()
+		checked := proxy.stats > 0
+		proxy.mu.Unlock()
+		if tc.policy == "" && checked {
+			t.Fatal("expected the proxy not to be checked without a policy")
+		}
+	}
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	_, err := New(cacheDir, 10*1024*1024, WithProxySizeMismatchPolicy("both"))
+	if err == nil {
+		t.Fatal("expected an error for an unsupported policy")
+	}
+}
+
+func TestProxySizeMismatchPolicyV2(t *testing.T) {
+	ctx := context.Background()
+
+	backend := newTestServer(t)
+	defer backend.srv.Close()
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := testutils.NewSilentLogger()
+	proxy, err := httpproxy.New(url, "zstd", &http.Client{}, logger, logger, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err := New(cacheDir, 10*1024*1024,
+		WithProxyBackend(proxy),
+		WithProxySizeMismatchPolicy("error"),
+		WithAccessLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxying to the backend is async.
+	for i := 0; backend.numItems() == 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected Put to be proxied to the backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The sizes match.
+	rc, _, err := testCache.Get(ctx, cache.CAS, hash, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected the blob to be found")
+	}
+	rc.Close()
+
+	// Change the logical size in the backend's casblob header.
+	backend.mu.Lock()
+	for _, m := range []map[string][]byte{backend.ac, backend.cas} {
+		blob, ok := m[hash]
+		if ok {
+			binary.LittleEndian.PutUint64(blob[8:casblob.LogicalSizeHeaderSize], uint64(len(data)+1))
+		}
+	}
+	backend.mu.Unlock()
+
+	_, _, err = testCache.Get(ctx, cache.CAS, hash, -1, 0)
+	if err == nil {
+		t.Fatal("Expected Get to fail when the proxy backend reports a different size")
+	}
+}
+
 func TestCacheDirLostAndFound(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
@@ -1477,3 +2121,30 @@ func TestCacheDirLostAndFound(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCacheDirTempFiles(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	// Temporary files left behind by a previous run are removed, and
+	// don't prevent the cache dir from being loaded.
+	staleFile := path.Join(cacheDir, TempDirName, "stale")
+	err := os.MkdirAll(path.Dir(staleFile), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(staleFile, []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(cacheDir, 4096, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(staleFile)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected %q to be removed, got: %v", staleFile, err)
+	}
+}
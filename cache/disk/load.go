@@ -30,6 +30,12 @@ import (
 
 const lowercaseDSStoreFile = ".ds_store"
 
+// TempDirName is the name of a directory in the cache dir for temporary
+// files which are not cache entries, eg those written while unpacking
+// archives for the remote asset API. Its contents are removed when the
+// cache is loaded.
+const TempDirName = "tmp"
+
 // New returns a new instance of a filesystem-based cache rooted at `dir`,
 // with a maximum size of `maxSizeBytes` bytes and `opts` Options set.
 func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
@@ -78,6 +84,8 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 			Name: "bazel_remote_disk_cache_longest_item_idle_time_seconds",
 			Help: "The idle time (now - atime) of the last item in the LRU cache, updated once per minute. Depending on filesystem mount options (e.g. relatime), the resolution may be measured in 'days' and not accurate to the second. If using noatime this will be 0.",
 		}),
+
+		proxyPutMetrics: newProxyPutMetrics(),
 	}
 
 	cc := CacheConfig{diskCache: &c}
@@ -90,6 +98,13 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 		}
 	}
 
+	if c.proxySizeMismatchPolicy != sizeMismatchUnchecked && c.storageMode == casblob.Zstandard {
+		_, ok := c.proxy.(cache.Stater)
+		if !ok {
+			log.Println("Warning: the proxy backend can't report the logical size of compressed CAS blobs, so the proxy size mismatch policy may have no effect")
+		}
+	}
+
 	// Create the directory structure.
 	hexLetters := []byte("0123456789abcdef")
 	for _, c1 := range hexLetters {
@@ -110,6 +125,12 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 		}
 	}
 
+	// Remove temporary files left behind by a previous run.
+	err = os.RemoveAll(filepath.Join(dir, TempDirName))
+	if err != nil {
+		return nil, err
+	}
+
 	err = c.migrateDirectories()
 	if err != nil {
 		return nil, fmt.Errorf("Attempting to migrate the old directory structure failed: %w", err)
@@ -504,7 +525,7 @@ func (c *diskCache) scanDir() (scanResult, error) {
 			return scanResult{}, fmt.Errorf("Unexpected file: %s", name)
 		}
 
-		if name == lostAndFound {
+		if name == lostAndFound || name == TempDirName {
 			continue
 		}
 
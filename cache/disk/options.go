@@ -51,6 +51,24 @@ func WithMaxBlobSize(size int64) Option {
 	}
 }
 
+// WithMaxBlobSizeForKind sets a maximum blob size for entries of the given
+// kind, which is applied in addition to the limit set by WithMaxBlobSize.
+// For example, this can be used to reject unexpectedly large AC entries
+// while still allowing large CAS blobs.
+func WithMaxBlobSizeForKind(kind cache.EntryKind, size int64) Option {
+	return func(c *CacheConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid max %s blob size: %d", kind, size)
+		}
+
+		if c.diskCache.maxBlobSizeByKind == nil {
+			c.diskCache.maxBlobSizeByKind = make(map[cache.EntryKind]int64)
+		}
+		c.diskCache.maxBlobSizeByKind[kind] = size
+		return nil
+	}
+}
+
 func WithProxyBackend(proxy cache.Proxy) Option {
 	return func(c *CacheConfig) error {
 		if c.diskCache.proxy != nil && proxy != nil {
@@ -77,6 +95,53 @@ func WithProxyMaxBlobSize(maxProxyBlobSize int64) Option {
 	}
 }
 
+// WithProxyMinBlobSizeForKind sets the minimum size of blobs of the given
+// kind that are uploaded to the proxy backend, smaller blobs are only
+// stored locally. For example, this can avoid the latency of uploading
+// small AC entries to a slow object storage backend.
+func WithProxyMinBlobSizeForKind(kind cache.EntryKind, size int64) Option {
+	return func(c *CacheConfig) error {
+		if size < 0 {
+			return fmt.Errorf("Invalid min proxy %s blob size: %d", kind, size)
+		}
+
+		if c.diskCache.minProxyPutSizeByKind == nil {
+			c.diskCache.minProxyPutSizeByKind = make(map[cache.EntryKind]int64)
+		}
+		c.diskCache.minProxyPutSizeByKind[kind] = size
+		return nil
+	}
+}
+
+// WithProxySizeMismatchPolicy makes CAS lookups which are found locally
+// also check the logical size reported by the proxy backend (see
+// cache.Stat), and sets what happens if the sizes differ, which indicates
+// that one of the copies is corrupt. With the zstd storage mode, this
+// requires a proxy backend which implements cache.Stater, since Contains
+// doesn't report the size of compressed blobs. `policy` is one of:
+//   - "local": use the local copy.
+//   - "proxy": remove the local copy, and use the proxy backend instead.
+//   - "error": fail the request, and report the blob as missing.
+//
+// In each case the disagreement is logged. Note that this adds a proxy
+// backend request to every local cache hit.
+func WithProxySizeMismatchPolicy(policy string) Option {
+	return func(c *CacheConfig) error {
+		switch policy {
+		case "local":
+			c.diskCache.proxySizeMismatchPolicy = sizeMismatchPreferLocal
+		case "proxy":
+			c.diskCache.proxySizeMismatchPolicy = sizeMismatchPreferProxy
+		case "error":
+			c.diskCache.proxySizeMismatchPolicy = sizeMismatchError
+		default:
+			return fmt.Errorf("Unsupported proxy size mismatch policy: %q", policy)
+		}
+
+		return nil
+	}
+}
+
 func WithAccessLogger(logger *log.Logger) Option {
 	return func(c *CacheConfig) error {
 		c.diskCache.accessLogger = logger
@@ -0,0 +1,63 @@
+package disk
+
+import (
+	"sync"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// proxyPutMetrics tracks the logical and on-disk sizes of the blobs that
+// are passed to the proxy backend, to expose the compression ratio that
+// is achieved for each kind of entry.
+type proxyPutMetrics struct {
+	logicalBytes    *prometheus.CounterVec
+	sizeOnDiskBytes *prometheus.CounterVec
+	ratio           *prometheus.GaugeVec
+
+	mu              sync.Mutex
+	logicalTotal    map[cache.EntryKind]int64
+	sizeOnDiskTotal map[cache.EntryKind]int64
+}
+
+func newProxyPutMetrics() *proxyPutMetrics {
+	return &proxyPutMetrics{
+		logicalBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_remote_disk_cache_proxy_put_logical_bytes_total",
+			Help: "The total logical (uncompressed) size of blobs passed to the proxy backend",
+		}, []string{"kind"}),
+		sizeOnDiskBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_remote_disk_cache_proxy_put_size_on_disk_bytes_total",
+			Help: "The total on-disk (possibly compressed) size of blobs passed to the proxy backend",
+		}, []string{"kind"}),
+		ratio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_remote_disk_cache_proxy_put_compression_ratio",
+			Help: "The total logical size divided by the total on-disk size of blobs passed to the proxy backend",
+		}, []string{"kind"}),
+		logicalTotal:    make(map[cache.EntryKind]int64),
+		sizeOnDiskTotal: make(map[cache.EntryKind]int64),
+	}
+}
+
+func (m *proxyPutMetrics) register() {
+	prometheus.MustRegister(m.logicalBytes)
+	prometheus.MustRegister(m.sizeOnDiskBytes)
+	prometheus.MustRegister(m.ratio)
+}
+
+func (m *proxyPutMetrics) observe(kind cache.EntryKind, logicalSize int64, sizeOnDisk int64) {
+	lbls := prometheus.Labels{"kind": kind.String()}
+	m.logicalBytes.With(lbls).Add(float64(logicalSize))
+	m.sizeOnDiskBytes.With(lbls).Add(float64(sizeOnDisk))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.logicalTotal[kind] += logicalSize
+	m.sizeOnDiskTotal[kind] += sizeOnDisk
+
+	if m.sizeOnDiskTotal[kind] > 0 {
+		m.ratio.With(lbls).Set(float64(m.logicalTotal[kind]) / float64(m.sizeOnDiskTotal[kind]))
+	}
+}
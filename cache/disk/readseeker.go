@@ -0,0 +1,123 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+// NewReadSeeker returns an io.ReadSeekCloser for the cache item stored
+// under `hash`, or nil if the item is not found. Callers should provide
+// the `size` of the item, or -1 if unknown.
+//
+// Seeking within items stored uncompressed on local disk is done on the
+// underlying file. Otherwise the item is reopened at the new offset via
+// Get on the next Read, which means that items which are only available
+// from the proxy backend are seekable once Get has stored them locally.
+func NewReadSeeker(ctx context.Context, c Cache, kind cache.EntryKind, hash string, size int64) (io.ReadSeekCloser, error) {
+	rc, foundSize, err := c.Get(ctx, kind, hash, size, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rc == nil {
+		return nil, nil
+	}
+	if foundSize < 0 {
+		rc.Close()
+		return nil, fmt.Errorf("unknown size for %s/%s", kind, hash)
+	}
+
+	return &readSeeker{
+		ctx:  ctx,
+		c:    c,
+		kind: kind,
+		hash: hash,
+		size: foundSize,
+		rc:   rc,
+	}, nil
+}
+
+type readSeeker struct {
+	ctx  context.Context
+	c    Cache
+	kind cache.EntryKind
+	hash string
+	size int64
+
+	// The current offset, and a reader positioned at that offset, or
+	// nil if the item needs to be reopened before the next Read.
+	pos int64
+	rc  io.ReadCloser
+}
+
+var errNegativeOffset = errors.New("seek to a negative offset")
+
+func (r *readSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil {
+		rc, _, err := r.c.Get(r.ctx, r.kind, r.hash, r.size, r.pos)
+		if err != nil {
+			return 0, err
+		}
+		if rc == nil {
+			return 0, fmt.Errorf("%s/%s is no longer available", r.kind, r.hash)
+		}
+		r.rc = rc
+	}
+
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return r.pos, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if pos < 0 {
+		return r.pos, errNegativeOffset
+	}
+	if pos == r.pos {
+		return pos, nil
+	}
+
+	if f, ok := r.rc.(*os.File); ok {
+		// The file is stored uncompressed, so we can seek directly.
+		_, err := f.Seek(pos, io.SeekStart)
+		if err != nil {
+			return r.pos, err
+		}
+	} else if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *readSeeker) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
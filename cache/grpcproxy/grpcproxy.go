@@ -372,3 +372,9 @@ func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKin
 		return false, -1
 	}
 }
+
+// CheckHealth implements cache.HealthChecker.
+func (r *remoteGrpcProxyCache) CheckHealth(ctx context.Context) error {
+	_, err := r.clients.cap.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{})
+	return err
+}
@@ -243,3 +243,123 @@ func (r *remoteHTTPProxyCache) Contains(ctx context.Context, kind cache.EntryKin
 
 	return false, -1
 }
+
+// Delete implements cache.Deleter.
+func (r *remoteHTTPProxyCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	url := r.requestURL(hash, kind)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := r.remote.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+
+	logResponse(r.accessLogger, "DELETE", rsp.StatusCode, url)
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return &cache.Error{
+		Code: rsp.StatusCode,
+		Text: fmt.Sprintf("Failed to delete %s: %s", url, rsp.Status),
+	}
+}
+
+// Stat implements cache.Stater. For CAS blobs in v2 mode, the logical size
+// is read from the casblob header with a Range request for its first
+// bytes, otherwise a HEAD request is used.
+func (r *remoteHTTPProxyCache) Stat(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, int64, error) {
+	url := r.requestURL(hash, kind)
+
+	v2CAS := kind == cache.CAS && r.v2mode
+
+	method := http.MethodHead
+	if v2CAS {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return false, -1, -1, err
+	}
+	if v2CAS {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", casblob.LogicalSizeHeaderSize-1))
+	}
+
+	rsp, err := r.remote.Do(req)
+	if err != nil {
+		return false, -1, -1, err
+	}
+	// If the server ignored the Range header, this abandons the download.
+	defer rsp.Body.Close()
+
+	logResponse(r.accessLogger, "STAT", rsp.StatusCode, url)
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		return false, -1, -1, nil
+	default:
+		return false, -1, -1, &cache.Error{
+			Code: rsp.StatusCode,
+			Text: fmt.Sprintf("Failed to stat %s: %s", url, rsp.Status),
+		}
+	}
+
+	sizeOnDisk := rsp.ContentLength
+	if rsp.StatusCode == http.StatusPartialContent {
+		sizeOnDisk = contentRangeSize(rsp.Header.Get("Content-Range"))
+	}
+
+	if !v2CAS {
+		return true, sizeOnDisk, sizeOnDisk, nil
+	}
+
+	_, logicalSize, err := casblob.ExtractLogicalSize(rsp.Body)
+	if err != nil {
+		return false, -1, -1, err
+	}
+
+	return true, logicalSize, sizeOnDisk, nil
+}
+
+// Returns the complete length from a Content-Range header value, eg 1234
+// for "bytes 0-15/1234", or -1 if it is unknown.
+func contentRangeSize(value string) int64 {
+	_, length, found := strings.Cut(value, "/")
+	if !found {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+
+	return size
+}
+
+// CheckHealth implements cache.HealthChecker. Any HTTP response from the
+// backend, regardless of its status code, means that it is reachable.
+func (r *remoteHTTPProxyCache) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.baseURL, nil)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := r.remote.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	return nil
+}
@@ -58,7 +58,8 @@ func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
-		_, _ = w.Write(data)
+		// Supports Range requests.
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
 		return
 
 	case http.MethodPut:
@@ -78,6 +79,16 @@ func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(data)), 10))
 		return
+
+	case http.MethodDelete:
+		_, ok := kindMap[hash]
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		delete(kindMap, hash)
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 }
 
@@ -359,3 +370,155 @@ func TestEverything(t *testing.T) {
 	}
 	rc.Close()
 }
+
+func TestDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newTestServer()
+	defer s.srv.Close()
+
+	url, err := url.Parse(s.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := testutils.NewSilentLogger()
+	p, err := New(url, "zstd", &http.Client{}, logger, logger, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyCache, ok := p.(cache.Deleter)
+	if !ok {
+		t.Fatal("Expected the HTTP proxy backend to implement cache.Deleter")
+	}
+
+	acData, hash := testutils.RandomDataAndHash(16)
+	s.ac[hash] = acData
+
+	err = proxyCache.Delete(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.ac[hash]; ok {
+		t.Fatal("Expected the AC item to be deleted")
+	}
+
+	// Deleting an item which doesn't exist should succeed.
+	err = proxyCache.Delete(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server doesn't support this kind.
+	err = proxyCache.Delete(ctx, cache.RAW, hash)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newTestServer()
+	defer s.srv.Close()
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	url, err := url.Parse(s.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := testutils.NewSilentLogger()
+	proxyCache, err := New(url, "zstd", &http.Client{}, logger, logger, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diskCache, err := disk.New(cacheDir, 10*1024*1024, disk.WithProxyBackend(proxyCache),
+		disk.WithAccessLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casData, hash := testutils.RandomDataAndHash(1024)
+	acData := []byte{1, 2, 3, 4}
+
+	err = diskCache.Put(ctx, cache.AC, hash, int64(len(acData)), bytes.NewReader(acData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = diskCache.Put(ctx, cache.CAS, hash, int64(len(casData)), bytes.NewReader(casData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the uploads.
+	var stored map[cache.EntryKind][]byte
+	for i := 0; i < 100 && stored == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		if len(s.ac) == 1 && len(s.cas) == 1 {
+			stored = map[cache.EntryKind][]byte{cache.AC: s.ac[hash], cache.CAS: s.cas[hash]}
+		}
+		s.mu.Unlock()
+	}
+	if stored == nil {
+		t.Fatal("Expected the blobs to be uploaded")
+	}
+
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS} {
+		exists, logicalSize, sizeOnDisk, err := cache.Stat(ctx, proxyCache, kind, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("Expected %s item %s to exist", kind, hash)
+		}
+
+		containsExists, containsSize := proxyCache.Contains(ctx, kind, hash, -1)
+		if !containsExists {
+			t.Fatalf("Expected Contains to find %s item %s", kind, hash)
+		}
+		// Contains doesn't know the size of CAS blobs in v2 mode.
+		if containsSize != -1 && containsSize != logicalSize {
+			t.Fatalf("Expected the %s logical size %d to match Contains, got %d",
+				kind, containsSize, logicalSize)
+		}
+
+		rc, getSize, err := proxyCache.Get(ctx, kind, hash, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		if getSize != logicalSize {
+			t.Fatalf("Expected the %s logical size %d to match Get, got %d",
+				kind, getSize, logicalSize)
+		}
+
+		if sizeOnDisk != int64(len(stored[kind])) {
+			t.Fatalf("Expected the %s size on disk to be %d, got %d",
+				kind, len(stored[kind]), sizeOnDisk)
+		}
+	}
+
+	// The CAS blob is compressed, and has a header.
+	_, logicalSize, sizeOnDisk, _ := cache.Stat(ctx, proxyCache, cache.CAS, hash)
+	if logicalSize != int64(len(casData)) || sizeOnDisk == logicalSize {
+		t.Fatalf("Expected logical size %d and a different size on disk, got %d and %d",
+			len(casData), logicalSize, sizeOnDisk)
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(16)
+	exists, logicalSize, sizeOnDisk, err := cache.Stat(ctx, proxyCache, cache.CAS, missingHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists || logicalSize != -1 || sizeOnDisk != -1 {
+		t.Fatalf("Expected a missing blob, got %v, %d, %d", exists, logicalSize, sizeOnDisk)
+	}
+}
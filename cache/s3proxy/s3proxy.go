@@ -258,3 +258,78 @@ func (c *s3Cache) Contains(ctx context.Context, kind cache.EntryKind, hash strin
 
 	return exists, size
 }
+
+// Delete implements cache.Deleter.
+func (c *s3Cache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	// S3 doesn't return an error when deleting objects which don't exist.
+	err := c.mcore.RemoveObject(
+		ctx,
+		c.bucket,                    // bucketName
+		c.objectKey(hash, kind),     // objectName
+		minio.RemoveObjectOptions{}, // opts
+	)
+
+	logResponse(c.accessLogger, "DELETE", c.bucket, c.objectKey(hash, kind), err)
+
+	return err
+}
+
+// Stat implements cache.Stater. For CAS blobs in v2 mode, the logical size
+// is read from the casblob header with a ranged GET request for its first
+// bytes.
+func (c *s3Cache) Stat(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, int64, error) {
+	key := c.objectKey(hash, kind)
+
+	s, err := c.mcore.StatObject(
+		ctx,
+		c.bucket,                  // bucketName
+		key,                       // objectName
+		minio.StatObjectOptions{}, // opts
+	)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			logResponse(c.accessLogger, "STAT", c.bucket, key, errNotFound)
+			return false, -1, -1, nil
+		}
+		logResponse(c.accessLogger, "STAT", c.bucket, key, err)
+		return false, -1, -1, err
+	}
+
+	logResponse(c.accessLogger, "STAT", c.bucket, key, nil)
+
+	if kind != cache.CAS || !c.v2mode {
+		return true, s.Size, s.Size, nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	err = opts.SetRange(0, casblob.LogicalSizeHeaderSize-1)
+	if err != nil {
+		return false, -1, -1, err
+	}
+
+	rc, _, _, err := c.mcore.GetObject(ctx, c.bucket, key, opts)
+	if err != nil {
+		return false, -1, -1, err
+	}
+	defer rc.Close()
+
+	_, logicalSize, err := casblob.ExtractLogicalSize(rc)
+	if err != nil {
+		return false, -1, -1, err
+	}
+
+	return true, logicalSize, s.Size, nil
+}
+
+// CheckHealth implements cache.HealthChecker.
+func (c *s3Cache) CheckHealth(ctx context.Context) error {
+	exists, err := c.mcore.BucketExists(ctx, c.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %q does not exist", c.bucket)
+	}
+
+	return nil
+}
@@ -1,9 +1,22 @@
 package s3proxy
 
 import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk"
+	testutils "github.com/buchgr/bazel-remote/v2/utils"
 )
 
 func TestObjectKey(t *testing.T) {
@@ -36,3 +49,102 @@ func TestObjectKey(t *testing.T) {
 		}
 	}
 }
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+
+	backend := s3mem.New()
+	err := backend.CreateBucket("bazel-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gofakes3.New(backend).Server())
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := testutils.NewSilentLogger()
+	proxyCache := New(u.Host, "bazel-remote", minio.BucketLookupPath, "",
+		credentials.NewStaticV4("access", "secret", ""), true, false, "",
+		"zstd", logger, logger, 1, 10)
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	diskCache, err := disk.New(cacheDir, 10*1024*1024, disk.WithProxyBackend(proxyCache),
+		disk.WithAccessLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casData, hash := testutils.RandomDataAndHash(1024)
+	acData := []byte{1, 2, 3, 4}
+
+	err = diskCache.Put(ctx, cache.AC, hash, int64(len(acData)), bytes.NewReader(acData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = diskCache.Put(ctx, cache.CAS, hash, int64(len(casData)), bytes.NewReader(casData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS} {
+		// Wait for the upload.
+		var exists bool
+		for i := 0; i < 100 && !exists; i++ {
+			time.Sleep(10 * time.Millisecond)
+			exists, _ = proxyCache.Contains(ctx, kind, hash, -1)
+		}
+		if !exists {
+			t.Fatalf("Expected %s item %s to be uploaded", kind, hash)
+		}
+
+		exists, logicalSize, sizeOnDisk, err := cache.Stat(ctx, proxyCache, kind, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatalf("Expected %s item %s to exist", kind, hash)
+		}
+
+		// Contains doesn't know the size of CAS blobs in v2 mode.
+		_, containsSize := proxyCache.Contains(ctx, kind, hash, -1)
+		if containsSize != -1 && containsSize != logicalSize {
+			t.Fatalf("Expected the %s logical size %d to match Contains, got %d",
+				kind, containsSize, logicalSize)
+		}
+
+		rc, getSize, err := proxyCache.Get(ctx, kind, hash, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		if getSize != logicalSize {
+			t.Fatalf("Expected the %s logical size %d to match Get, got %d",
+				kind, getSize, logicalSize)
+		}
+
+		info, err := proxyCache.(*s3Cache).mcore.StatObject(ctx, "bazel-remote",
+			proxyCache.(*s3Cache).objectKey(hash, kind), minio.StatObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sizeOnDisk != info.Size {
+			t.Fatalf("Expected the %s size on disk to be %d, got %d",
+				kind, info.Size, sizeOnDisk)
+		}
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(16)
+	exists, logicalSize, sizeOnDisk, err := cache.Stat(ctx, proxyCache, cache.CAS, missingHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists || logicalSize != -1 || sizeOnDisk != -1 {
+		t.Fatalf("Expected a missing blob, got %v, %d, %d", exists, logicalSize, sizeOnDisk)
+	}
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// AssetHostConfig stores settings for remote asset API fetches from a
+// particular host.
+type AssetHostConfig struct {
+	// A PEM encoded CA bundle used to verify the host's certificate,
+	// instead of the system certificate pool.
+	CaFile string `yaml:"ca_file"`
+
+	// Disable TLS certificate verification for this host. This is
+	// dangerous, and should only be used for trusted internal mirrors.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	// If set, fetches from this host are sent to this base URL instead
+	// (eg an internal caching proxy), preserving the path.
+	RewriteTo string `yaml:"rewrite_to"`
+
+	// The region that this host serves, eg for geo-distributed mirrors.
+	// URIs on hosts in the preferred region are tried first.
+	Region string `yaml:"region"`
+
+	// If non-zero, the maximum size in bytes of assets fetched from this
+	// host. Larger responses are rejected.
+	MaxSize int64 `yaml:"max_size"`
+
+	// HTTP headers to send with fetches from this host, eg for
+	// authentication.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// If set, sent as an "Authorization: Bearer" header with fetches
+	// from this host.
+	BearerToken string `yaml:"bearer_token"`
+
+	// If set, the maximum number of redirects from this host that are
+	// followed by a fetch, eg for hosts known to redirect in a loop.
+	// Defaults to the global limit of 10.
+	MaxRedirects *int `yaml:"max_redirects"`
+}
+
+func validateAssetHosts(hosts map[string]AssetHostConfig) error {
+	for host, hc := range hosts {
+		if host == "" {
+			return errors.New("'asset_fetch_hosts' keys must not be empty")
+		}
+		if strings.Contains(host, "/") {
+			return fmt.Errorf("'asset_fetch_hosts' keys must be a hostname or host:port, found: %q", host)
+		}
+		if hc.CaFile != "" && hc.InsecureSkipVerify {
+			return fmt.Errorf("'ca_file' and 'insecure_skip_verify' are mutually exclusive for asset fetch host %q", host)
+		}
+		for name := range hc.Headers {
+			if name == "" {
+				return fmt.Errorf("'headers' names must not be empty for asset fetch host %q", host)
+			}
+			if hc.BearerToken != "" && strings.EqualFold(name, "Authorization") {
+				return fmt.Errorf("'bearer_token' and an Authorization header are mutually exclusive for asset fetch host %q", host)
+			}
+		}
+		if hc.MaxSize < 0 {
+			return fmt.Errorf("'max_size' for asset fetch host %q must not be negative", host)
+		}
+		if hc.MaxRedirects != nil && *hc.MaxRedirects < 0 {
+			return fmt.Errorf("'max_redirects' for asset fetch host %q must not be negative", host)
+		}
+		if hc.RewriteTo != "" {
+			u, err := url.Parse(hc.RewriteTo)
+			if err != nil {
+				return fmt.Errorf("Invalid 'rewrite_to' URL for asset fetch host %q: %w", host, err)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("'rewrite_to' for asset fetch host %q must be an http or https URL, found: %q", host, hc.RewriteTo)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateAssetExtensions(extensions []string) error {
+	for _, ext := range extensions {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("'asset_fetch_allowed_extensions' entries must start with a '.', found: %q", ext)
+		}
+	}
+
+	return nil
+}
+
+// DefaultAssetFetchBlockedNetworks are the networks that remote asset API
+// fetches are not allowed to connect to by default: private (RFC 1918,
+// carrier-grade NAT and IPv6 unique local), link-local (including cloud
+// metadata services), loopback and unspecified addresses. Connecting to
+// an unspecified address, eg 0.0.0.0, reaches the local host on Linux.
+// This prevents clients from using bazel-remote to probe internal
+// services.
+var DefaultAssetFetchBlockedNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+	"0.0.0.0/8",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+	"::/128",
+}
+
+func validateAssetAllowedHosts(hosts []string) error {
+	for _, host := range hosts {
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "/:*") {
+			return fmt.Errorf("'asset_fetch_allowed_hosts' entries must be a hostname, IP address or *.domain pattern, found: %q", host)
+		}
+	}
+
+	return nil
+}
+
+func validateAssetBlockedNetworks(networks []string) error {
+	for _, network := range networks {
+		_, _, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("Invalid 'asset_fetch_blocked_networks' entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the non-empty, comma-separated items in s.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) setAssetFetchHosts() error {
+	for host, hc := range c.AssetFetchHosts {
+		if hc.RewriteTo != "" {
+			target, err := url.Parse(hc.RewriteTo)
+			if err != nil {
+				return fmt.Errorf("Invalid 'rewrite_to' URL for asset fetch host %q: %w", host, err)
+			}
+
+			if c.AssetFetchRewrites == nil {
+				c.AssetFetchRewrites = make(map[string]*url.URL)
+			}
+			c.AssetFetchRewrites[host] = target
+		}
+
+		if !hc.HasTLSConfig() {
+			continue
+		}
+
+		// Fail early if the CA file can't be loaded, rather than
+		// when the gRPC server starts.
+		_, err := hc.TLSConfig()
+		if err != nil {
+			return fmt.Errorf("Invalid TLS settings for asset fetch host %q: %w", host, err)
+		}
+	}
+
+	return nil
+}
+
+// HasTLSConfig returns true if hc has custom TLS settings.
+func (hc AssetHostConfig) HasTLSConfig() bool {
+	return hc.CaFile != "" || hc.InsecureSkipVerify
+}
+
+// TLSConfig returns the TLS settings for fetches from this host. The CA
+// file, if any, is read on each call so that it can be reloaded.
+func (hc AssetHostConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: hc.InsecureSkipVerify,
+	}
+
+	if hc.CaFile != "" {
+		caCert, err := os.ReadFile(hc.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %w", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("Failed to add CA certificate from %s to cert pool", hc.CaFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return tlsConfig, nil
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -81,45 +82,102 @@ func (c *URLBackendConfig) validate(protocol string) error {
 
 // Config holds the top-level configuration for bazel-remote.
 type Config struct {
-	HTTPAddress                 string                    `yaml:"http_address"`
-	GRPCAddress                 string                    `yaml:"grpc_address"`
-	ProfileAddress              string                    `yaml:"profile_address"`
-	Dir                         string                    `yaml:"dir"`
-	MaxSize                     int                       `yaml:"max_size"`
-	StorageMode                 string                    `yaml:"storage_mode"`
-	ZstdImplementation          string                    `yaml:"zstd_implementation"`
-	HtpasswdFile                string                    `yaml:"htpasswd_file"`
-	MinTLSVersion               string                    `yaml:"min_tls_version"`
-	TLSCaFile                   string                    `yaml:"tls_ca_file"`
-	TLSCertFile                 string                    `yaml:"tls_cert_file"`
-	TLSKeyFile                  string                    `yaml:"tls_key_file"`
-	AllowUnauthenticatedReads   bool                      `yaml:"allow_unauthenticated_reads"`
-	S3CloudStorage              *S3CloudStorageConfig     `yaml:"s3_proxy,omitempty"`
-	AzBlobConfig                *AzBlobStorageConfig      `yaml:"azblob_proxy,omitempty"`
-	GoogleCloudStorage          *GoogleCloudStorageConfig `yaml:"gcs_proxy,omitempty"`
-	HTTPBackend                 *URLBackendConfig         `yaml:"http_proxy,omitempty"`
-	GRPCBackend                 *URLBackendConfig         `yaml:"grpc_proxy,omitempty"`
-	NumUploaders                int                       `yaml:"num_uploaders"`
-	MaxQueuedUploads            int                       `yaml:"max_queued_uploads"`
-	IdleTimeout                 time.Duration             `yaml:"idle_timeout"`
-	DisableHTTPACValidation     bool                      `yaml:"disable_http_ac_validation"`
-	DisableGRPCACDepsCheck      bool                      `yaml:"disable_grpc_ac_deps_check"`
-	EnableACKeyInstanceMangling bool                      `yaml:"enable_ac_key_instance_mangling"`
-	EnableEndpointMetrics       bool                      `yaml:"enable_endpoint_metrics"`
-	MetricsDurationBuckets      []float64                 `yaml:"endpoint_metrics_duration_buckets"`
-	ExperimentalRemoteAssetAPI  bool                      `yaml:"experimental_remote_asset_api"`
-	HTTPReadTimeout             time.Duration             `yaml:"http_read_timeout"`
-	HTTPWriteTimeout            time.Duration             `yaml:"http_write_timeout"`
-	AccessLogLevel              string                    `yaml:"access_log_level"`
-	LogTimezone                 string                    `yaml:"log_timezone"`
-	MaxBlobSize                 int64                     `yaml:"max_blob_size"`
-	MaxProxyBlobSize            int64                     `yaml:"max_proxy_blob_size"`
+	HTTPAddress                 string                     `yaml:"http_address"`
+	GRPCAddress                 string                     `yaml:"grpc_address"`
+	ProfileAddress              string                     `yaml:"profile_address"`
+	Dir                         string                     `yaml:"dir"`
+	MaxSize                     int                        `yaml:"max_size"`
+	StorageMode                 string                     `yaml:"storage_mode"`
+	ZstdImplementation          string                     `yaml:"zstd_implementation"`
+	HtpasswdFile                string                     `yaml:"htpasswd_file"`
+	MinTLSVersion               string                     `yaml:"min_tls_version"`
+	TLSCaFile                   string                     `yaml:"tls_ca_file"`
+	TLSCertFile                 string                     `yaml:"tls_cert_file"`
+	TLSKeyFile                  string                     `yaml:"tls_key_file"`
+	AllowUnauthenticatedReads   bool                       `yaml:"allow_unauthenticated_reads"`
+	S3CloudStorage              *S3CloudStorageConfig      `yaml:"s3_proxy,omitempty"`
+	AzBlobConfig                *AzBlobStorageConfig       `yaml:"azblob_proxy,omitempty"`
+	GoogleCloudStorage          *GoogleCloudStorageConfig  `yaml:"gcs_proxy,omitempty"`
+	HTTPBackend                 *URLBackendConfig          `yaml:"http_proxy,omitempty"`
+	GRPCBackend                 *URLBackendConfig          `yaml:"grpc_proxy,omitempty"`
+	NumUploaders                int                        `yaml:"num_uploaders"`
+	MaxQueuedUploads            int                        `yaml:"max_queued_uploads"`
+	IdleTimeout                 time.Duration              `yaml:"idle_timeout"`
+	DisableHTTPACValidation     bool                       `yaml:"disable_http_ac_validation"`
+	DisableGRPCACDepsCheck      bool                       `yaml:"disable_grpc_ac_deps_check"`
+	EnableACKeyInstanceMangling bool                       `yaml:"enable_ac_key_instance_mangling"`
+	EnableEndpointMetrics       bool                       `yaml:"enable_endpoint_metrics"`
+	MetricsDurationBuckets      []float64                  `yaml:"endpoint_metrics_duration_buckets"`
+	ExperimentalRemoteAssetAPI  bool                       `yaml:"experimental_remote_asset_api"`
+	AssetFetchHTTPSOnly         bool                       `yaml:"asset_fetch_https_only"`
+	AssetFetchDecodeContent     bool                       `yaml:"asset_fetch_decode_content_encoding"`
+	AssetFetchHeadProbe         bool                       `yaml:"asset_fetch_head_probe"`
+	AssetDirNormalizeNames      bool                       `yaml:"asset_directory_normalize_names"`
+	AssetDirMaxSize             int64                      `yaml:"asset_directory_max_size"`
+	AssetDirMaxEntries          int                        `yaml:"asset_directory_max_entries"`
+	AssetDirMaxUnpacks          int                        `yaml:"asset_directory_max_unpacks"`
+	AssetDirMaxNodes            int                        `yaml:"asset_directory_max_nodes"`
+	AssetPushVerifyInterval     time.Duration              `yaml:"asset_push_verify_interval"`
+	AssetAdminService           bool                       `yaml:"asset_admin_service"`
+	AssetAdminLocalDirs         []string                   `yaml:"asset_admin_local_directories,omitempty"`
+	AssetFetchTTL               time.Duration              `yaml:"asset_fetch_ttl"`
+	HTTPAssetFetchTimeout       time.Duration              `yaml:"http_asset_fetch_timeout"`
+	AssetFetchRequestTimeout    time.Duration              `yaml:"asset_fetch_request_timeout"`
+	HTTPAssetFetchRetries       int                        `yaml:"http_asset_fetch_retries"`
+	AssetFetchNetrc             string                     `yaml:"asset_fetch_netrc"`
+	HTTPReadTimeout             time.Duration              `yaml:"http_read_timeout"`
+	HTTPWriteTimeout            time.Duration              `yaml:"http_write_timeout"`
+	AccessLogLevel              string                     `yaml:"access_log_level"`
+	LogTimezone                 string                     `yaml:"log_timezone"`
+	MaxBlobSize                 int64                      `yaml:"max_blob_size"`
+	MaxACBlobSize               int64                      `yaml:"max_ac_blob_size"`
+	MaxProxyBlobSize            int64                      `yaml:"max_proxy_blob_size"`
+	MinProxyACBlobSize          int64                      `yaml:"min_proxy_ac_blob_size"`
+	MinProxyCASBlobSize         int64                      `yaml:"min_proxy_cas_blob_size"`
+	ProxySizeMismatchPolicy     string                     `yaml:"proxy_size_mismatch_policy"`
+	MaxAssetBlobSize            int64                      `yaml:"max_asset_blob_size"`
+	AssetFetchHosts             map[string]AssetHostConfig `yaml:"asset_fetch_hosts,omitempty"`
+	AssetFetchAllowedExtensions []string                   `yaml:"asset_fetch_allowed_extensions,omitempty"`
+	AssetFetchAllowedHosts      []string                   `yaml:"asset_fetch_allowed_hosts,omitempty"`
+	AssetFetchBlockedNetworks   []string                   `yaml:"asset_fetch_blocked_networks"`
+	AssetFetchRetryBudget       int                        `yaml:"asset_fetch_retry_budget"`
+	AssetFetchConcurrency       int                        `yaml:"asset_fetch_concurrency"`
+	AssetFetchAllowSizeChange   bool                       `yaml:"asset_fetch_allow_size_change"`
+	AssetFetchNotFoundWindow    time.Duration              `yaml:"asset_fetch_not_found_window"`
+	AssetFetchMismatchWindow    time.Duration              `yaml:"asset_fetch_mismatch_window"`
+	AssetFetchBreakerFailures   int                        `yaml:"asset_fetch_host_breaker_failures"`
+	AssetFetchBreakerCooldown   time.Duration              `yaml:"asset_fetch_host_breaker_cooldown"`
+	AssetFetchSidecarSuffix     string                     `yaml:"asset_fetch_checksum_sidecar_suffix"`
+	AssetFetchQuarantineDir     string                     `yaml:"asset_fetch_quarantine_dir"`
+	AssetIndexDir               string                     `yaml:"asset_index_dir"`
+	AssetIndexMaxSize           int64                      `yaml:"asset_index_max_size"`
+	AssetIndexFlushInterval     time.Duration              `yaml:"asset_index_flush_interval"`
+	AssetIndexFlushBatchSize    int                        `yaml:"asset_index_flush_batch_size"`
+	AssetIndexFlushParallelism  int                        `yaml:"asset_index_flush_parallelism"`
+	AssetFetchTempBudget        int64                      `yaml:"asset_fetch_temp_budget"`
+	AssetFetchBufferSize        int                        `yaml:"asset_fetch_buffer_size"`
+	AssetFetchRegion            string                     `yaml:"asset_fetch_region"`
+	AssetFetchConnectTimeout    time.Duration              `yaml:"asset_fetch_connect_timeout"`
+	AssetFetchTLSTimeout        time.Duration              `yaml:"asset_fetch_tls_handshake_timeout"`
+	AssetFetchHeaderTimeout     time.Duration              `yaml:"asset_fetch_response_header_timeout"`
+	AssetFetchMaxHeaderBytes    int64                      `yaml:"asset_fetch_max_response_header_bytes"`
+	AssetFetchMaxConnsPerHost   int                        `yaml:"asset_fetch_max_conns_per_host"`
+	AssetFetchMinTLSVersion     string                     `yaml:"asset_fetch_min_tls_version"`
+	AssetMaxRequestSize         int                        `yaml:"asset_max_request_size"`
+	AssetMaxURIs                int                        `yaml:"asset_max_uris"`
+	AssetMaxQualifiers          int                        `yaml:"asset_max_qualifiers"`
+	AssetMaxQualifierLength     int                        `yaml:"asset_max_qualifier_value_length"`
 
 	// Fields that are created by combinations of the flags above.
-	ProxyBackend cache.Proxy
-	TLSConfig    *tls.Config
-	AccessLogger *log.Logger
-	ErrorLogger  *log.Logger
+	ProxyBackend       cache.Proxy
+	TLSConfig          *tls.Config
+	AssetFetchRewrites map[string]*url.URL
+	AccessLogger       *log.Logger
+	ErrorLogger        *log.Logger
+	SecurityLogger     *log.Logger
+
+	// The minimum TLS version for asset fetches, or 0 for the default.
+	AssetFetchTLSVersion uint16
 }
 
 type YamlConfig struct {
@@ -164,12 +222,22 @@ func newFromArgs(dir string, maxSize int, storageMode string, zstdImplementation
 	enableACKeyInstanceMangling bool,
 	enableEndpointMetrics bool,
 	experimentalRemoteAssetAPI bool,
+	assetFetchHTTPSOnly bool,
+	assetFetchDecodeContent bool,
+	assetFetchTTL time.Duration,
+	httpAssetFetchTimeout time.Duration,
+	httpAssetFetchRetries int,
+	assetFetchNetrc string,
+	assetFetchAllowedHosts []string,
+	assetFetchBlockedNetworks []string,
 	httpReadTimeout time.Duration,
 	httpWriteTimeout time.Duration,
 	accessLogLevel string,
 	logTimezone string,
 	maxBlobSize int64,
-	maxProxyBlobSize int64) (*Config, error) {
+	maxACBlobSize int64,
+	maxProxyBlobSize int64,
+	maxAssetBlobSize int64) (*Config, error) {
 
 	c := Config{
 		HTTPAddress:                 httpAddress,
@@ -199,12 +267,22 @@ func newFromArgs(dir string, maxSize int, storageMode string, zstdImplementation
 		EnableEndpointMetrics:       enableEndpointMetrics,
 		MetricsDurationBuckets:      defaultDurationBuckets,
 		ExperimentalRemoteAssetAPI:  experimentalRemoteAssetAPI,
+		AssetFetchHTTPSOnly:         assetFetchHTTPSOnly,
+		AssetFetchDecodeContent:     assetFetchDecodeContent,
+		AssetFetchTTL:               assetFetchTTL,
+		HTTPAssetFetchTimeout:       httpAssetFetchTimeout,
+		HTTPAssetFetchRetries:       httpAssetFetchRetries,
+		AssetFetchNetrc:             assetFetchNetrc,
+		AssetFetchAllowedHosts:      assetFetchAllowedHosts,
+		AssetFetchBlockedNetworks:   assetFetchBlockedNetworks,
 		HTTPReadTimeout:             httpReadTimeout,
 		HTTPWriteTimeout:            httpWriteTimeout,
 		AccessLogLevel:              accessLogLevel,
 		LogTimezone:                 logTimezone,
 		MaxBlobSize:                 maxBlobSize,
+		MaxACBlobSize:               maxACBlobSize,
 		MaxProxyBlobSize:            maxProxyBlobSize,
+		MaxAssetBlobSize:            maxAssetBlobSize,
 	}
 
 	err := validateConfig(&c)
@@ -245,6 +323,8 @@ func newFromYaml(data []byte) (*Config, error) {
 			MetricsDurationBuckets: defaultDurationBuckets,
 			AccessLogLevel:         "all",
 			LogTimezone:            "UTC",
+
+			AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 		},
 	}
 
@@ -376,10 +456,32 @@ func validateConfig(c *Config) error {
 		return errors.New("The 'max_blob_size' flag/key must be a positive integer")
 	}
 
+	if c.MaxACBlobSize < 0 {
+		return errors.New("The 'max_ac_blob_size' flag/key must not be negative")
+	}
+
 	if c.MaxProxyBlobSize <= 0 {
 		return errors.New("The 'max_proxy_blob_size' flag/key must be a positive integer")
 	}
 
+	if c.MinProxyACBlobSize < 0 {
+		return errors.New("The 'min_proxy_ac_blob_size' key must not be negative")
+	}
+
+	if c.MinProxyCASBlobSize < 0 {
+		return errors.New("The 'min_proxy_cas_blob_size' key must not be negative")
+	}
+
+	switch c.ProxySizeMismatchPolicy {
+	case "", "local", "proxy", "error":
+	default:
+		return errors.New("The 'proxy_size_mismatch_policy' key must be one of \"local\", \"proxy\" or \"error\", got: " + c.ProxySizeMismatchPolicy)
+	}
+
+	if c.MaxAssetBlobSize < 0 {
+		return errors.New("The 'max_asset_blob_size' flag/key must not be negative")
+	}
+
 	if c.GoogleCloudStorage != nil && c.HTTPBackend != nil && c.S3CloudStorage != nil {
 		return errors.New("One can specify at most one proxying backend")
 	}
@@ -451,9 +553,9 @@ func validateConfig(c *Config) error {
 	}
 
 	switch c.AccessLogLevel {
-	case "none", "all":
+	case "none", "all", "debug":
 	default:
-		return errors.New("'access_log_level' must be set to either \"none\" or \"all\"")
+		return errors.New("'access_log_level' must be set to one of \"none\", \"all\" or \"debug\"")
 	}
 
 	switch c.LogTimezone {
@@ -462,6 +564,140 @@ func validateConfig(c *Config) error {
 		return errors.New("'log_timezone' must be set to either \"UTC\", \"local\" or \"none\"")
 	}
 
+	err := validateAssetHosts(c.AssetFetchHosts)
+	if err != nil {
+		return err
+	}
+
+	err = validateAssetExtensions(c.AssetFetchAllowedExtensions)
+	if err != nil {
+		return err
+	}
+
+	err = validateAssetAllowedHosts(c.AssetFetchAllowedHosts)
+	if err != nil {
+		return err
+	}
+
+	err = validateAssetBlockedNetworks(c.AssetFetchBlockedNetworks)
+	if err != nil {
+		return err
+	}
+
+	if c.AssetFetchRetryBudget < 0 {
+		return errors.New("'asset_fetch_retry_budget' must not be negative")
+	}
+
+	if c.AssetFetchConcurrency < 0 {
+		return errors.New("'asset_fetch_concurrency' must not be negative")
+	}
+
+	if c.AssetFetchNotFoundWindow < 0 {
+		return errors.New("'asset_fetch_not_found_window' must not be negative")
+	}
+
+	if c.AssetFetchMismatchWindow < 0 {
+		return errors.New("'asset_fetch_mismatch_window' must not be negative")
+	}
+
+	if c.AssetFetchBreakerFailures < 0 || c.AssetFetchBreakerCooldown < 0 {
+		return errors.New("'asset_fetch_host_breaker_failures' and 'asset_fetch_host_breaker_cooldown' must not be negative")
+	}
+
+	if c.AssetFetchBreakerFailures > 0 && c.AssetFetchBreakerCooldown == 0 {
+		return errors.New("'asset_fetch_host_breaker_cooldown' must be set if 'asset_fetch_host_breaker_failures' is")
+	}
+
+	if c.AssetFetchConnectTimeout < 0 || c.AssetFetchTLSTimeout < 0 || c.AssetFetchHeaderTimeout < 0 {
+		return errors.New("'asset_fetch_connect_timeout', 'asset_fetch_tls_handshake_timeout' and 'asset_fetch_response_header_timeout' must not be negative")
+	}
+
+	if c.AssetFetchMaxHeaderBytes < 0 {
+		return errors.New("'asset_fetch_max_response_header_bytes' must not be negative")
+	}
+
+	if c.AssetFetchMaxConnsPerHost < 0 {
+		return errors.New("'asset_fetch_max_conns_per_host' must not be negative")
+	}
+
+	if c.AssetFetchTTL < 0 {
+		return errors.New("'asset_fetch_ttl' must not be negative")
+	}
+
+	if c.AssetPushVerifyInterval < 0 {
+		return errors.New("'asset_push_verify_interval' must not be negative")
+	}
+
+	if c.HTTPAssetFetchTimeout < 0 {
+		return errors.New("'http_asset_fetch_timeout' must not be negative")
+	}
+
+	if c.AssetFetchRequestTimeout < 0 {
+		return errors.New("'asset_fetch_request_timeout' must not be negative")
+	}
+
+	if c.HTTPAssetFetchRetries < 0 {
+		return errors.New("'http_asset_fetch_retries' must not be negative")
+	}
+
+	if c.AssetIndexMaxSize < 0 {
+		return errors.New("'asset_index_max_size' must not be negative")
+	}
+
+	if c.AssetIndexFlushInterval < 0 || c.AssetIndexFlushBatchSize < 0 || c.AssetIndexFlushParallelism < 0 {
+		return errors.New("'asset_index_flush_interval', 'asset_index_flush_batch_size' and 'asset_index_flush_parallelism' must not be negative")
+	}
+
+	if c.AssetFetchTempBudget < 0 {
+		return errors.New("'asset_fetch_temp_budget' must not be negative")
+	}
+
+	if c.AssetFetchBufferSize < 0 {
+		return errors.New("'asset_fetch_buffer_size' must not be negative")
+	}
+
+	if c.AssetDirMaxSize < 0 || c.AssetDirMaxEntries < 0 {
+		return errors.New("'asset_directory_max_size' and 'asset_directory_max_entries' must not be negative")
+	}
+
+	if c.AssetDirMaxUnpacks < 0 {
+		return errors.New("'asset_directory_max_unpacks' must not be negative")
+	}
+
+	if c.AssetDirMaxNodes < 0 {
+		return errors.New("'asset_directory_max_nodes' must not be negative")
+	}
+
+	if c.AssetMaxRequestSize < 0 || c.AssetMaxURIs < 0 || c.AssetMaxQualifiers < 0 || c.AssetMaxQualifierLength < 0 {
+		return errors.New("'asset_max_request_size', 'asset_max_uris', 'asset_max_qualifiers' and 'asset_max_qualifier_value_length' must not be negative")
+	}
+
+	if len(c.AssetAdminLocalDirs) > 0 {
+		if !c.AssetAdminService {
+			return errors.New("'asset_admin_local_directories' requires 'asset_admin_service'")
+		}
+
+		// Anyone who can call the admin service can read these
+		// directories.
+		if c.TLSCaFile == "" && c.HtpasswdFile == "" {
+			return errors.New("'asset_admin_local_directories' is only available when authentication is enabled")
+		}
+
+		for _, dir := range c.AssetAdminLocalDirs {
+			if !filepath.IsAbs(dir) {
+				return fmt.Errorf("'asset_admin_local_directories' must be absolute paths, got %q", dir)
+			}
+		}
+	}
+
+	if c.AssetIndexDir != "" {
+		// The disk cache does not allow unexpected files in its directory.
+		rel, err := filepath.Rel(c.Dir, c.AssetIndexDir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errors.New("'asset_index_dir' must not be inside the cache directory")
+		}
+	}
+
 	return nil
 }
 
@@ -489,6 +725,11 @@ func Get(ctx *cli.Context) (*Config, error) {
 		return nil, err
 	}
 
+	err = cfg.setAssetFetchHosts()
+	if err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
@@ -617,11 +858,21 @@ func get(ctx *cli.Context) (*Config, error) {
 		ctx.Bool("enable_ac_key_instance_mangling"),
 		ctx.Bool("enable_endpoint_metrics"),
 		ctx.Bool("experimental_remote_asset_api"),
+		ctx.Bool("asset_fetch_https_only"),
+		ctx.Bool("asset_fetch_decode_content_encoding"),
+		ctx.Duration("asset_fetch_ttl"),
+		ctx.Duration("http_asset_fetch_timeout"),
+		ctx.Int("http_asset_fetch_retries"),
+		ctx.String("asset_fetch_netrc"),
+		splitList(ctx.String("asset_fetch_allowed_hosts")),
+		splitList(ctx.String("asset_fetch_blocked_networks")),
 		ctx.Duration("http_read_timeout"),
 		ctx.Duration("http_write_timeout"),
 		ctx.String("access_log_level"),
 		ctx.String("log_timezone"),
 		ctx.Int64("max_blob_size"),
+		ctx.Int64("max_ac_blob_size"),
 		ctx.Int64("max_proxy_blob_size"),
+		ctx.Int64("max_asset_blob_size"),
 	)
 }
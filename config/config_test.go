@@ -2,6 +2,7 @@ package config
 
 import (
 	"math"
+	"net"
 	"net/url"
 	"reflect"
 	"regexp"
@@ -60,6 +61,8 @@ log_timezone: local
 		MetricsDurationBuckets:      []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:              "none",
 		LogTimezone:                 "local",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !reflect.DeepEqual(config, expectedConfig) {
@@ -103,6 +106,8 @@ gcs_proxy:
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -147,6 +152,8 @@ http_proxy:
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -224,6 +231,8 @@ s3_proxy:
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -258,6 +267,8 @@ profile_address: :7070
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -306,6 +317,8 @@ endpoint_metrics_duration_buckets: [.005, .1, 5]
 		MetricsDurationBuckets: []float64{0.005, 0.1, 5},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -333,6 +346,305 @@ func TestMetricsDurationBucketsNoDuplicates(t *testing.T) {
 	}
 }
 
+func TestValidAssetFetchHosts(t *testing.T) {
+	yaml := `host: localhost
+port: 1234
+dir: /opt/cache-dir
+max_size: 42
+storage_mode: zstd
+asset_fetch_hosts:
+  mirror.example.com:
+    ca_file: /opt/mirror-ca.pem
+  artifacts.internal:8443:
+    insecure_skip_verify: true
+  github.com:
+    rewrite_to: http://proxy.internal:8080/github.com
+  untrusted.example.com:
+    max_size: 1048576
+  artifacts.example.com:
+    headers:
+      Authorization: Bearer some-token
+  packages.example.com:
+    bearer_token: some-token
+  loopy.example.com:
+    max_redirects: 0
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero := 0
+
+	expectedConfig := &Config{
+		HTTPAddress:            "localhost:1234",
+		Dir:                    "/opt/cache-dir",
+		MaxSize:                42,
+		StorageMode:            "zstd",
+		ZstdImplementation:     "go",
+		MinTLSVersion:          "1.0",
+		NumUploaders:           100,
+		MaxQueuedUploads:       1000000,
+		MaxBlobSize:            math.MaxInt64,
+		MaxProxyBlobSize:       math.MaxInt64,
+		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+		AccessLogLevel:         "all",
+		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
+		AssetFetchHosts: map[string]AssetHostConfig{
+			"mirror.example.com":      {CaFile: "/opt/mirror-ca.pem"},
+			"artifacts.internal:8443": {InsecureSkipVerify: true},
+			"github.com":              {RewriteTo: "http://proxy.internal:8080/github.com"},
+			"untrusted.example.com":   {MaxSize: 1048576},
+			"artifacts.example.com": {
+				Headers: map[string]string{"Authorization": "Bearer some-token"},
+			},
+			"packages.example.com": {BearerToken: "some-token"},
+			"loopy.example.com":    {MaxRedirects: &zero},
+		},
+	}
+
+	if !cmp.Equal(config, expectedConfig) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedConfig, config)
+	}
+}
+
+func TestAssetFetchHostsCaFileAndInsecureSkipVerify(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:        "localhost:8080",
+		MaxSize:            42,
+		MaxBlobSize:        200,
+		MaxProxyBlobSize:   math.MaxInt64,
+		Dir:                "/opt/cache-dir",
+		StorageMode:        "uncompressed",
+		ZstdImplementation: "go",
+		AccessLogLevel:     "all",
+		LogTimezone:        "UTC",
+		AssetFetchHosts: map[string]AssetHostConfig{
+			"mirror.example.com": {
+				CaFile:             "/opt/mirror-ca.pem",
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	err := validateConfig(testConfig)
+	if err == nil {
+		t.Fatal("Expected an error because both 'ca_file' and 'insecure_skip_verify' were set")
+	}
+	if !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("Unexpected error message: '%s'", err.Error())
+	}
+}
+
+func TestAssetFetchHostsBearerTokenAndAuthorizationHeader(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:        "localhost:8080",
+		MaxSize:            42,
+		MaxBlobSize:        200,
+		MaxProxyBlobSize:   math.MaxInt64,
+		Dir:                "/opt/cache-dir",
+		StorageMode:        "uncompressed",
+		ZstdImplementation: "go",
+		AccessLogLevel:     "all",
+		LogTimezone:        "UTC",
+		AssetFetchHosts: map[string]AssetHostConfig{
+			"artifacts.example.com": {
+				Headers:     map[string]string{"authorization": "Basic c29tZTpvbmU="},
+				BearerToken: "some-token",
+			},
+		},
+	}
+	err := validateConfig(testConfig)
+	if err == nil {
+		t.Fatal("Expected an error because both 'bearer_token' and an Authorization header were set")
+	}
+	if !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("Unexpected error message: '%s'", err.Error())
+	}
+}
+
+func TestAssetFetchAllowedExtensionsMissingDot(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:                 "localhost:8080",
+		MaxSize:                     42,
+		MaxBlobSize:                 200,
+		MaxProxyBlobSize:            math.MaxInt64,
+		Dir:                         "/opt/cache-dir",
+		StorageMode:                 "uncompressed",
+		ZstdImplementation:          "go",
+		AccessLogLevel:              "all",
+		LogTimezone:                 "UTC",
+		AssetFetchAllowedExtensions: []string{".tar.gz", "whl"},
+	}
+	err := validateConfig(testConfig)
+	if err == nil {
+		t.Fatal("Expected an error because 'asset_fetch_allowed_extensions' contained an entry without a leading '.'")
+	}
+	if !strings.Contains(err.Error(), "'asset_fetch_allowed_extensions'") {
+		t.Fatalf("Expected the error message to mention the invalid 'asset_fetch_allowed_extensions' key. Got '%s'", err.Error())
+	}
+}
+
+func TestAssetFetchHostPolicy(t *testing.T) {
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 42
+asset_fetch_allowed_hosts:
+  - github.com
+  - "*.example.com"
+asset_fetch_blocked_networks: []
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.AssetFetchAllowedHosts, []string{"github.com", "*.example.com"}) {
+		t.Fatalf("Unexpected 'asset_fetch_allowed_hosts': %v", config.AssetFetchAllowedHosts)
+	}
+	if len(config.AssetFetchBlockedNetworks) != 0 {
+		t.Fatalf("Expected the default 'asset_fetch_blocked_networks' to be overridden, got %v",
+			config.AssetFetchBlockedNetworks)
+	}
+
+	config, err = newFromYaml([]byte("dir: /opt/cache-dir\nmax_size: 42\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"0.0.0.0", "127.0.0.1", "100.64.0.1", "169.254.169.254", "::", "::1"} {
+		ip := net.ParseIP(addr)
+		blocked := false
+		for _, network := range config.AssetFetchBlockedNetworks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ipNet.Contains(ip) {
+				blocked = true
+			}
+		}
+		if !blocked {
+			t.Errorf("Expected %s to be blocked by default, got %v", addr, config.AssetFetchBlockedNetworks)
+		}
+	}
+
+	testCases := map[string]string{
+		"asset_fetch_allowed_hosts:\n  - example.com/foo\n": "'asset_fetch_allowed_hosts'",
+		"asset_fetch_allowed_hosts:\n  - \"*.\"\n":          "'asset_fetch_allowed_hosts'",
+		"asset_fetch_blocked_networks:\n  - 10.0.0.0\n":     "'asset_fetch_blocked_networks'",
+	}
+	for setting, expectedErr := range testCases {
+		_, err = newFromYaml([]byte("dir: /opt/cache-dir\nmax_size: 42\n" + setting))
+		if err == nil || !strings.Contains(err.Error(), expectedErr) {
+			t.Errorf("Expected an error mentioning %s for %q, got: %v", expectedErr, setting, err)
+		}
+	}
+}
+
+func TestAssetIndexDirInsideCacheDir(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:        "localhost:8080",
+		MaxSize:            42,
+		MaxBlobSize:        200,
+		MaxProxyBlobSize:   math.MaxInt64,
+		Dir:                "/opt/cache-dir",
+		StorageMode:        "uncompressed",
+		ZstdImplementation: "go",
+		AccessLogLevel:     "all",
+		LogTimezone:        "UTC",
+	}
+
+	for _, dir := range []string{"/opt/cache-dir", "/opt/cache-dir/asset-index"} {
+		testConfig.AssetIndexDir = dir
+		err := validateConfig(testConfig)
+		if err == nil {
+			t.Fatalf("Expected an error because 'asset_index_dir' %q is inside the cache directory", dir)
+		}
+		if !strings.Contains(err.Error(), "'asset_index_dir'") {
+			t.Fatalf("Expected the error message to mention the invalid 'asset_index_dir' key. Got '%s'", err.Error())
+		}
+	}
+
+	for _, dir := range []string{"/opt/asset-index", "/opt/cache-dir-asset-index"} {
+		testConfig.AssetIndexDir = dir
+		err := validateConfig(testConfig)
+		if err != nil {
+			t.Fatalf("Expected 'asset_index_dir' %q to be valid, got: %v", dir, err)
+		}
+	}
+}
+
+func TestAssetAdminLocalDirs(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:         "localhost:8080",
+		MaxSize:             42,
+		MaxBlobSize:         200,
+		MaxProxyBlobSize:    math.MaxInt64,
+		Dir:                 "/opt/cache-dir",
+		StorageMode:         "uncompressed",
+		ZstdImplementation:  "go",
+		AccessLogLevel:      "all",
+		LogTimezone:         "UTC",
+		AssetAdminLocalDirs: []string{"/srv/seed"},
+	}
+
+	err := validateConfig(testConfig)
+	if err == nil || !strings.Contains(err.Error(), "'asset_admin_service'") {
+		t.Fatalf("Expected an error because 'asset_admin_service' is not enabled, got: %v", err)
+	}
+
+	testConfig.AssetAdminService = true
+	err = validateConfig(testConfig)
+	if err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("Expected an error because authentication is not enabled, got: %v", err)
+	}
+
+	testConfig.HtpasswdFile = "/opt/htpasswd"
+	err = validateConfig(testConfig)
+	if err != nil {
+		t.Fatalf("Expected 'asset_admin_local_directories' to be valid, got: %v", err)
+	}
+
+	testConfig.AssetAdminLocalDirs = []string{"relative/seed"}
+	err = validateConfig(testConfig)
+	if err == nil || !strings.Contains(err.Error(), "'asset_admin_local_directories'") {
+		t.Fatalf("Expected an error because of a relative path, got: %v", err)
+	}
+}
+
+func TestAssetFetchHostBreaker(t *testing.T) {
+	testConfig := &Config{
+		HTTPAddress:               "localhost:8080",
+		MaxSize:                   42,
+		MaxBlobSize:               200,
+		MaxProxyBlobSize:          math.MaxInt64,
+		Dir:                       "/opt/cache-dir",
+		StorageMode:               "uncompressed",
+		ZstdImplementation:        "go",
+		AccessLogLevel:            "all",
+		LogTimezone:               "UTC",
+		AssetFetchBreakerFailures: 5,
+	}
+
+	err := validateConfig(testConfig)
+	if err == nil || !strings.Contains(err.Error(), "'asset_fetch_host_breaker_cooldown'") {
+		t.Fatalf("Expected an error because 'asset_fetch_host_breaker_cooldown' is not set, got: %v", err)
+	}
+
+	testConfig.AssetFetchBreakerCooldown = 30 * time.Second
+	err = validateConfig(testConfig)
+	if err != nil {
+		t.Fatalf("Expected the host circuit breaker config to be valid, got: %v", err)
+	}
+
+	testConfig.AssetFetchBreakerFailures = -1
+	err = validateConfig(testConfig)
+	if err == nil || !strings.Contains(err.Error(), "'asset_fetch_host_breaker_failures'") {
+		t.Fatalf("Expected an error because of negative failures, got: %v", err)
+	}
+}
+
 func TestStorageModes(t *testing.T) {
 	tests := []struct {
 		yaml     string
@@ -438,6 +750,8 @@ storage_mode: zstd
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -472,6 +786,8 @@ storage_mode: zstd
 		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
 		AccessLogLevel:         "all",
 		LogTimezone:            "UTC",
+
+		AssetFetchBlockedNetworks: DefaultAssetFetchBlockedNetworks,
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
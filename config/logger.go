@@ -23,6 +23,10 @@ func (c *Config) setLogger() error {
 	c.AccessLogger = log.New(os.Stdout, "", logFlags)
 	c.ErrorLogger = log.New(os.Stderr, "", logFlags)
 
+	// Security events are written to stderr with a distinct prefix, so
+	// that they can be filtered and alerted on separately.
+	c.SecurityLogger = log.New(os.Stderr, "SECURITY: ", logFlags|log.Lmsgprefix)
+
 	if c.AccessLogLevel == "none" {
 		c.AccessLogger.SetOutput(io.Discard)
 	}
@@ -8,16 +8,24 @@ import (
 	"os"
 )
 
+var supportedTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 func (c *Config) setTLSConfig() error {
 
-	supportedTLSServerVersions := map[string]uint16{
-		"1.0": tls.VersionTLS10,
-		"1.1": tls.VersionTLS11,
-		"1.2": tls.VersionTLS12,
-		"1.3": tls.VersionTLS13,
+	if c.AssetFetchMinTLSVersion != "" {
+		assetVersion, ok := supportedTLSVersions[c.AssetFetchMinTLSVersion]
+		if !ok {
+			return errors.New("Unsupported asset_fetch_min_tls_version: \"" + c.AssetFetchMinTLSVersion + "\", must be one of 1.0, 1.1, 1.2, 1.3.")
+		}
+		c.AssetFetchTLSVersion = assetVersion
 	}
 
-	minTLSVersion, ok := supportedTLSServerVersions[c.MinTLSVersion]
+	minTLSVersion, ok := supportedTLSVersions[c.MinTLSVersion]
 	if !ok {
 		return errors.New("Unsupported min_tls_version: \"" + c.MinTLSVersion + "\", must be one of 1.0, 1.1, 1.2, 1.3.")
 	}
@@ -9,12 +9,15 @@ import (
 	_ "net/http/pprof" // Register pprof handlers with DefaultServeMux.
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
 
 	auth "github.com/abbot/go-http-auth"
 
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
 	"github.com/buchgr/bazel-remote/v2/cache/disk"
 
 	"github.com/buchgr/bazel-remote/v2/config"
@@ -142,9 +145,21 @@ func run(ctx *cli.Context) error {
 		disk.WithProxyMaxBlobSize(c.MaxProxyBlobSize),
 		disk.WithAccessLogger(c.AccessLogger),
 	}
+	if c.MaxACBlobSize > 0 {
+		opts = append(opts, disk.WithMaxBlobSizeForKind(cache.AC, c.MaxACBlobSize))
+	}
+	if c.MinProxyACBlobSize > 0 {
+		opts = append(opts, disk.WithProxyMinBlobSizeForKind(cache.AC, c.MinProxyACBlobSize))
+	}
+	if c.MinProxyCASBlobSize > 0 {
+		opts = append(opts, disk.WithProxyMinBlobSizeForKind(cache.CAS, c.MinProxyCASBlobSize))
+	}
 	if c.ProxyBackend != nil {
 		opts = append(opts, disk.WithProxyBackend(c.ProxyBackend))
 	}
+	if c.ProxyBackend != nil && c.ProxySizeMismatchPolicy != "" {
+		opts = append(opts, disk.WithProxySizeMismatchPolicy(c.ProxySizeMismatchPolicy))
+	}
 	if c.EnableEndpointMetrics {
 		opts = append(opts, disk.WithEndpointMetrics())
 	}
@@ -408,6 +423,304 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 	}
 	log.Println("experimental gRPC remote asset API:", remoteAssetStatus)
 
+	var assetOpts []server.AssetOption
+	if enableRemoteAssetAPI {
+		hc, ok := c.ProxyBackend.(cache.HealthChecker)
+		if ok {
+			assetOpts = append(assetOpts,
+				server.WithAssetReadinessCheck("proxy backend", hc.CheckHealth))
+		}
+
+		assetOpts = append(assetOpts, server.WithAssetSecurityLogger(c.SecurityLogger))
+
+		if c.AccessLogLevel == "debug" {
+			assetOpts = append(assetOpts, server.WithAssetDebugLogger(c.AccessLogger))
+		}
+
+		if c.ProfileAddress != "" {
+			// Served by the profiling server, along with /debug/pprof/.
+			tracker := server.NewAssetFetchTracker()
+			http.Handle("/debug/asset", tracker)
+			assetOpts = append(assetOpts, server.WithAssetFetchTracker(tracker))
+		}
+
+		if c.AssetFetchHTTPSOnly {
+			assetOpts = append(assetOpts, server.WithAssetFetchHTTPSOnly())
+		}
+
+		if c.AssetFetchDecodeContent {
+			assetOpts = append(assetOpts, server.WithAssetFetchDecodeContentEncoding(true))
+		}
+
+		if c.AssetFetchHeadProbe {
+			assetOpts = append(assetOpts, server.WithAssetFetchHeadProbe())
+		}
+
+		if c.AssetDirNormalizeNames {
+			assetOpts = append(assetOpts, server.WithAssetDirectoryNameNormalization())
+		}
+
+		if c.AssetDirMaxSize > 0 || c.AssetDirMaxEntries > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetDirectoryLimits(c.AssetDirMaxSize, c.AssetDirMaxEntries))
+		}
+
+		if c.AssetDirMaxNodes > 0 {
+			assetOpts = append(assetOpts, server.WithAssetDirectoryMaxNodes(c.AssetDirMaxNodes))
+		}
+
+		if c.AssetDirMaxUnpacks > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetDirectoryMaxUnpacks(c.AssetDirMaxUnpacks))
+		}
+
+		if c.AssetAdminService {
+			assetOpts = append(assetOpts, server.WithAssetAdminService())
+
+			if len(c.AssetAdminLocalDirs) > 0 {
+				assetOpts = append(assetOpts,
+					server.WithAssetAdminLocalDirectories(c.AssetAdminLocalDirs...))
+			}
+		}
+
+		if c.AssetPushVerifyInterval > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetPushVerification(c.AssetPushVerifyInterval))
+		}
+
+		if c.AssetMaxRequestSize > 0 || c.AssetMaxURIs > 0 || c.AssetMaxQualifiers > 0 || c.AssetMaxQualifierLength > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetRequestLimits(c.AssetMaxRequestSize, c.AssetMaxURIs,
+					c.AssetMaxQualifiers, c.AssetMaxQualifierLength))
+		}
+
+		if len(c.AssetFetchAllowedExtensions) > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchAllowedExtensions(c.AssetFetchAllowedExtensions))
+		}
+
+		if len(c.AssetFetchAllowedHosts) > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchAllowedHosts(c.AssetFetchAllowedHosts))
+		}
+
+		if len(c.AssetFetchBlockedNetworks) > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchBlockedNetworks(c.AssetFetchBlockedNetworks))
+		}
+
+		if c.AssetFetchRetryBudget > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchRetryBudget(c.AssetFetchRetryBudget))
+		}
+
+		if c.AssetFetchConcurrency > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchConcurrency(c.AssetFetchConcurrency))
+		}
+
+		if c.HTTPAssetFetchRetries > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchRetries(c.HTTPAssetFetchRetries))
+		}
+
+		if c.AssetFetchAllowSizeChange {
+			assetOpts = append(assetOpts, server.WithAssetFetchAllowSizeChange())
+		}
+
+		if c.AssetFetchNotFoundWindow > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchNotFoundWindow(c.AssetFetchNotFoundWindow))
+		}
+
+		if c.AssetFetchMismatchWindow > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchMismatchWindow(c.AssetFetchMismatchWindow))
+		}
+
+		if c.AssetFetchBreakerFailures > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchHostCircuitBreaker(c.AssetFetchBreakerFailures, c.AssetFetchBreakerCooldown))
+		}
+
+		if c.AssetFetchSidecarSuffix != "" {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchChecksumSidecarSuffix(c.AssetFetchSidecarSuffix))
+		}
+
+		assetOpts = append(assetOpts,
+			server.WithAssetTempDir(filepath.Join(c.Dir, disk.TempDirName)))
+
+		if c.AssetFetchTempBudget > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchTempBudget(c.AssetFetchTempBudget))
+		}
+
+		if c.AssetFetchQuarantineDir != "" {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchQuarantineDir(c.AssetFetchQuarantineDir))
+		}
+
+		if c.AssetIndexDir != "" {
+			var indexOpts []assetindex.Option
+			if c.AssetIndexFlushInterval > 0 {
+				indexOpts = append(indexOpts,
+					assetindex.WithFlushInterval(c.AssetIndexFlushInterval))
+			}
+			if c.AssetIndexFlushBatchSize > 0 {
+				indexOpts = append(indexOpts,
+					assetindex.WithFlushBatchSize(c.AssetIndexFlushBatchSize))
+			}
+			if c.AssetIndexFlushParallelism > 0 {
+				indexOpts = append(indexOpts,
+					assetindex.WithFlushParallelism(c.AssetIndexFlushParallelism))
+			}
+
+			index, err := assetindex.New(c.AssetIndexDir, c.AssetIndexMaxSize, indexOpts...)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				// Write any changes which haven't been flushed yet.
+				err := index.Close()
+				if err != nil {
+					log.Println("Failed to flush the remote asset index:", err)
+				}
+			}()
+			assetOpts = append(assetOpts,
+				server.WithAssetIndex(index),
+				server.WithAssetReadinessCheck("asset index", index.CheckHealth))
+		} else if c.AssetIndexMaxSize > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetIndex(assetindex.NewInMemory(c.AssetIndexMaxSize)))
+		}
+
+		if c.AssetFetchTTL > 0 {
+			assetOpts = append(assetOpts, server.WithAssetFetchTTL(c.AssetFetchTTL))
+		}
+
+		if c.HTTPAssetFetchTimeout > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchTimeout(c.HTTPAssetFetchTimeout))
+		}
+
+		if c.AssetFetchRequestTimeout > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchRequestTimeout(c.AssetFetchRequestTimeout))
+		}
+
+		if c.AssetFetchConnectTimeout > 0 || c.AssetFetchTLSTimeout > 0 || c.AssetFetchHeaderTimeout > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchTransportTimeouts(c.AssetFetchConnectTimeout,
+					c.AssetFetchTLSTimeout, c.AssetFetchHeaderTimeout))
+		}
+
+		if c.AssetFetchMaxHeaderBytes > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchMaxResponseHeaderBytes(c.AssetFetchMaxHeaderBytes))
+		}
+
+		if c.MaxAssetBlobSize > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchMaxSize(c.MaxAssetBlobSize))
+		}
+
+		if c.AssetFetchMaxConnsPerHost > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchMaxConnsPerHost(c.AssetFetchMaxConnsPerHost))
+		}
+
+		if c.AssetFetchBufferSize > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchBufferSize(c.AssetFetchBufferSize))
+		}
+
+		if c.AssetFetchTLSVersion != 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchMinTLSVersion(c.AssetFetchTLSVersion))
+		}
+
+		if c.AssetFetchRegion != "" {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchRegion(c.AssetFetchRegion))
+		}
+
+		reloadTLS := false
+		hostHeaders := make(map[string]http.Header)
+		for host, hc := range c.AssetFetchHosts {
+			if len(hc.Headers) > 0 || hc.BearerToken != "" {
+				headers := make(http.Header)
+				for name, value := range hc.Headers {
+					headers.Set(name, value)
+				}
+				if hc.BearerToken != "" {
+					headers.Set("Authorization", "Bearer "+hc.BearerToken)
+				}
+				hostHeaders[host] = headers
+			}
+
+			if hc.Region != "" {
+				assetOpts = append(assetOpts,
+					server.WithAssetFetchHostRegion(host, hc.Region))
+			}
+
+			if hc.MaxSize > 0 {
+				assetOpts = append(assetOpts,
+					server.WithAssetFetchHostMaxSize(host, hc.MaxSize))
+			}
+
+			if hc.MaxRedirects != nil {
+				assetOpts = append(assetOpts,
+					server.WithAssetFetchHostMaxRedirects(host, *hc.MaxRedirects))
+			}
+
+			if hc.HasTLSConfig() {
+				assetOpts = append(assetOpts,
+					server.WithAssetFetchTLSConfigLoader(host, hc.TLSConfig))
+				reloadTLS = true
+			}
+		}
+
+		if reloadTLS {
+			// Reload CA files for asset fetches on SIGHUP.
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+
+			reload := make(chan struct{})
+			go func() {
+				for range hup {
+					log.Println("Received SIGHUP, reloading asset fetch TLS settings")
+					reload <- struct{}{}
+				}
+			}()
+
+			assetOpts = append(assetOpts, server.WithAssetFetchTLSReload(reload))
+		}
+
+		var credentials []server.CredentialProvider
+		if len(hostHeaders) > 0 {
+			credentials = append(credentials,
+				server.NewStaticCredentialProvider(hostHeaders))
+		}
+		if c.AssetFetchNetrc != "" {
+			netrc, err := server.NewNetrcCredentialProvider(c.AssetFetchNetrc)
+			if err != nil {
+				return err
+			}
+			credentials = append(credentials, netrc)
+		}
+		if len(credentials) > 0 {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchCredentialProvider(
+					server.NewCredentialProviderChain(credentials...)))
+		}
+
+		for host, target := range c.AssetFetchRewrites {
+			assetOpts = append(assetOpts,
+				server.WithAssetFetchRewrite(host, target))
+		}
+	}
+
 	network := "tcp"
 	addr := c.GRPCAddress
 	if strings.HasPrefix(c.GRPCAddress, "unix://") {
@@ -429,7 +742,8 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 		validateAC,
 		c.EnableACKeyInstanceMangling,
 		enableRemoteAssetAPI,
-		diskCache, c.AccessLogger, c.ErrorLogger)
+		diskCache, c.AccessLogger, c.ErrorLogger,
+		assetOpts...)
 }
 
 // A http.HandlerFunc wrapper which requires successful basic
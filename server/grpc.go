@@ -41,6 +41,8 @@ type grpcServer struct {
 	errorLogger  cache.Logger
 	depsCheck    bool
 	mangleACKeys bool
+
+	asset assetConfig
 }
 
 var readOnlyMethods = map[string]struct{}{
@@ -61,39 +63,79 @@ func ListenAndServeGRPC(
 	validateACDeps bool,
 	mangleACKeys bool,
 	enableRemoteAssetAPI bool,
-	c disk.Cache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger,
+	assetOpts ...AssetOption) error {
 
 	listener, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	return ServeGRPC(listener, srv, validateACDeps, mangleACKeys, enableRemoteAssetAPI, c, a, e)
+	return ServeGRPC(listener, srv, validateACDeps, mangleACKeys, enableRemoteAssetAPI, c, a, e, assetOpts...)
 }
 
 func ServeGRPC(l net.Listener, srv *grpc.Server,
 	validateACDepsCheck bool,
 	mangleACKeys bool,
 	enableRemoteAssetAPI bool,
-	c disk.Cache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger,
+	assetOpts ...AssetOption) error {
 
 	s := &grpcServer{
 		cache: c, accessLogger: a, errorLogger: e,
 		depsCheck:    validateACDepsCheck,
 		mangleACKeys: mangleACKeys,
+		asset:        defaultAssetConfig(),
+	}
+
+	for _, o := range assetOpts {
+		err := o(&s.asset)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.asset.securityLogger == nil {
+		s.asset.securityLogger = e
 	}
+
+	var err error
+	s.asset.httpClient, err = newAssetHTTPClient(&s.asset)
+	if err != nil {
+		return err
+	}
+
 	pb.RegisterActionCacheServer(srv, s)
 	pb.RegisterCapabilitiesServer(srv, s)
 	pb.RegisterContentAddressableStorageServer(srv, s)
 	bytestream.RegisterByteStreamServer(srv, s)
-	if enableRemoteAssetAPI {
-		asset.RegisterFetchServer(srv, s)
-	}
 
 	h := health.NewServer()
 	grpc_health_v1.RegisterHealthServer(srv, h)
 	h.SetServingStatus(grpcHealthServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
 
+	done := make(chan struct{})
+	defer close(done)
+
+	if enableRemoteAssetAPI {
+		s.asset.enabled = true
+		asset.RegisterFetchServer(srv, s)
+		asset.RegisterPushServer(srv, s)
+		go s.monitorAssetReadiness(h, done)
+
+		if s.asset.tlsReload != nil && s.asset.hostTransport != nil {
+			go s.reloadAssetTLSConfigs(done)
+		}
+
+		if s.asset.pushVerifications != nil {
+			go s.verifyPushes(done)
+		}
+
+		if s.asset.adminService {
+			srv.RegisterService(s.asset.adminServiceDesc(), s)
+		}
+	}
+
 	return srv.Serve(l)
 }
 
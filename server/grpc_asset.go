@@ -1,24 +1,46 @@
 package server
 
 import (
-	"bytes"
+	"bufio"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
 	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+	"github.com/buchgr/bazel-remote/v2/utils/validate"
 )
 
 // FetchServer implementation
@@ -26,10 +48,102 @@ import (
 var errNilFetchBlobRequest = grpc_status.Error(codes.InvalidArgument,
 	"expected a non-nil *FetchBlobRequest")
 
+// Hex-encoded digests of empty input, for each of the checksum.sri hash
+// algorithms. Requests for these can be satisfied without downloading
+// anything.
+var emptySRIDigests = map[string]string{
+	"sha256": emptySha256,
+	"sha384": "38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b",
+	"sha512": "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+	"sha1":   "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	"md5":    "d41d8cd98f00b204e9800998ecf8427e",
+}
+
+// Hash functions for checksum.sri algorithms other than sha256. These
+// can't be used to find blobs in the CAS directly, but they can be used
+// to verify downloads, and are then mapped to the sha256 of the content
+// in the asset index.
+var altSRIHashes = map[string]func() hash.Hash{
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// A checksum.sri qualifier with one of the algorithms in altSRIHashes.
+// The zero value means there is no such qualifier.
+type altChecksum struct {
+	algo string
+
+	// Hex encoded.
+	hash string
+
+	qualifier *asset.Qualifier
+}
+
+// Returns the index key which maps c to the sha256 of the content.
+func (c altChecksum) indexKey() string {
+	return altChecksumKey(c.algo, c.hash)
+}
+
+// Returns the index key which maps the hex encoded hash of some content,
+// using one of the algorithms in altSRIHashes, to the sha256 of the
+// content.
+func altChecksumKey(algo string, hash string) string {
+	return assetindex.Key(assetindex.Metadata, algo+"-"+hash, nil)
+}
+
+// altHashWriter is an io.Writer which computes the hash of the content
+// written to it with each of the algorithms in altSRIHashes, so that
+// fetched content can later be found by any of those checksums.
+type altHashWriter struct {
+	hashes map[string]hash.Hash
+
+	// The number of bytes written.
+	size int64
+}
+
+func newAltHashWriter() *altHashWriter {
+	w := &altHashWriter{hashes: make(map[string]hash.Hash, len(altSRIHashes))}
+	for algo, newHash := range altSRIHashes {
+		w.hashes[algo] = newHash()
+	}
+	return w
+}
+
+func (w *altHashWriter) Write(p []byte) (int, error) {
+	for _, h := range w.hashes {
+		h.Write(p)
+	}
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// Returns the hex encoded hashes, keyed by algorithm.
+func (w *altHashWriter) sums() map[string]string {
+	sums := make(map[string]string, len(w.hashes))
+	for algo, h := range w.hashes {
+		sums[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
 func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest) (*asset.FetchBlobResponse, error) {
+	source := assetSourceNone
+	resp, err := s.fetchBlob(ctx, req, &source)
+	observeAssetRequest("FetchBlob", resp.GetStatus(), err, source)
+	return resp, err
+}
+
+// Implements FetchBlob, and sets *source to say how a successful request
+// was resolved.
+func (s *grpcServer) fetchBlob(ctx context.Context, req *asset.FetchBlobRequest, source *assetSource) (*asset.FetchBlobResponse, error) {
 
 	var sha256Str string
 
+	// Only used if there is no sha256 checksum.
+	var alt altChecksum
+
 	// Q: which combinations of qualifiers to support?
 	// * simple file, identified by sha256 SRI AND/OR recognisable URL
 	// * git repository, identified by ???
@@ -37,7 +151,7 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 
 	// "strong" identifiers:
 	// checksum.sri -> direct lookup for sha256 (easy), indirect lookup for
-	//     others (eg sha256 of the SRI hash).
+	//     others, via the asset index (see indexAltChecksums).
 	// vcs.commit + .git extension -> indirect lookup? or sha1 lookup?
 	//     But this could waste a lot of space.
 	//
@@ -48,14 +162,60 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 	//
 	//    git archive --format=tar --remote=http://foo/bar.git ref dir...
 
-	// For TTL items, we need another (persistent) index, eg BadgerDB?
-	// key -> CAS sha256 + timestamp
-	// Should we place a limit on the size of the index?
+	// Weak identifiers are resolved using s.asset.index, which maps
+	// URIs + qualifiers -> CAS digest + timestamp, for content that was
+	// pushed or fetched within the TTL.
 
 	if req == nil {
 		return nil, errNilFetchBlobRequest
 	}
 
+	limitStatus := s.asset.limits.check(req)
+	if limitStatus != nil {
+		return &asset.FetchBlobResponse{Status: limitStatus}, nil
+	}
+
+	for i, uri := range req.GetUris() {
+		err := validateFetchURI(uri)
+		if err != nil {
+			return &asset.FetchBlobResponse{
+				Status: &status.Status{
+					Code:    int32(codes.InvalidArgument),
+					Message: fmt.Sprintf("invalid URI at index %d in FetchBlobRequest: %v", i, err),
+				},
+			}, nil
+		}
+	}
+
+	requested, err := requestedTimeout(req.GetQualifiers())
+	if err != nil {
+		// Not worth failing the request for, use the server's timeout.
+		s.errorLogger.Printf("GRPC ASSET FETCH ignoring %v", err)
+	}
+
+	expectedSize, err := requestedSize(req.GetQualifiers())
+	if err != nil {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			},
+		}, nil
+	}
+
+	entryKind, err := requestedEntryKind(req.GetQualifiers())
+	if err != nil {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			},
+		}, nil
+	}
+	if entryKind == cache.AC {
+		return s.fetchPushedACEntry(ctx, req, source), nil
+	}
+
 	for _, q := range req.GetQualifiers() {
 		if q == nil {
 			return &asset.FetchBlobResponse{
@@ -66,67 +226,263 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 			}, nil
 		}
 
-		if q.Name == "checksum.sri" && strings.HasPrefix(q.Value, "sha256-") {
+		if q.Name == "checksum.sri" {
 			// Ref: https://developer.mozilla.org/en-US/docs/Web/Security/Subresource_Integrity
 
-			b64hash := strings.TrimPrefix(q.Value, "sha256-")
-
-			decoded, err := base64.StdEncoding.DecodeString(b64hash)
+			algo, hexHash, err := parseSRI(q.Value)
 			if err != nil {
-				s.errorLogger.Printf("failed to base64 decode \"%s\": %v",
-					b64hash, err)
-				continue
+				return &asset.FetchBlobResponse{
+					Status: &status.Status{
+						Code:    int32(codes.InvalidArgument),
+						Message: err.Error(),
+					},
+				}, nil
 			}
 
-			sha256Str = hex.EncodeToString(decoded)
+			if empty, ok := emptySRIDigests[algo]; ok && hexHash == empty {
+				// There's nothing to download, and the empty blob
+				// is always available in the CAS.
+				s.asset.debugf("GRPC ASSET FETCH SRI HIT %s/%d %s=%s",
+					emptySha256, 0, q.Name, q.Value)
+				*source = assetSourceChecksum
+				s.setCacheControl(ctx, immutableCacheControl)
+				return &asset.FetchBlobResponse{
+					Status: &status.Status{Code: int32(codes.OK)},
+					BlobDigest: &pb.Digest{
+						Hash:      emptySha256,
+						SizeBytes: 0,
+					},
+					// Report which qualifier resulted in the hit.
+					Qualifiers: []*asset.Qualifier{q},
+				}, nil
+			}
 
-			found, size := s.cache.Contains(ctx, cache.CAS, sha256Str, -1)
-			if !found {
+			if algo != "sha256" {
+				if alt.algo == "" {
+					alt = altChecksum{algo: algo, hash: hexHash, qualifier: q}
+				}
 				continue
 			}
 
-			if size < 0 {
-				// We don't know the size yet (bad http backend?).
-				r, actualSize, err := s.cache.Get(ctx, cache.CAS, sha256Str, -1, 0)
-				if r != nil {
-					defer r.Close()
-				}
-				if err != nil || actualSize < 0 {
-					s.errorLogger.Printf("failed to get CAS %s from proxy backend size: %d err: %v",
-						sha256Str, actualSize, err)
-					continue
-				}
-				size = actualSize
+			sha256Str = hexHash
+
+			size, found := s.casBlobSize(ctx, sha256Str)
+			if !found {
+				continue
 			}
 
+			s.asset.debugf("GRPC ASSET FETCH SRI HIT %s/%d %s=%s",
+				sha256Str, size, q.Name, q.Value)
+			*source = assetSourceChecksum
+			s.setCacheControl(ctx, immutableCacheControl)
+			s.setContentType(ctx, s.lookupContentType(sha256Str))
 			return &asset.FetchBlobResponse{
 				Status: &status.Status{Code: int32(codes.OK)},
 				BlobDigest: &pb.Digest{
 					Hash:      sha256Str,
 					SizeBytes: size,
 				},
+				// Report which qualifier resulted in the hit.
+				Qualifiers: []*asset.Qualifier{q},
 			}, nil
 		}
 	}
 
-	// Cache miss.
+	headers, err := requestHeaders(req.GetQualifiers())
+	if err != nil {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			},
+		}, nil
+	}
 
-	// See if we can download one of the URIs.
+	decode, err := decodeContentEncoding(req.GetQualifiers(), s.asset.decodeContentEncoding)
+	if err != nil {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			},
+		}, nil
+	}
 
-	for _, uri := range req.GetUris() {
-		ok, actualHash, size := s.fetchItem(ctx, uri, sha256Str)
-		if ok {
+	if sha256Str != "" {
+		alt = altChecksum{}
+	} else if alt.algo != "" {
+		// Content that was downloaded by an earlier request with the
+		// same checksum.
+		digest, found := s.lookupAltChecksum(ctx, alt)
+		if found {
+			s.asset.debugf("GRPC ASSET FETCH SRI HIT %s/%d %s=%s",
+				digest.Hash, digest.SizeBytes, alt.qualifier.Name, alt.qualifier.Value)
+			*source = assetSourceChecksum
+			s.setCacheControl(ctx, immutableCacheControl)
+			s.setContentType(ctx, s.lookupContentType(digest.Hash))
 			return &asset.FetchBlobResponse{
-				Status: &status.Status{Code: int32(codes.OK)},
-				BlobDigest: &pb.Digest{
-					Hash:      actualHash,
-					SizeBytes: size,
-				},
-				Uri: uri,
+				Status:     &status.Status{Code: int32(codes.OK)},
+				BlobDigest: digest,
+				// Report which qualifier resulted in the hit.
+				Qualifiers: []*asset.Qualifier{alt.qualifier},
 			}, nil
 		}
+	}
 
-		// Not a simple file. Not yet handled...
+	// Content that was associated with one of the URIs by PushBlob, or
+	// by an earlier fetch without a checksum.
+	notBefore := fetchNotBefore(req.GetOldestContentAccepted(), requestedMaxAge(req.GetQualifiers()))
+	indexed, found := s.lookupIndexedAsset(ctx, assetindex.Blob, req.GetUris(), req.GetQualifiers(), notBefore)
+	if found {
+		*source = assetSourceIndex
+		s.setCacheControl(ctx, noCacheControl)
+		if indexed.contentType == "" {
+			indexed.contentType = s.lookupContentType(indexed.digest.GetHash())
+		}
+		s.setContentType(ctx, indexed.contentType)
+		s.setValidators(ctx, indexed.etag, indexed.lastModified)
+		return &asset.FetchBlobResponse{
+			Status:     &status.Status{Code: int32(codes.OK)},
+			Uri:        indexed.uri,
+			Qualifiers: req.GetQualifiers(),
+			ExpiresAt:  indexed.expiresAt,
+			BlobDigest: indexed.digest,
+		}, nil
+	}
+
+	// Cache miss.
+
+	// See if we can download one of the URIs, possibly several at the
+	// same time (see fetchURIs). Transient failures are retried with
+	// exponential backoff, up to s.asset.fetchRetries times per URI. If
+	// there is a retry budget, the number of retries is also shared by
+	// all of the URIs so that a single request can't make an unbounded
+	// number of attempts.
+
+	retryBudget := s.asset.retryBudget
+	if retryBudget == 0 && s.asset.fetchRetries > 0 {
+		// Only limited per URI.
+		retryBudget = -1
+	}
+
+	// Don't download the same URI more than once if it's listed several
+	// times, transient failures are retried anyway.
+	uris := s.asset.orderByRegion(uniqueURIs(req.GetUris()), s.assetRegion(ctx))
+	if s.asset.mismatches != nil {
+		uris = s.asset.mismatches.order(uris)
+	}
+
+	// The requested timeout also limits the total time spent fetching
+	// the URIs, including retries, rather than each attempt. So does
+	// s.asset.requestTimeout, if it's shorter.
+	fetchTimeout := requested
+	timeoutName := "requested timeout"
+	if s.asset.requestTimeout > 0 && (fetchTimeout == 0 || s.asset.requestTimeout < fetchTimeout) {
+		fetchTimeout = s.asset.requestTimeout
+		timeoutName = "FetchBlob timeout"
+	}
+
+	fetchCtx := ctx
+	if fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, fetchTimeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	winner, outcomes := s.fetchURIs(fetchCtx, uris, sha256Str, expectedSize, alt, headers, decode, &assetRetryBudget{remaining: retryBudget})
+	if winner >= 0 {
+		uri := uris[winner]
+		result := outcomes[winner].result
+
+		if sha256Str != "" {
+			// Identified by its checksum, so this never changes.
+			result.freshness = immutableCacheControl
+		} else if alt.algo != "" {
+			result.freshness = immutableCacheControl
+		} else {
+			if hasQualifier(req.GetQualifiers(), vcsTagQualifier) {
+				result.freshness = immutableCacheControl
+			}
+			s.indexFetchResult(uri, req.GetUris(), req.GetQualifiers(), result, started)
+		}
+		s.indexAltChecksums(uri, result)
+		s.indexContentType(uri, result)
+		*source = assetSourceDownload
+		s.setCacheControl(ctx, result.freshness)
+		s.setContentType(ctx, result.contentType)
+		s.setValidators(ctx, result.etag, result.lastModified)
+
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			BlobDigest: &pb.Digest{
+				Hash:      result.hash,
+				SizeBytes: result.size,
+			},
+			Uri: uri,
+		}, nil
+	}
+
+	if ctx.Err() != nil {
+		// The client gave up.
+		return nil, grpc_status.FromContextError(ctx.Err()).Err()
+	}
+
+	if fetchCtx.Err() != nil {
+		s.errorLogger.Printf("GRPC ASSET FETCH %s FAILED: %s of %v exceeded",
+			strings.Join(uris, ", "), timeoutName, fetchTimeout)
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.DeadlineExceeded),
+				Message: fmt.Sprintf("the %s of %v was exceeded fetching the requested URIs", timeoutName, fetchTimeout),
+			},
+		}, nil
+	}
+
+	// URI schemes that we can't fetch, so that we can tell the client why
+	// nothing was attempted.
+	var unsupportedSchemes []string
+	attempted := false
+
+	// Set if any of the URIs failed for reasons that might not happen
+	// if the client tries again later.
+	transientFailure := false
+
+	// Set if any of the attempts took longer than s.asset.fetchTimeout.
+	timedOut := false
+
+	for _, outcome := range outcomes {
+		if outcome.unsupportedScheme != "" {
+			unsupportedSchemes = append(unsupportedSchemes, outcome.unsupportedScheme)
+		} else if !outcome.cancelled {
+			attempted = true
+		}
+
+		transientFailure = transientFailure || outcome.transient
+		timedOut = timedOut || outcome.timedOut
+	}
+
+	if !attempted && len(unsupportedSchemes) > 0 {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code: int32(codes.InvalidArgument),
+				Message: fmt.Sprintf("unsupported URI scheme(s): %s (only http and https are supported)",
+					strings.Join(unsupportedSchemes, ", ")),
+			},
+		}, nil
+	}
+
+	if timedOut {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.DeadlineExceeded),
+				Message: "timed out fetching the requested URIs",
+			},
+		}, nil
+	}
+
+	if transientFailure {
+		return &asset.FetchBlobResponse{Status: retryLaterStatus()}, nil
 	}
 
 	return &asset.FetchBlobResponse{
@@ -134,74 +490,1089 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 	}, nil
 }
 
-func (s *grpcServer) fetchItem(ctx context.Context, uri string, expectedHash string) (bool, string, int64) {
+// Implements FetchBlob for requests with an entry_kind=ac qualifier. Action
+// cache entries can't be downloaded, so only those which were associated
+// with one of the URIs by PushBlob are returned.
+func (s *grpcServer) fetchPushedACEntry(ctx context.Context, req *asset.FetchBlobRequest, source *assetSource) *asset.FetchBlobResponse {
+	notBefore := fetchNotBefore(req.GetOldestContentAccepted(), requestedMaxAge(req.GetQualifiers()))
+	indexed, found := s.lookupIndexedAsset(ctx, assetindex.Blob, req.GetUris(), req.GetQualifiers(), notBefore)
+	if !found {
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.NotFound),
+				Message: "no action cache entry was pushed for the URIs",
+			},
+		}
+	}
+
+	*source = assetSourceIndex
+	s.setCacheControl(ctx, noCacheControl)
+	return &asset.FetchBlobResponse{
+		Status:     &status.Status{Code: int32(codes.OK)},
+		Uri:        indexed.uri,
+		Qualifiers: req.GetQualifiers(),
+		ExpiresAt:  indexed.expiresAt,
+		BlobDigest: indexed.digest,
+	}
+}
+
+// How long clients are asked to wait before retrying a FetchBlob request
+// which failed due to transient upstream errors.
+const assetFetchRetryDelay = 5 * time.Second
+
+// Returns an Unavailable status with RetryInfo details, so that clients
+// back off and retry.
+func retryLaterStatus() *status.Status {
+	st := &status.Status{
+		Code:    int32(codes.Unavailable),
+		Message: "transient failure fetching the requested URIs, try again later",
+	}
+
+	retryInfo, err := anypb.New(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(assetFetchRetryDelay),
+	})
+	if err == nil {
+		st.Details = append(st.Details, retryInfo)
+	}
+
+	return st
+}
+
+// Returns the size of the CAS blob with the given sha256 hash, if it is
+// in the cache or the proxy backend. The size reported by the proxy
+// backend's Contains method is used when it is known, so that the blob
+// only needs to be downloaded into the local cache if the backend can't
+// report sizes.
+func (s *grpcServer) casBlobSize(ctx context.Context, hash string) (int64, bool) {
+	found, size := s.cache.Contains(ctx, cache.CAS, hash, -1)
+	if !found {
+		return -1, false
+	}
+	if size >= 0 {
+		return size, true
+	}
+
+	// We don't know the size yet (bad http backend?).
+	r, size, err := s.cache.Get(ctx, cache.CAS, hash, -1, 0)
+	if r != nil {
+		r.Close()
+	}
+	if err != nil || size < 0 {
+		s.errorLogger.Printf("failed to get CAS %s from proxy backend size: %d err: %v",
+			hash, size, err)
+		return -1, false
+	}
+
+	return size, true
+}
+
+// The base64 variants accepted in checksum.sri qualifiers. SRI uses
+// standard padded base64, but some tools produce unpadded or URL-safe
+// base64, so try those too.
+var sriEncodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// Decodes the base64 hash from a checksum.sri qualifier value.
+func decodeSRIHash(b64hash string) ([]byte, error) {
+	var firstErr error
+	for _, enc := range sriEncodings {
+		decoded, err := enc.DecodeString(b64hash)
+		if err == nil {
+			return decoded, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// Parses a checksum.sri qualifier value into its hash algorithm and the
+// hex encoded hash. Only sha256 and the algorithms in altSRIHashes are
+// supported.
+func parseSRI(value string) (algo string, hexHash string, err error) {
+	algo, b64hash, found := strings.Cut(value, "-")
+	if !found {
+		return "", "", fmt.Errorf("invalid checksum.sri qualifier: %q", value)
+	}
+
+	size := sha256.Size
+	if algo != "sha256" {
+		newHash, ok := altSRIHashes[algo]
+		if !ok {
+			return "", "", fmt.Errorf("unsupported checksum.sri hash algorithm: %q", algo)
+		}
+		size = newHash().Size()
+	}
+
+	decoded, err := decodeSRIHash(b64hash)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to base64 decode checksum.sri hash %q: %w", b64hash, err)
+	}
+	if len(decoded) != size {
+		return "", "", fmt.Errorf("invalid %s checksum.sri hash length: %d bytes", algo, len(decoded))
+	}
+
+	return algo, hex.EncodeToString(decoded), nil
+}
+
+// The qualifier which clients can use to specify the size in bytes of
+// the content, if they know it. Downloads of any other size are rejected
+// before they are stored, eg truncated responses from proxies.
+const expectedSizeQualifier = "expected_size"
+
+// Returns the size from an expected_size qualifier, or -1 if there is
+// none.
+func requestedSize(qualifiers []*asset.Qualifier) (int64, error) {
+	for _, q := range qualifiers {
+		if q.GetName() != expectedSizeQualifier {
+			continue
+		}
+
+		size, err := strconv.ParseInt(q.GetValue(), 10, 64)
+		if err != nil || size < 0 {
+			return -1, fmt.Errorf("invalid %s qualifier: %q", expectedSizeQualifier, q.GetValue())
+		}
+
+		return size, nil
+	}
+
+	return -1, nil
+}
+
+// Returns a non-nil status if req exceeds any of the limits.
+func (l *assetRequestLimits) check(req *asset.FetchBlobRequest) *status.Status {
+	if l.maxRequestSize > 0 {
+		size := proto.Size(protoadapt.MessageV2Of(req))
+		if size > l.maxRequestSize {
+			return &status.Status{
+				Code: int32(codes.ResourceExhausted),
+				Message: fmt.Sprintf("FetchBlobRequest size %d exceeds the limit of %d bytes",
+					size, l.maxRequestSize),
+			}
+		}
+	}
+
+	if l.maxURIs > 0 && len(req.GetUris()) > l.maxURIs {
+		return &status.Status{
+			Code: int32(codes.InvalidArgument),
+			Message: fmt.Sprintf("FetchBlobRequest has %d URIs, the limit is %d",
+				len(req.GetUris()), l.maxURIs),
+		}
+	}
+
+	if l.maxQualifiers > 0 && len(req.GetQualifiers()) > l.maxQualifiers {
+		return &status.Status{
+			Code: int32(codes.InvalidArgument),
+			Message: fmt.Sprintf("FetchBlobRequest has %d qualifiers, the limit is %d",
+				len(req.GetQualifiers()), l.maxQualifiers),
+		}
+	}
+
+	if l.maxQualifierValueLength > 0 {
+		for _, q := range req.GetQualifiers() {
+			if len(q.GetValue()) > l.maxQualifierValueLength {
+				return &status.Status{
+					Code: int32(codes.InvalidArgument),
+					Message: fmt.Sprintf("FetchBlobRequest qualifier %q value length %d exceeds the limit of %d",
+						q.GetName(), len(q.GetValue()), l.maxQualifierValueLength),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns uris without duplicates, in the order they were first listed.
+func uniqueURIs(uris []string) []string {
+	seen := make(map[string]bool, len(uris))
+	unique := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if seen[uri] {
+			continue
+		}
+		seen[uri] = true
+		unique = append(unique, uri)
+	}
+
+	return unique
+}
+
+// Returns an error describing why uri is clearly malformed, or nil.
+// URIs with schemes that we can't fetch are not rejected here, since
+// another URI in the same request might still be usable.
+func validateFetchURI(uri string) error {
+	if uri == "" {
+		return errors.New("empty URI")
+	}
+
+	if strings.TrimSpace(uri) == "" {
+		return errors.New("whitespace-only URI")
+	}
+
+	_, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The gRPC request metadata key that clients can use to specify their
+// preferred region, overriding the server's default.
+const assetRegionKey = "bazel-remote-asset-region"
+
+// Returns the preferred region for asset fetches for this request.
+func (s *grpcServer) assetRegion(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		regions := md.Get(assetRegionKey)
+		if len(regions) > 0 && regions[0] != "" {
+			return regions[0]
+		}
+	}
+
+	return s.asset.region
+}
+
+// The gRPC request metadata key that clients can set to "true" to try
+// URIs which recently returned 404 or 410 anyway, eg to retry a mirror
+// which has just been fixed without waiting for the not found window.
+const assetBypassNotFoundKey = "bazel-remote-asset-bypass-not-found"
+
+// Returns true if the client asked to bypass s.asset.notFound for this
+// request.
+func bypassNotFound(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	values := md.Get(assetBypassNotFoundKey)
+	if len(values) == 0 {
+		return false
+	}
+
+	bypass, err := strconv.ParseBool(values[0])
+	return err == nil && bypass
+}
+
+// unsupportedSchemeError is returned by fetchItem for URIs which have a
+// scheme that we can't fetch.
+type unsupportedSchemeError struct {
+	scheme string
+}
+
+func (e *unsupportedSchemeError) Error() string {
+	return fmt.Sprintf("unsupported URI scheme: %q", e.scheme)
+}
+
+// Sends a GET request for u, see assetRequest.
+func (s *grpcServer) assetGet(ctx context.Context, u *url.URL, headers http.Header, trace *httptrace.ClientTrace) (*http.Response, error) {
+	return s.assetRequest(ctx, http.MethodGet, u, headers, trace)
+}
+
+// Sends a `method` request for u, with the given headers from the client,
+// if any, and headers from the credential provider if there is one, which
+// take precedence. If trace is non-nil, it is used to trace the request.
+func (s *grpcServer) assetRequest(ctx context.Context, method string, u *url.URL, headers http.Header, trace *httptrace.ClientTrace) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if headers != nil {
+		req.Header = headers.Clone()
+	}
+
+	if trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+
+	if s.asset.credentials != nil {
+		credHeaders, err := s.asset.credentials.Headers(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get credentials: %w", err)
+		}
+		for name := range credHeaders {
+			req.Header.Del(name)
+		}
+		for name, values := range credHeaders {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+
+	return s.asset.httpClient.Do(req)
+}
+
+// Called when a fetch of u returned 403 Forbidden in resp. If enabled,
+// refreshes the credentials for u and repeats the request once. Otherwise
+// or if the credentials can't be refreshed, returns resp unchanged.
+func (s *grpcServer) refreshAndRetry(ctx context.Context, u *url.URL, headers http.Header, trace *httptrace.ClientTrace, resp *http.Response, logURI string) (*http.Response, error) {
+	if !s.asset.refreshOnForbidden {
+		return resp, nil
+	}
+
+	refresher, ok := s.asset.credentials.(CredentialRefresher)
+	if !ok {
+		return resp, nil
+	}
+
+	err := refresher.Refresh(ctx, u)
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET FETCH %s failed to refresh credentials: %v", logURI, err)
+		return resp, nil
+	}
+
+	s.accessLogger.Printf("GRPC ASSET FETCH %s %s, retrying with refreshed credentials", logURI, resp.Status)
+	resp.Body.Close()
+
+	return s.assetGet(ctx, u, headers, trace)
+}
+
+// Returns the error for a fetch request for logURI which failed with err
+// before a response was received, which is a transientFetchError if the
+// request might succeed if it is retried.
+func (s *grpcServer) requestError(logURI string, err error) error {
+	var blockedErr *blockedFetchError
+	if errors.As(err, &blockedErr) {
+		// Eg a redirect to a host that isn't allowed, or a hostname
+		// which resolves to a blocked address.
+		s.asset.securityLogger.Printf("GRPC ASSET FETCH %s BLOCKED: %v", logURI, blockedErr)
+		return err
+	}
+	if isCertificateError(err) {
+		// Retrying won't help.
+		return err
+	}
+	var redirectErr *redirectLimitError
+	if errors.As(err, &redirectErr) {
+		// Most likely a redirect loop, retrying won't help.
+		return err
+	}
+	if isResponseHeaderSizeError(err) {
+		s.asset.securityLogger.Printf("GRPC ASSET FETCH %s BLOCKED: response headers are too large", logURI)
+		return err
+	}
+	return &transientFetchError{err: err}
+}
+
+// Returns the error for a fetch request which received a non-2xx
+// response, which is a transientFetchError if the request might succeed
+// if it is retried.
+func responseStatusError(resp *http.Response) error {
+	err := &fetchStatusError{status: resp.Status, code: resp.StatusCode}
+	if retryableStatus(resp.StatusCode) {
+		return &transientFetchError{
+			err:        err,
+			retryAfter: parseRetryAfter(resp.Header, time.Now()),
+		}
+	}
+	return err
+}
+
+// The result of a successful fetchItem call.
+type fetchResult struct {
+	hash string
+	size int64
+
+	// A Cache-Control style freshness hint for the content.
+	freshness string
+
+	// The Content-Type reported by the upstream server, if any.
+	contentType string
+
+	// The ETag and Last-Modified headers reported by the upstream
+	// server, if any.
+	etag         string
+	lastModified string
+
+	// The hex encoded hashes of the content with the algorithms in
+	// altSRIHashes, keyed by algorithm, if they are known.
+	altHashes map[string]string
+}
+
+// transientFetchError is returned by fetchItem for failures that might
+// not happen if the fetch is retried, eg connection errors or 503
+// responses.
+type transientFetchError struct {
+	err error
+
+	// The size reported by the upstream server, if the failure happened
+	// while reading the content and the size is known.
+	size int64
+
+	// The delay requested by the upstream server's Retry-After header,
+	// if any.
+	retryAfter time.Duration
+}
+
+func (e *transientFetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientFetchError) Unwrap() error {
+	return e.err
+}
+
+// fetchStatusError is returned by fetchItem when the upstream server
+// responds with an unsuccessful status.
+type fetchStatusError struct {
+	status string
+	code   int
+}
+
+func (e *fetchStatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.status)
+}
+
+// Returns true if the status means that the URI doesn't exist.
+func (e *fetchStatusError) notFound() bool {
+	return e.code == http.StatusNotFound || e.code == http.StatusGone
+}
+
+// Returns true if err is due to a TLS certificate which failed
+// verification.
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// Calls fetchItem, limited to s.asset.fetchTimeout if it is set, and
+// records the outcome in the download metrics.
+func (s *grpcServer) fetchItemWithTimeout(ctx context.Context, uri string, expectedHash string, requestedSize int64, alt altChecksum, headers http.Header, decode bool, previousSize int64) (fetchResult, error) {
+	start := time.Now()
+
+	attemptCtx := ctx
+	if s.asset.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, s.asset.fetchTimeout)
+		defer cancel()
+	}
+
+	result, err := s.fetchItem(attemptCtx, uri, expectedHash, requestedSize, alt, headers, decode, previousSize)
+	if err != nil && s.asset.fetchTimeout > 0 && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+		// The error might not say why the download failed, eg if it
+		// was closed while reading the response body.
+		err = fmt.Errorf("attempt timed out after %v: %w",
+			s.asset.fetchTimeout, context.DeadlineExceeded)
+		result = fetchResult{}
+	}
+
+	observeAssetDownload(err, time.Since(start))
+
+	return result, err
+}
+
+// Returned when an upstream server responds successfully but with an empty
+// body, eg a misbehaving mirror, unless the expected checksum is that of
+// empty content. Without a checksum an empty download is also rejected,
+// so that it doesn't silently become a cached empty blob.
+var errEmptyDownload = errors.New("empty response body, but a non-empty asset was expected")
+
+// Logs and returns errEmptyDownload, if an empty download was not expected.
+func (s *grpcServer) checkEmptyDownload(logURI string, expectedHash string, resp *http.Response) error {
+	if expectedHash == emptySha256 {
+		return nil
+	}
+
+	s.asset.securityLogger.Printf("GRPC ASSET FETCH %s SUSPICIOUS: empty response body with status %s",
+		logURI, resp.Status)
+	return errEmptyDownload
+}
+
+// Returns true if err is due to an upstream server sending response
+// headers larger than the transport's MaxResponseHeaderBytes. net/http
+// doesn't export an error value for this, so we have to match the message.
+func isResponseHeaderSizeError(err error) bool {
+	return strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// Fetch uri and store it in the CAS. If alt is set, the content is also
+// verified using that checksum. If requestedSize is not -1, downloads of
+// any other size are rejected. The headers, if any, are added to the
+// request. If previousSize is not -1, it is the size reported by an
+// earlier attempt which failed part way through.
+func (s *grpcServer) fetchItem(ctx context.Context, uri string, expectedHash string, requestedSize int64, alt altChecksum, headers http.Header, decode bool, previousSize int64) (fetchResult, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
-		s.errorLogger.Printf("unable to parse URI: %s err: %v", uri, err)
-		return false, "", int64(-1)
+		return fetchResult{}, fmt.Errorf("unable to parse URI: %w", err)
 	}
 
 	if u.Scheme != "http" && u.Scheme != "https" {
-		s.errorLogger.Printf("unsupported URI: %s", uri)
-		return false, "", int64(-1)
+		return fetchResult{}, &unsupportedSchemeError{scheme: u.Scheme}
+	}
+
+	// Don't log passwords embedded in URIs.
+	logURI := u.Redacted()
+
+	if s.asset.httpsOnly && u.Scheme != "https" {
+		s.asset.securityLogger.Printf("GRPC ASSET FETCH %s BLOCKED: only https URIs are allowed", uri)
+		return fetchResult{}, errors.New("only https URIs are allowed")
+	}
+
+	if !s.asset.extensionAllowed(u.Path) {
+		return fetchResult{}, errors.New("file extension not allowed")
+	}
+
+	err = s.asset.hostPolicy.checkURL(u)
+	if err != nil {
+		s.asset.securityLogger.Printf("GRPC ASSET FETCH %s BLOCKED: %v", logURI, err)
+		return fetchResult{}, err
+	}
+
+	// Limits apply to the host in the request, even if it's rewritten.
+	maxSize := s.asset.fetchMaxSize(u)
+
+	// Requests might be sent elsewhere, but we continue to refer to the
+	// asset by the URI from the request.
+	u = s.asset.rewriteURL(u)
+	if u.String() != uri {
+		s.accessLogger.Printf("GRPC ASSET FETCH %s REWRITTEN TO %s", logURI, u.Redacted())
+	}
+
+	if expectedHash == "" && s.asset.checksumSidecarSuffix != "" {
+		expectedHash, err = s.fetchSidecarChecksum(ctx, u)
+		if err != nil {
+			return fetchResult{}, err
+		}
+	}
+
+	var trace *httptrace.ClientTrace
+	if s.asset.debugLogger != nil {
+		timings := newFetchTimings()
+		trace = timings.clientTrace()
+		defer func() {
+			s.asset.debugf("GRPC ASSET FETCH %s TIMINGS %s", uri, timings)
+		}()
 	}
 
-	resp, err := http.Get(uri)
+	s.asset.inFlight.fetches.Add(1)
+	defer s.asset.inFlight.fetches.Add(-1)
+
+	var tracked *trackedFetch
+	if s.asset.tracker != nil {
+		tracked = s.asset.tracker.start(logURI, expectedHash)
+		defer s.asset.tracker.finish(tracked)
+	}
+
+	if s.asset.headProbe {
+		probe, err := s.probeItem(ctx, u, headers, logURI)
+		if err != nil {
+			return fetchResult{}, err
+		}
+		if decode && len(contentCodings(probe.header)) > 0 {
+			// The size of the encoded content.
+			probe.size = -1
+		}
+
+		if requestedSize >= 0 && probe.size >= 0 && probe.size != requestedSize {
+			return fetchResult{}, fmt.Errorf("response size %d differs from the expected size %d",
+				probe.size, requestedSize)
+		}
+		if maxSize >= 0 && probe.size > maxSize {
+			s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: response size %d exceeds the limit of %d bytes",
+				logURI, probe.size, maxSize)
+			return fetchResult{}, fmt.Errorf("response size %d exceeds the limit of %d bytes",
+				probe.size, maxSize)
+		}
+
+		// FetchBlob checks for checksum.sri hits before fetching, but
+		// the checksum might be from a sidecar file, or the content
+		// might have been stored by another request since.
+		if expectedHash != "" {
+			size, found := s.casBlobSize(ctx, expectedHash)
+			if found && (probe.size < 0 || probe.size == size) {
+				s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: %s/%d is already in the CAS",
+					logURI, expectedHash, size)
+				return fetchResult{
+					hash:         expectedHash,
+					size:         size,
+					freshness:    fetchFreshness(probe.header),
+					contentType:  probe.header.Get("Content-Type"),
+					etag:         probe.header.Get("ETag"),
+					lastModified: probe.header.Get("Last-Modified"),
+				}, nil
+			}
+		}
+	}
+
+	resp, err := s.assetGet(ctx, u, headers, trace)
+	if err == nil && resp.StatusCode == http.StatusForbidden {
+		resp, err = s.refreshAndRetry(ctx, u, headers, trace, resp, logURI)
+	}
 	if err != nil {
-		s.errorLogger.Printf("failed to get URI: %s err: %v", uri, err)
-		return false, "", int64(-1)
+		return fetchResult{}, s.requestError(logURI, err)
 	}
 	defer resp.Body.Close()
+	resp.Body = &meteredBody{
+		ReadCloser: resp.Body,
+		bytes:      assetDownloadedBytes.WithLabelValues(assetDigestFunctionLabel),
+	}
+	if tracked != nil {
+		resp.Body = &trackedBody{ReadCloser: resp.Body, f: tracked}
+	}
 	rc := resp.Body
 
-	s.accessLogger.Printf("GRPC ASSET FETCH %s %s", uri, resp.Status)
+	s.accessLogger.Printf("GRPC ASSET FETCH %s %s", logURI, resp.Status)
+
+	// The http client follows redirects, but returns 3xx responses that
+	// don't have a Location header, which some misbehaving mirrors send.
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") == "" {
+		return fetchResult{}, fmt.Errorf("redirect without a Location header: %s", resp.Status)
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return false, "", int64(-1)
+		return fetchResult{}, responseStatusError(resp)
+	}
+
+	if decode {
+		codings := contentCodings(resp.Header)
+		if len(codings) > 0 {
+			decoded, err := newContentDecoder(resp.Body, codings)
+			if err != nil {
+				var decodingErr *contentDecodingError
+				if errors.As(err, &decodingErr) {
+					return fetchResult{}, err
+				}
+				return fetchResult{}, &transientFetchError{err: fmt.Errorf("failed to read data: %w", err)}
+			}
+			rc = io.NopCloser(decoded)
+			resp.Body = rc
+
+			// The Content-Length is the size of the encoded content.
+			resp.ContentLength = -1
+		}
 	}
 
 	expectedSize := resp.ContentLength
-	if expectedHash == "" || expectedSize < 0 {
-		// We can't call Put until we know the hash and size.
+	if requestedSize >= 0 {
+		if expectedSize >= 0 && expectedSize != requestedSize {
+			return fetchResult{}, fmt.Errorf("response size %d differs from the expected size %d",
+				expectedSize, requestedSize)
+		}
+		// Put verifies the size, so we don't need to read the content
+		// first if we also know the hash.
+		expectedSize = requestedSize
+	}
+	if resp.ContentLength == 0 {
+		err = s.checkEmptyDownload(logURI, expectedHash, resp)
+		if err != nil {
+			return fetchResult{}, err
+		}
+	}
+	if maxSize >= 0 && expectedSize > maxSize {
+		s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: response size %d exceeds the limit of %d bytes",
+			logURI, expectedSize, maxSize)
+		return fetchResult{}, fmt.Errorf("response size %d exceeds the limit of %d bytes",
+			expectedSize, maxSize)
+	}
+
+	// The hex encoded hashes of the content with the algorithms in
+	// altSRIHashes, keyed by algorithm.
+	var altHashes map[string]string
+
+	if expectedHash == "" || expectedSize < 0 || s.asset.quarantine != nil || s.asset.mismatches != nil || alt.algo != "" {
+		// We can't call Put until we know the hash and size, and if
+		// we need to quarantine mismatching content we must keep it.
+		// Mismatches are also told apart from other Put errors here.
 
-		data, err := io.ReadAll(resp.Body)
+		var body io.Reader = resp.Body
+		if maxSize >= 0 {
+			// Read one extra byte to detect oversized responses.
+			body = io.LimitReader(resp.Body, maxSize+1)
+		}
+		download := &readErrorRecorder{r: body}
+
+		spool := newDownloadSpool(s.asset.tempDir)
+		defer spool.close()
+
+		_, err = io.CopyBuffer(spool, download, make([]byte, s.asset.bufferSize))
+		var decodingErr *contentDecodingError
+		if errors.As(download.err, &decodingErr) {
+			return fetchResult{}, download.err
+		}
+		if download.err != nil {
+			return fetchResult{}, &transientFetchError{
+				err:  fmt.Errorf("failed to read data: %w", download.err),
+				size: resp.ContentLength,
+			}
+		}
 		if err != nil {
-			s.errorLogger.Printf("failed to read data: %v", uri)
-			return false, "", int64(-1)
+			return fetchResult{}, fmt.Errorf("failed to spool data: %w", err)
+		}
+
+		if maxSize >= 0 && spool.size > maxSize {
+			// The partial download is discarded by spool.close.
+			s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: response size exceeds the limit of %d bytes",
+				logURI, maxSize)
+			return fetchResult{}, fmt.Errorf("response size exceeds the limit of %d bytes",
+				maxSize)
+		}
+
+		if resp.ContentLength >= 0 && spool.size != resp.ContentLength {
+			// The body ended early without a read error, so don't
+			// store a truncated blob.
+			return fetchResult{}, &transientFetchError{
+				err: fmt.Errorf("read %d bytes, but the Content-Length is %d",
+					spool.size, resp.ContentLength),
+				size: resp.ContentLength,
+			}
+		}
+
+		if requestedSize >= 0 && spool.size != requestedSize {
+			err = fmt.Errorf("response size %d differs from the expected size %d",
+				spool.size, requestedSize)
+			if spool.size < requestedSize {
+				// Most likely truncated.
+				return fetchResult{}, &transientFetchError{err: err, size: spool.size}
+			}
+			return fetchResult{}, err
 		}
 
-		expectedSize = int64(len(data))
-		hashBytes := sha256.Sum256(data)
-		hashStr := hex.EncodeToString(hashBytes[:])
+		expectedSize = spool.size
+		if expectedSize == 0 {
+			err = s.checkEmptyDownload(logURI, expectedHash, resp)
+			if err != nil {
+				return fetchResult{}, err
+			}
+		}
+
+		// Without a checksum we can't tell if the content changed between
+		// attempts, unless the size changed.
+		if expectedHash == "" && alt.algo == "" && previousSize >= 0 && expectedSize != previousSize && !s.asset.allowSizeChange {
+			return fetchResult{}, fmt.Errorf("size %d differs from the size %d reported by a previous attempt",
+				expectedSize, previousSize)
+		}
+
+		if alt.algo != "" {
+			altHash := spool.altHash(alt.algo)
+			if altHash != alt.hash {
+				return fetchResult{}, &checksumMismatchError{algo: alt.algo, expected: alt.hash, actual: altHash}
+			}
+		}
+
+		hashStr := spool.sha256Hash()
 
 		if expectedHash != "" && hashStr != expectedHash {
-			s.errorLogger.Printf("URI data has hash %s, expected %s",
-				hashStr, expectedHash)
-			return false, "", int64(-1)
+			if s.asset.quarantine != nil {
+				err = s.quarantineSpool(uri, expectedHash, hashStr, spool)
+				if err != nil {
+					s.errorLogger.Printf("GRPC ASSET FETCH %s failed to quarantine data: %v", uri, err)
+				} else {
+					s.asset.securityLogger.Printf("GRPC ASSET FETCH %s QUARANTINED: data has hash %s, expected %s",
+						uri, hashStr, expectedHash)
+				}
+			}
+
+			return fetchResult{}, &checksumMismatchError{expected: expectedHash, actual: hashStr}
 		}
 
 		expectedHash = hashStr
-		rc = io.NopCloser(bytes.NewReader(data))
+		altHashes = spool.alt.sums()
+		data, err := spool.reader()
+		if err != nil {
+			return fetchResult{}, err
+		}
+		rc = io.NopCloser(data)
+	}
+
+	// Put returns a non-nil error if rc ends before expectedSize bytes
+	// have been read (eg if the connection was closed early), so there
+	// is no need to special-case io.EOF here.
+	if s.asset.tempBudget != nil {
+		release, err := s.asset.tempBudget.reserve(ctx, expectedSize)
+		if err != nil {
+			return fetchResult{}, err
+		}
+		defer release()
+	}
+
+	var data io.Reader = rc
+	var altWriter *altHashWriter
+	if altHashes == nil {
+		// Compute the other checksums while the content is written.
+		altWriter = newAltHashWriter()
+		data = io.TeeReader(rc, altWriter)
+	}
+
+	if s.asset.bufferSize > defaultAssetFetchBufferSize {
+		// The cache copies data with a default sized buffer, so read
+		// and hash the content in larger chunks ahead of it.
+		data = bufio.NewReaderSize(data, s.asset.bufferSize)
+	}
+
+	body := &readErrorRecorder{r: data}
+	err = s.cache.Put(ctx, cache.CAS, expectedHash, expectedSize, body)
+	if err != nil {
+		err = fmt.Errorf("failed to Put %s: %w", expectedHash, err)
+		var decodingErr *contentDecodingError
+		if errors.As(body.err, &decodingErr) {
+			return fetchResult{}, err
+		}
+		if body.err != nil || (body.eof && body.n < expectedSize) {
+			// The download failed or ended part way through.
+			return fetchResult{}, &transientFetchError{err: err, size: expectedSize}
+		}
+		return fetchResult{}, err
+	}
+
+	if altWriter != nil && altWriter.size == expectedSize {
+		// Put verified the content, and read all of it.
+		altHashes = altWriter.sums()
+	}
+
+	return fetchResult{
+		hash:         expectedHash,
+		size:         expectedSize,
+		freshness:    fetchFreshness(resp.Header),
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		altHashes:    altHashes,
+	}, nil
+}
+
+// Stores the content of a download which failed checksum verification in
+// the quarantine directory.
+func (s *grpcServer) quarantineSpool(uri string, expectedHash string, actualHash string, spool *downloadSpool) error {
+	data, err := spool.reader()
+	if err != nil {
+		return err
+	}
+
+	return s.asset.quarantine.store(uri, expectedHash, actualHash, data, spool.size)
+}
+
+// readErrorRecorder wraps an io.Reader and records the first error other
+// than io.EOF that it returns, and how much was read before it ended.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+
+	// The number of bytes read.
+	n int64
+
+	// Set once io.EOF has been returned.
+	eof bool
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// The maximum size of checksum sidecar files that we will read.
+const maxSidecarSize = 4096
+
+// Try to download the sha256 checksum for u from a sidecar file, whose
+// URL is u with s.asset.checksumSidecarSuffix appended to the path. The
+// sidecar can either contain just the hex encoded checksum, or the output
+// of sha256sum. If there is no sidecar file, an empty string is returned
+// and the download is not verified.
+func (s *grpcServer) fetchSidecarChecksum(ctx context.Context, u *url.URL) (string, error) {
+	sidecarURL := *u
+	sidecarURL.Path += s.asset.checksumSidecarSuffix
+	sidecarURL.RawPath = ""
+	sidecar := sidecarURL.String()
+
+	resp, err := s.assetGet(ctx, &sidecarURL, nil, nil)
+	if err != nil {
+		return "", &transientFetchError{err: fmt.Errorf("failed to get checksum sidecar: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	s.accessLogger.Printf("GRPC ASSET FETCH %s %s", sidecar, resp.Status)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("unexpected checksum sidecar status: %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return "", &transientFetchError{err: err}
+		}
+		return "", err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSidecarSize))
+	if err != nil {
+		return "", &transientFetchError{err: fmt.Errorf("failed to read checksum sidecar: %w", err)}
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum sidecar: %s", sidecar)
 	}
 
-	err = s.cache.Put(ctx, cache.CAS, expectedHash, expectedSize, rc)
-	if err != nil && err != io.EOF {
-		s.errorLogger.Printf("failed to Put %s: %v", expectedHash, err)
-		return false, "", int64(-1)
+	hash := strings.ToLower(fields[0])
+	if !validate.HashKeyRegex.MatchString(hash) {
+		return "", fmt.Errorf("invalid sha256 checksum in sidecar %s: %q", sidecar, fields[0])
 	}
 
-	return true, expectedHash, expectedSize
+	return hash, nil
 }
 
-func (s *grpcServer) FetchDirectory(context.Context, *asset.FetchDirectoryRequest) (*asset.FetchDirectoryResponse, error) {
-	return nil, nil
+// The gRPC response header metadata key used to tell clients how long the
+// result of a successful FetchBlob call can be reused for.
+const cacheControlKey = "cache-control"
+
+// The gRPC response header metadata key used to tell clients the
+// Content-Type that the upstream server reported for the blob, if known.
+const contentTypeKey = "bazel-remote-asset-content-type"
+
+// The gRPC response header metadata keys used to tell clients the ETag
+// and Last-Modified headers that the upstream server reported for the
+// blob, if known, so that they can implement their own caching.
+const (
+	etagKey         = "bazel-remote-asset-etag"
+	lastModifiedKey = "bazel-remote-asset-last-modified"
+)
+
+const (
+	// Content that is identified by a checksum never changes.
+	immutableCacheControl = "immutable"
+
+	// Content that is only identified by its URI, and which the upstream
+	// server did not provide a freshness lifetime for.
+	noCacheControl = "no-cache"
+)
+
+// Returns a freshness hint for content that was downloaded without a
+// checksum, based on the upstream server's Cache-Control header.
+func fetchFreshness(h http.Header) string {
+	maxAge := int64(-1)
+
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		if directive == "no-cache" || directive == "no-store" {
+			return noCacheControl
+		}
+
+		seconds, found := strings.CutPrefix(directive, "max-age=")
+		if !found {
+			continue
+		}
+
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err == nil && n >= 0 {
+			maxAge = n
+		}
+	}
+
+	if maxAge < 0 {
+		return noCacheControl
+	}
+
+	return "max-age=" + strconv.FormatInt(maxAge, 10)
 }
 
-/* PushServer implementation
-func (s *grpcServer) PushBlob(context.Context, *asset.PushBlobRequest) (*asset.PushBlobResponse, error) {
-	return nil, nil
+func (s *grpcServer) setCacheControl(ctx context.Context, value string) {
+	err := grpc.SetHeader(ctx, metadata.Pairs(cacheControlKey, value))
+	if err != nil {
+		s.errorLogger.Printf("failed to set %s header: %v", cacheControlKey, err)
+	}
 }
 
-func (s *grpcServer) PushDirectory(context.Context, *asset.PushDirectoryRequest) (*asset.PushDirectoryResponse, error) {
-	return nil, nil
+func (s *grpcServer) setContentType(ctx context.Context, contentType string) {
+	if contentType == "" {
+		return
+	}
+
+	err := grpc.SetHeader(ctx, metadata.Pairs(contentTypeKey, contentType))
+	if err != nil {
+		s.errorLogger.Printf("failed to set %s header: %v", contentTypeKey, err)
+	}
+}
+
+func (s *grpcServer) setValidators(ctx context.Context, etag string, lastModified string) {
+	var kv []string
+	if etag != "" {
+		kv = append(kv, etagKey, etag)
+	}
+	if lastModified != "" {
+		kv = append(kv, lastModifiedKey, lastModified)
+	}
+	if len(kv) == 0 {
+		return
+	}
+
+	err := grpc.SetHeader(ctx, metadata.Pairs(kv...))
+	if err != nil {
+		s.errorLogger.Printf("failed to set %s and %s headers: %v", etagKey, lastModifiedKey, err)
+	}
+}
+
+// The service name that the Remote Asset API's readiness is reported under
+// by the gRPC health service.
+const assetHealthServiceName = "build.bazel.remote.asset.v1.Fetch"
+
+// Run the asset API's readiness checks every s.asset.readinessInterval and
+// report the result via the gRPC health service, until done is closed.
+func (s *grpcServer) monitorAssetReadiness(h *health.Server, done <-chan struct{}) {
+	ticker := time.NewTicker(s.asset.readinessInterval)
+	defer ticker.Stop()
+
+	servingStatus := grpc_health_v1.HealthCheckResponse_UNKNOWN
+
+	for {
+		newStatus := grpc_health_v1.HealthCheckResponse_SERVING
+		err := s.checkAssetReadiness()
+		if err != nil {
+			newStatus = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+
+		if newStatus != servingStatus {
+			if err != nil {
+				s.errorLogger.Printf("GRPC ASSET NOT READY: %v", err)
+			} else if servingStatus != grpc_health_v1.HealthCheckResponse_UNKNOWN {
+				s.errorLogger.Printf("GRPC ASSET READY")
+			}
+
+			servingStatus = newStatus
+			h.SetServingStatus(assetHealthServiceName, servingStatus)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Return a non-nil error if any of the asset API's readiness checks fail.
+func (s *grpcServer) checkAssetReadiness() error {
+	for _, rc := range s.asset.readinessChecks {
+		ctx, cancel := context.WithTimeout(context.Background(), s.asset.readinessInterval)
+		err := rc.check(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %w", rc.name, err)
+		}
+	}
+
+	return nil
 }
-*/
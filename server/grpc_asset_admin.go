@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+)
+
+// The asset admin service reports the internal state of the remote asset
+// API implementation, for live debugging, and if it is enabled seeds the
+// cache with local directories. There is no .proto file for it, its
+// methods use the well known Empty and Struct messages, and the remote
+// execution API's Digest.
+const assetAdminServiceName = "bazel_remote.asset.admin.v1.AssetAdmin"
+
+const (
+	assetAdminGetStatsMethod           = "/" + assetAdminServiceName + "/GetAssetStats"
+	assetAdminPushLocalDirectoryMethod = "/" + assetAdminServiceName + "/PushLocalDirectory"
+)
+
+// assetInFlight counts the remote asset API operations in progress.
+type assetInFlight struct {
+	fetches atomic.Int64
+	unpacks atomic.Int64
+}
+
+// assetAdminServer is the server API for the asset admin service.
+type assetAdminServer interface {
+	GetAssetStats(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+	PushLocalDirectory(context.Context, *structpb.Struct) (*pb.Digest, error)
+}
+
+var assetAdminServiceDesc = grpc.ServiceDesc{
+	ServiceName: assetAdminServiceName,
+	HandlerType: (*assetAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetAssetStats",
+			Handler:    assetAdminGetStatsHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "asset_admin",
+}
+
+// The PushLocalDirectory method, which is only added to the asset admin
+// service if local directories are allowed, see adminServiceDesc.
+var assetAdminPushLocalDirectoryMethodDesc = grpc.MethodDesc{
+	MethodName: "PushLocalDirectory",
+	Handler:    assetAdminPushLocalDirectoryHandler,
+}
+
+// Returns the description of the asset admin service to register, with
+// the methods enabled by c.
+func (c *assetConfig) adminServiceDesc() *grpc.ServiceDesc {
+	desc := assetAdminServiceDesc
+	if len(c.adminLocalDirs) > 0 {
+		desc.Methods = append(append([]grpc.MethodDesc{}, desc.Methods...),
+			assetAdminPushLocalDirectoryMethodDesc)
+	}
+	return &desc
+}
+
+func assetAdminGetStatsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	err := dec(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(assetAdminServer).GetAssetStats(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: assetAdminGetStatsMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(assetAdminServer).GetAssetStats(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func assetAdminPushLocalDirectoryHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	err := dec(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(assetAdminServer).PushLocalDirectory(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: assetAdminPushLocalDirectoryMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(assetAdminServer).PushLocalDirectory(ctx, req.(*structpb.Struct))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AssetAdminClient is a client for the asset admin service, which is
+// enabled by WithAssetAdminService.
+type AssetAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewAssetAdminClient returns an AssetAdminClient which uses cc.
+func NewAssetAdminClient(cc grpc.ClientConnInterface) *AssetAdminClient {
+	return &AssetAdminClient{cc: cc}
+}
+
+// GetAssetStats returns the state of the remote asset API, see
+// grpcServer.GetAssetStats.
+func (c *AssetAdminClient) GetAssetStats(ctx context.Context, opts ...grpc.CallOption) (*structpb.Struct, error) {
+	out := new(structpb.Struct)
+	err := c.cc.Invoke(ctx, assetAdminGetStatsMethod, &emptypb.Empty{}, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PushLocalDirectory stores a directory on the server's filesystem in the
+// CAS, see grpcServer.PushLocalDirectory.
+func (c *AssetAdminClient) PushLocalDirectory(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*pb.Digest, error) {
+	out := new(pb.Digest)
+	err := c.cc.Invoke(ctx, assetAdminPushLocalDirectoryMethod, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetAssetStats returns the state of the remote asset API:
+//
+//   - index_entries and index_size_bytes: the number of associations in
+//     the asset index, and their size.
+//   - fetches_in_flight and unpacks_in_flight: the number of URI
+//     downloads and FetchDirectory archive unpacks in progress.
+//   - not_found_uris: the number of URIs which are being skipped because
+//     they recently returned 404 or 410, if that's enabled.
+//   - mismatched_hosts: the hosts which are tried last because they
+//     recently served content that didn't match its checksum, if that's
+//     enabled, and the number of seconds until they're tried in the usual
+//     order again.
+//   - host_circuit_breakers: the hosts which recently had transient
+//     failures, if the circuit breaker is enabled, with the "state" of
+//     their breaker ("closed", "open" or "half_open"), the number of
+//     consecutive "failures", and the "open_seconds" until an open
+//     breaker becomes half open.
+func (s *grpcServer) GetAssetStats(ctx context.Context, req *emptypb.Empty) (*structpb.Struct, error) {
+	numEntries, size := s.asset.index.Stats()
+
+	notFound := 0
+	if s.asset.notFound != nil {
+		notFound = s.asset.notFound.len()
+	}
+
+	mismatched := make(map[string]interface{})
+	if s.asset.mismatches != nil {
+		for host, expires := range s.asset.mismatches.hosts() {
+			mismatched[host] = time.Until(expires).Seconds()
+		}
+	}
+
+	breakers := make(map[string]interface{})
+	if s.asset.breaker != nil {
+		for host, st := range s.asset.breaker.stats() {
+			breakers[host] = map[string]interface{}{
+				"state":        st.state,
+				"failures":     st.failures,
+				"open_seconds": st.remaining.Seconds(),
+			}
+		}
+	}
+
+	s.accessLogger.Printf("GRPC ASSET ADMIN GETASSETSTATS")
+
+	return structpb.NewStruct(map[string]interface{}{
+		"index_entries":         numEntries,
+		"index_size_bytes":      size,
+		"fetches_in_flight":     s.asset.inFlight.fetches.Load(),
+		"unpacks_in_flight":     s.asset.inFlight.unpacks.Load(),
+		"not_found_uris":        notFound,
+		"mismatched_hosts":      mismatched,
+		"host_circuit_breakers": breakers,
+	})
+}
+
+// PushLocalDirectory stores the directory tree at a path on the server's
+// filesystem in the CAS, in the same way as FetchDirectory unpacks
+// archives, with the same limits and name normalization, and returns the
+// digest of the root Directory. This can be used to seed the cache with
+// the results of FetchDirectory requests. It is only available if
+// WithAssetAdminLocalDirectories was used, and the path must be inside
+// one of those directories once symlinks are resolved. The request fields
+// are:
+//
+//   - path: the absolute path of the directory.
+//   - uris: optional URIs to associate the tree with, as if by a
+//     PushDirectory request.
+//   - qualifiers: optional qualifier names and values for the
+//     association.
+//
+// Symlinks are stored as symlinks, and are not followed. Other special
+// files are rejected.
+func (s *grpcServer) PushLocalDirectory(ctx context.Context, req *structpb.Struct) (*pb.Digest, error) {
+	if len(s.asset.adminLocalDirs) == 0 {
+		return nil, status.Error(codes.Unimplemented, "local directories are not enabled")
+	}
+
+	dir, uris, qualifiers, err := localDirectoryRequest(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Walked instead of `dir`, so that a symlink can't be changed to point
+	// elsewhere after it was checked. Symlinks inside the tree are stored
+	// as symlinks, and not followed.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !s.asset.adminLocalDirAllowed(dir) {
+		s.asset.securityLogger.Printf("GRPC ASSET ADMIN PUSHLOCALDIRECTORY %s DENIED: not inside an allowed directory", dir)
+		return nil, status.Errorf(codes.PermissionDenied,
+			"%s is not inside an allowed local directory", dir)
+	}
+
+	release, err := s.asset.startUnpack(ctx)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	root, err := s.buildTree(ctx, func(tb *treeBuilder) error {
+		return addLocalDirectory(ctx, dir, tb)
+	})
+	release()
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET ADMIN PUSHLOCALDIRECTORY %s FAILED: %v", dir, err)
+
+		var aerr *archiveError
+		if errors.As(err, &aerr) || errors.Is(err, fs.ErrNotExist) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if errors.Is(err, errIncompleteTree) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if len(uris) > 0 {
+		err = s.pushAsset(ctx, assetindex.Directory, cache.CAS, uris, qualifiers, nil, root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.accessLogger.Printf("GRPC ASSET ADMIN PUSHLOCALDIRECTORY %s OK %s/%d",
+		dir, root.GetHash(), root.GetSizeBytes())
+
+	return root, nil
+}
+
+// Returns true if `dir`, with symlinks resolved, is one of the directories
+// allowed by WithAssetAdminLocalDirectories, or inside one of them.
+func (c *assetConfig) adminLocalDirAllowed(dir string) bool {
+	for _, allowed := range c.adminLocalDirs {
+		rel, err := filepath.Rel(allowed, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the path, URIs and qualifiers of a PushLocalDirectory request.
+func localDirectoryRequest(req *structpb.Struct) (string, []string, []*asset.Qualifier, error) {
+	var dir string
+	var uris []string
+	var qualifiers []*asset.Qualifier
+
+	for name, v := range req.GetFields() {
+		switch name {
+		case "path":
+			dir = v.GetStringValue()
+
+		case "uris":
+			for _, u := range v.GetListValue().GetValues() {
+				uri, ok := u.GetKind().(*structpb.Value_StringValue)
+				if !ok {
+					return "", nil, nil, errors.New("uris must be a list of strings")
+				}
+				uris = append(uris, uri.StringValue)
+			}
+
+		case "qualifiers":
+			fields := v.GetStructValue().GetFields()
+			for _, name := range sortedKeys(fields) {
+				value, ok := fields[name].GetKind().(*structpb.Value_StringValue)
+				if !ok {
+					return "", nil, nil, fmt.Errorf("qualifier %q must be a string", name)
+				}
+				qualifiers = append(qualifiers, &asset.Qualifier{Name: name, Value: value.StringValue})
+			}
+
+		default:
+			return "", nil, nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	if !filepath.IsAbs(dir) {
+		return "", nil, nil, fmt.Errorf("expected an absolute path, got %q", dir)
+	}
+
+	return dir, uris, qualifiers, nil
+}
+
+// Adds the contents of the directory `dir` on the local filesystem to w.
+func addLocalDirectory(ctx context.Context, dir string, w ArchiveWriter) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if !d.IsDir() {
+				return &archiveError{err: fmt.Errorf("not a directory: %s", dir)}
+			}
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		switch d.Type() {
+		case 0:
+			return addLocalFile(ctx, p, name, w)
+
+		case fs.ModeDir:
+			return w.AddDir(name)
+
+		case fs.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return w.AddSymlink(name, filepath.ToSlash(target))
+
+		default:
+			return &archiveError{err: fmt.Errorf("unsupported file type: %s", p)}
+		}
+	})
+}
+
+// Adds the regular file at path `p` to w as `name`.
+func addLocalFile(ctx context.Context, p string, name string, w ArchiveWriter) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return w.AddFile(ctx, name, f, info.Size(), info.Mode()&0111 != 0)
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+
+	testutils "github.com/buchgr/bazel-remote/v2/utils"
+)
+
+func TestAssetAdminServiceDisabled(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	_, err := fixture.adminClient.GetAssetStats(ctx)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+}
+
+func TestAssetAdminGetAssetStats(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetAdminService(),
+		WithAssetFetchTTL(time.Hour),
+		WithAssetFetchNotFoundWindow(time.Hour),
+		WithAssetFetchMismatchWindow(time.Hour))
+	defer os.Remove(fixture.tempdir)
+
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/slow":
+			<-unblock
+			_, _ = w.Write([]byte("slow"))
+		default:
+			_, _ = w.Write([]byte("contents of " + r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+
+	stats := func() map[string]*structpb.Value {
+		t.Helper()
+
+		resp, err := fixture.adminClient.GetAssetStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Fields
+	}
+
+	initial := stats()
+	for _, name := range []string{"index_entries", "fetches_in_flight", "unpacks_in_flight", "not_found_uris"} {
+		if initial[name].GetNumberValue() != 0 {
+			t.Fatalf("expected %s to be 0, got %v", name, initial[name])
+		}
+	}
+
+	fetch := func(path string, qualifiers ...*asset.Qualifier) {
+		t.Helper()
+
+		_, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + path},
+			Qualifiers: qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Indexed for the TTL.
+	fetch("/a")
+	fetch("/b")
+
+	fetch("/missing")
+
+	wrongSum := sha256.Sum256([]byte("something else"))
+	fetch("/c", &asset.Qualifier{
+		Name:  "checksum.sri",
+		Value: "sha256-" + base64.StdEncoding.EncodeToString(wrongSum[:]),
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/slow"},
+		})
+		done <- err
+	}()
+
+	fields := stats()
+	for fields["fetches_in_flight"].GetNumberValue() == 0 {
+		time.Sleep(10 * time.Millisecond)
+		fields = stats()
+	}
+	close(unblock)
+
+	if fields["fetches_in_flight"].GetNumberValue() != 1 {
+		t.Errorf("expected 1 fetch in flight, got %v", fields["fetches_in_flight"])
+	}
+	if fields["index_entries"].GetNumberValue() < 2 || fields["index_size_bytes"].GetNumberValue() <= 0 {
+		t.Errorf("expected the fetched URIs to be indexed, got %v and %v",
+			fields["index_entries"], fields["index_size_bytes"])
+	}
+	if fields["not_found_uris"].GetNumberValue() != 1 {
+		t.Errorf("expected 1 URI which was not found, got %v", fields["not_found_uris"])
+	}
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := fields["mismatched_hosts"].GetStructValue().GetFields()
+	if len(hosts) != 1 || hosts[u.Host].GetNumberValue() <= 0 {
+		t.Errorf("expected %s to be a mismatched host, got %v", u.Host, hosts)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats()["fetches_in_flight"].GetNumberValue() != 0 {
+		t.Error("expected no fetches in flight")
+	}
+}
+
+func TestAssetAdminHostCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	const cooldown = 200 * time.Millisecond
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetAdminService(),
+		WithAssetFetchHostCircuitBreaker(2, cooldown))
+	defer os.Remove(fixture.tempdir)
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func() codes.Code {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/blob"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return codes.Code(resp.Status.GetCode())
+	}
+
+	breaker := func() map[string]*structpb.Value {
+		t.Helper()
+
+		resp, err := fixture.adminClient.GetAssetStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Fields["host_circuit_breakers"].GetStructValue().GetFields()[u.Host].GetStructValue().GetFields()
+	}
+
+	checkRequests := func(expected int32) {
+		t.Helper()
+
+		n := atomic.LoadInt32(&numRequests)
+		if n != expected {
+			t.Fatalf("expected %d HTTP requests, got %d", expected, n)
+		}
+	}
+
+	if fetch() == codes.OK {
+		t.Fatal("expected the fetch to fail")
+	}
+	b := breaker()
+	if b["state"].GetStringValue() != "closed" || b["failures"].GetNumberValue() != 1 {
+		t.Fatalf("expected a closed breaker with 1 failure, got %v", b)
+	}
+
+	if fetch() == codes.OK {
+		t.Fatal("expected the fetch to fail")
+	}
+	b = breaker()
+	if b["state"].GetStringValue() != "open" || b["open_seconds"].GetNumberValue() <= 0 {
+		t.Fatalf("expected an open breaker, got %v", b)
+	}
+
+	// The host is skipped while the breaker is open.
+	if fetch() == codes.OK {
+		t.Fatal("expected the fetch to fail")
+	}
+	checkRequests(2)
+
+	time.Sleep(cooldown)
+	b = breaker()
+	if b["state"].GetStringValue() != "half_open" {
+		t.Fatalf("expected a half open breaker, got %v", b)
+	}
+
+	// A successful attempt closes the breaker.
+	failing.Store(false)
+	if fetch() != codes.OK {
+		t.Fatal("expected the fetch to succeed")
+	}
+	checkRequests(3)
+	b = breaker()
+	if len(b) != 0 {
+		t.Fatalf("expected the host's breaker to be reset, got %v", b)
+	}
+}
+
+func TestAssetAdminPushLocalDirectory(t *testing.T) {
+	t.Parallel()
+
+	// Only directories inside allowed can be pushed.
+	allowed := testutils.TempDir(t)
+	defer os.RemoveAll(allowed)
+	outside := testutils.TempDir(t)
+	defer os.RemoveAll(outside)
+
+	dir := filepath.Join(allowed, "seed")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetAdminService(),
+		WithAssetAdminLocalDirectories(allowed),
+		WithAssetDirectoryNameNormalization())
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	files := []struct {
+		name     string
+		contents string
+		mode     os.FileMode
+	}{
+		{"a.txt", "a", 0644},
+		{"bin/run.sh", "#!/bin/sh", 0755},
+		// NFD, stored as NFC.
+		{"cafe\u0301.txt", "caf\u00e9", 0644},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.name))
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte(f.contents), f.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(dir, "empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("bin/run.sh", filepath.Join(dir, "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := structpb.NewStruct(map[string]interface{}{
+		"path":       dir,
+		"uris":       []interface{}{ts.URL + "/tree.tar.gz"},
+		"qualifiers": map[string]interface{}{"vcs.commit": "0123456789abcdef"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fixture.adminClient.PushLocalDirectory(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootDir := getTestDirectory(t, fixture, root)
+	var names []string
+	for _, f := range rootDir.Files {
+		names = append(names, f.Name)
+	}
+	for _, d := range rootDir.Directories {
+		names = append(names, d.Name+"/")
+	}
+	for _, l := range rootDir.Symlinks {
+		names = append(names, l.Name+"->"+l.Target)
+	}
+	expected := "a.txt caf\u00e9.txt bin/ empty/ run->bin/run.sh"
+	if strings.Join(names, " ") != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(names, " "))
+	}
+	if getTestBlob(t, fixture, rootDir.Files[1].Digest) != "caf\u00e9" {
+		t.Fatal("unexpected file contents")
+	}
+
+	bin := getTestDirectory(t, fixture, rootDir.Directories[0].Digest)
+	if len(bin.Files) != 1 || !bin.Files[0].IsExecutable ||
+		getTestBlob(t, fixture, bin.Files[0].Digest) != "#!/bin/sh" {
+		t.Fatalf("unexpected bin directory: %v", bin)
+	}
+
+	// The pushed URI and qualifiers resolve to the tree without a
+	// download.
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris:       []string{ts.URL + "/tree.tar.gz"},
+		Qualifiers: []*asset.Qualifier{{Name: "vcs.commit", Value: "0123456789abcdef"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || !proto.Equal(resp.RootDirectoryDigest, root) {
+		t.Fatalf("expected %v, got %v %v", root, resp.Status, resp.RootDirectoryDigest)
+	}
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+
+	// Pushing the same directory again gives the same tree.
+	req, err = structpb.NewStruct(map[string]interface{}{"path": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := fixture.adminClient.PushLocalDirectory(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(again, root) {
+		t.Fatalf("expected %v, got %v", root, again)
+	}
+
+	for _, fields := range []map[string]interface{}{
+		{"path": "relative/path"},
+		{"path": filepath.Join(dir, "missing")},
+		{"path": filepath.Join(dir, "a.txt")},
+		{"path": dir, "unknown": true},
+		{"path": dir, "uris": []interface{}{1}},
+	} {
+		req, err := structpb.NewStruct(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fixture.adminClient.PushLocalDirectory(ctx, req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", fields, err)
+		}
+	}
+
+	// Directories outside allowed are denied, including through symlinks.
+	err = os.Symlink(outside, filepath.Join(allowed, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		outside,
+		filepath.Join(allowed, "escape"),
+		filepath.Join(dir, "..", "..", filepath.Base(outside)),
+		filepath.Dir(allowed),
+	} {
+		req, err := structpb.NewStruct(map[string]interface{}{"path": path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fixture.adminClient.PushLocalDirectory(ctx, req)
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected PermissionDenied for %s, got %v", path, err)
+		}
+	}
+}
+
+func TestAssetAdminPushLocalDirectoryDisabled(t *testing.T) {
+	t.Parallel()
+
+	// Without allowed local directories, the method isn't registered.
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetAdminService())
+	defer os.Remove(fixture.tempdir)
+
+	req, err := structpb.NewStruct(map[string]interface{}{"path": fixture.tempdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixture.adminClient.PushLocalDirectory(ctx, req)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+}
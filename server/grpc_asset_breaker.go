@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The maximum number of hosts tracked by an assetHostBreaker. When it's
+// full, hosts whose breakers are closed are removed, and if that's not
+// enough new hosts are not recorded.
+const maxBreakerHosts = 1000
+
+var errHostBreakerOpen = errors.New("the host's circuit breaker is open")
+
+// States of a host's circuit breaker, as reported by GetAssetStats.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// assetHostBreaker is a circuit breaker for each upstream host. After a
+// number of consecutive transient failures, eg connection errors or 5xx
+// responses, the host's breaker opens and URIs on it are skipped for the
+// cooldown, so that requests don't wait for a host which is down. Then
+// the breaker is half open: a single attempt is allowed, which closes
+// the breaker if it succeeds and opens it again if it fails.
+type assetHostBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreakerState
+}
+
+type hostBreakerState struct {
+	// The number of consecutive failed attempts.
+	failures int
+
+	// If non-zero, the breaker is open until then, and half open after.
+	openUntil time.Time
+
+	// While the breaker is half open, other attempts are not allowed
+	// until then, unless the attempt which was allowed finishes first.
+	probeUntil time.Time
+}
+
+func newAssetHostBreaker(failures int, cooldown time.Duration) *assetHostBreaker {
+	return &assetHostBreaker{
+		failures: failures,
+		cooldown: cooldown,
+		hosts:    make(map[string]*hostBreakerState),
+	}
+}
+
+// Returns true if uri can be fetched, ie the breaker of its host is
+// closed, or it is half open and no other attempt is in progress.
+func (b *assetHostBreaker) allow(uri string) bool {
+	host := uriHost(uri)
+	if host == "" {
+		return true
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, found := b.hosts[host]
+	if !found || st.openUntil.IsZero() {
+		return true
+	}
+
+	if now.Before(st.openUntil) || now.Before(st.probeUntil) {
+		return false
+	}
+
+	st.probeUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Records that the host of uri responded, which closes its breaker.
+func (b *assetHostBreaker) success(uri string) {
+	host := uriHost(uri)
+	if host == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.hosts, host)
+}
+
+// Records a transient failure to fetch uri, which opens the breaker of
+// its host if there were too many in a row, or if it was half open.
+func (b *assetHostBreaker) failure(uri string) {
+	host := uriHost(uri)
+	if host == "" {
+		return
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, found := b.hosts[host]
+	if !found {
+		if len(b.hosts) >= maxBreakerHosts {
+			for h, s := range b.hosts {
+				if s.openUntil.IsZero() {
+					delete(b.hosts, h)
+				}
+			}
+			if len(b.hosts) >= maxBreakerHosts {
+				return
+			}
+		}
+
+		st = &hostBreakerState{}
+		b.hosts[host] = st
+	}
+
+	st.failures++
+	if !st.openUntil.IsZero() || st.failures >= b.failures {
+		st.openUntil = now.Add(b.cooldown)
+		st.probeUntil = time.Time{}
+	}
+}
+
+// hostBreakerStats is the state of a host's breaker.
+type hostBreakerStats struct {
+	state    string
+	failures int
+
+	// How long the breaker stays open, if it is.
+	remaining time.Duration
+}
+
+// Returns the state of the breaker of each host which recently failed.
+func (b *assetHostBreaker) stats() map[string]hostBreakerStats {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make(map[string]hostBreakerStats, len(b.hosts))
+	for host, st := range b.hosts {
+		s := hostBreakerStats{state: breakerClosed, failures: st.failures}
+		if !st.openUntil.IsZero() {
+			if now.Before(st.openUntil) {
+				s.state = breakerOpen
+				s.remaining = st.openUntil.Sub(now)
+			} else {
+				s.state = breakerHalfOpen
+			}
+		}
+		stats[host] = s
+	}
+	return stats
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+)
+
+var assetFetchTempBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "bazel_remote_asset_fetch_temp_bytes",
+	Help: "The number of bytes reserved for in-progress asset downloads being written to the cache",
+})
+
+// assetTempBudget limits the total size of asset downloads which are
+// being written to temporary files in the cache at the same time.
+type assetTempBudget struct {
+	size int64
+	sem  *semaphore.Weighted
+}
+
+func newAssetTempBudget(size int64) *assetTempBudget {
+	return &assetTempBudget{
+		size: size,
+		sem:  semaphore.NewWeighted(size),
+	}
+}
+
+// Waits until `size` bytes are available in the budget, or ctx is done.
+// On success the caller must call the returned function once the bytes
+// are no longer in use.
+func (b *assetTempBudget) reserve(ctx context.Context, size int64) (func(), error) {
+	if size > b.size {
+		return nil, fmt.Errorf("download size %d exceeds the temporary file budget of %d bytes",
+			size, b.size)
+	}
+
+	err := b.sem.Acquire(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+	assetFetchTempBytes.Add(float64(size))
+
+	return func() {
+		assetFetchTempBytes.Sub(float64(size))
+		b.sem.Release(size)
+	}, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// CredentialProvider supplies HTTP headers, eg Authorization, to send
+// with asset fetches. It is called for each request, so implementations
+// can return short-lived credentials obtained from an external source,
+// eg a metadata server or secret store.
+type CredentialProvider interface {
+	// Headers returns the headers to add to a request for u, which may
+	// be nil if no credentials are required.
+	Headers(ctx context.Context, u *url.URL) (http.Header, error)
+}
+
+// CredentialRefresher can optionally be implemented by CredentialProviders
+// which cache credentials that may expire, eg OAuth tokens. See
+// WithAssetFetchRefreshOnForbidden.
+type CredentialRefresher interface {
+	// Refresh discards any cached credentials for u, so that the next
+	// Headers call returns fresh ones.
+	Refresh(ctx context.Context, u *url.URL) error
+}
+
+// staticCredentials is a CredentialProvider which returns fixed headers
+// for specific hosts.
+type staticCredentials map[string]http.Header
+
+// NewStaticCredentialProvider returns a CredentialProvider which returns
+// fixed headers for each host in `hosts`, keyed by either hostname
+// (matching any port) or host:port.
+func NewStaticCredentialProvider(hosts map[string]http.Header) CredentialProvider {
+	creds := make(staticCredentials, len(hosts))
+	for host, headers := range hosts {
+		creds[host] = headers.Clone()
+	}
+
+	return creds
+}
+
+func (s staticCredentials) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	headers, ok := s[u.Host]
+	if !ok {
+		headers = s[u.Hostname()]
+	}
+
+	return headers, nil
+}
+
+// credentialChain is a CredentialProvider which returns the headers from
+// the first of its providers that has credentials for a URL.
+type credentialChain []CredentialProvider
+
+// NewCredentialProviderChain returns a CredentialProvider which tries each
+// of `providers` in order, and returns the first non-empty set of headers.
+func NewCredentialProviderChain(providers ...CredentialProvider) CredentialProvider {
+	return credentialChain(providers)
+}
+
+func (c credentialChain) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	for _, p := range c {
+		headers, err := p.Headers(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) > 0 {
+			return headers, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c credentialChain) Refresh(ctx context.Context, u *url.URL) error {
+	for _, p := range c {
+		r, ok := p.(CredentialRefresher)
+		if !ok {
+			continue
+		}
+		err := r.Refresh(ctx, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewNetrcCredentialProvider returns a CredentialProvider which sends
+// HTTP Basic authentication headers to the hosts listed in the netrc file
+// at `path`. The file is read once, when this is called. "default" entries
+// are ignored, so that credentials are only sent to the hosts they are for.
+func NewNetrcCredentialProvider(path string) (CredentialProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netrc file: %w", err)
+	}
+
+	creds := make(staticCredentials)
+	for _, m := range parseNetrc(string(data)) {
+		if _, found := creds[m.machine]; found {
+			// As with other netrc readers, the first entry wins.
+			continue
+		}
+
+		auth := base64.StdEncoding.EncodeToString([]byte(m.login + ":" + m.password))
+		creds[m.machine] = http.Header{"Authorization": {"Basic " + auth}}
+	}
+
+	return creds, nil
+}
+
+// A "machine" entry from a netrc file.
+type netrcMachine struct {
+	machine  string
+	login    string
+	password string
+}
+
+// Returns the "machine" entries in a netrc file, in order.
+func parseNetrc(data string) []netrcMachine {
+	var machines []netrcMachine
+
+	// The entry that following login and password tokens apply to, or
+	// nil if they should be ignored (eg in a "default" entry).
+	var current *netrcMachine
+	inMacro := false
+
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// Macro definitions end with an empty line.
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "default":
+				current = nil
+				continue
+			case "macdef":
+				// The rest of the line is the macro name.
+				inMacro = true
+			}
+			if inMacro || i+1 >= len(fields) {
+				break
+			}
+
+			value := fields[i+1]
+			switch fields[i] {
+			case "machine":
+				machines = append(machines, netrcMachine{machine: value})
+				current = &machines[len(machines)-1]
+			case "login":
+				if current != nil {
+					current.login = value
+				}
+			case "password":
+				if current != nil {
+					current.password = value
+				}
+			}
+			i++
+		}
+	}
+
+	return machines
+}
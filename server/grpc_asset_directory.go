@@ -0,0 +1,919 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+)
+
+var errNilFetchDirectoryRequest = grpc_status.Error(codes.InvalidArgument,
+	"expected a non-nil *FetchDirectoryRequest")
+
+// FetchDirectory fetches an archive (.tar, .tar.gz or .zip) in the same
+// way as FetchBlob, including checksum.sri qualifier handling, then
+// unpacks it into the CAS and returns the digest of the root Directory.
+func (s *grpcServer) FetchDirectory(ctx context.Context, req *asset.FetchDirectoryRequest) (*asset.FetchDirectoryResponse, error) {
+	source := assetSourceNone
+	resp, err := s.fetchDirectoryOnce(ctx, req, &source)
+	observeAssetRequest("FetchDirectory", resp.GetStatus(), err, source)
+	return resp, err
+}
+
+// The result of a fetchDirectory call, which may be shared by several
+// requests.
+type directoryFetchResult struct {
+	resp   *asset.FetchDirectoryResponse
+	err    error
+	source assetSource
+}
+
+// Calls fetchDirectory, sharing the result with concurrent requests which
+// have the same directoryFetchKey, so that an archive is only downloaded
+// and unpacked once.
+func (s *grpcServer) fetchDirectoryOnce(ctx context.Context, req *asset.FetchDirectoryRequest, source *assetSource) (*asset.FetchDirectoryResponse, error) {
+	if req == nil {
+		return nil, errNilFetchDirectoryRequest
+	}
+
+	key := directoryFetchKey(req)
+	for {
+		ch := s.asset.directoryFetches.DoChan(key, func() (interface{}, error) {
+			r := directoryFetchResult{source: assetSourceNone}
+			r.resp, r.err = s.fetchDirectory(ctx, req, &r.source)
+			return r, nil
+		})
+
+		var res singleflight.Result
+		select {
+		case <-ctx.Done():
+			return nil, grpc_status.FromContextError(ctx.Err()).Err()
+		case res = <-ch:
+		}
+
+		r := res.Val.(directoryFetchResult)
+		code := grpc_status.Code(r.err)
+		if res.Shared && (code == codes.Canceled || code == codes.DeadlineExceeded) && ctx.Err() == nil {
+			// The request which did the fetch gave up, but this one
+			// hasn't, so try again.
+			continue
+		}
+
+		if res.Shared {
+			s.asset.debugf("GRPC ASSET FETCH DIRECTORY shared the result of an identical request")
+		}
+
+		*source = r.source
+		return r.resp, r.err
+	}
+}
+
+// Returns a key which is the same for FetchDirectory requests that
+// resolve to the same archive: the checksum.sri qualifier if there is
+// one, and otherwise the set of URIs and the qualifiers which identify
+// the content.
+func directoryFetchKey(req *asset.FetchDirectoryRequest) string {
+	for _, q := range req.GetQualifiers() {
+		if q.GetName() == "checksum.sri" {
+			return "checksum.sri=" + q.GetValue()
+		}
+	}
+
+	return uriSetKey(assetindex.Directory, req.GetUris(), req.GetQualifiers())
+}
+
+// Implements FetchDirectory, and sets *source to say how a successful
+// request was resolved.
+func (s *grpcServer) fetchDirectory(ctx context.Context, req *asset.FetchDirectoryRequest, source *assetSource) (*asset.FetchDirectoryResponse, error) {
+	if req == nil {
+		return nil, errNilFetchDirectoryRequest
+	}
+
+	// Archives are unpacked from the CAS, so action cache entries, which
+	// fetchBlob would return for entry_kind=ac, can't be used.
+	entryKind, err := requestedEntryKind(req.GetQualifiers())
+	if err == nil && entryKind == cache.AC {
+		err = fmt.Errorf("%s=ac is not supported by FetchDirectory", entryKindQualifier)
+	}
+	if err != nil {
+		return &asset.FetchDirectoryResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			},
+		}, nil
+	}
+
+	started := time.Now()
+
+	// Content that was associated with one of the URIs by PushDirectory.
+	// If some of the tree is missing from the CAS, try to fetch the
+	// archive again, and if that fails report what is missing.
+	var missing []*pb.Digest
+	notBefore := fetchNotBefore(req.GetOldestContentAccepted(), requestedMaxAge(req.GetQualifiers()))
+	indexed, found := s.lookupIndexedAsset(ctx, assetindex.Directory, req.GetUris(), req.GetQualifiers(), notBefore)
+	if found {
+		missing, err = s.missingDirectoryBlobs(ctx, indexed.digest)
+		if err != nil {
+			// We can't tell if the tree is complete, so assume that it
+			// is, like when it was pushed.
+			s.errorLogger.Printf("GRPC ASSET FETCH DIRECTORY %s/%d failed to check for missing blobs: %v",
+				indexed.digest.GetHash(), indexed.digest.GetSizeBytes(), err)
+		}
+
+		if len(missing) == 0 {
+			*source = assetSourceIndex
+			return &asset.FetchDirectoryResponse{
+				Status:              &status.Status{Code: int32(codes.OK)},
+				Uri:                 indexed.uri,
+				Qualifiers:          req.GetQualifiers(),
+				ExpiresAt:           indexed.expiresAt,
+				RootDirectoryDigest: indexed.digest,
+			}, nil
+		}
+	}
+
+	// The archive is resolved in the same way as the directory.
+	blobResp, err := s.fetchBlob(ctx, &asset.FetchBlobRequest{
+		InstanceName:          req.GetInstanceName(),
+		Timeout:               req.GetTimeout(),
+		OldestContentAccepted: req.GetOldestContentAccepted(),
+		Uris:                  req.GetUris(),
+		Qualifiers:            req.GetQualifiers(),
+	}, source)
+	if err != nil {
+		return nil, err
+	}
+	if blobResp.Status.GetCode() != int32(codes.OK) {
+		if len(missing) > 0 {
+			s.accessLogger.Printf("GRPC ASSET FETCH DIRECTORY %s %s/%d PARTIAL: %d blobs missing",
+				indexed.uri, indexed.digest.GetHash(), indexed.digest.GetSizeBytes(), len(missing))
+
+			return &asset.FetchDirectoryResponse{
+				Status:              partialDirectoryStatus(indexed.digest, missing),
+				Uri:                 indexed.uri,
+				Qualifiers:          req.GetQualifiers(),
+				ExpiresAt:           indexed.expiresAt,
+				RootDirectoryDigest: indexed.digest,
+			}, nil
+		}
+
+		return &asset.FetchDirectoryResponse{Status: blobResp.Status}, nil
+	}
+
+	archive := blobResp.BlobDigest
+	release, err := s.asset.startUnpack(ctx)
+	if err != nil {
+		return nil, grpc_status.FromContextError(err).Err()
+	}
+	rootDigest, err := s.unpackArchive(ctx, archive)
+	release()
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET FETCH DIRECTORY %s/%d FAILED: %v",
+			archive.GetHash(), archive.GetSizeBytes(), err)
+
+		code := codes.Internal
+		var aerr *archiveError
+		if errors.As(err, &aerr) || errors.Is(err, ErrMalformedArchive) {
+			code = codes.InvalidArgument
+		} else if errors.Is(err, errIncompleteTree) {
+			code = codes.Unavailable
+		}
+
+		return &asset.FetchDirectoryResponse{
+			Status: &status.Status{
+				Code:    int32(code),
+				Message: fmt.Sprintf("failed to unpack archive: %v", err),
+			},
+		}, nil
+	}
+
+	if !hasQualifier(req.GetQualifiers(), "checksum.sri") {
+		s.indexDirectoryResult(blobResp.Uri, req.GetUris(), req.GetQualifiers(), rootDigest, started)
+	}
+
+	s.accessLogger.Printf("GRPC ASSET FETCH DIRECTORY %s/%d OK %s/%d",
+		archive.GetHash(), archive.GetSizeBytes(),
+		rootDigest.GetHash(), rootDigest.GetSizeBytes())
+
+	return &asset.FetchDirectoryResponse{
+		Status:              &status.Status{Code: int32(codes.OK)},
+		Uri:                 blobResp.Uri,
+		Qualifiers:          blobResp.Qualifiers,
+		RootDirectoryDigest: rootDigest,
+	}, nil
+}
+
+// Returns the digests of the Directory messages and files in the tree
+// rooted at the Directory `root` which are not in the CAS. The contents of
+// missing Directory messages are unknown, so their descendants are not
+// included.
+func (s *grpcServer) missingDirectoryBlobs(ctx context.Context, root *pb.Digest) ([]*pb.Digest, error) {
+	var missing []*pb.Digest
+	var files []*pb.Digest
+	seen := make(map[string]bool)
+
+	pending := []*pb.Digest{root}
+	for len(pending) > 0 {
+		digest := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		data, err := s.getBlobData(ctx, digest.GetHash(), digest.GetSizeBytes())
+		if err == errBlobNotFound {
+			missing = append(missing, digest)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dir := &pb.Directory{}
+		err = proto.Unmarshal(data, dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Directory %s/%d: %w",
+				digest.GetHash(), digest.GetSizeBytes(), err)
+		}
+
+		for _, d := range dir.GetDirectories() {
+			if d.GetDigest() != nil && !seen[d.Digest.Hash] {
+				seen[d.Digest.Hash] = true
+				pending = append(pending, d.Digest)
+			}
+		}
+
+		for _, f := range dir.GetFiles() {
+			if f.GetDigest() != nil && !seen[f.Digest.Hash] {
+				seen[f.Digest.Hash] = true
+				files = append(files, f.Digest)
+			}
+		}
+	}
+
+	missingFiles, err := s.cache.FindMissingCasBlobs(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(missing, missingFiles...), nil
+}
+
+// Returns a FailedPrecondition status for a Directory which is only
+// partially available, with a PreconditionFailure detail listing the
+// missing blobs in the same way as the remote execution API's Execute
+// method, so that clients can upload or fetch them.
+func partialDirectoryStatus(root *pb.Digest, missing []*pb.Digest) *status.Status {
+	st := &status.Status{
+		Code: int32(codes.FailedPrecondition),
+		Message: fmt.Sprintf("directory %s/%d is partially available, missing %d blobs",
+			root.GetHash(), root.GetSizeBytes(), len(missing)),
+	}
+
+	failure := &errdetails.PreconditionFailure{}
+	for _, d := range missing {
+		failure.Violations = append(failure.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:    "MISSING",
+			Subject: fmt.Sprintf("blobs/%s/%d", d.GetHash(), d.GetSizeBytes()),
+		})
+	}
+
+	detail, err := anypb.New(failure)
+	if err == nil {
+		st.Details = append(st.Details, detail)
+	}
+
+	return st
+}
+
+// archiveError is returned for archives which are not in a supported
+// format, or are malformed.
+type archiveError struct {
+	err error
+}
+
+func (e *archiveError) Error() string {
+	return e.err.Error()
+}
+
+func (e *archiveError) Unwrap() error {
+	return e.err
+}
+
+// Waits until another archive can be unpacked, if the number of
+// concurrent unpacks is limited, or until ctx is done. On success the
+// caller must call the returned function when the unpack is finished.
+func (c *assetConfig) startUnpack(ctx context.Context) (func(), error) {
+	if c.unpacks != nil {
+		err := c.unpacks.Acquire(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	assetDirectoryUnpacks.Inc()
+	c.inFlight.unpacks.Add(1)
+
+	return func() {
+		c.inFlight.unpacks.Add(-1)
+		assetDirectoryUnpacks.Dec()
+		if c.unpacks != nil {
+			c.unpacks.Release(1)
+		}
+	}, nil
+}
+
+// Files up to this size are buffered in memory while unpacking archives,
+// larger files are buffered in temporary files.
+const maxInMemoryArchiveFileSize = 1024 * 1024
+
+// Unpacks the archive stored in the CAS under `digest`, stores its
+// contents in the CAS and returns the digest of the root Directory.
+func (s *grpcServer) unpackArchive(ctx context.Context, digest *pb.Digest) (*pb.Digest, error) {
+	return s.buildTree(ctx, func(tb *treeBuilder) error {
+		return s.unpackTo(ctx, digest, tb)
+	})
+}
+
+// errIncompleteTree is returned by buildTree if blobs of the tree were
+// evicted from the CAS while it was being stored, eg because the cache is
+// too small for it.
+var errIncompleteTree = errors.New("blobs of the tree were evicted from the CAS while it was stored")
+
+// The number of times that buildTree stores a tree before giving up, if
+// some of its blobs are evicted from the CAS each time.
+const maxTreeStoreAttempts = 2
+
+// Builds a tree by calling `add` with a treeBuilder which has the
+// configured limits for unpacking archives, stores it in the CAS and
+// returns the digest of the root Directory, once all of the blobs that it
+// refers to are in the CAS. `add` may be called several times.
+func (s *grpcServer) buildTree(ctx context.Context, add func(*treeBuilder) error) (*pb.Digest, error) {
+	if s.asset.maxTreeNodes > 0 {
+		// Count the nodes of the tree without storing anything first,
+		// so that trees which are too large are rejected without
+		// leaving any of their files in the CAS.
+		tb := s.newArchiveTreeBuilder()
+		tb.dryRun = true
+		err := add(tb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		tb := s.newArchiveTreeBuilder()
+		err := add(tb)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err := tb.store(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Blobs can be evicted while the rest of the tree is stored,
+		// and the root must not be returned with dangling references.
+		// Blobs which are in the CAS are skipped, so storing the tree
+		// again only replaces the missing ones.
+		missing, err := s.missingDirectoryBlobs(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			return root, nil
+		}
+
+		s.errorLogger.Printf("GRPC ASSET TREE %s/%d is missing %d blobs after storing it (attempt %d)",
+			root.GetHash(), root.GetSizeBytes(), len(missing), attempt)
+
+		if attempt == maxTreeStoreAttempts {
+			return nil, fmt.Errorf("%w: %d missing", errIncompleteTree, len(missing))
+		}
+	}
+}
+
+// Returns a treeBuilder with the configured limits for unpacking archives.
+func (s *grpcServer) newArchiveTreeBuilder() *treeBuilder {
+	tb := newTreeBuilder(s)
+	tb.maxSize = s.asset.maxUnpackedSize
+	if tb.maxSize == 0 {
+		// More than this can't be stored anyway.
+		tb.maxSize = s.cache.MaxSize()
+	}
+	tb.maxEntries = s.asset.maxArchiveEntries
+	tb.maxNodes = s.asset.maxTreeNodes
+
+	return tb
+}
+
+// Unpacks the archive stored in the CAS under `digest` into tb.
+func (s *grpcServer) unpackTo(ctx context.Context, digest *pb.Digest, tb *treeBuilder) error {
+	rc, _, err := s.cache.Get(ctx, cache.CAS, digest.GetHash(), digest.GetSizeBytes(), 0)
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return fmt.Errorf("archive %s not found in the CAS", digest.GetHash())
+	}
+	defer rc.Close()
+
+	br := bufio.NewReaderSize(rc, archiveHeaderSize)
+	header, _ := br.Peek(archiveHeaderSize)
+
+	u := s.asset.unpackers.detect(header)
+	if u == nil {
+		return s.asset.unpackers.unsupportedError()
+	}
+
+	return u.Unpack(ctx, br, digest.GetSizeBytes(), tb)
+}
+
+// treeBuilder builds a directory tree from archive entries, storing the
+// files in the CAS as they are added. It implements ArchiveWriter.
+type treeBuilder struct {
+	s    *grpcServer
+	root *dirEntry
+
+	// If true, entry names and symlink targets are normalized, see
+	// normalizeName.
+	normalize bool
+
+	// Limits on the total size of the files and the number of entries
+	// added, or zero for no limit, and the amounts added so far.
+	maxSize    int64
+	maxEntries int
+	size       int64
+	entries    int
+
+	// The maximum number of files, directories and symlinks in the tree,
+	// excluding the root, or zero for no limit, and the number so far.
+	maxNodes int
+	nodes    int
+
+	// If true, file contents are read but not stored, and the tree is
+	// only built to check the limits.
+	dryRun bool
+}
+
+// Counts an entry with `size` bytes of content towards tb's limits, and
+// returns an error if it exceeds them.
+func (tb *treeBuilder) addEntry(size int64) error {
+	if size < 0 {
+		return &archiveError{err: fmt.Errorf("invalid archive entry size: %d", size)}
+	}
+
+	tb.entries++
+	if tb.maxEntries > 0 && tb.entries > tb.maxEntries {
+		return &archiveError{err: fmt.Errorf("archive has more than %d entries", tb.maxEntries)}
+	}
+
+	tb.size += size
+	if tb.maxSize > 0 && (size > tb.maxSize || tb.size > tb.maxSize) {
+		return &archiveError{err: fmt.Errorf("archive contents are larger than %d bytes", tb.maxSize)}
+	}
+
+	return nil
+}
+
+// Counts a node added to the tree, and returns an error if there are
+// too many.
+func (tb *treeBuilder) addNode() error {
+	tb.nodes++
+	if tb.maxNodes > 0 && tb.nodes > tb.maxNodes {
+		return &archiveError{err: fmt.Errorf("archive has more than %d files, directories and symlinks", tb.maxNodes)}
+	}
+
+	return nil
+}
+
+type dirEntry struct {
+	files    map[string]*pb.FileNode
+	dirs     map[string]*dirEntry
+	symlinks map[string]*pb.SymlinkNode
+}
+
+func newDirEntry() *dirEntry {
+	return &dirEntry{
+		files:    make(map[string]*pb.FileNode),
+		dirs:     make(map[string]*dirEntry),
+		symlinks: make(map[string]*pb.SymlinkNode),
+	}
+}
+
+func newTreeBuilder(s *grpcServer) *treeBuilder {
+	return &treeBuilder{s: s, root: newDirEntry(), normalize: s.asset.normalizeNames}
+}
+
+// Returns `name` with backslashes replaced by forward slashes, and in
+// Unicode normalization form C, if tb.normalize is set. Otherwise `name`
+// is returned unchanged. This makes the tree the same for archives which
+// were created on Windows, or on systems like macOS which use NFD names.
+func (tb *treeBuilder) normalizeName(name string) string {
+	if !tb.normalize {
+		return name
+	}
+
+	return norm.NFC.String(strings.ReplaceAll(name, "\\", "/"))
+}
+
+// Returns the cleaned, relative path of an archive entry, or "" for the
+// root directory. Paths which refer to locations outside the archive are
+// rejected.
+func archivePath(name string) (string, error) {
+	p := pathpkg.Clean(strings.TrimLeft(name, "/"))
+	if p == "." {
+		return "", nil
+	}
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", &archiveError{err: fmt.Errorf("invalid archive entry path: %q", name)}
+	}
+
+	return p, nil
+}
+
+// Returns the directory at `dirPath`, creating it and its parents if
+// they don't exist.
+func (tb *treeBuilder) mkdirAll(dirPath string) (*dirEntry, error) {
+	d := tb.root
+	if dirPath == "" {
+		return d, nil
+	}
+
+	for _, name := range strings.Split(dirPath, "/") {
+		if _, ok := d.files[name]; ok {
+			return nil, &archiveError{err: fmt.Errorf("%q is both a file and a directory", dirPath)}
+		}
+		if _, ok := d.symlinks[name]; ok {
+			return nil, &archiveError{err: fmt.Errorf("%q is both a symlink and a directory", dirPath)}
+		}
+
+		child, ok := d.dirs[name]
+		if !ok {
+			err := tb.addNode()
+			if err != nil {
+				return nil, err
+			}
+			child = newDirEntry()
+			d.dirs[name] = child
+		}
+		d = child
+	}
+
+	return d, nil
+}
+
+// Returns the parent directory of `p` and the base name, for adding a
+// file or symlink. Later archive entries replace earlier ones with the
+// same path, but not directories.
+func (tb *treeBuilder) parentOf(p string) (*dirEntry, string, error) {
+	dir, name := pathpkg.Split(p)
+	d, err := tb.mkdirAll(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, ok := d.dirs[name]; ok {
+		return nil, "", &archiveError{err: fmt.Errorf("%q is both a directory and a file", p)}
+	}
+
+	_, isFile := d.files[name]
+	_, isSymlink := d.symlinks[name]
+	if !isFile && !isSymlink {
+		err = tb.addNode()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	delete(d.files, name)
+	delete(d.symlinks, name)
+
+	return d, name, nil
+}
+
+func (tb *treeBuilder) AddFile(ctx context.Context, name string, r io.Reader, size int64, executable bool) error {
+	p, err := archivePath(tb.normalizeName(name))
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return &archiveError{err: fmt.Errorf("invalid archive file path: %q", name)}
+	}
+
+	// Checked before reading the file, so that it's never stored.
+	err = tb.addEntry(size)
+	if err != nil {
+		return err
+	}
+
+	d, base, err := tb.parentOf(p)
+	if err != nil {
+		return err
+	}
+
+	digest, err := tb.putFile(ctx, r, size)
+	if err != nil {
+		return fmt.Errorf("failed to store %q: %w", name, err)
+	}
+	d.files[base] = &pb.FileNode{
+		Name:         base,
+		Digest:       digest,
+		IsExecutable: executable,
+	}
+
+	return nil
+}
+
+// Adds a hard link to a file which was previously added.
+func (tb *treeBuilder) AddLink(name string, target string) error {
+	err := tb.addEntry(0)
+	if err != nil {
+		return err
+	}
+
+	p, err := archivePath(tb.normalizeName(name))
+	if err != nil {
+		return err
+	}
+	targetPath, err := archivePath(tb.normalizeName(target))
+	if err != nil {
+		return err
+	}
+
+	targetDir, targetName := pathpkg.Split(targetPath)
+	d := tb.root
+	for _, dirName := range strings.Split(strings.TrimSuffix(targetDir, "/"), "/") {
+		if dirName == "" {
+			continue
+		}
+		d = d.dirs[dirName]
+		if d == nil {
+			break
+		}
+	}
+	var targetNode *pb.FileNode
+	if d != nil {
+		targetNode = d.files[targetName]
+	}
+	if targetNode == nil {
+		return &archiveError{err: fmt.Errorf("hard link %q refers to unknown file %q", name, target)}
+	}
+
+	d, base, err := tb.parentOf(p)
+	if err != nil {
+		return err
+	}
+	d.files[base] = &pb.FileNode{
+		Name:         base,
+		Digest:       targetNode.Digest,
+		IsExecutable: targetNode.IsExecutable,
+	}
+
+	return nil
+}
+
+func (tb *treeBuilder) AddSymlink(name string, target string) error {
+	err := tb.addEntry(0)
+	if err != nil {
+		return err
+	}
+
+	p, err := archivePath(tb.normalizeName(name))
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return &archiveError{err: fmt.Errorf("invalid archive symlink path: %q", name)}
+	}
+
+	d, base, err := tb.parentOf(p)
+	if err != nil {
+		return err
+	}
+	d.symlinks[base] = &pb.SymlinkNode{
+		Name:   base,
+		Target: tb.normalizeName(target),
+	}
+
+	return nil
+}
+
+func (tb *treeBuilder) AddDir(name string) error {
+	err := tb.addEntry(0)
+	if err != nil {
+		return err
+	}
+
+	p, err := archivePath(tb.normalizeName(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = tb.mkdirAll(p)
+	return err
+}
+
+// Reads `size` bytes from r, stores them in the CAS and returns their
+// digest. In a dry run the bytes are discarded, and the digest is nil.
+func (tb *treeBuilder) putFile(ctx context.Context, r io.Reader, size int64) (*pb.Digest, error) {
+	if tb.dryRun {
+		n, err := io.Copy(io.Discard, io.LimitReader(r, size))
+		if err != nil {
+			return nil, &archiveError{err: err}
+		}
+		if n != size {
+			return nil, &archiveError{err: io.ErrUnexpectedEOF}
+		}
+		return nil, nil
+	}
+
+	hasher := sha256.New()
+
+	var data io.Reader
+	if size <= maxInMemoryArchiveFileSize {
+		buf := make([]byte, size)
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return nil, &archiveError{err: err}
+		}
+		hasher.Write(buf)
+		data = bytes.NewReader(buf)
+	} else if ro, ok := r.(reopener); ok {
+		// Hash the content, then read it again to store it, instead
+		// of writing it to a temporary file.
+		n, err := io.Copy(hasher, io.LimitReader(r, size))
+		if err != nil {
+			return nil, &archiveError{err: err}
+		}
+		if n != size {
+			return nil, &archiveError{err: io.ErrUnexpectedEOF}
+		}
+
+		rc, err := ro.reopen()
+		if err != nil {
+			return nil, &archiveError{err: err}
+		}
+		defer rc.Close()
+		data = io.LimitReader(rc, size)
+	} else {
+		f, cleanup, err := tb.createTemp(ctx, "bazel-remote-asset-*", size)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+
+		n, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r, size))
+		if err != nil {
+			return nil, &archiveError{err: err}
+		}
+		if n != size {
+			return nil, &archiveError{err: io.ErrUnexpectedEOF}
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		data = f
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	err := tb.putBlob(ctx, hash, size, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Digest{Hash: hash, SizeBytes: size}, nil
+}
+
+// Creates a temporary file for up to `size` bytes in the asset temporary
+// file directory, after waiting for the bytes to be available in the
+// temporary file budget, if there is one. The returned function closes
+// and removes the file, and releases the bytes.
+func (tb *treeBuilder) createTemp(ctx context.Context, pattern string, size int64) (*os.File, func(), error) {
+	release := func() {}
+	if tb.s.asset.tempBudget != nil {
+		var err error
+		release, err = tb.s.asset.tempBudget.reserve(ctx, size)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.CreateTemp(tb.s.asset.tempDir, pattern)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+		release()
+	}, nil
+}
+
+// Stores a serialized message in the CAS and returns its digest.
+func (tb *treeBuilder) putMessage(ctx context.Context, m proto.Message) (*pb.Digest, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	hashBytes := sha256.Sum256(data)
+	hash := hex.EncodeToString(hashBytes[:])
+	size := int64(len(data))
+
+	err = tb.putBlob(ctx, hash, size, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Digest{Hash: hash, SizeBytes: size}, nil
+}
+
+// Stores a blob in the CAS, unless it's already there, eg because an
+// earlier attempt to unpack the same archive was interrupted, or another
+// archive contains the same file.
+func (tb *treeBuilder) putBlob(ctx context.Context, hash string, size int64, r io.Reader) error {
+	found, _ := tb.s.cache.Contains(ctx, cache.CAS, hash, size)
+	if found {
+		return nil
+	}
+
+	return tb.s.cache.Put(ctx, cache.CAS, hash, size, r)
+}
+
+// Stores the Directory messages for the tree in the CAS and returns the
+// digest of the root Directory. Only the root digest is returned, clients
+// can use GetTree for the rest, so no Tree message is built or stored.
+func (tb *treeBuilder) store(ctx context.Context) (*pb.Digest, error) {
+	return tb.storeDir(ctx, tb.root)
+}
+
+// Stores the Directory message for d and its descendants, and returns its
+// digest. The entries of each directory are released once its message is
+// stored, so only the messages on the current path are held in memory.
+func (tb *treeBuilder) storeDir(ctx context.Context, d *dirEntry) (*pb.Digest, error) {
+	dir := &pb.Directory{}
+
+	for _, name := range sortedKeys(d.dirs) {
+		digest, err := tb.storeDir(ctx, d.dirs[name])
+		if err != nil {
+			return nil, err
+		}
+
+		dir.Directories = append(dir.Directories, &pb.DirectoryNode{
+			Name:   name,
+			Digest: digest,
+		})
+	}
+
+	for _, name := range sortedKeys(d.files) {
+		dir.Files = append(dir.Files, d.files[name])
+	}
+
+	for _, name := range sortedKeys(d.symlinks) {
+		dir.Symlinks = append(dir.Symlinks, d.symlinks[name])
+	}
+
+	digest, err := tb.putMessage(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d.dirs, d.files, d.symlinks = nil, nil, nil
+
+	return digest, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,1364 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk"
+	testutils "github.com/buchgr/bazel-remote/v2/utils"
+)
+
+const (
+	testArchiveFile   = "hello world\n"
+	testArchiveScript = "#!/bin/sh\necho hello\n"
+)
+
+func testTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+
+	entries := []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./pkg/", Mode: 0755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./pkg/README", Mode: 0644}, data: testArchiveFile},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "pkg/bin/tool.sh", Mode: 0755}, data: testArchiveScript},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "pkg/tool", Linkname: "bin/tool.sh"}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "pkg/README.copy", Linkname: "pkg/README"}},
+	}
+
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.data))
+		err := tw.WriteHeader(&e.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(e.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	entries := []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{name: "pkg/", mode: os.ModeDir | 0755},
+		{name: "pkg/README", mode: 0644, data: testArchiveFile},
+		{name: "pkg/bin/tool.sh", mode: 0755, data: testArchiveScript},
+		{name: "pkg/tool", mode: os.ModeSymlink | 0777, data: "bin/tool.sh"},
+		{name: "pkg/README.copy", mode: 0644, data: testArchiveFile},
+	}
+
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(e.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(e.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func getTestDirectory(t *testing.T, fixture grpcTestFixture, digest *pb.Digest) *pb.Directory {
+	rc, _, err := fixture.diskCache.Get(ctx, cache.CAS, digest.GetHash(), digest.GetSizeBytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatalf("directory %s not found in the CAS", digest.GetHash())
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := &pb.Directory{}
+	err = proto.Unmarshal(data, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func getTestBlob(t *testing.T, fixture grpcTestFixture, digest *pb.Digest) string {
+	rc, _, err := fixture.diskCache.Get(ctx, cache.CAS, digest.GetHash(), digest.GetSizeBytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatalf("blob %s not found in the CAS", digest.GetHash())
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestAssetFetchDirectory(t *testing.T) {
+	t.Parallel()
+
+	archives := map[string][]byte{
+		"/pkg.tar.gz": testTarGz(t),
+		"/pkg.zip":    testZip(t),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := archives[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	for name, data := range archives {
+		fixture := grpcTestSetup(t)
+		defer os.Remove(fixture.tempdir)
+
+		sum := sha256.Sum256(data)
+
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + "/missing.tar", ts.URL + name},
+			Qualifiers: []*asset.Qualifier{
+				{
+					Name:  "checksum.sri",
+					Value: "sha256-" + base64.StdEncoding.EncodeToString(sum[:]),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch of %s, got %v", name, resp.Status)
+		}
+		if resp.Uri != ts.URL+name {
+			t.Errorf("expected URI %q, got %q", ts.URL+name, resp.Uri)
+		}
+
+		root := getTestDirectory(t, fixture, resp.RootDirectoryDigest)
+		if len(root.Files) != 0 || len(root.Symlinks) != 0 || len(root.Directories) != 1 ||
+			root.Directories[0].Name != "pkg" {
+			t.Fatalf("unexpected root directory: %v", root)
+		}
+
+		pkg := getTestDirectory(t, fixture, root.Directories[0].Digest)
+		if len(pkg.Files) != 2 || pkg.Files[0].Name != "README" || pkg.Files[1].Name != "README.copy" {
+			t.Fatalf("unexpected files in pkg: %v", pkg.Files)
+		}
+		for _, f := range pkg.Files {
+			if f.IsExecutable {
+				t.Errorf("expected %s to not be executable", f.Name)
+			}
+			if getTestBlob(t, fixture, f.Digest) != testArchiveFile {
+				t.Errorf("unexpected contents of %s", f.Name)
+			}
+		}
+
+		if len(pkg.Symlinks) != 1 || pkg.Symlinks[0].Name != "tool" ||
+			pkg.Symlinks[0].Target != "bin/tool.sh" {
+			t.Fatalf("unexpected symlinks in pkg: %v", pkg.Symlinks)
+		}
+
+		if len(pkg.Directories) != 1 || pkg.Directories[0].Name != "bin" {
+			t.Fatalf("unexpected directories in pkg: %v", pkg.Directories)
+		}
+
+		bin := getTestDirectory(t, fixture, pkg.Directories[0].Digest)
+		if len(bin.Files) != 1 || bin.Files[0].Name != "tool.sh" || !bin.Files[0].IsExecutable {
+			t.Fatalf("unexpected files in pkg/bin: %v", bin.Files)
+		}
+		if getTestBlob(t, fixture, bin.Files[0].Digest) != testArchiveScript {
+			t.Error("unexpected contents of tool.sh")
+		}
+	}
+}
+
+func TestAssetFetchDirectoryFailures(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/not-an-archive.tar":
+			_, _ = w.Write([]byte("this is not an archive"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	acQualifier := []*asset.Qualifier{{Name: entryKindQualifier, Value: "ac"}}
+
+	testCases := []struct {
+		uri        string
+		qualifiers []*asset.Qualifier
+		code       codes.Code
+	}{
+		{uri: ts.URL + "/missing.tar.gz", code: codes.NotFound},
+		{uri: ts.URL + "/not-an-archive.tar", code: codes.InvalidArgument},
+		{uri: ts.URL + "/missing.tar.gz", qualifiers: acQualifier, code: codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris:       []string{tc.uri},
+			Qualifiers: tc.qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(tc.code) {
+			t.Errorf("expected %v for %s, got %v", tc.code, tc.uri, resp.Status)
+		}
+	}
+}
+
+// lineUnpacker unpacks a trivial archive format for testing, with a magic
+// line followed by one "<path> <contents>" line per file.
+type lineUnpacker struct{}
+
+const lineArchiveMagic = "LINEAR\n"
+
+func (lineUnpacker) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(lineArchiveMagic))
+}
+
+func (lineUnpacker) Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimPrefix(string(data), lineArchiveMagic), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		name, contents, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%w: invalid line %q", ErrMalformedArchive, line)
+		}
+		err = w.AddFile(ctx, name, strings.NewReader(contents), int64(len(contents)), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestAssetFetchDirectoryCustomUnpacker(t *testing.T) {
+	t.Parallel()
+
+	archives := map[string]string{
+		"/pkg.linear":       lineArchiveMagic + "pkg/a hello\npkg/b world\n",
+		"/malformed.linear": lineArchiveMagic + "no-contents\n",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(archives[r.URL.Path]))
+	}))
+	defer ts.Close()
+
+	// Without the custom unpacker, the format is not supported.
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/pkg.linear"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+		t.Fatalf("expected an unsupported format error, got %v", resp.Status)
+	}
+
+	fixture = grpcTestSetupWithAssetOptions(t, WithAssetUnpacker("linear", lineUnpacker{}))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err = fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/pkg.linear"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+
+	root := getTestDirectory(t, fixture, resp.RootDirectoryDigest)
+	if len(root.Files) != 0 || len(root.Directories) != 1 || root.Directories[0].Name != "pkg" {
+		t.Fatalf("unexpected root directory: %v", root)
+	}
+
+	pkg := getTestDirectory(t, fixture, root.Directories[0].Digest)
+	if len(pkg.Files) != 2 || pkg.Files[0].Name != "a" || pkg.Files[1].Name != "b" {
+		t.Fatalf("unexpected files in pkg: %v", pkg.Files)
+	}
+	if getTestBlob(t, fixture, pkg.Files[0].Digest) != "hello" ||
+		getTestBlob(t, fixture, pkg.Files[1].Digest) != "world" {
+		t.Error("unexpected file contents in pkg")
+	}
+
+	resp, err = fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/malformed.linear"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+		t.Fatalf("expected a malformed archive error, got %v", resp.Status)
+	}
+}
+
+func TestAssetFetchDirectoryLargeTree(t *testing.T) {
+	t.Parallel()
+
+	const numDirs = 1000
+
+	var archive strings.Builder
+	archive.WriteString(lineArchiveMagic)
+	for i := 0; i < numDirs; i++ {
+		fmt.Fprintf(&archive, "pkg/d%04d/f contents%d\n", i, i)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(archive.String()))
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetUnpacker("linear", lineUnpacker{}))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/pkg.linear"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+
+	// The archive, the files, and a Directory message for each of the
+	// directories, the root and pkg. No Tree message holding every
+	// Directory is stored.
+	_, _, numItems, _ := fixture.diskCache.Stats()
+	expectedItems := 1 + numDirs + numDirs + 2
+	if numItems != expectedItems {
+		t.Fatalf("expected %d items in the CAS, found %d", expectedItems, numItems)
+	}
+
+	stream, err := fixture.casClient.GetTree(ctx, &pb.GetTreeRequest{RootDigest: resp.RootDirectoryDigest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs []*pb.Directory
+	for {
+		treeResp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, treeResp.Directories...)
+	}
+
+	if len(dirs) != numDirs+2 {
+		t.Fatalf("expected %d directories from GetTree, got %d", numDirs+2, len(dirs))
+	}
+	if len(dirs[1].Directories) != numDirs {
+		t.Fatalf("expected %d directories in pkg, got %d", numDirs, len(dirs[1].Directories))
+	}
+	last := dirs[len(dirs)-1]
+	if len(last.Files) != 1 ||
+		getTestBlob(t, fixture, last.Files[0].Digest) != fmt.Sprintf("contents%d", numDirs-1) {
+		t.Fatalf("unexpected last directory: %v", last)
+	}
+}
+
+// countingUnpacker wraps lineUnpacker, and records the number of unpacks
+// and the maximum number in progress at the same time.
+type countingUnpacker struct {
+	lineUnpacker
+
+	// Unpacks wait until this is closed, if it's non-nil, and then
+	// for delay.
+	wait  chan struct{}
+	delay time.Duration
+
+	unpacks   int32
+	active    int32
+	maxActive int32
+}
+
+func (u *countingUnpacker) Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error {
+	atomic.AddInt32(&u.unpacks, 1)
+	active := atomic.AddInt32(&u.active, 1)
+	defer atomic.AddInt32(&u.active, -1)
+
+	for {
+		max := atomic.LoadInt32(&u.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&u.maxActive, max, active) {
+			break
+		}
+	}
+
+	if u.wait != nil {
+		<-u.wait
+	}
+	time.Sleep(u.delay)
+
+	return u.lineUnpacker.Unpack(ctx, r, size, w)
+}
+
+func TestAssetFetchDirectoryMaxUnpacks(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(lineArchiveMagic + "pkg" + r.URL.Path + " hello\n"))
+	}))
+	defer ts.Close()
+
+	unpacker := &countingUnpacker{delay: 200 * time.Millisecond}
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetUnpacker("linear", unpacker),
+		WithAssetDirectoryMaxUnpacks(1))
+	defer os.Remove(fixture.tempdir)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, name := range []string{"/a", "/b"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+				Uris: []string{ts.URL + name},
+			})
+			if err == nil && resp.Status.GetCode() != int32(codes.OK) {
+				err = fmt.Errorf("expected successful fetch of %s, got %v", name, resp.Status)
+			}
+			errs <- err
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&unpacker.unpacks) != 2 {
+		t.Fatalf("expected 2 unpacks, got %d", atomic.LoadInt32(&unpacker.unpacks))
+	}
+	if atomic.LoadInt32(&unpacker.maxActive) != 1 {
+		t.Fatalf("expected the unpacks to be serialized, %d ran at the same time",
+			atomic.LoadInt32(&unpacker.maxActive))
+	}
+
+	// Requests waiting for an unpack respect their deadline.
+	unpacker = &countingUnpacker{wait: make(chan struct{})}
+	fixture = grpcTestSetupWithAssetOptions(t,
+		WithAssetUnpacker("linear", unpacker),
+		WithAssetDirectoryMaxUnpacks(1))
+	defer os.Remove(fixture.tempdir)
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + "/a"},
+		})
+		blocked <- err
+	}()
+
+	for atomic.LoadInt32(&unpacker.active) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if testutil.ToFloat64(assetDirectoryUnpacks) < 1 {
+		t.Error("expected the unpack in progress to be counted")
+	}
+
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err := fixture.assetClient.FetchDirectory(shortCtx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/b"},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded while waiting to unpack, got %v", err)
+	}
+
+	close(unpacker.wait)
+	err = <-blocked
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&unpacker.unpacks) != 1 {
+		t.Fatalf("expected only the first request to unpack, got %d unpacks",
+			atomic.LoadInt32(&unpacker.unpacks))
+	}
+}
+
+func TestAssetFetchDirectorySingleFlight(t *testing.T) {
+	t.Parallel()
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		_, _ = w.Write([]byte(lineArchiveMagic + "pkg/a hello\n"))
+	}))
+	defer ts.Close()
+
+	unpacker := &countingUnpacker{wait: make(chan struct{})}
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetUnpacker("linear", unpacker))
+	defer os.Remove(fixture.tempdir)
+
+	// The same URIs in a different order are identical requests.
+	requests := [][]string{
+		{ts.URL + "/a", ts.URL + "/b"},
+		{ts.URL + "/b", ts.URL + "/a"},
+	}
+
+	const numFetches = 5
+
+	var wg sync.WaitGroup
+	resps := make(chan *asset.FetchDirectoryResponse, numFetches)
+	errs := make(chan error, numFetches)
+	for i := 0; i < numFetches; i++ {
+		wg.Add(1)
+		go func(uris []string) {
+			defer wg.Done()
+
+			resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{Uris: uris})
+			if err != nil {
+				errs <- err
+				return
+			}
+			resps <- resp
+		}(requests[i%len(requests)])
+	}
+
+	// Let the other requests join the first one before it unpacks.
+	for atomic.LoadInt32(&unpacker.active) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(unpacker.wait)
+
+	wg.Wait()
+	close(resps)
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	var root *pb.Digest
+	for resp := range resps {
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		if root == nil {
+			root = resp.RootDirectoryDigest
+		} else if !proto.Equal(root, resp.RootDirectoryDigest) {
+			t.Fatalf("expected the same root for every request, got %v and %v",
+				root, resp.RootDirectoryDigest)
+		}
+	}
+
+	if atomic.LoadInt32(&unpacker.unpacks) != 1 {
+		t.Fatalf("expected one unpack, got %d", atomic.LoadInt32(&unpacker.unpacks))
+	}
+	if atomic.LoadInt32(&numRequests) != 1 {
+		t.Fatalf("expected one download, got %d", atomic.LoadInt32(&numRequests))
+	}
+}
+
+func TestDirectoryFetchKey(t *testing.T) {
+	a := directoryFetchKey(&asset.FetchDirectoryRequest{
+		Uris: []string{"https://a/x.tar", "https://b/x.tar"},
+	})
+	b := directoryFetchKey(&asset.FetchDirectoryRequest{
+		Uris: []string{"https://b/x.tar", "https://a/x.tar", "https://b/x.tar"},
+	})
+	if a != b {
+		t.Error("expected the order and duplicates of URIs to be ignored")
+	}
+
+	c := directoryFetchKey(&asset.FetchDirectoryRequest{
+		Uris:       []string{"https://a/x.tar"},
+		Qualifiers: []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}},
+	})
+	if a == c {
+		t.Error("expected different URIs and qualifiers to have different keys")
+	}
+
+	sri := &asset.Qualifier{Name: "checksum.sri", Value: "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	d := directoryFetchKey(&asset.FetchDirectoryRequest{
+		Uris:       []string{"https://a/x.tar"},
+		Qualifiers: []*asset.Qualifier{sri},
+	})
+	e := directoryFetchKey(&asset.FetchDirectoryRequest{
+		Uris:       []string{"https://c/y.tar"},
+		Qualifiers: []*asset.Qualifier{sri},
+	})
+	if d != e {
+		t.Error("expected requests with the same checksum to have the same key")
+	}
+}
+
+// Returns a zip file with a regular file for each of `names`.
+func testZipWithNames(t *testing.T, names []string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(testArchiveFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestAssetFetchDirectoryArchiveBomb(t *testing.T) {
+	t.Parallel()
+
+	// A small archive containing a large file.
+	bomb := make([]byte, 16*1024*1024)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("zeros")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(bomb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%d", i)
+	}
+
+	archives := map[string][]byte{
+		"/bomb.zip":    buf.Bytes(),
+		"/entries.zip": testZipWithNames(t, names),
+		"/pkg.tar.gz":  testTarGz(t),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archives[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetDirectoryLimits(1024*1024, 10))
+	defer os.Remove(fixture.tempdir)
+
+	expectedCodes := map[string]codes.Code{
+		"/bomb.zip":    codes.InvalidArgument,
+		"/entries.zip": codes.InvalidArgument,
+		"/pkg.tar.gz":  codes.OK,
+	}
+	for path, code := range expectedCodes {
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + path},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(code) {
+			t.Fatalf("%s: expected %v, got %v", path, code, resp.Status)
+		}
+	}
+
+	// The large file was rejected before it was stored.
+	bombHash := sha256.Sum256(bomb)
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, hex.EncodeToString(bombHash[:]), int64(len(bomb)))
+	if found {
+		t.Fatal("expected the unpacked file to not be stored")
+	}
+}
+
+func TestAssetFetchDirectoryInvalidSize(t *testing.T) {
+	t.Parallel()
+
+	// A zip64 entry whose size doesn't fit in an int64.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "huge",
+		Method:             zip.Store,
+		CompressedSize64:   uint64(len(testArchiveFile)),
+		UncompressedSize64: 1 << 63,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte(testArchiveFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/huge.zip"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+		t.Fatalf("expected InvalidArgument, got %v", resp.Status)
+	}
+
+	// Negative sizes from other unpackers are rejected too, without
+	// reducing the total size counted so far.
+	s := &grpcServer{cache: fixture.diskCache, asset: defaultAssetConfig()}
+	tb := newTreeBuilder(s)
+	tb.maxSize = 10
+	err = tb.AddFile(ctx, "negative", strings.NewReader(""), -1<<62, false)
+	var aerr *archiveError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("expected an archive error, got %v", err)
+	}
+	if tb.size != 0 {
+		t.Fatalf("expected the size to be unchanged, got %d", tb.size)
+	}
+}
+
+// Returns a zip file with a stored entry for each of `files`, and a CRC-32
+// which doesn't match the content for those in `badCRC`.
+func testZipWithCRCs(t *testing.T, files map[string][]byte, badCRC map[string]bool) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, name := range sortedKeys(files) {
+		data := files[name]
+		crc := crc32.ChecksumIEEE(data)
+		if badCRC[name] {
+			crc ^= 1
+		}
+
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestAssetFetchDirectoryZipCRC(t *testing.T) {
+	t.Parallel()
+
+	large, _ := testutils.RandomDataAndHash(2 * maxInMemoryArchiveFileSize)
+	files := map[string][]byte{
+		"small": []byte(testArchiveFile),
+		"large": large,
+	}
+
+	archives := map[string][]byte{
+		"/good.zip":      testZipWithCRCs(t, files, nil),
+		"/bad-small.zip": testZipWithCRCs(t, files, map[string]bool{"small": true}),
+		"/bad-large.zip": testZipWithCRCs(t, files, map[string]bool{"large": true}),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archives[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	// The budget fits the copy of the archive, but not another copy of
+	// the large file as well.
+	tempDir := testutils.TempDir(t)
+	defer os.RemoveAll(tempDir)
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetTempDir(tempDir),
+		WithAssetFetchTempBudget(int64(len(archives["/good.zip"]))+maxInMemoryArchiveFileSize))
+	defer os.Remove(fixture.tempdir)
+
+	expectedCodes := map[string]codes.Code{
+		"/good.zip":      codes.OK,
+		"/bad-small.zip": codes.InvalidArgument,
+		"/bad-large.zip": codes.InvalidArgument,
+	}
+	for path, code := range expectedCodes {
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + path},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(code) {
+			t.Fatalf("%s: expected %v, got %v", path, code, resp.Status)
+		}
+	}
+
+	// Temporary files are removed once they are no longer needed.
+	des, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(des) != 0 {
+		t.Fatalf("expected the temporary file directory to be empty, found %d files", len(des))
+	}
+}
+
+func TestAssetFetchDirectoryMaxNodes(t *testing.T) {
+	t.Parallel()
+
+	archives := map[string][]byte{
+		// A single file with many parent directories.
+		"/deep.linear": []byte(lineArchiveMagic + "a/b/c/d/e/f/file deep-contents\n"),
+		// Many files.
+		"/wide.linear": []byte(lineArchiveMagic +
+			"a wide-a\nb wide-b\nc wide-c\nd wide-d\ne wide-e\nf wide-f\ng wide-g\n"),
+		// Exactly the limit: pkg, pkg/README, pkg/README.copy, pkg/bin,
+		// pkg/bin/tool.sh and pkg/tool.
+		"/pkg.tar.gz": testTarGz(t),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archives[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetUnpacker("linear", lineUnpacker{}),
+		WithAssetDirectoryMaxNodes(6))
+	defer os.Remove(fixture.tempdir)
+
+	for _, path := range []string{"/deep.linear", "/wide.linear"} {
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + path},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+			t.Fatalf("%s: expected InvalidArgument, got %v", path, resp.Status)
+		}
+	}
+
+	// Only the archives were stored, none of their files or
+	// directories.
+	_, _, numItems, _ := fixture.diskCache.Stats()
+	if numItems != 2 {
+		t.Fatalf("expected only the 2 archives in the CAS, found %d items", numItems)
+	}
+	for _, contents := range []string{"deep-contents", "wide-a"} {
+		hash := sha256.Sum256([]byte(contents))
+		found, _ := fixture.diskCache.Contains(ctx, cache.CAS, hex.EncodeToString(hash[:]), int64(len(contents)))
+		if found {
+			t.Fatalf("expected %q to not be stored", contents)
+		}
+	}
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/pkg.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+}
+
+// putCountingCache wraps a disk.Cache and counts the Put calls for each
+// hash.
+type putCountingCache struct {
+	disk.Cache
+
+	mu   sync.Mutex
+	puts map[string]int
+}
+
+func (c *putCountingCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error {
+	c.mu.Lock()
+	c.puts[hash]++
+	c.mu.Unlock()
+
+	return c.Cache.Put(ctx, kind, hash, size, r)
+}
+
+// Returns the total number of Put calls.
+func (c *putCountingCache) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for _, n := range c.puts {
+		total += n
+	}
+	return total
+}
+
+func TestAssetUnpackArchiveResume(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	diskCache, err := disk.New(dir, 10*1024*1024,
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &putCountingCache{Cache: diskCache, puts: make(map[string]int)}
+
+	s := &grpcServer{
+		cache:        c,
+		accessLogger: testutils.NewSilentLogger(),
+		errorLogger:  testutils.NewSilentLogger(),
+		asset:        defaultAssetConfig(),
+	}
+	err = WithAssetUnpacker("linear", lineUnpacker{})(&s.asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putArchive := func(data string) *pb.Digest {
+		t.Helper()
+
+		sum := sha256.Sum256([]byte(data))
+		hash := hex.EncodeToString(sum[:])
+		err := diskCache.Put(ctx, cache.CAS, hash, int64(len(data)), strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pb.Digest{Hash: hash, SizeBytes: int64(len(data))}
+	}
+
+	hashOf := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Interrupted by a malformed line after two files were stored.
+	interrupted := putArchive(lineArchiveMagic + "pkg/a resume-a\npkg/b resume-b\nmalformed\n")
+	complete := putArchive(lineArchiveMagic + "pkg/a resume-a\npkg/b resume-b\npkg/c resume-c\n")
+
+	_, err = s.unpackArchive(ctx, interrupted)
+	if !errors.Is(err, ErrMalformedArchive) {
+		t.Fatalf("expected a malformed archive error, got %v", err)
+	}
+
+	root, err := s.unpackArchive(ctx, complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contents := range []string{"resume-a", "resume-b", "resume-c"} {
+		n := c.puts[hashOf(contents)]
+		if n != 1 {
+			t.Errorf("expected %q to be stored once, it was stored %d times", contents, n)
+		}
+	}
+
+	// Unpacking again doesn't store anything, including the Directory
+	// messages.
+	numPuts := c.total()
+	_, err = s.unpackArchive(ctx, complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.total() != numPuts {
+		t.Fatalf("expected no more blobs to be stored, got %d", c.total()-numPuts)
+	}
+
+	found, _ := diskCache.Contains(ctx, cache.CAS, root.Hash, root.SizeBytes)
+	if !found {
+		t.Fatal("expected the root directory to be stored")
+	}
+}
+
+// evictingCache wraps a disk.Cache and discards the first `evictions`
+// Put calls for `hash`, as if the blob was evicted right after it was
+// stored.
+type evictingCache struct {
+	disk.Cache
+
+	hash string
+
+	mu        sync.Mutex
+	evictions int
+}
+
+func (c *evictingCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error {
+	c.mu.Lock()
+	evict := hash == c.hash && c.evictions > 0
+	if evict {
+		c.evictions--
+	}
+	c.mu.Unlock()
+
+	if evict {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+
+	return c.Cache.Put(ctx, kind, hash, size, r)
+}
+
+func TestAssetFetchDirectoryEvictedChild(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	diskCache, err := disk.New(dir, 10*1024*1024,
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(lineArchiveMagic + "pkg/a a\npkg/b evicted" + r.URL.Path + "\n"))
+	}))
+	defer ts.Close()
+
+	fetch := func(name string, evictions int) (*asset.FetchDirectoryResponse, *grpcServer) {
+		t.Helper()
+
+		evictedSum := sha256.Sum256([]byte("evicted" + name))
+		evictedHash := hex.EncodeToString(evictedSum[:])
+
+		s := &grpcServer{
+			cache:        &evictingCache{Cache: diskCache, hash: evictedHash, evictions: evictions},
+			accessLogger: testutils.NewSilentLogger(),
+			errorLogger:  testutils.NewSilentLogger(),
+			asset:        defaultAssetConfig(),
+		}
+		err := WithAssetUnpacker("linear", lineUnpacker{})(&s.asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := s.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, s
+	}
+
+	// Evicted once, so it's stored again before the root is returned.
+	resp, s := fetch("/once", 1)
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	missing, err := s.missingDirectoryBlobs(ctx, resp.RootDirectoryDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected the whole tree to be in the CAS, missing %v", missing)
+	}
+
+	// Evicted every time, so the root isn't returned.
+	resp, _ = fetch("/always", maxTreeStoreAttempts)
+	if resp.Status.GetCode() != int32(codes.Unavailable) {
+		t.Fatalf("expected Unavailable, got %v", resp.Status)
+	}
+	if resp.RootDirectoryDigest != nil {
+		t.Fatalf("expected no root directory, got %v", resp.RootDirectoryDigest)
+	}
+}
+
+func TestAssetFetchDirectoryNameNormalization(t *testing.T) {
+	t.Parallel()
+
+	archives := map[string][]byte{
+		// Created on Windows, with "é" decomposed into "e" and a
+		// combining acute accent.
+		"/windows.zip": testZipWithNames(t, []string{"pkg\\bin\\tool.sh", "pkg\\cafe\u0301.txt"}),
+		"/unix.zip":    testZipWithNames(t, []string{"pkg/bin/tool.sh", "pkg/caf\u00e9.txt"}),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archives[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	fetch := func(fixture grpcTestFixture, name string) *pb.Digest {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris: []string{ts.URL + name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch of %s, got %v", name, resp.Status)
+		}
+
+		return resp.RootDirectoryDigest
+	}
+
+	// Without normalization, the names are used as they are.
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	if proto.Equal(fetch(fixture, "/windows.zip"), fetch(fixture, "/unix.zip")) {
+		t.Fatal("expected different trees without name normalization")
+	}
+
+	fixture = grpcTestSetupWithAssetOptions(t, WithAssetDirectoryNameNormalization())
+	defer os.Remove(fixture.tempdir)
+
+	windows := fetch(fixture, "/windows.zip")
+	unix := fetch(fixture, "/unix.zip")
+	if !proto.Equal(windows, unix) {
+		t.Fatalf("expected the same tree for both archives, got %v and %v", windows, unix)
+	}
+
+	root := getTestDirectory(t, fixture, windows)
+	if len(root.Files) != 0 || len(root.Directories) != 1 || root.Directories[0].Name != "pkg" {
+		t.Fatalf("unexpected root directory: %v", root)
+	}
+
+	pkg := getTestDirectory(t, fixture, root.Directories[0].Digest)
+	if len(pkg.Files) != 1 || pkg.Files[0].Name != "caf\u00e9.txt" {
+		t.Fatalf("unexpected files in pkg: %v", pkg.Files)
+	}
+	if len(pkg.Directories) != 1 || pkg.Directories[0].Name != "bin" {
+		t.Fatalf("unexpected directories in pkg: %v", pkg.Directories)
+	}
+}
+
+func TestAssetFetchDirectoryPartial(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	// The archive can't be fetched.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	putBlob := func(data []byte) *pb.Digest {
+		sum := sha256.Sum256(data)
+		digest := &pb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+		err := fixture.diskCache.Put(ctx, cache.CAS, digest.Hash, digest.SizeBytes, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	cached := putBlob([]byte(testArchiveFile))
+	missingData := []byte(testArchiveScript)
+	missingSum := sha256.Sum256(missingData)
+	missing := &pb.Digest{Hash: hex.EncodeToString(missingSum[:]), SizeBytes: int64(len(missingData))}
+
+	dir := &pb.Directory{
+		Files: []*pb.FileNode{
+			{Name: "README", Digest: cached},
+			{Name: "tool.sh", Digest: missing, IsExecutable: true},
+		},
+	}
+	dirData, err := proto.Marshal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := putBlob(dirData)
+
+	uri := ts.URL + "/pkg.tar.gz"
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{uri},
+		RootDirectoryDigest: root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{uri},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.FailedPrecondition) {
+		t.Fatalf("expected FailedPrecondition for a partially available directory, got %v", resp.Status)
+	}
+	if resp.RootDirectoryDigest.GetHash() != root.Hash || resp.Uri != uri {
+		t.Fatalf("expected %s from %s, got %s from %s",
+			root.Hash, uri, resp.RootDirectoryDigest.GetHash(), resp.Uri)
+	}
+
+	if len(resp.Status.GetDetails()) != 1 {
+		t.Fatalf("expected one status detail, got %v", resp.Status.GetDetails())
+	}
+	var failure errdetails.PreconditionFailure
+	err = resp.Status.GetDetails()[0].UnmarshalTo(&failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSubject := fmt.Sprintf("blobs/%s/%d", missing.Hash, missing.SizeBytes)
+	if len(failure.Violations) != 1 || failure.Violations[0].Type != "MISSING" ||
+		failure.Violations[0].Subject != expectedSubject {
+		t.Fatalf("expected %s to be reported missing, got %v", expectedSubject, failure.Violations)
+	}
+
+	// Once the missing file is uploaded, the directory is fully available.
+	putBlob(missingData)
+
+	resp, err = fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{uri},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+}
+
+func TestArchivePath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+		valid    bool
+	}{
+		{name: "foo/bar", expected: "foo/bar", valid: true},
+		{name: "./foo/", expected: "foo", valid: true},
+		{name: "/foo//bar", expected: "foo/bar", valid: true},
+		{name: "./", expected: "", valid: true},
+		{name: "foo/../bar", expected: "bar", valid: true},
+		{name: "../foo", valid: false},
+		{name: "foo/../../bar", valid: false},
+	}
+
+	for _, tc := range testCases {
+		p, err := archivePath(tc.name)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("expected %q to be rejected, got %q", tc.name, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.name, err)
+		}
+		if p != tc.expected {
+			t.Errorf("expected %q for %q, got %q", tc.expected, tc.name, p)
+		}
+	}
+}
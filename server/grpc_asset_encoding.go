@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+)
+
+// The qualifier which clients can use to choose whether the content of
+// responses with a Content-Encoding is decoded before it is hashed and
+// stored, with a value of "true" or "false". This overrides the default
+// set by WithAssetFetchDecodeContentEncoding.
+//
+// Without decoding the content is stored as received. Go's http.Transport
+// transparently decodes gzip responses to the "Accept-Encoding: gzip"
+// header that it adds itself, but not if the client set Accept-Encoding
+// with an http_header qualifier, or if a server sends an encoding that
+// wasn't asked for. The stored blob is then the encoded content, which
+// won't match a checksum.sri computed over the file. With decoding, the
+// codings listed in Content-Encoding are removed first, so the blob is
+// the file itself. That is the wrong choice for servers which label
+// compressed files, eg .tar.gz archives, with "Content-Encoding: gzip".
+const decodeContentEncodingQualifier = "decode_content_encoding"
+
+// Returns the value of a decode_content_encoding qualifier, or `dflt` if
+// there is none.
+func decodeContentEncoding(qualifiers []*asset.Qualifier, dflt bool) (bool, error) {
+	for _, q := range qualifiers {
+		if q.GetName() != decodeContentEncodingQualifier {
+			continue
+		}
+
+		decode, err := strconv.ParseBool(q.GetValue())
+		if err != nil {
+			return false, fmt.Errorf("invalid %s qualifier: %q", decodeContentEncodingQualifier, q.GetValue())
+		}
+
+		return decode, nil
+	}
+
+	return dflt, nil
+}
+
+// contentDecodingError is returned for responses whose content can't be
+// decoded, which won't be fixed by retrying.
+type contentDecodingError struct {
+	err error
+}
+
+func (e *contentDecodingError) Error() string {
+	return fmt.Sprintf("failed to decode content: %v", e.err)
+}
+
+func (e *contentDecodingError) Unwrap() error {
+	return e.err
+}
+
+// Returns the content codings listed in the Content-Encoding headers, in
+// the order they were applied, excluding "identity".
+func contentCodings(header http.Header) []string {
+	var codings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" || coding == "identity" {
+				continue
+			}
+			codings = append(codings, coding)
+		}
+	}
+
+	return codings
+}
+
+// Returns a reader of body with the content codings in `codings` removed.
+// Errors reading body itself are returned unchanged, so they can be told
+// apart from malformed content, which is reported as a
+// contentDecodingError.
+func newContentDecoder(body io.Reader, codings []string) (io.Reader, error) {
+	raw := &readErrorRecorder{r: body}
+
+	// Codings are listed in the order they were applied, so double
+	// encoded content, eg "gzip, gzip", is decoded from the last.
+	var r io.Reader = raw
+	for i := len(codings) - 1; i >= 0; i-- {
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(2)
+		if raw.err != nil {
+			return nil, raw.err
+		}
+
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			if !bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+				// Some servers label uncompressed content as gzip.
+				r = br
+				continue
+			}
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				if raw.err != nil {
+					return nil, raw.err
+				}
+				return nil, &contentDecodingError{err: err}
+			}
+			r = zr
+		case "deflate":
+			// This should be zlib format, but some servers send raw
+			// deflate data.
+			if len(magic) == 2 && magic[0]&0x0f == 8 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+				zr, err := zlib.NewReader(br)
+				if err != nil {
+					if raw.err != nil {
+						return nil, raw.err
+					}
+					return nil, &contentDecodingError{err: err}
+				}
+				r = zr
+			} else {
+				r = flate.NewReader(br)
+			}
+		default:
+			return nil, &contentDecodingError{err: fmt.Errorf("unsupported Content-Encoding %q", codings[i])}
+		}
+	}
+
+	return &contentDecoder{r: r, raw: raw}, nil
+}
+
+// contentDecoder wraps errors from the decoded reader r in
+// contentDecodingError, unless they were caused by reading the raw body.
+type contentDecoder struct {
+	r   io.Reader
+	raw *readErrorRecorder
+}
+
+func (d *contentDecoder) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF && d.raw.err == nil {
+		err = &contentDecodingError{err: err}
+	}
+	return n, err
+}
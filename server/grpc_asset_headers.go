@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+)
+
+// The prefix of qualifier names which specify HTTP request headers to
+// send when fetching the request's URIs, eg "http_header:Accept", so
+// that clients can steer content negotiation.
+const httpHeaderQualifierPrefix = "http_header:"
+
+// Headers which clients can set with http_header qualifiers, in canonical
+// form, in addition to custom "X-" headers. Other headers are ignored,
+// including hop-by-hop headers like Connection and Transfer-Encoding, and
+// headers like Authorization and Host which could change who the request
+// is sent to or on behalf of.
+var forwardableHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"User-Agent":      true,
+}
+
+func forwardableHeader(name string) bool {
+	return forwardableHeaders[name] || strings.HasPrefix(name, "X-")
+}
+
+// Returns the headers specified by http_header qualifiers which can be
+// forwarded, or nil if there are none, or an error if any of them are
+// malformed.
+func requestHeaders(qualifiers []*asset.Qualifier) (http.Header, error) {
+	var headers http.Header
+
+	for _, q := range qualifiers {
+		name, found := strings.CutPrefix(q.GetName(), httpHeaderQualifierPrefix)
+		if !found {
+			continue
+		}
+
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name in %q qualifier", q.GetName())
+		}
+		if strings.ContainsAny(q.GetValue(), "\r\n\x00") {
+			return nil, fmt.Errorf("invalid header value in %q qualifier", q.GetName())
+		}
+
+		name = http.CanonicalHeaderKey(name)
+		if !forwardableHeader(name) {
+			continue
+		}
+
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Add(name, q.GetValue())
+	}
+
+	return headers, nil
+}
+
+// Returns true if name is a valid HTTP header field name, ie a non-empty
+// RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
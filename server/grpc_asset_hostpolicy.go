@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// assetHostPolicy restricts which hosts and addresses asset fetches can
+// reach, so that a bazel-remote instance which is reachable by untrusted
+// clients can't be used to probe internal services.
+type assetHostPolicy struct {
+	// If non-empty, only these hosts can be fetched from. Entries are
+	// lowercase hostnames or IP addresses, or "*.example.com" patterns
+	// which match any subdomain of example.com.
+	allowedHosts []string
+
+	// Connections to addresses in these networks are blocked.
+	blockedNetworks []*net.IPNet
+}
+
+// blockedFetchError is returned for fetches which are not allowed by the
+// assetHostPolicy.
+type blockedFetchError struct {
+	reason string
+}
+
+func (e *blockedFetchError) Error() string {
+	return e.reason
+}
+
+// Returns a *blockedFetchError if u's host is not allowed, or if it's an
+// IP address in one of the blocked networks. Hostnames are checked again
+// after they are resolved, see controlDial.
+func (p *assetHostPolicy) checkURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+
+	if len(p.allowedHosts) > 0 && !p.hostAllowed(host) {
+		return &blockedFetchError{reason: fmt.Sprintf("host %q is not in the allowed hosts", host)}
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return p.checkIP(ip)
+	}
+
+	return nil
+}
+
+func (p *assetHostPolicy) hostAllowed(host string) bool {
+	for _, pattern := range p.allowedHosts {
+		if pattern == host {
+			return true
+		}
+
+		domain, found := strings.CutPrefix(pattern, "*.")
+		if found && strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *assetHostPolicy) checkIP(ip net.IP) error {
+	for _, network := range p.blockedNetworks {
+		if network.Contains(ip) {
+			return &blockedFetchError{
+				reason: fmt.Sprintf("address %s is in blocked network %s", ip, network),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Used as a net.Dialer's Control function, so that addresses are checked
+// after DNS resolution, immediately before connecting. This prevents
+// hostnames which resolve to blocked addresses, including those which
+// change what they resolve to between checks (DNS rebinding), from
+// bypassing the policy.
+func (p *assetHostPolicy) controlDial(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &blockedFetchError{reason: fmt.Sprintf("unexpected address %q", address)}
+	}
+
+	return p.checkIP(ip)
+}
+
+// Wraps `proxy`, an http.Transport Proxy function, so that requests which
+// are sent via a proxy are blocked if their target host resolves to an
+// address in one of the blocked networks. controlDial only sees the
+// address of the proxy in that case, and the proxy resolves the target
+// itself.
+func (p *assetHostPolicy) checkProxiedRequest(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		err = p.checkHost(req.Context(), req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		return proxyURL, nil
+	}
+}
+
+// Returns a *blockedFetchError if `host` is, or resolves to, an address in
+// one of the blocked networks.
+func (p *assetHostPolicy) checkHost(ctx context.Context, host string) error {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return p.checkIP(ip)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		err = p.checkIP(addr.IP)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+)
+
+// The digest function label of the asset metrics. Only sha256 is
+// supported for now.
+var assetDigestFunctionLabel = pb.DigestFunction_SHA256.String()
+
+// How a remote asset API request was resolved, used as the outcome label
+// of assetRequests.
+type assetSource string
+
+const (
+	// The request failed.
+	assetSourceNone assetSource = "failure"
+
+	// Found in the CAS by a checksum.sri qualifier.
+	assetSourceChecksum assetSource = "checksum_hit"
+
+	// Found in the asset index, ie pushed or fetched by an earlier
+	// request.
+	assetSourceIndex assetSource = "index_hit"
+
+	// Downloaded from one of the request's URIs.
+	assetSourceDownload assetSource = "download"
+)
+
+// Buckets for download latencies, which range from milliseconds for
+// small files on nearby mirrors to minutes for large archives.
+var assetDownloadDurationBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	assetRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_asset_requests_total",
+		Help: "The total number of remote asset API fetch requests, by how they were resolved",
+	}, []string{"method", "digest_function", "outcome"})
+
+	assetDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_asset_fetch_downloads_total",
+		Help: "The total number of attempts to download a URI for the remote asset API, by outcome",
+	}, []string{"digest_function", "outcome"})
+
+	assetDownloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_asset_fetch_downloaded_bytes_total",
+		Help: "The total number of bytes downloaded for the remote asset API, including failed downloads",
+	}, []string{"digest_function"})
+
+	assetDownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bazel_remote_asset_fetch_download_duration_seconds",
+		Help:    "The time taken by attempts to download a URI for the remote asset API, by outcome",
+		Buckets: assetDownloadDurationBuckets,
+	}, []string{"digest_function", "outcome"})
+
+	assetDirectoryUnpacks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_asset_directory_unpacks_in_flight",
+		Help: "The number of archives being unpacked by FetchDirectory",
+	})
+)
+
+// Records a FetchBlob or FetchDirectory request, which was resolved by
+// source if it was successful.
+func observeAssetRequest(method string, st *status.Status, err error, source assetSource) {
+	if err != nil || st.GetCode() != int32(codes.OK) {
+		source = assetSourceNone
+	}
+
+	assetRequests.WithLabelValues(method, assetDigestFunctionLabel, string(source)).Inc()
+}
+
+// Returns the outcome label for an attempt to download a URI which
+// returned err.
+func assetDownloadOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// Eg the client gave up, or another URI was fetched first.
+		return "cancelled"
+	}
+
+	var statusErr *fetchStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.notFound():
+			return "not_found"
+		case statusErr.code >= 500:
+			return "server_error"
+		case statusErr.code >= 400:
+			return "client_error"
+		}
+	}
+
+	return "error"
+}
+
+// Records an attempt to download a URI which took d and returned err.
+func observeAssetDownload(err error, d time.Duration) {
+	var schemeErr *unsupportedSchemeError
+	if errors.As(err, &schemeErr) {
+		// Nothing was downloaded.
+		return
+	}
+
+	outcome := assetDownloadOutcome(err)
+	assetDownloads.WithLabelValues(assetDigestFunctionLabel, outcome).Inc()
+	assetDownloadDuration.WithLabelValues(assetDigestFunctionLabel, outcome).Observe(d.Seconds())
+}
+
+// meteredBody wraps a response body and counts the bytes read from it in
+// assetDownloadedBytes.
+type meteredBody struct {
+	io.ReadCloser
+	bytes prometheus.Counter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.Add(float64(n))
+	return n, err
+}
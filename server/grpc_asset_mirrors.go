@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// When several URIs are fetched concurrently and one of them succeeds,
+// how long to wait for URIs earlier in the request that are still being
+// fetched, which are preferred if they also succeed.
+const defaultAssetFetchPreferenceWindow = 100 * time.Millisecond
+
+var errRecentlyNotFound = errors.New("recently not found")
+
+// The outcome of fetching a single URI, including any retries.
+type uriFetchOutcome struct {
+	result fetchResult
+
+	// Nil if the fetch succeeded.
+	err error
+
+	// Non-empty if the URI has a scheme that we can't fetch, so nothing
+	// was attempted.
+	unsupportedScheme string
+
+	// Set if the fetch was stopped because ctx was done, either because
+	// the client gave up or because another URI was fetched first.
+	cancelled bool
+
+	// Set if the fetch failed for reasons that might not happen if the
+	// client tries again later.
+	transient bool
+
+	// Set if an attempt took longer than s.asset.fetchTimeout.
+	timedOut bool
+}
+
+// Fetch uri, retrying transient failures with exponential backoff, up to
+// s.asset.fetchRetries times and as long as budget allows.
+func (s *grpcServer) fetchURI(ctx context.Context, uri string, sha256Str string, requestedSize int64, alt altChecksum, headers http.Header, decode bool, budget *assetRetryBudget) uriFetchOutcome {
+	if s.asset.notFound != nil && !bypassNotFound(ctx) && s.asset.notFound.contains(uri) {
+		s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: recently not found", uri)
+		return uriFetchOutcome{err: errRecentlyNotFound}
+	}
+
+	if s.asset.breaker != nil && !s.asset.breaker.allow(uri) {
+		s.accessLogger.Printf("GRPC ASSET FETCH %s SKIPPED: host circuit breaker is open", uri)
+		return uriFetchOutcome{err: errHostBreakerOpen, transient: true}
+	}
+
+	// The size reported by a previous attempt to fetch this URI which
+	// failed part way through, or -1 if unknown.
+	previousSize := int64(-1)
+
+	retries := 0
+	for {
+		result, err := s.fetchItemWithTimeout(ctx, uri, sha256Str, requestedSize, alt, headers, decode, previousSize)
+		if err == nil {
+			if s.asset.breaker != nil {
+				s.asset.breaker.success(uri)
+			}
+			if s.asset.notFound != nil {
+				// Eg if the URI was fixed and fetched with the not
+				// found window bypassed, other requests can use it
+				// again.
+				s.asset.notFound.remove(uri)
+			}
+			return uriFetchOutcome{result: result}
+		}
+
+		if ctx.Err() != nil {
+			return uriFetchOutcome{err: ctx.Err(), cancelled: true}
+		}
+
+		s.errorLogger.Printf("GRPC ASSET FETCH %s FAILED: %v", uri, err)
+
+		outcome := uriFetchOutcome{err: err}
+
+		var schemeErr *unsupportedSchemeError
+		if errors.As(err, &schemeErr) {
+			outcome.unsupportedScheme = schemeErr.scheme
+		}
+
+		var transientErr *transientFetchError
+		isTransient := errors.As(err, &transientErr)
+		if s.asset.breaker != nil {
+			if isTransient || errors.Is(err, context.DeadlineExceeded) {
+				s.asset.breaker.failure(uri)
+			} else {
+				// The host responded, eg with a 404.
+				s.asset.breaker.success(uri)
+			}
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			// Retrying would most likely time out again.
+			outcome.timedOut = true
+			return outcome
+		}
+
+		var statusErr *fetchStatusError
+		if s.asset.notFound != nil && errors.As(err, &statusErr) && statusErr.notFound() {
+			s.asset.notFound.add(uri)
+		}
+
+		var mismatchErr *checksumMismatchError
+		if s.asset.mismatches != nil && errors.As(err, &mismatchErr) {
+			s.asset.mismatches.add(uri)
+			s.asset.securityLogger.Printf("GRPC ASSET FETCH %s MISMATCH: preferring other hosts for %v",
+				uri, s.asset.mismatches.window)
+		}
+
+		if !isTransient {
+			return outcome
+		}
+		if transientErr.size > 0 {
+			previousSize = transientErr.size
+		}
+
+		outcome.transient = true
+		if s.asset.fetchRetries > 0 && retries >= s.asset.fetchRetries {
+			return outcome
+		}
+
+		delay := transientErr.retryAfter
+		if delay == 0 {
+			delay = assetFetchBackoff(s.asset.retryBackoff, retries)
+		}
+		if delay > maxAssetFetchBackoff {
+			// Too long to keep the client waiting.
+			return outcome
+		}
+
+		if s.asset.breaker != nil && !s.asset.breaker.allow(uri) {
+			s.accessLogger.Printf("GRPC ASSET FETCH %s NOT RETRIED: host circuit breaker is open", uri)
+			return outcome
+		}
+
+		if !budget.take() {
+			return outcome
+		}
+
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return uriFetchOutcome{err: err, cancelled: true}
+		}
+
+		retries++
+	}
+}
+
+// Fetch uris until one succeeds, and return the index of that URI, or -1
+// if none succeeded, along with the outcome for each URI. URIs which were
+// not tried because an earlier URI succeeded are marked as cancelled.
+//
+// If s.asset.fetchConcurrency is greater than one, up to that many URIs
+// are fetched at the same time. URIs earlier in the list are still
+// preferred: when a URI succeeds, fetches of later URIs are cancelled,
+// and earlier URIs which are still being fetched are given up to
+// s.asset.preferenceWindow to succeed before they are cancelled too.
+// Cancelling a fetch also cancels its Put, so that losing downloads
+// don't fill the cache. This returns once all of the fetches that it
+// started have stopped.
+func (s *grpcServer) fetchURIs(ctx context.Context, uris []string, sha256Str string, requestedSize int64, alt altChecksum, headers http.Header, decode bool, budget *assetRetryBudget) (int, []uriFetchOutcome) {
+	outcomes := make([]uriFetchOutcome, len(uris))
+	for i := range outcomes {
+		outcomes[i] = uriFetchOutcome{err: context.Canceled, cancelled: true}
+	}
+
+	if s.asset.fetchConcurrency <= 1 || len(uris) <= 1 {
+		for i, uri := range uris {
+			outcomes[i] = s.fetchURI(ctx, uri, sha256Str, requestedSize, alt, headers, decode, budget)
+			if outcomes[i].err == nil {
+				return i, outcomes
+			}
+			if outcomes[i].cancelled {
+				return -1, outcomes
+			}
+		}
+		return -1, outcomes
+	}
+
+	type finishedFetch struct {
+		i       int
+		outcome uriFetchOutcome
+	}
+	finished := make(chan finishedFetch, len(uris))
+
+	cancels := make([]context.CancelFunc, len(uris))
+	done := make([]bool, len(uris))
+	next := 0
+	running := 0
+	winner := -1
+
+	var preferenceTimeout <-chan time.Time
+
+	for {
+		// Start more fetches, unless a URI was already fetched, in
+		// which case the remaining URIs are less preferred.
+		for winner < 0 && next < len(uris) && running < s.asset.fetchConcurrency {
+			i := next
+			fetchCtx, cancel := context.WithCancel(ctx)
+			cancels[i] = cancel
+			go func() {
+				finished <- finishedFetch{i: i, outcome: s.fetchURI(fetchCtx, uris[i], sha256Str, requestedSize, alt, headers, decode, budget)}
+			}()
+			next++
+			running++
+		}
+
+		if running == 0 {
+			return winner, outcomes
+		}
+
+		select {
+		case f := <-finished:
+			running--
+			done[f.i] = true
+			outcomes[f.i] = f.outcome
+			cancels[f.i]()
+
+			if f.outcome.err == nil && (winner < 0 || f.i < winner) {
+				winner = f.i
+				for j := winner + 1; j < next; j++ {
+					cancels[j]()
+				}
+
+				if preferenceTimeout == nil {
+					timer := time.NewTimer(s.asset.preferenceWindow)
+					defer timer.Stop()
+					preferenceTimeout = timer.C
+				}
+			}
+
+			if winner >= 0 {
+				earlierRunning := false
+				for j := 0; j < winner; j++ {
+					if !done[j] {
+						earlierRunning = true
+						break
+					}
+				}
+				if !earlierRunning {
+					// Any other fetches have been cancelled, we
+					// just need to wait for them to stop.
+					preferenceTimeout = nil
+				}
+			}
+
+		case <-preferenceTimeout:
+			preferenceTimeout = nil
+			for j := 0; j < winner; j++ {
+				cancels[j]()
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The maximum number of hosts tracked by an assetMismatchCache. When it's
+// full, expired entries are removed, and if that's not enough new hosts
+// are not recorded.
+const maxMismatchHosts = 1000
+
+// checksumMismatchError is returned by fetchItem for content which doesn't
+// match the expected checksum.
+type checksumMismatchError struct {
+	// The algorithm of the checksum, or "" for sha256.
+	algo string
+
+	expected string
+	actual   string
+}
+
+func (e *checksumMismatchError) Error() string {
+	if e.algo != "" {
+		return fmt.Sprintf("URI data has %s hash %s, expected %s", e.algo, e.actual, e.expected)
+	}
+	return fmt.Sprintf("URI data has hash %s, expected %s", e.actual, e.expected)
+}
+
+// assetMismatchCache records hosts which recently served content that
+// didn't match the expected checksum, eg a mirror with a corrupt or
+// tampered copy of a file. Unlike URIs which weren't found, the URIs of
+// these hosts are not skipped, but they are tried after the other URIs of
+// a request, so that a good mirror is used without first downloading the
+// content from the bad one.
+type assetMismatchCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newAssetMismatchCache(window time.Duration) *assetMismatchCache {
+	return &assetMismatchCache{
+		window:  window,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Returns the host that uri is recorded by, or "" if it can't be parsed.
+func uriHost(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// Records that the host of uri served mismatching content.
+func (c *assetMismatchCache) add(uri string) {
+	host := uriHost(uri)
+	if host == "" {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, found := c.expires[host]
+	if !found && len(c.expires) >= maxMismatchHosts {
+		for h, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, h)
+			}
+		}
+		if len(c.expires) >= maxMismatchHosts {
+			return
+		}
+	}
+
+	c.expires[host] = now.Add(c.window)
+}
+
+// Returns true if the host of uri served mismatching content within the
+// window.
+func (c *assetMismatchCache) contains(uri string) bool {
+	host := uriHost(uri)
+	if host == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, found := c.expires[host]
+	if !found {
+		return false
+	}
+
+	if !time.Now().Before(expires) {
+		delete(c.expires, host)
+		return false
+	}
+
+	return true
+}
+
+// Returns the hosts which served mismatching content within the window,
+// and when they will be tried in the usual order again.
+func (c *assetMismatchCache) hosts() map[string]time.Time {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hosts := make(map[string]time.Time, len(c.expires))
+	for host, expires := range c.expires {
+		if now.Before(expires) {
+			hosts[host] = expires
+		}
+	}
+	return hosts
+}
+
+// Returns `uris`, reordered so that those on hosts which recently served
+// mismatching content come last. The relative order of the URIs is
+// otherwise unchanged.
+func (c *assetMismatchCache) order(uris []string) []string {
+	ordered := make([]string, 0, len(uris))
+	var mismatched []string
+
+	for _, uri := range uris {
+		if c.contains(uri) {
+			mismatched = append(mismatched, uri)
+		} else {
+			ordered = append(ordered, uri)
+		}
+	}
+
+	return append(ordered, mismatched...)
+}
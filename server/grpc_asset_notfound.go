@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// The maximum number of URIs tracked by an assetNotFoundCache. When it's
+// full, expired entries are removed, and if that's not enough new URIs
+// are not recorded.
+const maxNotFoundEntries = 10000
+
+// assetNotFoundCache records URIs which recently returned 404 or 410, so
+// that other requests which include the same URI (eg a mirror which is
+// missing the file) can skip it for a short while, instead of trying it
+// again every time.
+type assetNotFoundCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newAssetNotFoundCache(window time.Duration) *assetNotFoundCache {
+	return &assetNotFoundCache{
+		window:  window,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Records that uri was not found.
+func (c *assetNotFoundCache) add(uri string) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, found := c.expires[uri]
+	if !found && len(c.expires) >= maxNotFoundEntries {
+		for u, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, u)
+			}
+		}
+		if len(c.expires) >= maxNotFoundEntries {
+			return
+		}
+	}
+
+	c.expires[uri] = now.Add(c.window)
+}
+
+// Forgets that uri was not found, eg because it has since been fetched.
+func (c *assetNotFoundCache) remove(uri string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.expires, uri)
+}
+
+// Returns true if uri was not found within the window.
+func (c *assetNotFoundCache) contains(uri string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, found := c.expires[uri]
+	if !found {
+		return false
+	}
+
+	if !time.Now().Before(expires) {
+		delete(c.expires, uri)
+		return false
+	}
+
+	return true
+}
+
+// Returns the number of URIs which were not found within the window.
+func (c *assetNotFoundCache) len() int {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, expires := range c.expires {
+		if now.Before(expires) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,1195 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+)
+
+// AssetOption is used to configure the Remote Asset API implementation.
+type AssetOption func(*assetConfig) error
+
+// A named readiness check for one of the asset API's dependencies.
+type readinessCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// assetConfig holds the settings for the Remote Asset API implementation.
+type assetConfig struct {
+	readinessChecks   []readinessCheck
+	readinessInterval time.Duration
+
+	// Functions which return the TLS settings for specific hosts, keyed
+	// by hostname or host:port. These are called again when a value is
+	// received from tlsReload.
+	hostTLSLoaders map[string]func() (*tls.Config, error)
+	tlsReload      <-chan struct{}
+
+	// The minimum TLS version for fetches.
+	minTLSVersion uint16
+
+	// Transport timeouts for fetches, zero means use the net/http default.
+	connectTimeout        time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+
+	// The maximum size of the response headers for fetches, zero means
+	// use the net/http default.
+	maxResponseHeaderBytes int64
+
+	// The maximum number of connections to each upstream host for
+	// fetches, zero means no limit.
+	maxConnsPerHost int
+
+	// Base URLs that requests to specific hosts are sent to instead,
+	// keyed by hostname or host:port.
+	rewrites map[string]*url.URL
+
+	// The regions of specific hosts, keyed by hostname or host:port,
+	// and the default preferred region.
+	hostRegions map[string]string
+	region      string
+
+	// The maximum sizes of assets fetched from specific hosts, keyed by
+	// hostname or host:port.
+	hostMaxSizes map[string]int64
+
+	// The maximum size of assets fetched from any host, zero means no
+	// limit.
+	maxSize int64
+
+	// The maximum number of redirects followed from specific hosts, keyed
+	// by hostname or host:port.
+	hostMaxRedirects map[string]int
+
+	// If non-nil, called to get headers with credentials for fetches.
+	credentials CredentialProvider
+
+	// If true, a 403 response triggers a credential refresh and a
+	// single retry of the request.
+	refreshOnForbidden bool
+
+	// The archive formats supported by FetchDirectory.
+	unpackers unpackerRegistry
+
+	// If true, FetchDirectory normalizes archive entry names.
+	normalizeNames bool
+
+	// The maximum total size of the files unpacked from an archive by
+	// FetchDirectory, or 0 for the disk cache's maximum size, and the
+	// maximum number of archive entries.
+	maxUnpackedSize   int64
+	maxArchiveEntries int
+
+	// The maximum number of nodes in a tree unpacked by FetchDirectory,
+	// or 0 for no limit.
+	maxTreeNodes int
+
+	// If non-nil, limits the number of archives that FetchDirectory
+	// unpacks at the same time.
+	unpacks *semaphore.Weighted
+
+	// Shares the results of concurrent identical FetchDirectory
+	// requests, see directoryFetchKey.
+	directoryFetches *singleflight.Group
+
+	// If non-nil, blobs pushed for URIs are queued here to be verified,
+	// one every pushVerifyInterval.
+	pushVerifications  chan pushVerification
+	pushVerifyInterval time.Duration
+
+	// If true, fetches send a HEAD request before downloading.
+	headProbe bool
+
+	// If true, the content of responses with a Content-Encoding is
+	// decoded before it is stored, unless the request has a
+	// decode_content_encoding qualifier.
+	decodeContentEncoding bool
+
+	// If true, only https URIs are fetched.
+	httpsOnly bool
+
+	// If non-empty, only URIs whose path ends with one of these
+	// (lowercase) file extensions are fetched.
+	allowedExtensions []string
+
+	// Restricts the hosts and addresses that fetches can reach.
+	hostPolicy assetHostPolicy
+
+	// The total number of times that transient fetch failures are
+	// retried per FetchBlob call, shared by all of the request's URIs.
+	retryBudget int
+
+	// The maximum number of times that transient failures are retried
+	// for each URI, zero means only limited by retryBudget.
+	fetchRetries int
+
+	// The delay before the first retry of a URI.
+	retryBackoff time.Duration
+
+	// The maximum number of URIs fetched at the same time for each
+	// FetchBlob call, zero or one means they are fetched one at a time.
+	fetchConcurrency int
+
+	// How long to wait for a more preferred URI when fetching URIs
+	// concurrently, see fetchURIs.
+	preferenceWindow time.Duration
+
+	// If true, a retried fetch without a checksum may return content of
+	// a different size than a previous attempt.
+	allowSizeChange bool
+
+	// If non-nil, URIs which recently returned 404 or 410 are skipped.
+	notFound *assetNotFoundCache
+
+	// If non-nil, URIs on hosts which recently served content that
+	// didn't match the expected checksum are tried last.
+	mismatches *assetMismatchCache
+
+	// If non-nil, URIs on hosts which keep failing are skipped for a
+	// while.
+	breaker *assetHostBreaker
+
+	// If non-empty, and a FetchBlob request has no checksum, try to
+	// download a sha256 checksum from the URI with this suffix appended.
+	checksumSidecarSuffix string
+
+	// The size of the buffer used to copy and hash downloads.
+	bufferSize int
+
+	// If non-nil, limits the total size of downloads being written to
+	// the cache, and of temporary files written while unpacking archives,
+	// at the same time.
+	tempBudget *assetTempBudget
+
+	// The directory for temporary files, or "" for the default
+	// directory for temporary files.
+	tempDir string
+
+	// If non-nil, downloads which fail checksum verification are stored
+	// here.
+	quarantine *assetQuarantine
+
+	// Associations from PushBlob and PushDirectory requests, and the
+	// results of fetches without a checksum.
+	index *assetindex.Index
+
+	// How long the results of fetches without a checksum are reused for,
+	// zero means they are not reused unless the request asks for it.
+	fetchTTL time.Duration
+
+	// The maximum duration of each attempt to fetch a URI, zero means no
+	// limit other than the request's deadline.
+	fetchTimeout time.Duration
+
+	// The maximum duration of all of the attempts to fetch the URIs of a
+	// FetchBlob request, zero means no limit other than the request's
+	// deadline and requested timeout.
+	requestTimeout time.Duration
+
+	// Limits on the size of FetchBlob requests, zero means no limit.
+	limits assetRequestLimits
+
+	// Used to log security related events, eg blocked fetches or
+	// disabled TLS certificate verification. Defaults to the error logger.
+	securityLogger cache.Logger
+
+	// If non-nil, used to log debug messages, eg checksum.sri cache hits.
+	debugLogger cache.Logger
+
+	// If non-nil, keeps track of the downloads in progress.
+	tracker *AssetFetchTracker
+
+	// The numbers of downloads and unpacks in progress.
+	inFlight *assetInFlight
+
+	// If true, the asset admin service is registered.
+	adminService bool
+
+	// The directories, with symlinks resolved, which the asset admin
+	// service's PushLocalDirectory method can read. The method is only
+	// registered if there are any.
+	adminLocalDirs []string
+
+	// True if the remote asset API is registered, set by ServeGRPC.
+	enabled bool
+
+	// The client used to fetch assets, and its per-host transports if
+	// any, set up from the fields above.
+	httpClient    *http.Client
+	hostTransport *hostRoundTripper
+}
+
+const defaultAssetReadinessInterval = 30 * time.Second
+
+func defaultAssetConfig() assetConfig {
+	return assetConfig{
+		readinessInterval: defaultAssetReadinessInterval,
+		minTLSVersion:     tls.VersionTLS12,
+		retryBackoff:      defaultAssetFetchBackoff,
+		preferenceWindow:  defaultAssetFetchPreferenceWindow,
+		bufferSize:        defaultAssetFetchBufferSize,
+		index:             assetindex.NewInMemory(0),
+		httpClient:        http.DefaultClient,
+		unpackers:         defaultUnpackers(),
+		maxArchiveEntries: defaultMaxArchiveEntries,
+		directoryFetches:  &singleflight.Group{},
+		inFlight:          &assetInFlight{},
+	}
+}
+
+// WithAssetReadinessCheck adds a function that is called periodically to
+// determine if one of the asset API's dependencies is healthy. If any of
+// the checks return a non-nil error, the asset service is reported as
+// NOT_SERVING by the gRPC health service.
+func WithAssetReadinessCheck(name string, check func(context.Context) error) AssetOption {
+	return func(c *assetConfig) error {
+		if check == nil {
+			return fmt.Errorf("Invalid nil readiness check: %s", name)
+		}
+
+		c.readinessChecks = append(c.readinessChecks, readinessCheck{name: name, check: check})
+		return nil
+	}
+}
+
+// WithAssetReadinessInterval sets how often the readiness checks are run.
+func WithAssetReadinessInterval(interval time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("Invalid asset readiness interval: %v", interval)
+		}
+
+		c.readinessInterval = interval
+		return nil
+	}
+}
+
+// WithAssetSecurityLogger sets the logger used for security related
+// events, so that they can be audited separately from other errors.
+func WithAssetSecurityLogger(logger cache.Logger) AssetOption {
+	return func(c *assetConfig) error {
+		if logger == nil {
+			return fmt.Errorf("Invalid nil asset security logger")
+		}
+
+		c.securityLogger = logger
+		return nil
+	}
+}
+
+// WithAssetDebugLogger enables debug logging of asset requests, eg cache
+// hits for checksum.sri qualifiers, which are otherwise not logged, and
+// the DNS, connect, TLS, time to first byte and total timings of fetches.
+func WithAssetDebugLogger(logger cache.Logger) AssetOption {
+	return func(c *assetConfig) error {
+		if logger == nil {
+			return fmt.Errorf("Invalid nil asset debug logger")
+		}
+
+		c.debugLogger = logger
+		return nil
+	}
+}
+
+// Logs a debug message, if debug logging is enabled.
+func (c *assetConfig) debugf(format string, v ...interface{}) {
+	if c.debugLogger != nil {
+		c.debugLogger.Printf(format, v...)
+	}
+}
+
+// WithAssetFetchCredentialProvider sets a CredentialProvider which is
+// called to get headers with credentials for each asset fetch request.
+func WithAssetFetchCredentialProvider(provider CredentialProvider) AssetOption {
+	return func(c *assetConfig) error {
+		if provider == nil {
+			return fmt.Errorf("Invalid nil asset fetch credential provider")
+		}
+
+		c.credentials = provider
+		return nil
+	}
+}
+
+// WithAssetFetchRefreshOnForbidden makes asset fetches which get a 403
+// Forbidden response refresh their credentials and retry once before
+// giving up on the URI, since with short-lived credentials a 403 may just
+// mean that a token has expired. This only has an effect if the
+// CredentialProvider implements CredentialRefresher.
+func WithAssetFetchRefreshOnForbidden() AssetOption {
+	return func(c *assetConfig) error {
+		c.refreshOnForbidden = true
+		return nil
+	}
+}
+
+// WithAssetUnpacker registers an Unpacker for FetchDirectory archives in
+// `format`, eg "7z". This replaces the default Unpacker if `format` is one
+// of the built in formats: "zip", "tar.gz" or "tar". Formats are detected
+// in the order they are registered, after the built in formats.
+func WithAssetUnpacker(format string, u Unpacker) AssetOption {
+	return func(c *assetConfig) error {
+		if format == "" {
+			return fmt.Errorf("Invalid empty archive format")
+		}
+		if u == nil {
+			return fmt.Errorf("Invalid nil unpacker for archive format: %s", format)
+		}
+
+		c.unpackers = c.unpackers.register(format, u)
+		return nil
+	}
+}
+
+// WithAssetDirectoryNameNormalization makes FetchDirectory replace
+// backslashes with forward slashes in archive entry names and symlink
+// targets, and convert them to Unicode normalization form C. Archives
+// created on different platforms then produce the same directory tree
+// digest. This is not the default, because backslashes are valid in
+// file names on other platforms.
+func WithAssetDirectoryNameNormalization() AssetOption {
+	return func(c *assetConfig) error {
+		c.normalizeNames = true
+		return nil
+	}
+}
+
+// The default maximum number of entries in an archive unpacked by
+// FetchDirectory.
+const defaultMaxArchiveEntries = 1000000
+
+// WithAssetDirectoryLimits limits the archives that FetchDirectory
+// unpacks, to protect against archive bombs: `maxSize` is the maximum
+// total size of the files in an archive in bytes, and `maxEntries` is the
+// maximum number of entries. Archives which exceed these limits are
+// rejected with an INVALID_ARGUMENT status. Zero means the default: the
+// disk cache's maximum size, and 1000000 entries.
+func WithAssetDirectoryLimits(maxSize int64, maxEntries int) AssetOption {
+	return func(c *assetConfig) error {
+		if maxSize < 0 || maxEntries < 0 {
+			return fmt.Errorf("Invalid negative asset directory limit")
+		}
+
+		c.maxUnpackedSize = maxSize
+		if maxEntries > 0 {
+			c.maxArchiveEntries = maxEntries
+		}
+		return nil
+	}
+}
+
+// WithAssetDirectoryMaxNodes limits the total number of files,
+// directories and symlinks in the trees returned by FetchDirectory to
+// `n`, including directories which are not archive entries themselves.
+// Archives are checked before anything is stored in the CAS, which means
+// that they are read twice, and larger trees are rejected with an
+// INVALID_ARGUMENT status.
+func WithAssetDirectoryMaxNodes(n int) AssetOption {
+	return func(c *assetConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid maximum number of directory tree nodes: %d", n)
+		}
+
+		c.maxTreeNodes = n
+		return nil
+	}
+}
+
+// WithAssetDirectoryMaxUnpacks limits the number of archives that
+// FetchDirectory unpacks at the same time to `n`. Other requests wait for
+// one of the unpacks to finish, or until they're cancelled.
+func WithAssetDirectoryMaxUnpacks(n int) AssetOption {
+	return func(c *assetConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid maximum number of concurrent archive unpacks: %d", n)
+		}
+
+		c.unpacks = semaphore.NewWeighted(int64(n))
+		return nil
+	}
+}
+
+// WithAssetFetchDecodeContentEncoding sets whether the content of asset
+// fetch responses with a Content-Encoding, eg gzip, is decoded before it
+// is hashed and stored, for requests without a decode_content_encoding
+// qualifier. The default is to store the content as received.
+func WithAssetFetchDecodeContentEncoding(decode bool) AssetOption {
+	return func(c *assetConfig) error {
+		c.decodeContentEncoding = decode
+		return nil
+	}
+}
+
+// WithAssetPushVerification enables background verification of blobs
+// associated with URIs by PushBlob. The URIs are downloaded one at a time,
+// at most once per `interval`, and associations whose content doesn't
+// match are removed from the index. Downloads that fail are inconclusive,
+// and the association is kept.
+func WithAssetPushVerification(interval time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("Invalid asset push verification interval: %s", interval)
+		}
+
+		c.pushVerifications = make(chan pushVerification, maxQueuedPushVerifications)
+		c.pushVerifyInterval = interval
+		return nil
+	}
+}
+
+// WithAssetFetchHeadProbe makes asset fetches send a HEAD request before
+// downloading a URI, to check that it is available and learn its size.
+// Servers which reject HEAD requests are sent a GET request for the first
+// byte instead. URIs which are missing, or whose size is larger than the
+// maximum size or differs from an expected_size qualifier are skipped
+// without downloading them, as are URIs whose content is already in the
+// CAS under the expected checksum.
+func WithAssetFetchHeadProbe() AssetOption {
+	return func(c *assetConfig) error {
+		c.headProbe = true
+		return nil
+	}
+}
+
+// WithAssetFetchMinTLSVersion sets the minimum TLS version for asset
+// fetches, eg tls.VersionTLS13. The default is TLS 1.2. This also applies
+// to hosts with custom TLS settings.
+func WithAssetFetchMinTLSVersion(version uint16) AssetOption {
+	return func(c *assetConfig) error {
+		if version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+			return fmt.Errorf("Invalid asset fetch minimum TLS version: %#x", version)
+		}
+
+		c.minTLSVersion = version
+		return nil
+	}
+}
+
+// WithAssetFetchHTTPSOnly restricts asset fetches to https URIs.
+func WithAssetFetchHTTPSOnly() AssetOption {
+	return func(c *assetConfig) error {
+		c.httpsOnly = true
+		return nil
+	}
+}
+
+// WithAssetFetchAllowedExtensions restricts asset fetches to URIs whose
+// path ends with one of the given file extensions, eg ".tar.gz". The
+// comparison is case-insensitive. If no extensions are given, all URIs
+// are allowed.
+func WithAssetFetchAllowedExtensions(extensions []string) AssetOption {
+	return func(c *assetConfig) error {
+		for _, ext := range extensions {
+			if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+				return fmt.Errorf("Invalid asset fetch file extension: %q", ext)
+			}
+
+			c.allowedExtensions = append(c.allowedExtensions, strings.ToLower(ext))
+		}
+		return nil
+	}
+}
+
+// WithAssetFetchAllowedHosts restricts asset fetches, including redirects,
+// to URIs whose host is one of the given hostnames or IP addresses, or
+// matches a pattern like "*.example.com", which matches any subdomain of
+// example.com. The comparison is case-insensitive. If no hosts are given,
+// all hosts are allowed.
+func WithAssetFetchAllowedHosts(hosts []string) AssetOption {
+	return func(c *assetConfig) error {
+		for _, host := range hosts {
+			name := strings.TrimPrefix(host, "*.")
+			if name == "" || strings.ContainsAny(name, "/:*") {
+				return fmt.Errorf("Invalid asset fetch allowed host: %q", host)
+			}
+
+			c.hostPolicy.allowedHosts = append(c.hostPolicy.allowedHosts, strings.ToLower(host))
+		}
+		return nil
+	}
+}
+
+// WithAssetFetchBlockedNetworks prevents asset fetches from connecting to
+// addresses in any of the given CIDR networks, eg "10.0.0.0/8". Addresses
+// are checked after DNS resolution, so this also applies to hostnames
+// which resolve to these networks, to redirects and to rewritten hosts.
+// If an HTTP proxy is used (eg because HTTPS_PROXY is set), the target
+// hostname is resolved and checked before the request is sent to the
+// proxy. Without this option no networks are blocked, but note that the
+// asset_fetch_blocked_networks configuration setting has a default.
+func WithAssetFetchBlockedNetworks(networks []string) AssetOption {
+	return func(c *assetConfig) error {
+		for _, network := range networks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return fmt.Errorf("Invalid asset fetch blocked network: %w", err)
+			}
+
+			c.hostPolicy.blockedNetworks = append(c.hostPolicy.blockedNetworks, ipNet)
+		}
+		return nil
+	}
+}
+
+// Returns true if the given URI path may be fetched, according to the
+// allowedExtensions setting.
+func (c *assetConfig) extensionAllowed(path string) bool {
+	if len(c.allowedExtensions) == 0 {
+		return true
+	}
+
+	path = strings.ToLower(path)
+	for _, ext := range c.allowedExtensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Limits on FetchBlob requests, to protect against abusive clients.
+type assetRequestLimits struct {
+	// The maximum encoded size of a request, in bytes.
+	maxRequestSize int
+
+	// The maximum number of URIs and qualifiers in a request.
+	maxURIs       int
+	maxQualifiers int
+
+	// The maximum length of a single qualifier value, in bytes.
+	maxQualifierValueLength int
+}
+
+// WithAssetRequestLimits sets limits on the encoded size of FetchBlob
+// requests in bytes, the number of URIs and qualifiers they contain, and
+// the length of each qualifier value. Requests which exceed these limits
+// are rejected without fetching anything. Zero means no limit.
+func WithAssetRequestLimits(maxRequestSize int, maxURIs int, maxQualifiers int, maxQualifierValueLength int) AssetOption {
+	return func(c *assetConfig) error {
+		if maxRequestSize < 0 || maxURIs < 0 || maxQualifiers < 0 || maxQualifierValueLength < 0 {
+			return fmt.Errorf("Invalid negative asset request limit")
+		}
+
+		c.limits = assetRequestLimits{
+			maxRequestSize:          maxRequestSize,
+			maxURIs:                 maxURIs,
+			maxQualifiers:           maxQualifiers,
+			maxQualifierValueLength: maxQualifierValueLength,
+		}
+		return nil
+	}
+}
+
+// WithAssetFetchRetryBudget sets the total number of retries of transient
+// fetch failures (connection errors, and 429, 502, 503 and 504 responses)
+// allowed per FetchBlob call, shared by all of the URIs in the request.
+// The default is 0, ie no retries unless WithAssetFetchRetries is used.
+func WithAssetFetchRetryBudget(retries int) AssetOption {
+	return func(c *assetConfig) error {
+		if retries < 0 {
+			return fmt.Errorf("Invalid asset fetch retry budget: %d", retries)
+		}
+
+		c.retryBudget = retries
+		return nil
+	}
+}
+
+// WithAssetFetchRetries sets the maximum number of retries of transient
+// fetch failures for each URI in a FetchBlob request. Retries are made
+// after an exponentially increasing delay with jitter, or the delay from
+// the upstream server's Retry-After header. If a retry budget is also set,
+// whichever limit is reached first applies.
+func WithAssetFetchRetries(retries int) AssetOption {
+	return func(c *assetConfig) error {
+		if retries < 0 {
+			return fmt.Errorf("Invalid asset fetch retries: %d", retries)
+		}
+
+		c.fetchRetries = retries
+		return nil
+	}
+}
+
+// WithAssetFetchConcurrency makes FetchBlob download up to `concurrency`
+// of a request's URIs at the same time, instead of trying them one after
+// another, and return as soon as one of them is fetched. URIs earlier in
+// the request are still preferred if several succeed at about the same
+// time. The default is 1.
+func WithAssetFetchConcurrency(concurrency int) AssetOption {
+	return func(c *assetConfig) error {
+		if concurrency < 0 {
+			return fmt.Errorf("Invalid asset fetch concurrency: %d", concurrency)
+		}
+
+		c.fetchConcurrency = concurrency
+		return nil
+	}
+}
+
+// WithAssetFetchAllowSizeChange allows a retried fetch to succeed when
+// the upstream server reports a different size than a previous attempt,
+// even if there is no checksum to verify the content. By default such
+// fetches fail, since the content may have changed between attempts.
+func WithAssetFetchAllowSizeChange() AssetOption {
+	return func(c *assetConfig) error {
+		c.allowSizeChange = true
+		return nil
+	}
+}
+
+// WithAssetFetchNotFoundWindow makes URIs which return 404 or 410 be
+// skipped by other FetchBlob requests for `window`, even if the requests
+// have different sets of URIs. This avoids repeatedly trying a mirror
+// which is missing a file that is available elsewhere. Requests can
+// bypass this with the "bazel-remote-asset-bypass-not-found" metadata key.
+func WithAssetFetchNotFoundWindow(window time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if window <= 0 {
+			return fmt.Errorf("Invalid asset fetch not found window: %v", window)
+		}
+
+		c.notFound = newAssetNotFoundCache(window)
+		return nil
+	}
+}
+
+// WithAssetFetchMismatchWindow makes FetchBlob requests try URIs on hosts
+// which served content that didn't match the expected checksum after
+// their other URIs for `window`, even if the requests have different
+// sets of URIs. Without this, URIs are always tried in the order given,
+// so a mirror with a corrupt copy of a file is downloaded from first by
+// every request that lists it first.
+func WithAssetFetchMismatchWindow(window time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if window <= 0 {
+			return fmt.Errorf("Invalid asset fetch mismatch window: %v", window)
+		}
+
+		c.mismatches = newAssetMismatchCache(window)
+		return nil
+	}
+}
+
+// WithAssetFetchHostCircuitBreaker makes FetchBlob requests skip URIs on
+// hosts which failed `failures` times in a row with transient errors, eg
+// connection errors or 5xx responses, for `cooldown`. After that a single
+// attempt is allowed, and the host is used again if it succeeds. Without
+// this, URIs on hosts which are down are tried, and retried, by every
+// request that lists them.
+func WithAssetFetchHostCircuitBreaker(failures int, cooldown time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if failures <= 0 {
+			return fmt.Errorf("Invalid asset fetch host circuit breaker failures: %d", failures)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("Invalid asset fetch host circuit breaker cooldown: %v", cooldown)
+		}
+
+		c.breaker = newAssetHostBreaker(failures, cooldown)
+		return nil
+	}
+}
+
+// WithAssetFetchChecksumSidecarSuffix enables checksum verification of
+// FetchBlob requests which don't have a checksum.sri qualifier, using a
+// sha256 checksum downloaded from a sidecar file whose URL is the asset's
+// URL with `suffix` (eg ".sha256") appended to the path.
+func WithAssetFetchChecksumSidecarSuffix(suffix string) AssetOption {
+	return func(c *assetConfig) error {
+		if suffix == "" {
+			return fmt.Errorf("Invalid empty checksum sidecar suffix")
+		}
+
+		c.checksumSidecarSuffix = suffix
+		return nil
+	}
+}
+
+// WithAssetAdminService registers the asset admin service with the gRPC
+// server, which reports the internal state of the remote asset API, see
+// AssetAdminClient. If authentication is enabled it's required for the
+// admin service, even if unauthenticated reads are allowed.
+func WithAssetAdminService() AssetOption {
+	return func(c *assetConfig) error {
+		c.adminService = true
+		return nil
+	}
+}
+
+// WithAssetAdminLocalDirectories enables the asset admin service's
+// PushLocalDirectory method, which stores directories from the server's
+// filesystem in the CAS, limited to `dirs` and their subdirectories. Any
+// client which can call the method can read the files in them, so it must
+// only be used if the gRPC server requires authentication for writes. It
+// has no effect without WithAssetAdminService.
+func WithAssetAdminLocalDirectories(dirs ...string) AssetOption {
+	return func(c *assetConfig) error {
+		for _, dir := range dirs {
+			if !filepath.IsAbs(dir) {
+				return fmt.Errorf("Invalid asset admin local directory, expected an absolute path: %q", dir)
+			}
+
+			resolved, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return fmt.Errorf("Invalid asset admin local directory %q: %w", dir, err)
+			}
+			c.adminLocalDirs = append(c.adminLocalDirs, resolved)
+		}
+
+		return nil
+	}
+}
+
+// WithAssetFetchTempBudget limits the total size of asset downloads that
+// are written to temporary files in the cache at the same time. Fetches
+// which would exceed the limit wait for other fetches to finish first,
+// and fetches larger than the limit fail.
+func WithAssetFetchTempBudget(size int64) AssetOption {
+	return func(c *assetConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid asset fetch temporary file budget: %d", size)
+		}
+
+		c.tempBudget = newAssetTempBudget(size)
+		return nil
+	}
+}
+
+// WithAssetTempDir makes downloads which don't fit in memory, and the
+// temporary files written while unpacking archives, be stored in `dir`
+// instead of the default directory for temporary files. The directory is
+// created if it doesn't exist.
+func WithAssetTempDir(dir string) AssetOption {
+	return func(c *assetConfig) error {
+		if dir == "" {
+			return fmt.Errorf("Invalid empty asset temporary file directory")
+		}
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create asset temporary file directory: %w", err)
+		}
+
+		c.tempDir = dir
+		return nil
+	}
+}
+
+// WithAssetFetchQuarantineDir makes asset fetches which fail checksum
+// verification store the downloaded content in `dir`, along with an
+// index of the URIs and expected hashes, instead of discarding it. Note
+// that this requires all downloads to be spooled to a temporary file (or
+// memory, if they are small) before they are verified.
+func WithAssetFetchQuarantineDir(dir string) AssetOption {
+	return func(c *assetConfig) error {
+		if dir == "" {
+			return fmt.Errorf("Invalid empty asset fetch quarantine directory")
+		}
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create asset fetch quarantine directory: %w", err)
+		}
+
+		c.quarantine = &assetQuarantine{dir: dir}
+		return nil
+	}
+}
+
+// WithAssetIndex sets the index used to store associations from PushBlob
+// and PushDirectory requests, and the results of fetches without a
+// checksum. By default they are only kept in memory.
+func WithAssetIndex(index *assetindex.Index) AssetOption {
+	return func(c *assetConfig) error {
+		if index == nil {
+			return fmt.Errorf("Invalid nil asset index")
+		}
+
+		c.index = index
+		return nil
+	}
+}
+
+// WithAssetFetchTTL makes the results of fetches without a checksum be
+// reused by later requests for the same URI and qualifiers, for up to
+// `ttl`. Requests can override this with a "bazel_request.requested_timeout"
+// qualifier.
+func WithAssetFetchTTL(ttl time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if ttl <= 0 {
+			return fmt.Errorf("Invalid asset fetch TTL: %v", ttl)
+		}
+
+		c.fetchTTL = ttl
+		return nil
+	}
+}
+
+// WithAssetFetchTimeout limits the time taken by each attempt to fetch a
+// URI, including reading the response body. If no URI can be fetched and
+// an attempt timed out, FetchBlob returns a DEADLINE_EXCEEDED status.
+func WithAssetFetchTimeout(timeout time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid asset fetch timeout: %v", timeout)
+		}
+
+		c.fetchTimeout = timeout
+		return nil
+	}
+}
+
+// WithAssetFetchRequestTimeout limits the total time that a FetchBlob
+// request spends fetching its URIs, including retries. Once it has
+// passed, the remaining URIs are skipped and FetchBlob returns a
+// DEADLINE_EXCEEDED status. Requests with a shorter
+// bazel_request.requested_timeout qualifier are limited by that instead.
+func WithAssetFetchRequestTimeout(timeout time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid asset fetch request timeout: %v", timeout)
+		}
+
+		c.requestTimeout = timeout
+		return nil
+	}
+}
+
+// WithAssetFetchRewrite sends asset fetches for URIs on `host` (either a
+// hostname, matching any port, or host:port) to `target` instead, eg an
+// internal caching proxy. The scheme and host of the URI are replaced by
+// those of `target`, and the URI's path is appended to `target`'s path.
+func WithAssetFetchRewrite(host string, target *url.URL) AssetOption {
+	return func(c *assetConfig) error {
+		if host == "" {
+			return fmt.Errorf("Invalid empty asset fetch rewrite host")
+		}
+		if target == nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("Invalid asset fetch rewrite target for host %s: %v", host, target)
+		}
+
+		if c.rewrites == nil {
+			c.rewrites = make(map[string]*url.URL)
+		}
+		c.rewrites[host] = target
+		return nil
+	}
+}
+
+// Returns the URL that requests for u should be sent to, according to
+// the rewrites setting. If there is no matching rewrite, u is returned.
+func (c *assetConfig) rewriteURL(u *url.URL) *url.URL {
+	target, ok := c.rewrites[u.Host]
+	if !ok {
+		target, ok = c.rewrites[u.Hostname()]
+		if !ok {
+			return u
+		}
+	}
+
+	rewritten := *u
+	rewritten.Scheme = target.Scheme
+	rewritten.Host = target.Host
+	rewritten.User = target.User
+	rewritten.Path = strings.TrimRight(target.Path, "/") + u.Path
+	rewritten.RawPath = ""
+
+	return &rewritten
+}
+
+// WithAssetFetchHostRegion records that `host` (either a hostname,
+// matching any port, or host:port) serves `region`. URIs on hosts in
+// the preferred region are tried before the other URIs in a request.
+func WithAssetFetchHostRegion(host string, region string) AssetOption {
+	return func(c *assetConfig) error {
+		if host == "" || region == "" {
+			return fmt.Errorf("Invalid asset fetch host region: %q %q", host, region)
+		}
+
+		if c.hostRegions == nil {
+			c.hostRegions = make(map[string]string)
+		}
+		c.hostRegions[host] = region
+		return nil
+	}
+}
+
+// WithAssetFetchHostMaxSize limits the size of assets fetched from `host`
+// (either a hostname, matching any port, or host:port) to `size` bytes.
+// Larger responses are rejected, without downloading them if the size is
+// known in advance.
+func WithAssetFetchHostMaxSize(host string, size int64) AssetOption {
+	return func(c *assetConfig) error {
+		if host == "" || size <= 0 {
+			return fmt.Errorf("Invalid asset fetch host max size: %q %d", host, size)
+		}
+
+		if c.hostMaxSizes == nil {
+			c.hostMaxSizes = make(map[string]int64)
+		}
+		c.hostMaxSizes[host] = size
+		return nil
+	}
+}
+
+// Returns the maximum size of assets fetched from the host of u, or -1
+// if there is no host specific limit.
+func (c *assetConfig) hostMaxSize(u *url.URL) int64 {
+	size, ok := c.hostMaxSizes[u.Host]
+	if !ok {
+		size, ok = c.hostMaxSizes[u.Hostname()]
+		if !ok {
+			return -1
+		}
+	}
+
+	return size
+}
+
+// WithAssetFetchMaxSize limits the size of assets fetched from any host
+// to `size` bytes. Larger responses are rejected, without downloading
+// them if the size is known in advance. Host specific limits set by
+// WithAssetFetchHostMaxSize only apply if they are smaller.
+func WithAssetFetchMaxSize(size int64) AssetOption {
+	return func(c *assetConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid asset fetch max size: %d", size)
+		}
+
+		c.maxSize = size
+		return nil
+	}
+}
+
+// Returns the maximum size of assets fetched from the host of u, or -1
+// if there is no limit.
+func (c *assetConfig) fetchMaxSize(u *url.URL) int64 {
+	size := c.hostMaxSize(u)
+	if c.maxSize > 0 && (size < 0 || c.maxSize < size) {
+		size = c.maxSize
+	}
+
+	return size
+}
+
+// WithAssetFetchHostMaxRedirects limits the number of redirects from
+// `host` (either a hostname, matching any port, or host:port) that are
+// followed by each fetch to `limit`, which can be zero to reject all
+// redirects from the host. The limit of 10 redirects per fetch still
+// applies. This is useful for hosts which are known to redirect in a loop.
+func WithAssetFetchHostMaxRedirects(host string, limit int) AssetOption {
+	return func(c *assetConfig) error {
+		if host == "" || limit < 0 {
+			return fmt.Errorf("Invalid asset fetch host max redirects: %q %d", host, limit)
+		}
+
+		if c.hostMaxRedirects == nil {
+			c.hostMaxRedirects = make(map[string]int)
+		}
+		c.hostMaxRedirects[host] = limit
+		return nil
+	}
+}
+
+// Returns the maximum number of redirects followed from the host of u.
+func (c *assetConfig) redirectLimit(u *url.URL) int {
+	limit, ok := c.hostMaxRedirects[u.Host]
+	if !ok {
+		limit, ok = c.hostMaxRedirects[u.Hostname()]
+		if !ok {
+			return maxAssetFetchRedirects
+		}
+	}
+
+	return limit
+}
+
+// WithAssetFetchRegion sets the preferred region for asset fetches, which
+// is used unless the client specifies a different region in the request
+// metadata.
+func WithAssetFetchRegion(region string) AssetOption {
+	return func(c *assetConfig) error {
+		c.region = region
+		return nil
+	}
+}
+
+// Returns the region of the host in `uri`, or an empty string if it is
+// unknown.
+func (c *assetConfig) uriRegion(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	region, ok := c.hostRegions[u.Host]
+	if !ok {
+		region = c.hostRegions[u.Hostname()]
+	}
+
+	return region
+}
+
+// Returns `uris`, reordered so that those in `region` come first. The
+// relative order of the URIs is otherwise unchanged.
+func (c *assetConfig) orderByRegion(uris []string, region string) []string {
+	if region == "" || len(c.hostRegions) == 0 {
+		return uris
+	}
+
+	ordered := make([]string, 0, len(uris))
+	var others []string
+
+	for _, uri := range uris {
+		if c.uriRegion(uri) == region {
+			ordered = append(ordered, uri)
+		} else {
+			others = append(others, uri)
+		}
+	}
+
+	return append(ordered, others...)
+}
+
+// WithAssetFetchTransportTimeouts sets the maximum time that asset fetches
+// may take to connect to a host, to complete the TLS handshake, and to
+// receive the response headers after sending the request. These do not
+// limit the time taken to download the response body. Zero values leave
+// the net/http defaults unchanged.
+func WithAssetFetchTransportTimeouts(connect, tlsHandshake, responseHeader time.Duration) AssetOption {
+	return func(c *assetConfig) error {
+		if connect < 0 || tlsHandshake < 0 || responseHeader < 0 {
+			return fmt.Errorf("Invalid negative asset fetch transport timeout: %v, %v, %v",
+				connect, tlsHandshake, responseHeader)
+		}
+
+		c.connectTimeout = connect
+		c.tlsHandshakeTimeout = tlsHandshake
+		c.responseHeaderTimeout = responseHeader
+		return nil
+	}
+}
+
+// WithAssetFetchMaxResponseHeaderBytes limits the size of the response
+// headers that upstream servers can send for asset fetches. URIs whose
+// responses exceed the limit are skipped. The default is the net/http
+// default, currently 1MiB.
+func WithAssetFetchMaxResponseHeaderBytes(size int64) AssetOption {
+	return func(c *assetConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid asset fetch max response header size: %d", size)
+		}
+
+		c.maxResponseHeaderBytes = size
+		return nil
+	}
+}
+
+// WithAssetFetchMaxConnsPerHost limits the number of connections that
+// asset fetches open to each upstream host, including idle connections.
+// Requests which would exceed the limit wait for a connection to become
+// available. This is separate from the number of URIs fetched at the
+// same time, and by default there is no limit.
+func WithAssetFetchMaxConnsPerHost(conns int) AssetOption {
+	return func(c *assetConfig) error {
+		if conns <= 0 {
+			return fmt.Errorf("Invalid asset fetch max connections per host: %d", conns)
+		}
+
+		c.maxConnsPerHost = conns
+		return nil
+	}
+}
+
+// WithAssetFetchTracker records the downloads that are in progress in
+// tracker, which can be served over HTTP for debugging.
+func WithAssetFetchTracker(tracker *AssetFetchTracker) AssetOption {
+	return func(c *assetConfig) error {
+		if tracker == nil {
+			return fmt.Errorf("Invalid nil asset fetch tracker")
+		}
+
+		c.tracker = tracker
+		return nil
+	}
+}
+
+// WithAssetFetchBufferSize sets the size of the buffer used to copy and
+// hash downloads. Larger buffers reduce the number of system calls, which
+// can increase throughput on fast networks and disks. The default is
+// 32KiB, the same as io.Copy.
+func WithAssetFetchBufferSize(size int) AssetOption {
+	return func(c *assetConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid asset fetch buffer size: %d", size)
+		}
+
+		c.bufferSize = size
+		return nil
+	}
+}
+
+// WithAssetFetchTLSConfig uses tlsConfig for asset fetches from host, which
+// can either be a hostname (matching any port) or host:port. Other hosts
+// are verified using the default settings.
+func WithAssetFetchTLSConfig(host string, tlsConfig *tls.Config) AssetOption {
+	if tlsConfig == nil {
+		return func(c *assetConfig) error {
+			return fmt.Errorf("Invalid nil TLS config for asset fetch host: %s", host)
+		}
+	}
+
+	return WithAssetFetchTLSConfigLoader(host, func() (*tls.Config, error) {
+		return tlsConfig, nil
+	})
+}
+
+// WithAssetFetchTLSConfigLoader is like WithAssetFetchTLSConfig, but the
+// TLS settings are returned by `load`, which is called when the server
+// starts and again each time the settings are reloaded (see
+// WithAssetFetchTLSReload).
+func WithAssetFetchTLSConfigLoader(host string, load func() (*tls.Config, error)) AssetOption {
+	return func(c *assetConfig) error {
+		if host == "" {
+			return fmt.Errorf("Invalid empty asset fetch host")
+		}
+		if load == nil {
+			return fmt.Errorf("Invalid nil TLS config loader for asset fetch host: %s", host)
+		}
+
+		if c.hostTLSLoaders == nil {
+			c.hostTLSLoaders = make(map[string]func() (*tls.Config, error))
+		}
+		c.hostTLSLoaders[host] = load
+		return nil
+	}
+}
+
+// WithAssetFetchTLSReload reloads the per-host TLS settings for asset
+// fetches each time a value is received from `trigger`, eg on SIGHUP.
+// Existing connections are unaffected, but new connections use the
+// reloaded settings. If any of the settings fail to load, the previous
+// settings continue to be used.
+func WithAssetFetchTLSReload(trigger <-chan struct{}) AssetOption {
+	return func(c *assetConfig) error {
+		c.tlsReload = trigger
+		return nil
+	}
+}
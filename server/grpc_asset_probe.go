@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The result of probing a URI before downloading it.
+type probeResult struct {
+	// The size of the content, or -1 if it is unknown.
+	size int64
+
+	// The response headers.
+	header http.Header
+}
+
+// Checks that the content at u is available and tries to learn its size,
+// without downloading it. This sends a HEAD request, or if the server
+// doesn't support HEAD, a GET request for the first byte. Errors are
+// classified in the same way as for the GET request in fetchItem.
+func (s *grpcServer) probeItem(ctx context.Context, u *url.URL, headers http.Header, logURI string) (probeResult, error) {
+	resp, err := s.assetRequest(ctx, http.MethodHead, u, headers, nil)
+	if err != nil {
+		return probeResult{}, s.requestError(logURI, err)
+	}
+	resp.Body.Close()
+
+	s.asset.debugf("GRPC ASSET FETCH %s HEAD %s", logURI, resp.Status)
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return s.probeItemRange(ctx, u, headers, logURI)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return probeResult{}, responseStatusError(resp)
+	}
+
+	return probeResult{size: resp.ContentLength, header: resp.Header}, nil
+}
+
+// Probes u with a GET request for the first byte of the content, for
+// servers that reject HEAD requests.
+func (s *grpcServer) probeItemRange(ctx context.Context, u *url.URL, headers http.Header, logURI string) (probeResult, error) {
+	rangeHeaders := make(http.Header)
+	if headers != nil {
+		rangeHeaders = headers.Clone()
+	}
+	rangeHeaders.Set("Range", "bytes=0-0")
+
+	resp, err := s.assetRequest(ctx, http.MethodGet, u, rangeHeaders, nil)
+	if err != nil {
+		return probeResult{}, s.requestError(logURI, err)
+	}
+	// If the server ignored the Range header, this abandons the download.
+	resp.Body.Close()
+
+	s.asset.debugf("GRPC ASSET FETCH %s RANGE %s", logURI, resp.Status)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return probeResult{size: resp.ContentLength, header: resp.Header}, nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// A 416 response is expected for empty content.
+		return probeResult{size: contentRangeSize(resp.Header), header: resp.Header}, nil
+	}
+
+	return probeResult{}, responseStatusError(resp)
+}
+
+// Returns the complete length from a Content-Range header, eg 1234 for
+// "bytes 0-0/1234" or 0 for "bytes */0", or -1 if it is unknown.
+func contentRangeSize(header http.Header) int64 {
+	_, length, found := strings.Cut(header.Get("Content-Range"), "/")
+	if !found {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+
+	return size
+}
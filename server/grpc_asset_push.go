@@ -0,0 +1,792 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+	"github.com/buchgr/bazel-remote/v2/utils/validate"
+)
+
+var (
+	errNilPushBlobRequest = status.Error(codes.InvalidArgument,
+		"expected a non-nil *PushBlobRequest")
+	errNilPushDirectoryRequest = status.Error(codes.InvalidArgument,
+		"expected a non-nil *PushDirectoryRequest")
+)
+
+// PushBlob associates the request's URIs and qualifiers with a blob that
+// is already in the CAS, so that later FetchBlob requests with the same
+// URI and qualifiers return it without downloading anything. With an
+// entry_kind=ac qualifier the digest refers to an action cache entry
+// instead.
+func (s *grpcServer) PushBlob(ctx context.Context, req *asset.PushBlobRequest) (*asset.PushBlobResponse, error) {
+	if req == nil {
+		return nil, errNilPushBlobRequest
+	}
+
+	entryKind, err := requestedEntryKind(req.GetQualifiers())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = s.pushAsset(ctx, assetindex.Blob, entryKind, req.GetUris(), req.GetQualifiers(),
+		req.GetExpireAt(), req.GetBlobDigest())
+	if err != nil {
+		return nil, err
+	}
+
+	return &asset.PushBlobResponse{}, nil
+}
+
+// PushDirectory associates the request's URIs and qualifiers with a
+// Directory that is already in the CAS, so that later FetchDirectory
+// requests with the same URI and qualifiers return it without downloading
+// anything.
+func (s *grpcServer) PushDirectory(ctx context.Context, req *asset.PushDirectoryRequest) (*asset.PushDirectoryResponse, error) {
+	if req == nil {
+		return nil, errNilPushDirectoryRequest
+	}
+
+	entryKind, err := requestedEntryKind(req.GetQualifiers())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if entryKind != cache.CAS {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"directories can only be pushed to the CAS, not %s", entryKind)
+	}
+
+	err = s.pushAsset(ctx, assetindex.Directory, entryKind, req.GetUris(), req.GetQualifiers(),
+		req.GetExpireAt(), req.GetRootDirectoryDigest())
+	if err != nil {
+		return nil, err
+	}
+
+	return &asset.PushDirectoryResponse{}, nil
+}
+
+// The gRPC request metadata keys that clients can set on a ByteStream
+// Write to associate the uploaded blob with URIs once the upload has
+// completed, as if by a PushBlob request, so that content is uploaded and
+// pushed in one flow. Qualifiers are given as "name=value".
+const (
+	assetPushURIKey       = "bazel-remote-asset-push-uri"
+	assetPushQualifierKey = "bazel-remote-asset-push-qualifier"
+)
+
+// Returns the URIs and qualifiers which the client asked a ByteStream
+// Write to push the uploaded blob with, if any.
+func (s *grpcServer) writePushRequest(ctx context.Context) ([]string, []*asset.Qualifier, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	uris := md.Get(assetPushURIKey)
+	values := md.Get(assetPushQualifierKey)
+	if len(uris) == 0 {
+		if len(values) > 0 {
+			return nil, nil, status.Errorf(codes.InvalidArgument,
+				"%s requires %s", assetPushQualifierKey, assetPushURIKey)
+		}
+		return nil, nil, nil
+	}
+
+	if !s.asset.enabled {
+		return nil, nil, status.Errorf(codes.InvalidArgument,
+			"%s requires the remote asset API", assetPushURIKey)
+	}
+
+	qualifiers := make([]*asset.Qualifier, 0, len(values))
+	for _, v := range values {
+		name, value, found := strings.Cut(v, "=")
+		if !found || name == "" {
+			return nil, nil, status.Errorf(codes.InvalidArgument,
+				"invalid %s, expected name=value: %q", assetPushQualifierKey, v)
+		}
+		qualifiers = append(qualifiers, &asset.Qualifier{Name: name, Value: value})
+	}
+
+	return uris, qualifiers, nil
+}
+
+// Associates the CAS blob uploaded by a ByteStream Write of resourceName
+// with the URIs and qualifiers from writePushRequest.
+func (s *grpcServer) pushWrittenBlob(ctx context.Context, resourceName string,
+	uris []string, qualifiers []*asset.Qualifier) error {
+
+	hash, size, _, err := s.parseWriteResource(resourceName)
+	if err != nil {
+		return err
+	}
+
+	return s.pushAsset(ctx, assetindex.Blob, cache.CAS, uris, qualifiers, nil,
+		&pb.Digest{Hash: hash, SizeBytes: size})
+}
+
+func (s *grpcServer) pushAsset(ctx context.Context, kind assetindex.Kind, entryKind cache.EntryKind, uris []string,
+	qualifiers []*asset.Qualifier, expireAt *timestamppb.Timestamp, digest *pb.Digest) error {
+
+	if len(uris) == 0 {
+		return status.Errorf(codes.InvalidArgument, "expected at least one URI to push %s", kind)
+	}
+	for i, uri := range uris {
+		err := validateFetchURI(uri)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid URI at index %d: %v", i, err)
+		}
+	}
+	for _, q := range qualifiers {
+		if q == nil {
+			return status.Error(codes.InvalidArgument, "unexpected nil qualifier")
+		}
+	}
+
+	if digest == nil {
+		return status.Errorf(codes.InvalidArgument, "expected a %s digest", kind)
+	}
+	if !validate.HashKeyRegex.MatchString(digest.Hash) || digest.SizeBytes < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid %s digest: %s/%d",
+			kind, digest.Hash, digest.SizeBytes)
+	}
+
+	if !s.containsIndexedDigest(ctx, entryKind, digest.Hash, digest.SizeBytes) {
+		return status.Errorf(codes.InvalidArgument, "%s %s/%d not found in the %s",
+			kind, digest.Hash, digest.SizeBytes, entryKind)
+	}
+
+	err := s.verifyPushedChecksums(ctx, kind, entryKind, qualifiers, digest)
+	if err != nil {
+		return err
+	}
+
+	entry := assetindex.Entry{
+		Hash:           digest.Hash,
+		Size:           digest.SizeBytes,
+		DigestFunction: pb.DigestFunction_SHA256.String(),
+	}
+	if expireAt != nil {
+		err := expireAt.CheckValid()
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid expire_at: %v", err)
+		}
+		entry.ExpiresAt = expireAt.AsTime()
+	}
+
+	// Requests which list the same set of URIs find the association with
+	// a single lookup, others by any one of the URIs.
+	setKey := uriSetKey(kind, uris, qualifiers)
+	err = s.asset.index.Put(setKey, entry)
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET PUSH %s %v FAILED: %v", kind, uris, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for _, uri := range uniqueURIs(uris) {
+		key := associationKey(kind, uri, qualifiers)
+		if key != setKey {
+			err := s.asset.index.Put(key, entry)
+			if err != nil {
+				s.errorLogger.Printf("GRPC ASSET PUSH %s %s FAILED: %v", kind, uri, err)
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		s.accessLogger.Printf("GRPC ASSET PUSH %s %s %s/%d", kind, uri,
+			digest.Hash, digest.SizeBytes)
+
+		if kind == assetindex.Blob && entryKind == cache.CAS {
+			s.queuePushVerification(key, setKey, uri, digest)
+		}
+	}
+
+	return nil
+}
+
+// Returns an InvalidArgument error unless the pushed content matches
+// each of the checksum.sri qualifiers, since fetches with the same
+// checksum would otherwise return content which doesn't match it.
+func (s *grpcServer) verifyPushedChecksums(ctx context.Context, kind assetindex.Kind, entryKind cache.EntryKind,
+	qualifiers []*asset.Qualifier, digest *pb.Digest) error {
+
+	for _, q := range qualifiers {
+		if q.Name != "checksum.sri" {
+			continue
+		}
+
+		if entryKind != cache.CAS {
+			return status.Errorf(codes.InvalidArgument,
+				"checksum.sri qualifiers are not supported for %s entries", entryKind)
+		}
+
+		algo, hexHash, err := parseSRI(q.Value)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		var matches bool
+		if kind == assetindex.Directory {
+			matches, err = s.directoryMatchesChecksum(ctx, digest, algo, hexHash)
+		} else {
+			matches, err = s.blobMatchesChecksum(ctx, digest, algo, hexHash)
+		}
+		if err != nil {
+			return err
+		}
+		if !matches {
+			return status.Errorf(codes.InvalidArgument, "%s %s/%d does not match %s=%s",
+				kind, digest.Hash, digest.SizeBytes, q.Name, q.Value)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the blob in the CAS with the given digest has the hex
+// encoded hash `hexHash` when hashed with `algo`. Checksums other than
+// sha256 are verified by reading the blob, and are then indexed like
+// those of fetched content.
+func (s *grpcServer) blobMatchesChecksum(ctx context.Context, digest *pb.Digest, algo string, hexHash string) (bool, error) {
+	if algo == "sha256" {
+		return digest.Hash == hexHash, nil
+	}
+
+	rc, _, err := s.cache.Get(ctx, cache.CAS, digest.Hash, digest.SizeBytes, 0)
+	if err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
+	if rc == nil {
+		return false, status.Errorf(codes.InvalidArgument, "blob %s/%d not found in the CAS",
+			digest.Hash, digest.SizeBytes)
+	}
+	defer rc.Close()
+
+	h := altSRIHashes[algo]()
+	_, err = io.Copy(h, rc)
+	if err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hexHash {
+		return false, nil
+	}
+
+	err = s.asset.index.Put(altChecksumKey(algo, hexHash),
+		assetindex.Entry{
+			Hash:           digest.Hash,
+			Size:           digest.SizeBytes,
+			DigestFunction: pb.DigestFunction_SHA256.String(),
+			Timestamp:      time.Now(),
+		})
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET PUSH failed to index %s-%s: %v", algo, hexHash, err)
+	}
+
+	return true, nil
+}
+
+// Returns true if unpacking the archive with the hex encoded hash
+// `hexHash`, using `algo`, results in the Directory `root`. The archive
+// must be in the CAS, otherwise the checksum can't be verified.
+func (s *grpcServer) directoryMatchesChecksum(ctx context.Context, root *pb.Digest, algo string, hexHash string) (bool, error) {
+	var archive *pb.Digest
+	if algo == "sha256" {
+		size, found := s.casBlobSize(ctx, hexHash)
+		if found {
+			archive = &pb.Digest{Hash: hexHash, SizeBytes: size}
+		}
+	} else {
+		archive, _ = s.lookupAltChecksum(ctx, altChecksum{algo: algo, hash: hexHash})
+	}
+	if archive == nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"can't verify checksum.sri %s-%s, the archive is not in the CAS", algo, hexHash)
+	}
+
+	release, err := s.asset.startUnpack(ctx)
+	if err != nil {
+		return false, status.FromContextError(err).Err()
+	}
+	unpacked, err := s.unpackArchive(ctx, archive)
+	release()
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"can't verify checksum.sri %s-%s, failed to unpack archive: %v", algo, hexHash, err)
+	}
+
+	return unpacked.Hash == root.Hash && unpacked.SizeBytes == root.SizeBytes, nil
+}
+
+// Returns uri with its scheme and host in lower case, since they are case
+// insensitive, so that associations don't depend on how clients spell
+// them. URIs which can't be parsed are returned unchanged.
+func canonicalURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// Returns the canonical form of a set of URIs: the canonicalURI of each
+// of them, without duplicates, sorted.
+func canonicalURIs(uris []string) []string {
+	canonical := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		canonical = append(canonical, canonicalURI(uri))
+	}
+	canonical = uniqueURIs(canonical)
+	sort.Strings(canonical)
+
+	return canonical
+}
+
+// Returns the index key which associates content of the given kind with
+// uri and the qualifiers. Pushed associations are made for each URI, as
+// well as for the set of URIs (see uriSetKey), so that requests which list
+// any of them can find the content.
+func associationKey(kind assetindex.Kind, uri string, qualifiers []*asset.Qualifier) string {
+	return assetindex.Key(kind, canonicalURI(uri), qualifierMap(qualifiers))
+}
+
+// Returns the index key which associates content of the given kind with a
+// set of URIs and the qualifiers, which doesn't depend on the order of the
+// URIs, duplicates or the case of their hosts. Pushes are indexed with
+// this key, and lookups try it before the key of each URI.
+func uriSetKey(kind assetindex.Kind, uris []string, qualifiers []*asset.Qualifier) string {
+	return assetindex.Key(kind, strings.Join(canonicalURIs(uris), "\x00"), qualifierMap(qualifiers))
+}
+
+// The qualifier which clients can use to limit the total time spent
+// fetching the request's URIs. It also overrides the TTL of content that
+// was fetched without a checksum.
+const requestedTimeoutQualifier = "bazel_request.requested_timeout"
+
+// The qualifier which clients can use to push and fetch action cache
+// entries instead of CAS blobs, with the value "ac". The default is "cas".
+const entryKindQualifier = "entry_kind"
+
+// Returns the cache.EntryKind selected by the entryKindQualifier, or
+// cache.CAS if it was not specified.
+func requestedEntryKind(qualifiers []*asset.Qualifier) (cache.EntryKind, error) {
+	for _, q := range qualifiers {
+		if q.GetName() != entryKindQualifier {
+			continue
+		}
+
+		switch q.GetValue() {
+		case "cas":
+			return cache.CAS, nil
+		case "ac":
+			return cache.AC, nil
+		}
+
+		return cache.CAS, fmt.Errorf("invalid %s qualifier: %q, expected \"ac\" or \"cas\"",
+			entryKindQualifier, q.GetValue())
+	}
+
+	return cache.CAS, nil
+}
+
+// Returns true if the digest of an index entry is in the cache. The
+// size of action cache entries is not checked, since the digest is of
+// the Action rather than the ActionResult.
+func (s *grpcServer) containsIndexedDigest(ctx context.Context, kind cache.EntryKind, hash string, size int64) bool {
+	if kind == cache.AC {
+		size = -1
+	}
+
+	found, _ := s.cache.Contains(ctx, kind, hash, size)
+	return found
+}
+
+// Returns the request's qualifiers as a map from name to value, for use
+// in index keys. Qualifiers which don't identify the content are omitted:
+// the requested timeout, HTTP headers (which may contain credentials that
+// change between requests), the expected size, whether to decode the
+// content encoding and the default entry kind.
+func qualifierMap(qualifiers []*asset.Qualifier) map[string]string {
+	m := make(map[string]string, len(qualifiers))
+	for _, q := range qualifiers {
+		switch {
+		case q.GetName() == entryKindQualifier && q.GetValue() == "cas",
+			q.GetName() == requestedTimeoutQualifier,
+			q.GetName() == expectedSizeQualifier,
+			q.GetName() == decodeContentEncodingQualifier,
+			strings.HasPrefix(q.GetName(), httpHeaderQualifierPrefix):
+			continue
+		}
+		m[q.GetName()] = q.GetValue()
+	}
+	return m
+}
+
+// Returns the value of the requestedTimeoutQualifier, either a duration
+// like "5m" or a number of seconds, or zero if it was not specified.
+func requestedTimeout(qualifiers []*asset.Qualifier) (time.Duration, error) {
+	for _, q := range qualifiers {
+		if q.GetName() != requestedTimeoutQualifier {
+			continue
+		}
+
+		d, err := time.ParseDuration(q.GetValue())
+		if err != nil {
+			seconds, err2 := strconv.ParseInt(q.GetValue(), 10, 64)
+			if err2 != nil {
+				return 0, fmt.Errorf("invalid %s qualifier: %q", requestedTimeoutQualifier, q.GetValue())
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid %s qualifier: %q must be positive", requestedTimeoutQualifier, q.GetValue())
+		}
+
+		return d, nil
+	}
+
+	return 0, nil
+}
+
+// Returns the value of the requestedTimeoutQualifier, for use as the
+// maximum age of content that was fetched without a checksum, or zero if
+// it was not specified. Invalid values are ignored, in the same way as
+// for the fetch deadline.
+func requestedMaxAge(qualifiers []*asset.Qualifier) time.Duration {
+	maxAge, err := requestedTimeout(qualifiers)
+	if err != nil {
+		return 0
+	}
+
+	return maxAge
+}
+
+// Returns the time before which index entries are too old for a request,
+// based on its oldest_content_accepted field and requested maximum age.
+// The zero time means that there is no limit.
+func fetchNotBefore(oldest *timestamppb.Timestamp, maxAge time.Duration) time.Time {
+	var notBefore time.Time
+	if oldest != nil {
+		notBefore = oldest.AsTime()
+	}
+
+	if maxAge > 0 {
+		t := time.Now().Add(-maxAge)
+		if t.After(notBefore) {
+			notBefore = t
+		}
+	}
+
+	return notBefore
+}
+
+// The qualifier for content fetched from a version control system at a
+// tag. Unlike branches, tags are expected to always refer to the same
+// commit, so the results of fetches with this qualifier are indexed
+// without an expiry time, even if there is no default TTL. Clients can
+// fetch them again with oldest_content_accepted.
+const vcsTagQualifier = "vcs.tag"
+
+// Returns true if one of qualifiers is called name.
+func hasQualifier(qualifiers []*asset.Qualifier, name string) bool {
+	for _, q := range qualifiers {
+		if q.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the time that the result of a fetch without a checksum which
+// finished at `now` expires from the index, the zero time if it never
+// expires, and false if it shouldn't be indexed. The requested maximum
+// age overrides the default TTL.
+func (s *grpcServer) fetchResultExpiry(qualifiers []*asset.Qualifier, now time.Time) (time.Time, bool) {
+	if hasQualifier(qualifiers, vcsTagQualifier) {
+		return time.Time{}, true
+	}
+
+	ttl := s.asset.fetchTTL
+	maxAge := requestedMaxAge(qualifiers)
+	if maxAge > 0 {
+		ttl = maxAge
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+
+	return now.Add(ttl), true
+}
+
+// Add the result of fetching uri, one of the request's URIs, without a
+// checksum, which started at `started`, to the index, so that it can be
+// reused for the request's TTL, or the default TTL, or indefinitely for
+// tags. It is associated with uri and with the request's set of URIs.
+func (s *grpcServer) indexFetchResult(uri string, uris []string, qualifiers []*asset.Qualifier, result fetchResult, started time.Time) {
+	now := time.Now()
+	expiresAt, ok := s.fetchResultExpiry(qualifiers, now)
+	if !ok {
+		return
+	}
+
+	e := assetindex.Entry{
+		Hash:           result.hash,
+		Size:           result.size,
+		DigestFunction: pb.DigestFunction_SHA256.String(),
+		Timestamp:      started,
+		ExpiresAt:      expiresAt,
+		ContentType:    result.contentType,
+		ETag:           result.etag,
+		LastModified:   result.lastModified,
+	}
+
+	for _, key := range fetchResultKeys(assetindex.Blob, uri, uris, qualifiers) {
+		err := s.indexNewerResult(key, e)
+		if err != nil {
+			s.errorLogger.Printf("GRPC ASSET FETCH %s failed to update the index: %v", uri, err)
+			return
+		}
+	}
+}
+
+// Returns the index keys for the result of fetching uri, one of `uris`.
+func fetchResultKeys(kind assetindex.Kind, uri string, uris []string, qualifiers []*asset.Qualifier) []string {
+	setKey := uriSetKey(kind, uris, qualifiers)
+	key := associationKey(kind, uri, qualifiers)
+	if key == setKey {
+		return []string{key}
+	}
+
+	return []string{setKey, key}
+}
+
+// Add the root of a tree unpacked from an archive fetched from uri to the
+// index, in the same way as indexFetchResult, so that it's not unpacked
+// again.
+func (s *grpcServer) indexDirectoryResult(uri string, uris []string, qualifiers []*asset.Qualifier, root *pb.Digest, started time.Time) {
+	now := time.Now()
+	expiresAt, ok := s.fetchResultExpiry(qualifiers, now)
+	if !ok {
+		return
+	}
+
+	e := assetindex.Entry{
+		Hash:           root.GetHash(),
+		Size:           root.GetSizeBytes(),
+		DigestFunction: pb.DigestFunction_SHA256.String(),
+		Timestamp:      started,
+		ExpiresAt:      expiresAt,
+	}
+
+	for _, key := range fetchResultKeys(assetindex.Directory, uri, uris, qualifiers) {
+		err := s.indexNewerResult(key, e)
+		if err != nil {
+			s.errorLogger.Printf("GRPC ASSET FETCH DIRECTORY %s failed to update the index: %v", uri, err)
+			return
+		}
+	}
+}
+
+// Stores e, the result of a fetch which started at e.Timestamp, under key,
+// unless the index already has the result of a fetch which started later.
+// The entry is compared and swapped, so when the same URI is fetched
+// concurrently, eg to refresh a branch, the newest result is kept
+// whichever order the fetches finish in.
+func (s *grpcServer) indexNewerResult(key string, e assetindex.Entry) error {
+	for {
+		current, found := s.asset.index.Get(key)
+		if found && current.Timestamp.After(e.Timestamp) {
+			return nil
+		}
+
+		ok, err := s.asset.index.CompareAndPut(key, current.Hash, e)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+// Record the content type of a fetched blob in the index, so that it can
+// be returned by later requests which find the blob by its checksum.
+func (s *grpcServer) indexContentType(uri string, result fetchResult) {
+	if result.contentType == "" {
+		return
+	}
+
+	err := s.asset.index.Put(assetindex.Key(assetindex.Metadata, result.hash, nil),
+		assetindex.Entry{
+			Hash:           result.hash,
+			Size:           result.size,
+			DigestFunction: pb.DigestFunction_SHA256.String(),
+			Timestamp:      time.Now(),
+			ContentType:    result.contentType,
+		})
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET FETCH %s failed to update the index: %v", uri, err)
+	}
+}
+
+// Record that content fetched from uri, which is now in the CAS, has
+// the checksums in result.altHashes, so that requests with a checksum.sri
+// qualifier using one of those algorithms can find it.
+func (s *grpcServer) indexAltChecksums(uri string, result fetchResult) {
+	for algo, hash := range result.altHashes {
+		err := s.asset.index.Put(altChecksumKey(algo, hash),
+			assetindex.Entry{
+				Hash:           result.hash,
+				Size:           result.size,
+				DigestFunction: pb.DigestFunction_SHA256.String(),
+				Timestamp:      time.Now(),
+			})
+		if err != nil {
+			s.errorLogger.Printf("GRPC ASSET FETCH %s failed to update the index: %v", uri, err)
+			return
+		}
+	}
+}
+
+// Returns the digest of content in the CAS which was previously found to
+// match the checksum alt.
+func (s *grpcServer) lookupAltChecksum(ctx context.Context, alt altChecksum) (*pb.Digest, bool) {
+	key := alt.indexKey()
+	e, found := s.asset.index.Get(key)
+	if !found || e.DigestFunction != pb.DigestFunction_SHA256.String() {
+		return nil, false
+	}
+
+	found, _ = s.cache.Contains(ctx, cache.CAS, e.Hash, e.Size)
+	if !found {
+		// The content was evicted from the cache.
+		s.asset.index.Evict(key)
+		return nil, false
+	}
+
+	return &pb.Digest{Hash: e.Hash, SizeBytes: e.Size}, true
+}
+
+// Returns the content type recorded for the blob with the given sha256
+// hash, or an empty string if it is not known.
+func (s *grpcServer) lookupContentType(hash string) string {
+	e, found := s.asset.index.Get(assetindex.Key(assetindex.Metadata, hash, nil))
+	if !found || e.DigestFunction != pb.DigestFunction_SHA256.String() {
+		return ""
+	}
+
+	return e.ContentType
+}
+
+// indexedAsset is content found in the asset index.
+type indexedAsset struct {
+	uri    string
+	digest *pb.Digest
+
+	// Nil if the association does not expire.
+	expiresAt *timestamppb.Timestamp
+
+	// Empty if the content type is not known.
+	contentType string
+
+	// Empty if the upstream server's ETag and Last-Modified headers are
+	// not known.
+	etag         string
+	lastModified string
+}
+
+// Look for content of the given kind that was associated with the set of
+// URIs, or one of them, and the qualifiers no earlier than notBefore, and
+// which is still in the CAS.
+func (s *grpcServer) lookupIndexedAsset(ctx context.Context, kind assetindex.Kind, uris []string,
+	qualifiers []*asset.Qualifier, notBefore time.Time) (indexedAsset, bool) {
+
+	if len(uris) == 0 {
+		return indexedAsset{}, false
+	}
+
+	// Invalid values are rejected by the callers.
+	entryKind, _ := requestedEntryKind(qualifiers)
+
+	// Content associated with the same set of URIs, by a push or fetch
+	// with them, is found with a single lookup.
+	// The URI of each key, or "" for the set key.
+	keys := []string{uriSetKey(kind, uris, qualifiers)}
+	keyURIs := []string{""}
+	for _, uri := range uris {
+		key := associationKey(kind, uri, qualifiers)
+		if key == keys[0] {
+			// The only URI in the set.
+			continue
+		}
+		keys = append(keys, key)
+		keyURIs = append(keyURIs, uri)
+	}
+
+	for i, key := range keys {
+		e, found := s.asset.index.Get(key)
+		if !found {
+			continue
+		}
+
+		if e.DigestFunction != pb.DigestFunction_SHA256.String() || e.Timestamp.Before(notBefore) {
+			continue
+		}
+
+		if !s.containsIndexedDigest(ctx, entryKind, e.Hash, e.Size) {
+			// The content was evicted from the cache.
+			s.asset.index.Evict(key)
+			continue
+		}
+
+		uri := keyURIs[i]
+		if uri == "" {
+			uri = s.indexedSetURI(kind, uris, qualifiers, e.Hash)
+		}
+
+		result := indexedAsset{
+			uri:          uri,
+			digest:       &pb.Digest{Hash: e.Hash, SizeBytes: e.Size},
+			contentType:  e.ContentType,
+			etag:         e.ETag,
+			lastModified: e.LastModified,
+		}
+		if !e.ExpiresAt.IsZero() {
+			result.expiresAt = timestamppb.New(e.ExpiresAt)
+		}
+
+		s.asset.debugf("GRPC ASSET INDEX HIT %s %s %s/%d", kind, uri, e.Hash, e.Size)
+		return result, true
+	}
+
+	return indexedAsset{}, false
+}
+
+// Returns the first of uris which is associated with the content with the
+// given hash by itself, or the first URI if there is none, to report which
+// URI content found by the uriSetKey came from.
+func (s *grpcServer) indexedSetURI(kind assetindex.Kind, uris []string, qualifiers []*asset.Qualifier, hash string) string {
+	for _, uri := range uris {
+		e, found := s.asset.index.Get(associationKey(kind, uri, qualifiers))
+		if found && e.Hash == hash {
+			return uri
+		}
+	}
+
+	return uris[0]
+}
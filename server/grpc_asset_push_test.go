@@ -0,0 +1,1149 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/assetindex"
+	testutils "github.com/buchgr/bazel-remote/v2/utils"
+)
+
+func TestAssetPushBlob(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))}
+
+	qualifiers := []*asset.Qualifier{
+		{Name: "vcs.branch", Value: "main"},
+		{Name: "vcs.commit", Value: "0123456789abcdef"},
+	}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{ts.URL + "/a", ts.URL + "/b"},
+		Qualifiers: qualifiers,
+		BlobDigest: digest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Either of the pushed URIs, with the same qualifiers in any order,
+	// should resolve without a download.
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/c", ts.URL + "/b"},
+		Qualifiers: []*asset.Qualifier{qualifiers[1], qualifiers[0]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash || resp.Uri != ts.URL+"/b" {
+		t.Fatalf("expected %s from %s, got %s from %s",
+			hash, ts.URL+"/b", resp.BlobDigest.GetHash(), resp.Uri)
+	}
+	if resp.ExpiresAt != nil {
+		t.Fatalf("expected no expiry time, got %v", resp.ExpiresAt)
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+
+	// Different qualifiers should not match.
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/a"},
+		Qualifiers: qualifiers[:1],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound, got %v", resp.Status)
+	}
+
+	// Pushed blobs can't be fetched as directories.
+	dirResp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris:       []string{ts.URL + "/a"},
+		Qualifiers: qualifiers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirResp.Status.GetCode() == int32(codes.OK) {
+		t.Fatalf("expected FetchDirectory to fail, got %v", dirResp.RootDirectoryDigest)
+	}
+}
+
+func TestAssetPushBlobByteStream(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	blob, hash := testutils.RandomDataAndHash(1024)
+	resourceName := fmt.Sprintf("uploads/%s/blobs/%s/%d", uuid.New().String(), hash, len(blob))
+
+	write := func(uri string, qualifiers ...string) error {
+		t.Helper()
+
+		kv := []string{assetPushURIKey, uri}
+		for _, q := range qualifiers {
+			kv = append(kv, assetPushQualifierKey, q)
+		}
+
+		bswc, err := fixture.bsClient.Write(metadata.AppendToOutgoingContext(ctx, kv...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Stream the blob in a few chunks.
+		for offset := 0; offset < len(blob); offset += 256 {
+			err = bswc.Send(&bytestream.WriteRequest{
+				ResourceName: resourceName,
+				WriteOffset:  int64(offset),
+				Data:         blob[offset : offset+256],
+				FinishWrite:  offset+256 == len(blob),
+			})
+			if err == io.EOF {
+				// The server returned early, eg because the blob
+				// already exists.
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = bswc.CloseAndRecv()
+		return err
+	}
+
+	fetch := func(uri string, qualifiers ...*asset.Qualifier) *asset.FetchBlobResponse {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{uri},
+			Qualifiers: qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	err := write(ts.URL+"/a", "vcs.branch=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := fetch(ts.URL+"/a", &asset.Qualifier{Name: "vcs.branch", Value: "main"})
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash ||
+		resp.BlobDigest.GetSizeBytes() != int64(len(blob)) {
+		t.Fatalf("expected %s/%d, got %v %v", hash, len(blob), resp.Status, resp.BlobDigest)
+	}
+
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, hash, int64(len(blob)))
+	if !found {
+		t.Fatal("expected the blob to be uploaded to the CAS")
+	}
+
+	// Uploading a blob which already exists still pushes it.
+	err = write(ts.URL + "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp = fetch(ts.URL + "/b")
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+
+	// Invalid push metadata fails the upload.
+	err = write(ts.URL+"/c", "no-value")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	err = write("http://example.com/%zz")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestAssetPushBlobActionCache(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	ar, acHash := testutils.RandomDataAndHash(64)
+	err := fixture.diskCache.Put(ctx, cache.AC, acHash, int64(len(ar)), bytes.NewReader(ar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size of the Action, which is not stored.
+	acDigest := &pb.Digest{Hash: acHash, SizeBytes: 1234}
+
+	blob, casHash := testutils.RandomDataAndHash(64)
+	err = fixture.diskCache.Put(ctx, cache.CAS, casHash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	casDigest := &pb.Digest{Hash: casHash, SizeBytes: int64(len(blob))}
+
+	acQualifiers := []*asset.Qualifier{{Name: "entry_kind", Value: "ac"}}
+
+	// The digest must exist in the selected kind.
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{ts.URL + "/action"},
+		Qualifiers: acQualifiers,
+		BlobDigest: casDigest,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a CAS blob pushed as an AC entry, got %v", err)
+	}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{ts.URL + "/action"},
+		Qualifiers: []*asset.Qualifier{{Name: "entry_kind", Value: "rbe"}},
+		BlobDigest: acDigest,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an invalid entry_kind, got %v", err)
+	}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{ts.URL + "/action"},
+		Qualifiers: acQualifiers,
+		BlobDigest: acDigest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/action"},
+		Qualifiers: acQualifiers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if !proto.Equal(resp.BlobDigest, acDigest) {
+		t.Fatalf("expected %v, got %v", acDigest, resp.BlobDigest)
+	}
+
+	// The default kind is CAS, which has nothing for the URI.
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/action"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound for the CAS, got %v", resp.Status)
+	}
+	if atomic.LoadInt32(&numRequests) != 1 {
+		t.Fatalf("expected one HTTP request, got %d", atomic.LoadInt32(&numRequests))
+	}
+
+	// AC entries which weren't pushed are not downloaded.
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/other"},
+		Qualifiers: acQualifiers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound, got %v", resp.Status)
+	}
+	if atomic.LoadInt32(&numRequests) != 1 {
+		t.Fatalf("expected no more HTTP requests, got %d", atomic.LoadInt32(&numRequests))
+	}
+
+	// Directories can only be pushed to the CAS.
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{ts.URL + "/action"},
+		Qualifiers:          acQualifiers,
+		RootDirectoryDigest: acDigest,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an AC directory, got %v", err)
+	}
+}
+
+func TestAssetPushBlobExpiry(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))}
+
+	future := timestamppb.New(time.Now().Add(time.Hour).Truncate(time.Second))
+	past := timestamppb.New(time.Now().Add(-time.Hour))
+
+	for path, expireAt := range map[string]*timestamppb.Timestamp{"/future": future, "/past": past} {
+		_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+			Uris:       []string{ts.URL + path},
+			ExpireAt:   expireAt,
+			BlobDigest: digest,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/future"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if !resp.ExpiresAt.AsTime().Equal(future.AsTime()) {
+		t.Fatalf("expected expiry time %v, got %v", future.AsTime(), resp.ExpiresAt.AsTime())
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/past"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected expired association to be ignored, got %v", resp.Status)
+	}
+}
+
+func TestAssetPushBlobVerification(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	otherBlob, _ := testutils.RandomDataAndHash(256)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		switch r.URL.Path {
+		case "/good":
+			_, _ = w.Write(blob)
+		case "/bad":
+			_, _ = w.Write(otherBlob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	index := assetindex.NewInMemory(0)
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetIndex(index),
+		WithAssetPushVerification(time.Millisecond))
+	defer os.Remove(fixture.tempdir)
+
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uris := []string{ts.URL + "/good", ts.URL + "/missing", ts.URL + "/bad"}
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       uris,
+		BlobDigest: &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The URIs are verified in order.
+	badKey := assetindex.Key(assetindex.Blob, ts.URL+"/bad", map[string]string{})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, found := index.Get(badKey)
+		if !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the mismatching association to be invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The matching association, and the one that couldn't be verified,
+	// are kept.
+	for _, uri := range uris[:2] {
+		_, found := index.Get(assetindex.Key(assetindex.Blob, uri, map[string]string{}))
+		if !found {
+			t.Errorf("expected the association for %s to be kept", uri)
+		}
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 3 {
+		t.Fatalf("expected one request per pushed URI, got %d", n)
+	}
+}
+
+func TestAssetPushMissingContent(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	_, hash := testutils.RandomDataAndHash(256)
+	missing := &pb.Digest{Hash: hash, SizeBytes: 256}
+
+	_, err := fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{"https://example.com/blob"},
+		BlobDigest: missing,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a missing blob, got %v", err)
+	}
+
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{"https://example.com/dir.tar.gz"},
+		RootDirectoryDigest: missing,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a missing directory, got %v", err)
+	}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		BlobDigest: missing,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without URIs, got %v", err)
+	}
+}
+
+func TestAssetPushDirectory(t *testing.T) {
+	t.Parallel()
+
+	index := assetindex.NewInMemory(0)
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetIndex(index))
+	defer os.Remove(fixture.tempdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected HTTP request: %s", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	// The contents of the root Directory aren't checked.
+	data, hash := testutils.RandomDataAndHash(64)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := &pb.Digest{Hash: hash, SizeBytes: int64(len(data))}
+
+	uri := ts.URL + "/repo.git"
+	qualifiers := []*asset.Qualifier{{Name: "vcs.commit", Value: "0123456789abcdef"}}
+
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{uri},
+		Qualifiers:          qualifiers,
+		RootDirectoryDigest: digest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found := index.Get(assetindex.Key(assetindex.Directory, uri, qualifierMap(qualifiers)))
+	if !found {
+		t.Fatal("expected the association to be stored in the index")
+	}
+
+	resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris:       []string{uri},
+		Qualifiers: qualifiers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.RootDirectoryDigest.GetHash() != hash || resp.Uri != uri {
+		t.Fatalf("expected %s from %s, got %s from %s",
+			hash, uri, resp.RootDirectoryDigest.GetHash(), resp.Uri)
+	}
+}
+
+func TestAssetPushChecksumSRI(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetUnpacker("linear", lineUnpacker{}))
+	defer os.Remove(fixture.tempdir)
+
+	sri := func(algo string, sum []byte) *asset.Qualifier {
+		return &asset.Qualifier{Name: "checksum.sri",
+			Value: algo + "-" + base64.StdEncoding.EncodeToString(sum)}
+	}
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))}
+	sha256Sum := sha256.Sum256(blob)
+	sha512Sum := sha512.Sum512(blob)
+	otherSum := sha256.Sum256([]byte("other"))
+
+	testCases := []struct {
+		name       string
+		qualifiers []*asset.Qualifier
+		entryKind  string
+		code       codes.Code
+	}{
+		{"sha256", []*asset.Qualifier{sri("sha256", sha256Sum[:])}, "", codes.OK},
+		{"sha512", []*asset.Qualifier{sri("sha512", sha512Sum[:])}, "", codes.OK},
+		{"mismatched sha256", []*asset.Qualifier{sri("sha256", otherSum[:])}, "", codes.InvalidArgument},
+		{"mismatched sha1", []*asset.Qualifier{sri("sha1", otherSum[:20])}, "", codes.InvalidArgument},
+		{"unknown algorithm", []*asset.Qualifier{{Name: "checksum.sri", Value: "foo-"}}, "", codes.InvalidArgument},
+		{"action cache", []*asset.Qualifier{sri("sha256", sha256Sum[:])}, "ac", codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		qualifiers := tc.qualifiers
+		if tc.entryKind != "" {
+			qualifiers = append(qualifiers, &asset.Qualifier{Name: "entry_kind", Value: tc.entryKind})
+		}
+
+		_, err := fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+			Uris:       []string{"https://example.com/" + strings.ReplaceAll(tc.name, " ", "-")},
+			Qualifiers: qualifiers,
+			BlobDigest: digest,
+		})
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.code, err)
+		}
+	}
+
+	// A verified sha512 checksum can be used to find the blob from any
+	// URI afterwards.
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{"https://example.com/elsewhere"},
+		Qualifiers: []*asset.Qualifier{sri("sha512", sha512Sum[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+
+	// Directories are verified by unpacking the archive.
+	archive := []byte(lineArchiveMagic + "pkg/a hello\n")
+	archiveSum := sha256.Sum256(archive)
+	archiveHash := hex.EncodeToString(archiveSum[:])
+	err = fixture.diskCache.Put(ctx, cache.CAS, archiveHash, int64(len(archive)), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirResp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris:       []string{"https://example.com/pkg.linear"},
+		Qualifiers: []*asset.Qualifier{sri("sha256", archiveSum[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirResp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", dirResp.Status)
+	}
+	root := dirResp.RootDirectoryDigest
+
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{"https://example.com/mirror/pkg.linear"},
+		Qualifiers:          []*asset.Qualifier{sri("sha256", archiveSum[:])},
+		RootDirectoryDigest: root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{"https://example.com/mirror/pkg.linear"},
+		Qualifiers:          []*asset.Qualifier{sri("sha256", archiveSum[:])},
+		RootDirectoryDigest: digest,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a mismatched directory, got %v", err)
+	}
+
+	// Archives which aren't in the CAS can't be verified.
+	_, err = fixture.pushClient.PushDirectory(ctx, &asset.PushDirectoryRequest{
+		Uris:                []string{"https://example.com/missing.linear"},
+		Qualifiers:          []*asset.Qualifier{sri("sha256", otherSum[:])},
+		RootDirectoryDigest: root,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a missing archive, got %v", err)
+	}
+}
+
+func TestAssetFetchBlobTTL(t *testing.T) {
+	t.Parallel()
+
+	index := assetindex.NewInMemory(0)
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetIndex(index), WithAssetFetchTTL(time.Hour))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	uri := ts.URL + "/unversioned.tar.gz"
+	qualifiers := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+
+	fetch := func(req *asset.FetchBlobRequest, expectedRequests int32) {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+		}
+
+		n := atomic.LoadInt32(&numRequests)
+		if n != expectedRequests {
+			t.Fatalf("expected %d HTTP requests, got %d", expectedRequests, n)
+		}
+	}
+
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers}, 1)
+
+	// Within the TTL, with the same qualifiers.
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers}, 1)
+
+	// Different qualifiers.
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}}, 2)
+
+	// The requested timeout qualifier is not part of the key, but it can
+	// make the entry too old.
+	time.Sleep(10 * time.Millisecond)
+	timeoutQualifiers := []*asset.Qualifier{
+		qualifiers[0],
+		{Name: "bazel_request.requested_timeout", Value: "5ms"},
+	}
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: timeoutQualifiers}, 3)
+
+	// So can oldest_content_accepted.
+	fetch(&asset.FetchBlobRequest{
+		Uris:                  []string{uri},
+		Qualifiers:            qualifiers,
+		OldestContentAccepted: timestamppb.New(time.Now().Add(time.Minute)),
+	}, 4)
+
+	// Evicted entries are fetched again.
+	index.Evict(assetindex.Key(assetindex.Blob, uri, qualifierMap(qualifiers)))
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers}, 5)
+
+	// An invalid requested timeout is ignored.
+	fetch(&asset.FetchBlobRequest{
+		Uris:       []string{uri},
+		Qualifiers: append(qualifiers, &asset.Qualifier{Name: "bazel_request.requested_timeout", Value: "soon"}),
+	}, 5)
+}
+
+func TestAssetFetchVCSTag(t *testing.T) {
+	t.Parallel()
+
+	unpacker := &countingUnpacker{}
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetUnpacker("linear", unpacker))
+	defer os.Remove(fixture.tempdir)
+
+	archive := lineArchiveMagic + "pkg/a hello\n"
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		_, _ = w.Write([]byte(archive))
+	}))
+	defer ts.Close()
+
+	uri := ts.URL + "/repo.linear"
+	tag := []*asset.Qualifier{{Name: "vcs.tag", Value: "v1.0.0"}}
+
+	fetch := func(req *asset.FetchBlobRequest, expectedRequests int32) {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		if resp.ExpiresAt != nil {
+			t.Fatalf("expected no expiry time, got %v", resp.ExpiresAt)
+		}
+
+		n := atomic.LoadInt32(&numRequests)
+		if n != expectedRequests {
+			t.Fatalf("expected %d HTTP requests, got %d", expectedRequests, n)
+		}
+	}
+
+	// Tags are reused without a TTL.
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: tag}, 1)
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: tag}, 1)
+
+	// Unlike branches.
+	branch := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: branch}, 2)
+	fetch(&asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: branch}, 3)
+
+	// Clients can still force a refetch.
+	fetch(&asset.FetchBlobRequest{
+		Uris:                  []string{uri},
+		Qualifiers:            tag,
+		OldestContentAccepted: timestamppb.New(time.Now().Add(time.Minute)),
+	}, 4)
+
+	// Directories are unpacked once, and then found in the index.
+	dirTag := []*asset.Qualifier{{Name: "vcs.tag", Value: "v2.0.0"}}
+	var root *pb.Digest
+	for i := 0; i < 2; i++ {
+		resp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+			Uris:       []string{uri},
+			Qualifiers: dirTag,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		if root != nil && !proto.Equal(root, resp.RootDirectoryDigest) {
+			t.Fatalf("expected %v, got %v", root, resp.RootDirectoryDigest)
+		}
+		root = resp.RootDirectoryDigest
+	}
+
+	if atomic.LoadInt32(&numRequests) != 5 {
+		t.Fatalf("expected one more HTTP request, got %d", atomic.LoadInt32(&numRequests))
+	}
+	if atomic.LoadInt32(&unpacker.unpacks) != 1 {
+		t.Fatalf("expected one unpack, got %d", atomic.LoadInt32(&unpacker.unpacks))
+	}
+}
+
+func TestAssetFetchBlobConcurrentRefetch(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTTL(time.Hour))
+	defer os.Remove(fixture.tempdir)
+
+	oldBlob, oldHash := testutils.RandomDataAndHash(256)
+	newBlob, newHash := testutils.RandomDataAndHash(256)
+
+	// The first request gets the old content, but only responds after
+	// the second request, which gets the new content, has finished.
+	var numRequests int32
+	received := make(chan struct{})
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numRequests, 1) == 1 {
+			close(received)
+			<-unblock
+			_, _ = w.Write(oldBlob)
+			return
+		}
+		_, _ = w.Write(newBlob)
+	}))
+	defer ts.Close()
+
+	uri := ts.URL + "/main.tar.gz"
+	qualifiers := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+
+	fetch := func(refetch bool) string {
+		req := &asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers}
+		if refetch {
+			req.OldestContentAccepted = timestamppb.Now()
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, req)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Errorf("expected successful fetch, got %v", resp.Status)
+		}
+		return resp.BlobDigest.GetHash()
+	}
+
+	first := make(chan string, 1)
+	go func() {
+		first <- fetch(true)
+	}()
+	<-received
+
+	if fetch(true) != newHash {
+		t.Fatal("expected the second fetch to get the new content")
+	}
+	close(unblock)
+	if <-first != oldHash {
+		t.Fatal("expected the first fetch to get the old content")
+	}
+
+	// The result of the fetch which started last is kept, even though it
+	// finished first.
+	if fetch(false) != newHash {
+		t.Fatal("expected the newest result to be indexed")
+	}
+	n := atomic.LoadInt32(&numRequests)
+	if n != 2 {
+		t.Fatalf("expected 2 HTTP requests, got %d", n)
+	}
+}
+
+func TestIndexNewerResult(t *testing.T) {
+	t.Parallel()
+
+	s := &grpcServer{
+		accessLogger: testutils.NewSilentLogger(),
+		errorLogger:  testutils.NewSilentLogger(),
+		asset:        defaultAssetConfig(),
+	}
+	s.asset.fetchTTL = time.Hour
+
+	uri := "https://example.com/main.tar.gz"
+	qualifiers := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+	key := associationKey(assetindex.Blob, uri, qualifiers)
+
+	// Results of fetches which started at different times are indexed
+	// concurrently in a random order, the newest should always win.
+	const fetches = 50
+	base := time.Now()
+
+	for round := 0; round < 10; round++ {
+		s.asset.index.Evict(key)
+
+		var wg sync.WaitGroup
+		for _, i := range rand.Perm(fetches) {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s.indexFetchResult(uri, []string{uri}, qualifiers, fetchResult{
+					hash: fmt.Sprintf("%064x", i),
+					size: int64(i),
+				}, base.Add(time.Duration(i)*time.Second))
+			}(i)
+		}
+		wg.Wait()
+
+		e, found := s.asset.index.Get(key)
+		if !found || e.Size != fetches-1 {
+			t.Fatalf("expected the result of fetch %d, got %d (found: %v)", fetches-1, e.Size, found)
+		}
+	}
+}
+
+func TestAssociationKeys(t *testing.T) {
+	qualifiers := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+
+	a := uriSetKey(assetindex.Blob, []string{"https://a.example.com/x", "https://b.example.com/x"}, qualifiers)
+	b := uriSetKey(assetindex.Blob, []string{"https://B.example.com/x", "https://a.example.com/x", "https://b.example.com/x"}, qualifiers)
+	if a != b {
+		t.Error("expected URI sets differing by order, duplicates and host case to have the same key")
+	}
+
+	c := uriSetKey(assetindex.Blob, []string{"https://a.example.com/X", "https://b.example.com/x"}, qualifiers)
+	if a == c {
+		t.Error("expected URI sets with different paths to have different keys")
+	}
+
+	if associationKey(assetindex.Blob, "HTTPS://Mirror.Example.COM/a.tar", qualifiers) !=
+		associationKey(assetindex.Blob, "https://mirror.example.com/a.tar", qualifiers) {
+		t.Error("expected the scheme and host case to be ignored")
+	}
+
+	expected := []string{"https://a.example.com/x", "https://b.example.com/x"}
+	canonical := canonicalURIs([]string{"https://b.example.com/x", "https://A.example.com/x", "https://b.example.com/x"})
+	if strings.Join(canonical, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v, got %v", expected, canonical)
+	}
+}
+
+func TestAssetPushBlobCanonicalURIs(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       []string{"https://Mirror.Example.com/a.tar", "https://mirror.example.com/a.tar"},
+		BlobDigest: &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Found without downloading anything, which would fail.
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{"https://MIRROR.EXAMPLE.COM/a.tar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+}
+
+func TestAssetPushBlobURISet(t *testing.T) {
+	t.Parallel()
+
+	index := assetindex.NewInMemory(0)
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetIndex(index))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qualifiers := []*asset.Qualifier{{Name: "vcs.branch", Value: "main"}}
+	uris := []string{"https://b.example.com/x.tar", "https://a.example.com/x.tar", "https://b.example.com/x.tar"}
+
+	_, err = fixture.pushClient.PushBlob(ctx, &asset.PushBlobRequest{
+		Uris:       uris,
+		Qualifiers: qualifiers,
+		BlobDigest: &pb.Digest{Hash: hash, SizeBytes: int64(len(blob))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reordered := []string{"https://A.example.com/x.tar", "https://b.example.com/x.tar"}
+	e, found := index.Get(uriSetKey(assetindex.Blob, reordered, qualifiers))
+	if !found || e.Hash != hash {
+		t.Fatalf("expected the association with the URI set to be indexed, got %v (found: %v)", e, found)
+	}
+
+	// The set of URIs is enough to find the content, without the
+	// associations with each URI.
+	for _, uri := range uris {
+		index.Evict(associationKey(assetindex.Blob, uri, qualifiers))
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       reordered,
+		Qualifiers: qualifiers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+	if resp.Uri != reordered[0] {
+		t.Fatalf("expected the first URI, got %s", resp.Uri)
+	}
+}
+
+func TestQualifierMap(t *testing.T) {
+	m := qualifierMap([]*asset.Qualifier{
+		{Name: "vcs.branch", Value: "main"},
+		{Name: "bazel_request.requested_timeout", Value: "30s"},
+		{Name: "http_header:X-Auth-Token", Value: "secret"},
+		{Name: "expected_size", Value: "42"},
+		{Name: "decode_content_encoding", Value: "true"},
+		{Name: "entry_kind", Value: "cas"},
+	})
+
+	if len(m) != 1 || m["vcs.branch"] != "main" {
+		t.Fatalf("expected only the qualifiers which identify the content, got %v", m)
+	}
+
+	m = qualifierMap([]*asset.Qualifier{{Name: "entry_kind", Value: "ac"}})
+	if len(m) != 1 || m["entry_kind"] != "ac" {
+		t.Fatalf("expected a non-default entry_kind to identify the content, got %v", m)
+	}
+}
+
+func TestAssetFetchBlobRequestedTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Without a default TTL, fetch results are only reused if the request
+	// asks for it.
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, _ := testutils.RandomDataAndHash(256)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	requests := []*asset.FetchBlobRequest{
+		{Uris: []string{ts.URL + "/a"}},
+		{Uris: []string{ts.URL + "/a"}},
+		{
+			Uris:       []string{ts.URL + "/b"},
+			Qualifiers: []*asset.Qualifier{{Name: "bazel_request.requested_timeout", Value: "3600"}},
+		},
+		{
+			Uris:       []string{ts.URL + "/b"},
+			Qualifiers: []*asset.Qualifier{{Name: "bazel_request.requested_timeout", Value: "1h"}},
+		},
+	}
+
+	for _, req := range requests {
+		resp, err := fixture.assetClient.FetchBlob(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 3 {
+		t.Fatalf("expected 3 HTTP requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobRequestedTimeoutDeadline(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	// Mirrors which don't respond until the request is cancelled.
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"},
+		Qualifiers: []*asset.Qualifier{{Name: "bazel_request.requested_timeout", Value: "300ms"}},
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", resp.Status)
+	}
+
+	// The timeout applies to all of the URIs together, not each of them.
+	if elapsed > 3*time.Second {
+		t.Fatalf("expected the fetch to stop after the requested timeout, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&numRequests); n != 1 {
+		t.Fatalf("expected 1 HTTP request, got %d", n)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// assetQuarantine stores downloads which failed checksum verification,
+// so that content served by compromised or broken mirrors can be
+// analysed later. Quarantined content is never added to the cache.
+type assetQuarantine struct {
+	dir string
+
+	// Serializes appends to the index file.
+	mu sync.Mutex
+}
+
+// The name of the file in the quarantine directory that describes each
+// of the quarantined downloads, one JSON object per line.
+const quarantineIndexFile = "index.jsonl"
+
+// An entry in the quarantine index file.
+type quarantineRecord struct {
+	Time         time.Time `json:"time"`
+	URI          string    `json:"uri"`
+	ExpectedHash string    `json:"expected_hash"`
+	ActualHash   string    `json:"actual_hash"`
+	Size         int64     `json:"size"`
+}
+
+// Writes `size` bytes from data to the quarantine directory, in a file
+// named by its actual hash, and records where it came from in the index
+// file.
+func (q *assetQuarantine) store(uri string, expectedHash string, actualHash string, data io.Reader, size int64) error {
+	f, err := os.CreateTemp(q.dir, actualHash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = io.Copy(f, io.LimitReader(data, size))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(q.dir, actualHash))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	line, err := json.Marshal(quarantineRecord{
+		Time:         time.Now().UTC(),
+		URI:          uri,
+		ExpectedHash: expectedHash,
+		ActualHash:   actualHash,
+		Size:         size,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	index, err := os.OpenFile(filepath.Join(q.dir, quarantineIndexFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = index.Write(line)
+	if err != nil {
+		index.Close()
+		return fmt.Errorf("failed to update quarantine index: %w", err)
+	}
+
+	return index.Close()
+}
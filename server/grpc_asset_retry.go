@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The delay before the first retry of a transient fetch failure, which
+// doubles for each subsequent retry of the same URI, up to
+// maxAssetFetchBackoff.
+const defaultAssetFetchBackoff = 200 * time.Millisecond
+
+// The longest that we wait before retrying a fetch. If an upstream server
+// asks us to wait longer than this with a Retry-After header, we don't
+// retry that URI.
+const maxAssetFetchBackoff = 10 * time.Second
+
+// Returns true if an upstream server's response with this status code
+// might succeed if it is retried.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Returns the delay requested by a Retry-After header, which is either a
+// number of seconds or an HTTP date, or 0 if there is no valid header.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		if seconds > int64(maxAssetFetchBackoff/time.Second) {
+			// Don't overflow, we won't wait this long anyway.
+			return maxAssetFetchBackoff + time.Second
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+
+	delay := date.Sub(now)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Returns how long to wait before the given retry (starting from 0) of a
+// URI: exponential backoff from `base`, with jitter so that requests which
+// failed at the same time don't all retry at the same time.
+func assetFetchBackoff(base time.Duration, retry int) time.Duration {
+	delay := base
+	for i := 0; i < retry && delay < maxAssetFetchBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxAssetFetchBackoff {
+		delay = maxAssetFetchBackoff
+	}
+
+	// Somewhere between half and all of the delay.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Waits for `delay`, or until ctx is done, in which case ctx's error is
+// returned.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// assetRetryBudget limits the total number of retries for a FetchBlob
+// request, which may be shared by URIs that are fetched concurrently.
+type assetRetryBudget struct {
+	mu sync.Mutex
+
+	// The number of retries left, or -1 for no limit.
+	remaining int
+}
+
+// Returns false if there are no retries left, otherwise uses one up.
+func (b *assetRetryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.remaining == 0 {
+		return false
+	}
+	if b.remaining > 0 {
+		b.remaining--
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// Downloads up to this size are kept in memory until they have been
+// verified, larger downloads are written to a temporary file.
+const maxInMemoryDownloadSize = 1024 * 1024
+
+// The default size of the buffer used to copy and hash downloads, the
+// same as io.Copy uses.
+const defaultAssetFetchBufferSize = 32 * 1024
+
+// downloadSpool is an io.Writer which holds the content of a download
+// until it has been verified and can be added to the CAS, and which
+// hashes the content as it is written, so that memory use is bounded
+// regardless of the size of the download.
+type downloadSpool struct {
+	// Used until the content exceeds memLimit bytes.
+	buf      bytes.Buffer
+	memLimit int64
+
+	// Non-nil once the content exceeds memLimit bytes.
+	file *os.File
+
+	// The directory the file is created in, or "" for the default
+	// directory for temporary files.
+	dir string
+
+	size   int64
+	sha256 hash.Hash
+
+	// The checksums other than sha256 that the content can be verified
+	// and looked up with.
+	alt *altHashWriter
+}
+
+func newDownloadSpool(dir string) *downloadSpool {
+	return &downloadSpool{
+		dir:      dir,
+		memLimit: maxInMemoryDownloadSize,
+		sha256:   sha256.New(),
+		alt:      newAltHashWriter(),
+	}
+}
+
+func (d *downloadSpool) Write(p []byte) (int, error) {
+	if d.file == nil && int64(d.buf.Len()+len(p)) > d.memLimit {
+		f, err := os.CreateTemp(d.dir, "bazel-remote-asset-*")
+		if err != nil {
+			return 0, err
+		}
+		d.file = f
+
+		_, err = f.Write(d.buf.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		d.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if d.file != nil {
+		n, err = d.file.Write(p)
+	} else {
+		n, err = d.buf.Write(p)
+	}
+
+	d.size += int64(n)
+	d.sha256.Write(p[:n])
+	d.alt.Write(p[:n])
+
+	return n, err
+}
+
+// Returns the hex encoded sha256 hash of the content.
+func (d *downloadSpool) sha256Hash() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+// Returns the hex encoded hash of the content, using one of the
+// algorithms in altSRIHashes.
+func (d *downloadSpool) altHash(algo string) string {
+	return hex.EncodeToString(d.alt.hashes[algo].Sum(nil))
+}
+
+// Returns a reader for the content, from the start. Only one reader can
+// be used at a time.
+func (d *downloadSpool) reader() (io.Reader, error) {
+	if d.file == nil {
+		return bytes.NewReader(d.buf.Bytes()), nil
+	}
+
+	_, err := d.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.file, nil
+}
+
+// Removes the temporary file, if there is one.
+func (d *downloadSpool) close() {
+	if d.file != nil {
+		d.file.Close()
+		os.Remove(d.file.Name())
+	}
+}
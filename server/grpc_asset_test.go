@@ -1,20 +1,54 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
 	//pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk"
 	testutils "github.com/buchgr/bazel-remote/v2/utils"
 )
 
@@ -63,6 +97,559 @@ func TestAssetFetchBlob(t *testing.T) {
 	}
 }
 
+func TestAssetFetchEmptyBlob(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+	}))
+	defer ts.Close()
+
+	emptySha512 := sha512.Sum512([]byte{})
+
+	req := asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/empty"},
+		Qualifiers: []*asset.Qualifier{
+			{
+				Name: "checksum.sri",
+				Value: "sha512-" +
+					base64.StdEncoding.EncodeToString(emptySha512[:]),
+			},
+		},
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatal("expected successful fetch")
+	}
+	if resp.BlobDigest.GetHash() != emptySha256 {
+		t.Fatalf("expected the empty sha256 hash, got %q", resp.BlobDigest.GetHash())
+	}
+	if resp.BlobDigest.GetSizeBytes() != 0 {
+		t.Fatalf("expected size 0, got %d", resp.BlobDigest.GetSizeBytes())
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobInvalidSRI(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+	}))
+	defer ts.Close()
+
+	values := []string{
+		// Unknown algorithms, which must not match the empty blob.
+		"foo-",
+		"foo-" + base64.StdEncoding.EncodeToString([]byte("foo")),
+		// Malformed values.
+		"sha256",
+		"sha256-",
+		"sha256-!!!",
+		"sha512-" + base64.StdEncoding.EncodeToString([]byte("too short")),
+	}
+
+	for _, value := range values {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + "/blob"},
+			Qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: value}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+			t.Errorf("expected InvalidArgument for %q, got %v %v",
+				value, resp.Status, resp.BlobDigest)
+		}
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+}
+
+// putRecordingProxy is a cache.Proxy which remembers the sizes passed
+// to Put, and never has any blobs available.
+type putRecordingProxy struct {
+	mu          sync.Mutex
+	logicalSize map[string]int64
+	sizeOnDisk  map[string]int64
+}
+
+func newPutRecordingProxy() *putRecordingProxy {
+	return &putRecordingProxy{
+		logicalSize: make(map[string]int64),
+		sizeOnDisk:  make(map[string]int64),
+	}
+}
+
+func (p *putRecordingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logicalSize[hash] = logicalSize
+	p.sizeOnDisk[hash] = sizeOnDisk
+}
+
+func (p *putRecordingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (p *putRecordingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
+	return false, -1
+}
+
+// sizeReportingProxy is a cache.Proxy which contains a single CAS blob,
+// and which optionally reports its size from Contains.
+type sizeReportingProxy struct {
+	hash       string
+	blob       []byte
+	reportSize bool
+
+	gets int32
+}
+
+func (p *sizeReportingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+}
+
+func (p *sizeReportingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64) (io.ReadCloser, int64, error) {
+	if kind != cache.CAS || hash != p.hash {
+		return nil, -1, nil
+	}
+
+	atomic.AddInt32(&p.gets, 1)
+	return io.NopCloser(bytes.NewReader(p.blob)), int64(len(p.blob)), nil
+}
+
+func (p *sizeReportingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
+	if kind != cache.CAS || hash != p.hash {
+		return false, -1
+	}
+
+	if !p.reportSize {
+		return true, -1
+	}
+	return true, int64(len(p.blob))
+}
+
+func TestAssetFetchBlobSRIProxySize(t *testing.T) {
+	t.Parallel()
+
+	for _, reportSize := range []bool{true, false} {
+		blob, hash := testutils.RandomDataAndHash(1024)
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := testutils.TempDir(t)
+		defer os.RemoveAll(dir)
+
+		// The proxy returns uncompressed blobs.
+		proxy := &sizeReportingProxy{hash: hash, blob: blob, reportSize: reportSize}
+		diskCache, err := disk.New(dir, 10*1024*1024,
+			disk.WithStorageMode("uncompressed"),
+			disk.WithProxyBackend(proxy),
+			disk.WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := &grpcServer{
+			cache:        diskCache,
+			accessLogger: testutils.NewSilentLogger(),
+			errorLogger:  testutils.NewSilentLogger(),
+			asset:        defaultAssetConfig(),
+		}
+
+		var numRequests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&numRequests, 1)
+		}))
+		defer ts.Close()
+
+		resp, err := s.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/blob"},
+			Qualifiers: []*asset.Qualifier{{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("reportSize: %v: expected OK, got %v", reportSize, resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != hash || resp.BlobDigest.GetSizeBytes() != int64(len(blob)) {
+			t.Fatalf("reportSize: %v: expected %s/%d, got %v", reportSize, hash, len(blob), resp.BlobDigest)
+		}
+
+		if n := atomic.LoadInt32(&numRequests); n != 0 {
+			t.Fatalf("reportSize: %v: expected no HTTP requests, got %d", reportSize, n)
+		}
+
+		// The blob is only downloaded from the proxy if its size is
+		// unknown.
+		expectedGets := int32(0)
+		if !reportSize {
+			expectedGets = 1
+		}
+		if n := atomic.LoadInt32(&proxy.gets); n != expectedGets {
+			t.Fatalf("reportSize: %v: expected %d proxy Get calls, got %d", reportSize, expectedGets, n)
+		}
+	}
+}
+
+func TestAssetFetchBlobSRIBase64Variants(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+	}))
+	defer ts.Close()
+
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.URLEncoding} {
+		blob, hash := testutils.RandomDataAndHash(256)
+		err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/blob"},
+			Qualifiers: []*asset.Qualifier{
+				{
+					Name:  "checksum.sri",
+					Value: "sha256-" + enc.EncodeToString(hashBytes),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+		}
+	}
+
+	n := atomic.LoadInt32(&numRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobDebugLogging(t *testing.T) {
+	t.Parallel()
+
+	if defaultAssetConfig().debugLogger != nil {
+		t.Fatal("expected debug logging to be disabled by default")
+	}
+
+	debugLogger := &recordingLogger{}
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetDebugLogger(debugLogger))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := "sha256-" + base64.StdEncoding.EncodeToString(hashBytes)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{"https://example.com/blob"},
+		Qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: sri}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected a cache hit, got %v", resp.Status)
+	}
+
+	expected := fmt.Sprintf("SRI HIT %s/%d checksum.sri=%s", hash, len(blob), sri)
+	if !debugLogger.contains(expected) {
+		t.Fatalf("expected a debug log message containing %q, got %v",
+			expected, debugLogger.messages)
+	}
+}
+
+func TestAssetFetchBlobTimingLogs(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ts.Certificate())
+
+	debugLogger := &recordingLogger{}
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetDebugLogger(debugLogger),
+		WithAssetFetchTLSConfig(strings.TrimPrefix(ts.URL, "https://"),
+			&tls.Config{RootCAs: caPool}))
+	defer os.Remove(fixture.tempdir)
+
+	uri := ts.URL + "/blob"
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{uri},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected successful fetch of %s, got %v", hash, resp)
+	}
+
+	if !debugLogger.contains(uri + " TIMINGS") {
+		t.Fatalf("expected a timing log message for %s, got %v", uri, debugLogger.messages)
+	}
+	for _, field := range []string{"dns=", "connect=", "tls=", "ttfb=", "total="} {
+		if !debugLogger.contains(field) {
+			t.Errorf("expected the timing log message to contain %q, got %v",
+				field, debugLogger.messages)
+		}
+	}
+}
+
+func TestAssetFetchBlobCompressedStorage(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	proxy := newPutRecordingProxy()
+	diskCache, err := disk.New(dir, 10*1024*1024,
+		disk.WithStorageMode("zstd"),
+		disk.WithProxyBackend(proxy),
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &grpcServer{
+		cache:        diskCache,
+		accessLogger: testutils.NewSilentLogger(),
+		errorLogger:  testutils.NewSilentLogger(),
+		asset:        defaultAssetConfig(),
+	}
+
+	// Highly compressible.
+	blob := bytes.Repeat([]byte("bazel-remote "), 10000)
+	hashBytes := sha256.Sum256(blob)
+	hash := hex.EncodeToString(hashBytes[:])
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	resp, err := s.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: []string{ts.URL + "/blob.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+
+	totalSize, _, numItems, uncompressedSize := diskCache.Stats()
+	if numItems != 1 {
+		t.Fatalf("expected 1 item in the cache, found %d", numItems)
+	}
+	if totalSize >= uncompressedSize {
+		t.Fatalf("expected the stored size (%d) to be smaller than the logical size (%d)",
+			totalSize, uncompressedSize)
+	}
+
+	proxy.mu.Lock()
+	logicalSize := proxy.logicalSize[hash]
+	sizeOnDisk := proxy.sizeOnDisk[hash]
+	proxy.mu.Unlock()
+
+	if logicalSize != int64(len(blob)) {
+		t.Fatalf("expected proxy logical size %d, found %d", len(blob), logicalSize)
+	}
+	if sizeOnDisk <= 0 || sizeOnDisk >= logicalSize {
+		t.Fatalf("expected proxy size on disk to be smaller than %d, found %d",
+			logicalSize, sizeOnDisk)
+	}
+
+	rc, size, err := diskCache.Get(ctx, cache.CAS, hash, int64(len(blob)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("expected the blob to be in the cache")
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(blob)) || !bytes.Equal(data, blob) {
+		t.Fatal("expected to read back the original data")
+	}
+}
+
+// Serve HTTP/1.0 style responses with the blobs keyed by request path,
+// closing the connection after each one and optionally omitting the
+// Content-Length header so that the client must read until EOF. Each
+// request is counted in *requests.
+func serveHTTP10(t *testing.T, l net.Listener, blobs map[string][]byte, sendContentLength bool, requests *atomic.Int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return // Listener closed.
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				t.Log(err)
+				return
+			}
+			requests.Add(1)
+
+			blob, ok := blobs[req.URL.Path]
+			if !ok {
+				_, _ = conn.Write([]byte("HTTP/1.0 404 Not Found\r\nConnection: close\r\n\r\n"))
+				return
+			}
+
+			header := "HTTP/1.0 200 OK\r\nConnection: close\r\n"
+			if sendContentLength {
+				header += fmt.Sprintf("Content-Length: %d\r\n", len(blob))
+			}
+			header += "\r\n"
+
+			_, _ = conn.Write([]byte(header))
+			_, _ = conn.Write(blob)
+		}(conn)
+	}
+}
+
+func TestAssetFetchBlobHTTP10(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	const numFetches = 3
+
+	for _, sendContentLength := range []bool{true, false} {
+		// A different blob for each fetch, so that none of them are
+		// served from the cache.
+		blobs := make(map[string][]byte, numFetches)
+		hashes := make(map[string]string, numFetches)
+		for i := 0; i < numFetches; i++ {
+			path := fmt.Sprintf("/blob%d", i)
+			blobs[path], hashes[path] = testutils.RandomDataAndHash(1024)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+
+		var requests atomic.Int32
+		go serveHTTP10(t, l, blobs, sendContentLength, &requests)
+
+		// Fetch a few times, with and without a checksum, to check
+		// that connections which are closed by the server aren't reused.
+		for i := 0; i < numFetches; i++ {
+			path := fmt.Sprintf("/blob%d", i)
+			blob, hash := blobs[path], hashes[path]
+			uri := "http://" + l.Addr().String() + path
+
+			req := asset.FetchBlobRequest{Uris: []string{uri}}
+			if i%2 == 0 {
+				hashBytes, err := hex.DecodeString(hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Qualifiers = []*asset.Qualifier{
+					{
+						Name:  "checksum.sri",
+						Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+					},
+				}
+			}
+
+			tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			resp, err := fixture.assetClient.FetchBlob(tctx, &req)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Status.GetCode() != int32(codes.OK) {
+				t.Fatalf("expected successful fetch (Content-Length: %v), got %v",
+					sendContentLength, resp.Status)
+			}
+			if resp.BlobDigest.GetHash() != hash {
+				t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+			}
+			if resp.BlobDigest.GetSizeBytes() != int64(len(blob)) {
+				t.Fatalf("expected size %d, got %d", len(blob), resp.BlobDigest.GetSizeBytes())
+			}
+		}
+
+		if n := requests.Load(); n != numFetches {
+			t.Fatalf("expected %d requests to reach the server (Content-Length: %v), got %d",
+				numFetches, sendContentLength, n)
+		}
+	}
+}
+
 type testGetServer struct {
 	srv *httptest.Server
 
@@ -82,12 +669,9 @@ func (s *testGetServer) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s.blob)))
 	w.WriteHeader(http.StatusOK)
 
-	if r.Method == http.MethodHead {
-		w.Header().Set("ContentLength", fmt.Sprintf("%d", len(s.blob)))
-	}
-
 	if r.Method == http.MethodGet {
 		_, _ = w.Write(s.blob)
 	}
@@ -104,3 +688,4106 @@ func newTestGetServer() *testGetServer {
 
 	return &ts
 }
+
+func TestAssetFetchBlobHeadProbe(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	otherBlob, otherHash := testutils.RandomDataAndHash(256)
+
+	var mu sync.Mutex
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if r.Header.Get("Range") != "" {
+			method = "RANGE"
+		}
+		mu.Lock()
+		requests = append(requests, method+" "+r.URL.Path)
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/no-head.bin":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+		case "/stored.bin":
+		case "/stored.bin.sha256":
+			_, _ = w.Write([]byte(otherHash))
+			return
+		case "/large.bin":
+			w.Header().Set("Content-Length", "1000")
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(make([]byte, 1000))
+			}
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		data := blob
+		if r.URL.Path == "/stored.bin" {
+			data = otherBlob
+		}
+		// Handles HEAD and Range requests.
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchHeadProbe(),
+		WithAssetFetchMaxSize(512),
+		WithAssetFetchChecksumSidecarSuffix(".sha256"))
+	defer os.Remove(fixture.tempdir)
+
+	err := fixture.diskCache.Put(ctx, cache.CAS, otherHash, int64(len(otherBlob)), bytes.NewReader(otherBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := []*asset.Qualifier{{
+		Name:  "checksum.sri",
+		Value: "sha256-" + base64.StdEncoding.EncodeToString(sum),
+	}}
+
+	testCases := []struct {
+		path       string
+		qualifiers []*asset.Qualifier
+		code       codes.Code
+		hash       string
+		requests   []string
+	}{
+		{
+			path:     "/missing.bin",
+			code:     codes.NotFound,
+			requests: []string{"GET /missing.bin.sha256", "HEAD /missing.bin"},
+		},
+		{
+			path:     "/large.bin",
+			code:     codes.NotFound,
+			requests: []string{"GET /large.bin.sha256", "HEAD /large.bin"},
+		},
+		{
+			// The sidecar checksum is already in the CAS.
+			path:     "/stored.bin",
+			code:     codes.OK,
+			hash:     otherHash,
+			requests: []string{"GET /stored.bin.sha256", "HEAD /stored.bin"},
+		},
+		{
+			path:       "/no-head.bin",
+			qualifiers: sri,
+			code:       codes.OK,
+			hash:       hash,
+			requests:   []string{"HEAD /no-head.bin", "RANGE /no-head.bin", "GET /no-head.bin"},
+		},
+	}
+
+	for _, tc := range testCases {
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + tc.path},
+			Qualifiers: tc.qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(tc.code) {
+			t.Fatalf("expected %v for %s, got %v", tc.code, tc.path, resp.Status)
+		}
+		if tc.code == codes.OK && resp.BlobDigest.GetHash() != tc.hash {
+			t.Fatalf("expected %s to have hash %s, got %s", tc.path, tc.hash, resp.BlobDigest.GetHash())
+		}
+
+		mu.Lock()
+		got := strings.Join(requests, ", ")
+		mu.Unlock()
+		if got != strings.Join(tc.requests, ", ") {
+			t.Fatalf("expected requests [%s] for %s, got [%s]",
+				strings.Join(tc.requests, ", "), tc.path, got)
+		}
+	}
+}
+
+func TestAssetReadiness(t *testing.T) {
+	t.Parallel()
+
+	var proxyAvailable atomic.Bool
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetReadinessInterval(10*time.Millisecond),
+		WithAssetReadinessCheck("proxy backend", func(context.Context) error {
+			if !proxyAvailable.Load() {
+				return errors.New("connection refused")
+			}
+			return nil
+		}))
+	defer os.Remove(fixture.tempdir)
+
+	waitForStatus := func(expected grpc_health_v1.HealthCheckResponse_ServingStatus) {
+		req := grpc_health_v1.HealthCheckRequest{Service: assetHealthServiceName}
+
+		var got grpc_health_v1.HealthCheckResponse_ServingStatus
+		for i := 0; i < 500; i++ {
+			resp, err := fixture.healthClient.Check(ctx, &req)
+			if err == nil {
+				got = resp.Status
+				if got == expected {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Fatalf("Expected asset health status %s, got %s", expected, got)
+	}
+
+	waitForStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	proxyAvailable.Store(true)
+	waitForStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+
+	proxyAvailable.Store(false)
+	waitForStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestAssetFetchBlobPerHostTLS(t *testing.T) {
+	t.Parallel()
+
+	newTLSServer := func() (*httptest.Server, string) {
+		blob, hash := testutils.RandomDataAndHash(256)
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(blob)
+		}))
+		return srv, hash
+	}
+
+	caServer, caHash := newTLSServer()
+	defer caServer.Close()
+
+	skipServer, skipHash := newTLSServer()
+	defer skipServer.Close()
+
+	otherServer, _ := newTLSServer()
+	defer otherServer.Close()
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(caServer.Certificate())
+
+	hostOf := func(srv *httptest.Server) string {
+		return strings.TrimPrefix(srv.URL, "https://")
+	}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchTLSConfig(hostOf(caServer), &tls.Config{RootCAs: caPool}),
+		WithAssetFetchTLSConfig(hostOf(skipServer), &tls.Config{InsecureSkipVerify: true}))
+	defer os.Remove(fixture.tempdir)
+
+	testCases := []struct {
+		name         string
+		uri          string
+		expectedCode codes.Code
+		expectedHash string
+	}{
+		{"custom CA", caServer.URL + "/blob", codes.OK, caHash},
+		{"insecure skip verify", skipServer.URL + "/blob", codes.OK, skipHash},
+		{"default verification", otherServer.URL + "/blob", codes.NotFound, ""},
+	}
+
+	for _, tc := range testCases {
+		req := asset.FetchBlobRequest{Uris: []string{tc.uri}}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if resp.Status.GetCode() != int32(tc.expectedCode) {
+			t.Fatalf("%s: expected status %v, got %v", tc.name, tc.expectedCode, resp.Status)
+		}
+
+		if tc.expectedHash != "" && resp.BlobDigest.GetHash() != tc.expectedHash {
+			t.Fatalf("%s: expected hash %s, got %s", tc.name, tc.expectedHash, resp.BlobDigest.GetHash())
+		}
+	}
+}
+
+func TestAssetFetchBlobMinTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	ts.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS10,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ts.Certificate())
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	testCases := []struct {
+		name          string
+		opts          []AssetOption
+		expectSuccess bool
+	}{
+		{
+			name: "default minimum",
+			opts: []AssetOption{
+				WithAssetFetchTLSConfig(host, &tls.Config{RootCAs: caPool}),
+			},
+		},
+		{
+			name: "minimum 1.2",
+			opts: []AssetOption{
+				WithAssetFetchMinTLSVersion(tls.VersionTLS12),
+				// The minimum version also overrides per-host settings.
+				WithAssetFetchTLSConfig(host, &tls.Config{
+					RootCAs:    caPool,
+					MinVersion: tls.VersionTLS10,
+				}),
+			},
+		},
+		{
+			name: "minimum 1.0",
+			opts: []AssetOption{
+				WithAssetFetchMinTLSVersion(tls.VersionTLS10),
+				WithAssetFetchTLSConfig(host, &tls.Config{RootCAs: caPool}),
+			},
+			expectSuccess: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		fixture := grpcTestSetupWithAssetOptions(t, tc.opts...)
+		defer os.Remove(fixture.tempdir)
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/blob"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.expectSuccess {
+			if resp.Status.GetCode() != int32(codes.OK) {
+				t.Errorf("%s: expected successful fetch, got %v", tc.name, resp.Status)
+			} else if resp.BlobDigest.GetHash() != hash {
+				t.Errorf("%s: expected hash %s, got %s", tc.name, hash, resp.BlobDigest.GetHash())
+			}
+		} else if resp.Status.GetCode() == int32(codes.OK) {
+			t.Errorf("%s: expected the TLS 1.0 fetch to fail", tc.name)
+		}
+	}
+}
+
+func TestAssetFetchBlobCacheControl(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	testCases := []struct {
+		name     string
+		req      asset.FetchBlobRequest
+		expected string
+	}{
+		{
+			name: "branch",
+			req: asset.FetchBlobRequest{
+				Uris: []string{ts.URL + "/archive/main.tar.gz"},
+				Qualifiers: []*asset.Qualifier{
+					{Name: "vcs.branch", Value: "main"},
+				},
+			},
+			expected: "max-age=300",
+		},
+		{
+			// Also a cache hit, after the previous fetch.
+			name: "checksum",
+			req: asset.FetchBlobRequest{
+				Uris: []string{ts.URL + "/archive/main.tar.gz"},
+				Qualifiers: []*asset.Qualifier{
+					{
+						Name:  "checksum.sri",
+						Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+					},
+				},
+			},
+			expected: "immutable",
+		},
+	}
+
+	for _, tc := range testCases {
+		var header metadata.MD
+		resp, err := fixture.assetClient.FetchBlob(ctx, &tc.req, grpc.Header(&header))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("%s: expected successful fetch, got %v", tc.name, resp.Status)
+		}
+
+		got := header.Get(cacheControlKey)
+		if len(got) != 1 || got[0] != tc.expected {
+			t.Fatalf("%s: expected %s %q, got %q", tc.name, cacheControlKey, tc.expected, got)
+		}
+	}
+}
+
+func TestAssetFetchBlobContentType(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTTL(time.Hour))
+	defer os.Remove(fixture.tempdir)
+
+	const contentType = "application/gzip"
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := &asset.Qualifier{
+		Name:  "checksum.sri",
+		Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	fetchContentType := func(req *asset.FetchBlobRequest) []string {
+		var header metadata.MD
+		resp, err := fixture.assetClient.FetchBlob(ctx, req, grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		return header.Get(contentTypeKey)
+	}
+
+	// Downloaded, without a checksum.
+	got := fetchContentType(&asset.FetchBlobRequest{Uris: []string{ts.URL + "/weak"}})
+	if len(got) != 1 || got[0] != contentType {
+		t.Fatalf("expected %s %q, got %q", contentTypeKey, contentType, got)
+	}
+
+	// Found in the index.
+	got = fetchContentType(&asset.FetchBlobRequest{Uris: []string{ts.URL + "/weak"}})
+	if len(got) != 1 || got[0] != contentType {
+		t.Fatalf("expected %s %q for an index hit, got %q", contentTypeKey, contentType, got)
+	}
+
+	// Found by its checksum, from a different URI.
+	got = fetchContentType(&asset.FetchBlobRequest{
+		Uris:       []string{ts.URL + "/other"},
+		Qualifiers: []*asset.Qualifier{sri},
+	})
+	if len(got) != 1 || got[0] != contentType {
+		t.Fatalf("expected %s %q for a checksum hit, got %q", contentTypeKey, contentType, got)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+
+	// Blobs without a recorded content type don't have the header.
+	otherBlob, otherHash := testutils.RandomDataAndHash(256)
+	err = fixture.diskCache.Put(ctx, cache.CAS, otherHash, int64(len(otherBlob)), bytes.NewReader(otherBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHashBytes, err := hex.DecodeString(otherHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = fetchContentType(&asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/unused"},
+		Qualifiers: []*asset.Qualifier{{
+			Name:  "checksum.sri",
+			Value: "sha256-" + base64.StdEncoding.EncodeToString(otherHashBytes),
+		}},
+	})
+	if len(got) != 0 {
+		t.Fatalf("expected no %s header, got %q", contentTypeKey, got)
+	}
+}
+
+func TestAssetFetchBlobValidators(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTTL(time.Hour))
+	defer os.Remove(fixture.tempdir)
+
+	const etag = `"5f3c-1a2b"`
+	const lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	fetchValidators := func(req *asset.FetchBlobRequest) metadata.MD {
+		var header metadata.MD
+		resp, err := fixture.assetClient.FetchBlob(ctx, req, grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+		return header
+	}
+
+	checkValidators := func(header metadata.MD, desc string) {
+		got := header.Get(etagKey)
+		if len(got) != 1 || got[0] != etag {
+			t.Fatalf("expected %s %q for %s, got %q", etagKey, etag, desc, got)
+		}
+		got = header.Get(lastModifiedKey)
+		if len(got) != 1 || got[0] != lastModified {
+			t.Fatalf("expected %s %q for %s, got %q", lastModifiedKey, lastModified, desc, got)
+		}
+	}
+
+	// Downloaded, without a checksum.
+	header := fetchValidators(&asset.FetchBlobRequest{Uris: []string{ts.URL + "/weak"}})
+	checkValidators(header, "a download")
+
+	// Found in the index.
+	header = fetchValidators(&asset.FetchBlobRequest{Uris: []string{ts.URL + "/weak"}})
+	checkValidators(header, "an index hit")
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+
+	// Checksum hits aren't associated with a URI.
+	header = fetchValidators(&asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/other"},
+		Qualifiers: []*asset.Qualifier{{
+			Name:  "checksum.sri",
+			Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+		}},
+	})
+	if got := header.Get(etagKey); len(got) != 0 {
+		t.Fatalf("expected no %s header for a checksum hit, got %q", etagKey, got)
+	}
+}
+
+func TestAssetFetchBlobAltChecksum(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	sha1Sum := sha1.Sum(blob)
+	sha256Bytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	fetch := func(path string, sri string) *asset.FetchBlobResponse {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + path},
+			Qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: sri}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Content which doesn't match the checksum is rejected.
+	wrongSum := sha1.Sum([]byte("something else"))
+	resp := fetch("/wrong", "sha1-"+base64.StdEncoding.EncodeToString(wrongSum[:]))
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected a fetch with the wrong sha1 checksum to fail")
+	}
+
+	sha1SRI := "sha1-" + base64.StdEncoding.EncodeToString(sha1Sum[:])
+	resp = fetch("/blob", sha1SRI)
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+
+	// Later requests with either checksum are found without downloading
+	// the content again, even from a different URI.
+	resp = fetch("/mirror", sha1SRI)
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected a sha1 hit for %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+	if len(resp.Qualifiers) != 1 || resp.Qualifiers[0].Value != sha1SRI {
+		t.Fatalf("expected the sha1 qualifier to be reported, got %v", resp.Qualifiers)
+	}
+
+	resp = fetch("/mirror", "sha256-"+base64.StdEncoding.EncodeToString(sha256Bytes))
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected a sha256 hit for %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobIndirectSRILookup(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	noChecksumBlob, noChecksumHash := testutils.RandomDataAndHash(256)
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/no-checksum" {
+			_, _ = w.Write(noChecksumBlob)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	fetch := func(uri string, qualifiers ...*asset.Qualifier) *asset.FetchBlobResponse {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{uri},
+			Qualifiers: qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	sri := func(algo string, sum []byte) *asset.Qualifier {
+		return &asset.Qualifier{Name: "checksum.sri", Value: algo + "-" + base64.StdEncoding.EncodeToString(sum)}
+	}
+
+	// Fetched with a sha256 checksum, and without a checksum.
+	sha256Bytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := fetch(ts.URL+"/blob", sri("sha256", sha256Bytes))
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected successful fetch of %s, got %v %v", hash, resp.Status, resp.BlobDigest)
+	}
+	resp = fetch(ts.URL + "/no-checksum")
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != noChecksumHash {
+		t.Fatalf("expected successful fetch of %s, got %v %v", noChecksumHash, resp.Status, resp.BlobDigest)
+	}
+
+	sha512Sum := sha512.Sum512(blob)
+	sha384Sum := sha512.Sum384(blob)
+	noChecksumSha384Sum := sha512.Sum384(noChecksumBlob)
+
+	testCases := []struct {
+		name      string
+		qualifier *asset.Qualifier
+		hash      string
+	}{
+		{"sha512", sri("sha512", sha512Sum[:]), hash},
+		{"sha384", sri("sha384", sha384Sum[:]), hash},
+		{"sha384 of content fetched without a checksum", sri("sha384", noChecksumSha384Sum[:]), noChecksumHash},
+	}
+
+	for _, tc := range testCases {
+		// The URI can't be fetched, so these must be found in the CAS.
+		resp := fetch("http://localhost:0/unused.tar.gz", tc.qualifier)
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("%s: expected the CAS blob to be found, got %v", tc.name, resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != tc.hash {
+			t.Fatalf("%s: expected hash %s, got %s", tc.name, tc.hash, resp.BlobDigest.GetHash())
+		}
+		if len(resp.Qualifiers) != 1 || resp.Qualifiers[0].Value != tc.qualifier.Value {
+			t.Fatalf("%s: expected the matching qualifier to be reported, got %v", tc.name, resp.Qualifiers)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobLargeUnknownSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	// Larger than we keep in memory.
+	blob, hash := testutils.RandomDataAndHash(3*maxInMemoryDownloadSize + 123)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the blob in chunks without a Content-Length header.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for offset := 0; offset < len(blob); offset += 64 * 1024 {
+			end := offset + 64*1024
+			if end > len(blob) {
+				end = len(blob)
+			}
+			_, _ = w.Write(blob[offset:end])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	// With the wrong checksum first, so that the content isn't cached yet.
+	_, wrongHash := testutils.RandomDataAndHash(256)
+	wrongHashBytes, err := hex.DecodeString(wrongHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name          string
+		checksum      []byte
+		expectSuccess bool
+	}{
+		{name: "wrong checksum", checksum: wrongHashBytes, expectSuccess: false},
+		{name: "no checksum", expectSuccess: true},
+		{name: "checksum", checksum: hashBytes, expectSuccess: true},
+	}
+
+	for _, tc := range testCases {
+		req := asset.FetchBlobRequest{Uris: []string{ts.URL + "/large"}}
+		if tc.checksum != nil {
+			req.Qualifiers = []*asset.Qualifier{{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(tc.checksum),
+			}}
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		success := resp.Status.GetCode() == int32(codes.OK)
+		if success != tc.expectSuccess {
+			t.Fatalf("%s: expected success: %v, got %v", tc.name, tc.expectSuccess, resp.Status)
+		}
+		if !success {
+			found, _ := fixture.diskCache.Contains(ctx, cache.CAS, hash, -1)
+			if found {
+				t.Fatalf("%s: expected mismatching content not to be cached", tc.name)
+			}
+			continue
+		}
+
+		if resp.BlobDigest.GetHash() != hash || resp.BlobDigest.GetSizeBytes() != int64(len(blob)) {
+			t.Fatalf("%s: expected %s/%d, got %v", tc.name, hash, len(blob), resp.BlobDigest)
+		}
+
+		rc, size, err := fixture.diskCache.Get(ctx, cache.CAS, hash, int64(len(blob)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(blob)) || !bytes.Equal(cached, blob) {
+			t.Fatalf("%s: the cached blob differs from the upstream content", tc.name)
+		}
+	}
+}
+
+func TestDownloadSpool(t *testing.T) {
+	blob, hash := testutils.RandomDataAndHash(1000)
+
+	for _, memLimit := range []int64{100, 10000} {
+		spool := newDownloadSpool("")
+		spool.memLimit = memLimit
+
+		_, err := io.Copy(spool, bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		usesFile := spool.file != nil
+		if usesFile != (memLimit < int64(len(blob))) {
+			t.Fatalf("memLimit %d: unexpected use of a temporary file: %v", memLimit, usesFile)
+		}
+		if spool.size != int64(len(blob)) || spool.sha256Hash() != hash {
+			t.Fatalf("memLimit %d: expected %s/%d, got %s/%d", memLimit,
+				hash, len(blob), spool.sha256Hash(), spool.size)
+		}
+		sha1Sum := sha1.Sum(blob)
+		if spool.altHash("sha1") != hex.EncodeToString(sha1Sum[:]) {
+			t.Fatalf("memLimit %d: unexpected sha1 hash %s", memLimit, spool.altHash("sha1"))
+		}
+
+		r, err := spool.reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, blob) {
+			t.Fatalf("memLimit %d: the spooled content differs", memLimit)
+		}
+
+		spool.close()
+		if usesFile {
+			_, err = os.Stat(spool.file.Name())
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected the temporary file to be removed, got: %v", err)
+			}
+		}
+	}
+}
+
+func TestAssetFetchBlobTruncated(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(4096)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim to send the whole blob, but close the connection half way.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+		_, _ = w.Write(blob[:len(blob)/2])
+	}))
+	defer ts.Close()
+
+	for _, withChecksum := range []bool{true, false} {
+		req := asset.FetchBlobRequest{Uris: []string{ts.URL + "/blob"}}
+		if withChecksum {
+			req.Qualifiers = []*asset.Qualifier{
+				{
+					Name:  "checksum.sri",
+					Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+				},
+			}
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Status.GetCode() == int32(codes.OK) {
+			t.Fatalf("expected truncated fetch to fail (checksum: %v), got %v",
+				withChecksum, resp.BlobDigest)
+		}
+	}
+
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, hash, int64(len(blob)))
+	if found {
+		t.Fatal("expected truncated blob to not be stored")
+	}
+}
+
+func TestAssetFetchBlobAllowedExtensions(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchAllowedExtensions([]string{".tar.gz", ".whl", ".jar"}))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var exeRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".exe") {
+			atomic.AddInt32(&exeRequests, 1)
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/setup.exe"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected .exe fetch to be skipped, got %v", resp.Status)
+	}
+	n := atomic.LoadInt32(&exeRequests)
+	if n != 0 {
+		t.Fatalf("expected no HTTP requests for the .exe URI, got %d", n)
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/setup.exe", ts.URL + "/archive.TAR.GZ"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if resp.Uri != ts.URL+"/archive.TAR.GZ" {
+		t.Fatalf("expected the .tar.gz URI to be used, got %s", resp.Uri)
+	}
+}
+
+func TestAssetFetchBlobRedirectWithoutLocation(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/redirect", ts.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if resp.Uri != ts.URL+"/blob" {
+		t.Fatalf("expected the second URI to be used, got %s", resp.Uri)
+	}
+}
+
+func TestAssetFetchBlobTransientFailureStatus(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/unavailable"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.Unavailable) {
+		t.Fatalf("expected Unavailable for a 503 response, got %v", resp.Status)
+	}
+	if len(resp.Status.GetDetails()) != 1 {
+		t.Fatalf("expected RetryInfo details, got %v", resp.Status.GetDetails())
+	}
+	var retryInfo errdetails.RetryInfo
+	err = resp.Status.GetDetails()[0].UnmarshalTo(&retryInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryInfo.GetRetryDelay().AsDuration() <= 0 {
+		t.Fatalf("expected a positive retry delay, got %v", retryInfo.GetRetryDelay())
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound for a 404 response, got %v", resp.Status)
+	}
+}
+
+func TestAssetFetchBlobRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	const retryBudget = 2
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchRetryBudget(retryBudget))
+	defer os.Remove(fixture.tempdir)
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	uris := []string{
+		ts.URL + "/missing",
+		ts.URL + "/unavailable1",
+		ts.URL + "/unavailable2",
+		ts.URL + "/unavailable3",
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: uris})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected fetch to fail")
+	}
+
+	// One attempt per URI, plus the shared retries. The 404 is not retried.
+	expected := int32(len(uris) + retryBudget)
+	n := atomic.LoadInt32(&attempts)
+	if n != expected {
+		t.Fatalf("expected %d attempts, got %d", expected, n)
+	}
+}
+
+func TestAssetFetchBlobDuplicateURIs(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	a, b := ts.URL+"/a", ts.URL+"/b"
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{a, b, a, a, b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound, got %v", resp.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 2 || attempts["/a"] != 1 || attempts["/b"] != 1 {
+		t.Fatalf("expected one attempt per unique URI, got %v", attempts)
+	}
+}
+
+// Makes retries of transient fetch failures happen quickly.
+func withFastAssetFetchBackoff(c *assetConfig) error {
+	c.retryBackoff = time.Millisecond
+	return nil
+}
+
+func TestAssetFetchBlobRetries(t *testing.T) {
+	t.Parallel()
+
+	const retries = 3
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchRetries(retries), withFastAssetFetchBackoff)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/flaky":
+			// Succeeds on the last retry.
+			if n <= retries {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write(blob)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	testCases := []struct {
+		path             string
+		expectedCode     codes.Code
+		expectedAttempts int
+	}{
+		{path: "/flaky", expectedCode: codes.OK, expectedAttempts: retries + 1},
+		{path: "/unavailable", expectedCode: codes.Unavailable, expectedAttempts: retries + 1},
+		{path: "/forbidden", expectedCode: codes.NotFound, expectedAttempts: 1},
+		{path: "/error", expectedCode: codes.NotFound, expectedAttempts: 1},
+		{path: "/missing", expectedCode: codes.NotFound, expectedAttempts: 1},
+	}
+
+	for _, tc := range testCases {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + tc.path},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(tc.expectedCode) {
+			t.Fatalf("%s: expected %v, got %v", tc.path, tc.expectedCode, resp.Status)
+		}
+		if tc.expectedCode == codes.OK && resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("%s: expected hash %s, got %s", tc.path, hash, resp.BlobDigest.GetHash())
+		}
+
+		mu.Lock()
+		n := attempts[tc.path]
+		mu.Unlock()
+		if n != tc.expectedAttempts {
+			t.Fatalf("%s: expected %d attempts, got %d", tc.path, tc.expectedAttempts, n)
+		}
+	}
+}
+
+func TestAssetFetchBlobRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchRetries(1), withFastAssetFetchBackoff)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/later" {
+			// Longer than we are willing to wait.
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected the retry to wait for the Retry-After delay, took %v", elapsed)
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/later"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.Unavailable) {
+		t.Fatalf("expected Unavailable, got %v", resp.Status)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: 0},
+		{value: "5", expected: 5 * time.Second},
+		{value: "-5", expected: 0},
+		{value: "bogus", expected: 0},
+		{value: "99999999999999999", expected: maxAssetFetchBackoff + time.Second},
+		{value: now.Add(3 * time.Second).Format(http.TimeFormat), expected: 3 * time.Second},
+		{value: now.Add(-3 * time.Second).Format(http.TimeFormat), expected: 0},
+	}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		if tc.value != "" {
+			header.Set("Retry-After", tc.value)
+		}
+
+		delay := parseRetryAfter(header, now)
+		if delay != tc.expected {
+			t.Errorf("Retry-After %q: expected %v, got %v", tc.value, tc.expected, delay)
+		}
+	}
+}
+
+func TestAssetFetchBackoff(t *testing.T) {
+	t.Parallel()
+
+	for retry := 0; retry < 100; retry++ {
+		delay := assetFetchBackoff(defaultAssetFetchBackoff, retry)
+
+		limit := defaultAssetFetchBackoff << retry
+		if retry >= 10 || limit > maxAssetFetchBackoff {
+			limit = maxAssetFetchBackoff
+		}
+
+		if delay < limit/2 || delay > limit {
+			t.Fatalf("retry %d: expected a delay between %v and %v, got %v",
+				retry, limit/2, limit, delay)
+		}
+	}
+}
+
+func TestAssetFetchBlobSizeChangeOnRetry(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		withChecksum    bool
+		allowSizeChange bool
+		expectSuccess   bool
+	}{
+		{name: "no checksum", withChecksum: false, allowSizeChange: false, expectSuccess: false},
+		{name: "checksum", withChecksum: true, allowSizeChange: false, expectSuccess: true},
+		{name: "allowed", withChecksum: false, allowSizeChange: true, expectSuccess: true},
+	}
+
+	for _, tc := range testCases {
+		opts := []AssetOption{WithAssetFetchRetryBudget(1)}
+		if tc.allowSizeChange {
+			opts = append(opts, WithAssetFetchAllowSizeChange())
+		}
+		fixture := grpcTestSetupWithAssetOptions(t, opts...)
+		defer os.Remove(fixture.tempdir)
+
+		blob, hash := testutils.RandomDataAndHash(1024)
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first attempt claims to be larger than the blob, and closes
+		// the connection early. The retry returns the whole blob.
+		var attempts int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", 2*len(blob)))
+				_, _ = w.Write(blob[:len(blob)/2])
+				return
+			}
+			_, _ = w.Write(blob)
+		}))
+		defer ts.Close()
+
+		req := asset.FetchBlobRequest{Uris: []string{ts.URL + "/blob"}}
+		if tc.withChecksum {
+			req.Qualifiers = []*asset.Qualifier{
+				{
+					Name:  "checksum.sri",
+					Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+				},
+			}
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := atomic.LoadInt32(&attempts)
+		if n != 2 {
+			t.Fatalf("%s: expected 2 attempts, got %d", tc.name, n)
+		}
+
+		success := resp.Status.GetCode() == int32(codes.OK)
+		if success != tc.expectSuccess {
+			t.Fatalf("%s: expected success: %v, got %v", tc.name, tc.expectSuccess, resp.Status)
+		}
+		if success && resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("%s: expected hash %s, got %s", tc.name, hash, resp.BlobDigest.GetHash())
+		}
+	}
+}
+
+func TestAssetFetchBlobTruncatedResponse(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		withChecksum  bool
+		contentLength bool
+	}{
+		{name: "Content-Length, no checksum", withChecksum: false, contentLength: true},
+		{name: "Content-Length, checksum", withChecksum: true, contentLength: true},
+		{name: "expected size, no checksum", withChecksum: false, contentLength: false},
+		{name: "expected size, checksum", withChecksum: true, contentLength: false},
+	}
+
+	for _, tc := range testCases {
+		fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchRetries(1))
+		defer os.Remove(fixture.tempdir)
+
+		blob, hash := testutils.RandomDataAndHash(1024)
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Responds successfully, but only sends half of the blob.
+		var attempts int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			if tc.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			}
+			_, _ = w.Write(blob[:len(blob)/2])
+			if !tc.contentLength {
+				// Otherwise the server sets the Content-Length.
+				w.(http.Flusher).Flush()
+			}
+		}))
+		defer ts.Close()
+
+		req := asset.FetchBlobRequest{Uris: []string{ts.URL + "/blob"}}
+		if tc.withChecksum {
+			req.Qualifiers = append(req.Qualifiers, &asset.Qualifier{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+			})
+		}
+		if !tc.contentLength {
+			req.Qualifiers = append(req.Qualifiers, &asset.Qualifier{
+				Name:  "expected_size",
+				Value: strconv.Itoa(len(blob)),
+			})
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() == int32(codes.OK) {
+			t.Fatalf("%s: expected the truncated fetch to fail, got %v", tc.name, resp)
+		}
+
+		// Truncated responses are retried.
+		n := atomic.LoadInt32(&attempts)
+		if n != 2 {
+			t.Fatalf("%s: expected 2 attempts, got %d", tc.name, n)
+		}
+
+		truncatedSum := sha256.Sum256(blob[:len(blob)/2])
+		truncatedHash := hex.EncodeToString(truncatedSum[:])
+		for _, h := range []string{hash, truncatedHash} {
+			found, _ := fixture.diskCache.Contains(ctx, cache.CAS, h, -1)
+			if found {
+				t.Fatalf("%s: expected %s not to be stored", tc.name, h)
+			}
+		}
+	}
+}
+
+func TestAssetFetchBlobExpectedSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchRetries(1))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(1024)
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	fetch := func(path string, size string) *asset.FetchBlobResponse {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + path},
+			Qualifiers: []*asset.Qualifier{{Name: "expected_size", Value: size}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := fetch("/wrong", strconv.Itoa(len(blob)+1))
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatalf("expected a size mismatch to fail, got %v", resp)
+	}
+	n := atomic.LoadInt32(&attempts)
+	if n != 1 {
+		t.Fatalf("expected a size mismatch not to be retried, got %d attempts", n)
+	}
+
+	resp = fetch("/right", strconv.Itoa(len(blob)))
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected successful fetch of %s, got %v", hash, resp)
+	}
+
+	for _, size := range []string{"-1", "1k", ""} {
+		resp = fetch("/invalid", size)
+		if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+			t.Fatalf("expected InvalidArgument for expected_size %q, got %v", size, resp.Status)
+		}
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAssetFetchBlobContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(1024)
+	gzipped := gzipData(t, blob)
+	gzippedSum := sha256.Sum256(gzipped)
+	gzippedHash := hex.EncodeToString(gzippedSum[:])
+
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	_, _ = zw.Write(blob)
+	_ = zw.Close()
+
+	corrupt := append([]byte{}, gzipped[:20]...)
+	corrupt = append(corrupt, bytes.Repeat([]byte{0xff}, 100)...)
+
+	type response struct {
+		encoding string
+		data     []byte
+	}
+	responses := map[string]response{
+		"/gzip":         {"gzip", gzipped},
+		"/double-gzip":  {"gzip, gzip", gzipData(t, gzipped)},
+		"/deflate":      {"deflate", zlibbed.Bytes()},
+		"/mislabelled":  {"gzip", blob},
+		"/identity":     {"identity", blob},
+		"/corrupt-gzip": {"gzip", corrupt},
+		"/brotli":       {"br", blob},
+	}
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		resp := responses[r.URL.Path]
+		w.Header().Set("Content-Encoding", resp.encoding)
+		_, _ = w.Write(resp.data)
+	}))
+	defer ts.Close()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchRetries(1), withFastAssetFetchBackoff)
+	defer os.Remove(fixture.tempdir)
+
+	decodingFixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchDecodeContentEncoding(true))
+	defer os.Remove(decodingFixture.tempdir)
+
+	testCases := []struct {
+		fixture grpcTestFixture
+		path    string
+		decode  string
+		code    codes.Code
+		hash    string
+	}{
+		// Without decoding, the content is stored as received.
+		{fixture, "/gzip", "", codes.OK, gzippedHash},
+		{fixture, "/gzip", "false", codes.OK, gzippedHash},
+		{decodingFixture, "/gzip", "false", codes.OK, gzippedHash},
+
+		{fixture, "/gzip", "true", codes.OK, hash},
+		{decodingFixture, "/gzip", "", codes.OK, hash},
+		{fixture, "/double-gzip", "true", codes.OK, hash},
+		{fixture, "/deflate", "true", codes.OK, hash},
+		{fixture, "/mislabelled", "true", codes.OK, hash},
+		{fixture, "/identity", "true", codes.OK, hash},
+		{fixture, "/corrupt-gzip", "true", codes.NotFound, ""},
+		{fixture, "/brotli", "true", codes.NotFound, ""},
+		{fixture, "/gzip", "maybe", codes.InvalidArgument, ""},
+	}
+
+	for _, tc := range testCases {
+		qualifiers := []*asset.Qualifier{
+			// Stop the http client from decoding gzip itself.
+			{Name: "http_header:Accept-Encoding", Value: "gzip, deflate"},
+		}
+		if tc.decode != "" {
+			qualifiers = append(qualifiers, &asset.Qualifier{Name: "decode_content_encoding", Value: tc.decode})
+		}
+
+		atomic.StoreInt32(&attempts, 0)
+		resp, err := tc.fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + tc.path},
+			Qualifiers: qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(tc.code) {
+			t.Fatalf("expected %v for %s with decode_content_encoding %q, got %v",
+				tc.code, tc.path, tc.decode, resp.Status)
+		}
+		if tc.code == codes.OK && resp.BlobDigest.GetHash() != tc.hash {
+			t.Fatalf("expected %s with decode_content_encoding %q to have hash %s, got %s",
+				tc.path, tc.decode, tc.hash, resp.BlobDigest.GetHash())
+		}
+		if tc.code == codes.NotFound && atomic.LoadInt32(&attempts) != 1 {
+			t.Fatalf("expected undecodable content from %s not to be retried, got %d attempts",
+				tc.path, atomic.LoadInt32(&attempts))
+		}
+	}
+}
+
+func TestAssetFetchBlobNotFoundWindow(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchNotFoundWindow(time.Minute))
+	defer os.Remove(fixture.tempdir)
+
+	// A mirror which is missing everything.
+	var mirrorRequests int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer mirror.Close()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer upstream.Close()
+
+	fetch := func(uris ...string) {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: uris})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected OK, got %v", resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+		}
+	}
+
+	fetch(mirror.URL+"/blob", upstream.URL+"/blob")
+	if n := atomic.LoadInt32(&mirrorRequests); n != 1 {
+		t.Fatalf("expected 1 mirror request, got %d", n)
+	}
+
+	// A different set of URIs which includes the missing one.
+	fetch(mirror.URL+"/blob", upstream.URL+"/blob?mirror=2")
+	if n := atomic.LoadInt32(&mirrorRequests); n != 1 {
+		t.Fatalf("expected the missing URI to be skipped, got %d mirror requests", n)
+	}
+
+	// Other URIs on the same mirror are still tried.
+	fetch(mirror.URL+"/other", upstream.URL+"/blob")
+	if n := atomic.LoadInt32(&mirrorRequests); n != 2 {
+		t.Fatalf("expected 2 mirror requests, got %d", n)
+	}
+
+	// If all of the URIs are skipped, the request fails.
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{mirror.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound, got %v", resp.Status)
+	}
+	if n := atomic.LoadInt32(&mirrorRequests); n != 2 {
+		t.Fatalf("expected 2 mirror requests, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobNotFoundWindowBypass(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchNotFoundWindow(time.Minute))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	// A mirror which is missing the blob until it's fixed.
+	var fixed atomic.Bool
+	var requests int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !fixed.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer mirror.Close()
+
+	fetch := func(reqCtx context.Context, expectedCode codes.Code, expectedRequests int32) {
+		t.Helper()
+
+		resp, err := fixture.assetClient.FetchBlob(reqCtx, &asset.FetchBlobRequest{
+			Uris: []string{mirror.URL + "/blob"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(expectedCode) {
+			t.Fatalf("expected %v, got %v", expectedCode, resp.Status)
+		}
+		if expectedCode == codes.OK && resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+		}
+		if n := atomic.LoadInt32(&requests); n != expectedRequests {
+			t.Fatalf("expected %d mirror requests, got %d", expectedRequests, n)
+		}
+	}
+
+	bypassCtx := metadata.AppendToOutgoingContext(ctx, assetBypassNotFoundKey, "true")
+
+	fetch(ctx, codes.NotFound, 1)
+
+	// Within the window the URI is skipped, unless the client asks to
+	// bypass the not found cache.
+	fixed.Store(true)
+	fetch(ctx, codes.NotFound, 1)
+	fetch(metadata.AppendToOutgoingContext(ctx, assetBypassNotFoundKey, "false"), codes.NotFound, 1)
+	fetch(bypassCtx, codes.OK, 2)
+
+	// Once the URI has been fetched, other requests can use it again.
+	fetch(ctx, codes.OK, 3)
+}
+
+func TestAssetNotFoundCacheExpiry(t *testing.T) {
+	t.Parallel()
+
+	c := newAssetNotFoundCache(10 * time.Millisecond)
+	c.add("https://example.com/missing")
+
+	if !c.contains("https://example.com/missing") {
+		t.Fatal("expected the URI to be found")
+	}
+	if c.contains("https://example.com/other") {
+		t.Fatal("expected an unrelated URI not to be found")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if c.contains("https://example.com/missing") {
+		t.Fatal("expected the URI to have expired")
+	}
+}
+
+func TestAssetFetchBlobMismatchWindow(t *testing.T) {
+	t.Parallel()
+
+	mismatches := newAssetMismatchCache(time.Minute)
+	fixture := grpcTestSetupWithAssetOptions(t, func(c *assetConfig) error {
+		c.mismatches = mismatches
+		return nil
+	})
+	defer os.Remove(fixture.tempdir)
+
+	blobs := make(map[string][]byte)
+	hashes := make(map[string]string)
+	for _, name := range []string{"/a", "/b"} {
+		blobs[name], hashes[name] = testutils.RandomDataAndHash(256)
+	}
+
+	// A mirror with corrupt copies of everything.
+	var badRequests int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badRequests, 1)
+		corrupt, _ := testutils.RandomDataAndHash(256)
+		_, _ = w.Write(corrupt)
+	}))
+	defer bad.Close()
+
+	var goodRequests int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodRequests, 1)
+		_, _ = w.Write(blobs[r.URL.Path])
+	}))
+	defer good.Close()
+
+	fetch := func(name string) {
+		t.Helper()
+
+		decoded, err := hex.DecodeString(hashes[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{bad.URL + name, good.URL + name},
+			Qualifiers: []*asset.Qualifier{{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(decoded),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected OK, got %v", resp.Status)
+		}
+		if resp.BlobDigest.GetHash() != hashes[name] {
+			t.Fatalf("expected hash %s, got %s", hashes[name], resp.BlobDigest.GetHash())
+		}
+		if resp.Uri != good.URL+name {
+			t.Fatalf("expected the good mirror to be used, got %s", resp.Uri)
+		}
+	}
+
+	fetch("/a")
+	if n := atomic.LoadInt32(&badRequests); n != 1 {
+		t.Fatalf("expected 1 request to the bad mirror, got %d", n)
+	}
+	if !mismatches.contains(bad.URL + "/a") {
+		t.Fatal("expected the bad mirror to be recorded")
+	}
+	if mismatches.contains(good.URL + "/a") {
+		t.Fatal("expected the good mirror not to be recorded")
+	}
+
+	// Other URIs on the bad mirror are tried after the good one, which
+	// succeeds first.
+	fetch("/b")
+	if n := atomic.LoadInt32(&badRequests); n != 1 {
+		t.Fatalf("expected the bad mirror to be tried last, got %d requests", n)
+	}
+	if n := atomic.LoadInt32(&goodRequests); n != 2 {
+		t.Fatalf("expected 2 requests to the good mirror, got %d", n)
+	}
+}
+
+func TestAssetMismatchCacheOrder(t *testing.T) {
+	t.Parallel()
+
+	c := newAssetMismatchCache(10 * time.Millisecond)
+	c.add("https://bad.example.com/a")
+
+	uris := []string{
+		"https://bad.example.com/b",
+		"https://good.example.com/b",
+		"https://other.example.com/b",
+	}
+
+	expected := []string{uris[1], uris[2], uris[0]}
+	if ordered := c.order(uris); strings.Join(ordered, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected %v, got %v", expected, ordered)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if ordered := c.order(uris); strings.Join(ordered, " ") != strings.Join(uris, " ") {
+		t.Fatalf("expected the bad host to have expired, got %v", ordered)
+	}
+}
+
+func TestAssetFetchBlobTimeout(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTimeout(50*time.Millisecond))
+	defer os.Remove(fixture.tempdir)
+
+	// Sends the headers, then stalls until the request is cancelled.
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{stalled.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", resp.Status)
+	}
+
+	// Other URIs are still tried after an attempt times out.
+	blob, hash := testutils.RandomDataAndHash(256)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer upstream.Close()
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{stalled.URL + "/blob", upstream.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+}
+
+func TestAssetFetchBlobRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 300 * time.Millisecond
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchRequestTimeout(timeout))
+	defer os.Remove(fixture.tempdir)
+
+	// Mirrors which are each slow to report that they don't have the
+	// blob, so trying all of them would take much longer than timeout.
+	var numRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	var uris []string
+	for i := 0; i < 20; i++ {
+		uris = append(uris, fmt.Sprintf("%s/blob%d", ts.URL, i))
+	}
+
+	start := time.Now()
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: uris})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", resp.Status)
+	}
+	if elapsed > 3*time.Second {
+		t.Fatalf("expected the fetch to stop after the request timeout of %v, took %v", timeout, elapsed)
+	}
+	if n := atomic.LoadInt32(&numRequests); n >= int32(len(uris)) {
+		t.Fatalf("expected the remaining URIs to be skipped, got %d HTTP requests", n)
+	}
+
+	// A shorter requested timeout takes precedence.
+	start = time.Now()
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       uris,
+		Qualifiers: []*asset.Qualifier{{Name: "bazel_request.requested_timeout", Value: "50ms"}},
+	})
+	elapsed = time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", resp.Status)
+	}
+	if !strings.Contains(resp.Status.GetMessage(), "requested timeout") {
+		t.Fatalf("expected the requested timeout to be exceeded, got %v", resp.Status)
+	}
+	if elapsed >= timeout {
+		t.Fatalf("expected the fetch to stop after the requested timeout, took %v", elapsed)
+	}
+}
+
+func TestAssetFetchBlobClientCancellation(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	cancelled := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer stalled.Close()
+
+	reqCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err := fixture.assetClient.FetchBlob(reqCtx, &asset.FetchBlobRequest{
+		Uris: []string{stalled.URL + "/blob"},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// The upstream request is cancelled too, rather than continuing in
+	// the background.
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not cancelled")
+	}
+}
+
+func TestAssetFetchBlobConcurrentMirrors(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchConcurrency(2))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(4096)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := "sha256-" + base64.StdEncoding.EncodeToString(hashBytes)
+
+	// Sends part of the blob and then stalls, so that the download is
+	// being written to the cache when it's cancelled.
+	cancelled := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		_, _ = w.Write(blob[:len(blob)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer stalled.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer mirror.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris:       []string{stalled.URL + "/blob", mirror.URL + "/blob"},
+		Qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: sri}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	if resp.Uri != mirror.URL+"/blob" {
+		t.Fatalf("expected the blob to be fetched from the mirror, got %q", resp.Uri)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+
+	// The losing download is cancelled rather than continuing in the
+	// background.
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled download was not cancelled")
+	}
+}
+
+func TestAssetFetchBlobConcurrentMirrorsPreferEarliest(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchConcurrency(3))
+	defer os.Remove(fixture.tempdir)
+
+	// Different content, so that we can tell which URI was used.
+	blobs := make(map[string][]byte)
+	for _, path := range []string{"/first", "/second"} {
+		blobs[path], _ = testutils.RandomDataAndHash(256)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first":
+			// Slightly slower than the second URI, but within the
+			// preference window.
+			time.Sleep(20 * time.Millisecond)
+		case "/second":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blobs[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/missing", ts.URL + "/first", ts.URL + "/second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	if resp.Uri != ts.URL+"/first" {
+		t.Fatalf("expected the earliest successful URI to be preferred, got %q", resp.Uri)
+	}
+	if resp.BlobDigest.GetSizeBytes() != int64(len(blobs["/first"])) {
+		t.Fatalf("unexpected digest %v", resp.BlobDigest)
+	}
+}
+
+func TestAssetFetchBlobConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	const concurrency = 2
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchConcurrency(concurrency))
+	defer os.Remove(fixture.tempdir)
+
+	var mu sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	var uris []string
+	for i := 0; i < 5; i++ {
+		uris = append(uris, fmt.Sprintf("%s/missing%d", ts.URL, i))
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: uris})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected NotFound, got %v", resp.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != len(uris) {
+		t.Fatalf("expected all %d URIs to be tried, got %d requests", len(uris), requests)
+	}
+	if maxInFlight > concurrency {
+		t.Fatalf("expected at most %d concurrent fetches, got %d", concurrency, maxInFlight)
+	}
+}
+
+func TestAssetFetchBlobEmptyBody(t *testing.T) {
+	t.Parallel()
+
+	securityLogger := &recordingLogger{}
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetSecurityLogger(securityLogger))
+	defer os.Remove(fixture.tempdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked.tar.gz" {
+			// No Content-Length header, so the body has to be read to
+			// find out that it's empty.
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	_, hash := testutils.RandomDataAndHash(256)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := "sha256-" + base64.StdEncoding.EncodeToString(hashBytes)
+
+	testCases := []struct {
+		path       string
+		qualifiers []*asset.Qualifier
+	}{
+		{path: "/empty.tar.gz", qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: sri}}},
+		{path: "/empty.tar.gz"},
+		{path: "/chunked.tar.gz", qualifiers: []*asset.Qualifier{{Name: "checksum.sri", Value: sri}}},
+		{path: "/chunked.tar.gz"},
+	}
+
+	for _, tc := range testCases {
+		uri := ts.URL + tc.path
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{uri},
+			Qualifiers: tc.qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.NotFound) {
+			t.Fatalf("%s (qualifiers: %v): expected the empty download to be rejected, got %v",
+				tc.path, tc.qualifiers, resp)
+		}
+	}
+
+	for _, path := range []string{"/empty.tar.gz", "/chunked.tar.gz"} {
+		if !securityLogger.contains(ts.URL + path + " SUSPICIOUS: empty response body") {
+			t.Errorf("expected the empty download from %s to be flagged", path)
+		}
+	}
+}
+
+func TestAssetFetchBlobMatchedQualifier(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	err := fixture.diskCache.Put(ctx, cache.CAS, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sri := func(hexHash string) string {
+		hashBytes, err := hex.DecodeString(hexHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "sha256-" + base64.StdEncoding.EncodeToString(hashBytes)
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(256)
+
+	matching := &asset.Qualifier{Name: "checksum.sri", Value: sri(hash)}
+
+	req := asset.FetchBlobRequest{
+		Uris: []string{"http://localhost:0/unused.tar.gz"},
+		Qualifiers: []*asset.Qualifier{
+			{Name: "vcs.branch", Value: "main"},
+			{Name: "checksum.sri", Value: sri(missingHash)},
+			matching,
+		},
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+
+	if len(resp.Qualifiers) != 1 {
+		t.Fatalf("expected exactly one matched qualifier, got %v", resp.Qualifiers)
+	}
+	if resp.Qualifiers[0].Name != matching.Name || resp.Qualifiers[0].Value != matching.Value {
+		t.Fatalf("expected matched qualifier %s=%s, got %s=%s",
+			matching.Name, matching.Value, resp.Qualifiers[0].Name, resp.Qualifiers[0].Value)
+	}
+}
+
+func TestAssetFetchBlobChecksumSidecar(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchChecksumSidecarSuffix(".sha256"))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	_, otherHash := testutils.RandomDataAndHash(256)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.tar.gz", "/bad.tar.gz":
+			_, _ = w.Write(blob)
+		case "/good.tar.gz.sha256":
+			// sha256sum format.
+			_, _ = w.Write([]byte(hash + "  good.tar.gz\n"))
+		case "/bad.tar.gz.sha256":
+			_, _ = w.Write([]byte(otherHash + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/good.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/bad.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected fetch with a mismatching checksum sidecar to fail")
+	}
+}
+
+func TestAssetFetchBlobQuarantine(t *testing.T) {
+	t.Parallel()
+
+	quarantineDir := filepath.Join(testutils.TempDir(t), "quarantine")
+	defer os.RemoveAll(filepath.Dir(quarantineDir))
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchQuarantineDir(quarantineDir))
+	defer os.Remove(fixture.tempdir)
+
+	blob, actualHash := testutils.RandomDataAndHash(256)
+	_, expectedHash := testutils.RandomDataAndHash(256)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	hashBytes, err := hex.DecodeString(expectedHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := ts.URL + "/compromised.tar.gz"
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{uri},
+		Qualifiers: []*asset.Qualifier{
+			{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected the mismatching fetch to fail, got %v", resp.Status)
+	}
+
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, actualHash, int64(len(blob)))
+	if found {
+		t.Fatal("expected the mismatching content not to be cached")
+	}
+
+	quarantined, err := os.ReadFile(filepath.Join(quarantineDir, actualHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(quarantined, blob) {
+		t.Fatal("quarantined content differs from the downloaded content")
+	}
+
+	index, err := os.ReadFile(filepath.Join(quarantineDir, quarantineIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record quarantineRecord
+	err = json.Unmarshal(index, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.URI != uri || record.ExpectedHash != expectedHash ||
+		record.ActualHash != actualHash || record.Size != int64(len(blob)) {
+		t.Fatalf("unexpected quarantine record: %+v", record)
+	}
+}
+
+func TestAssetFetchBlobTempBudget(t *testing.T) {
+	t.Parallel()
+
+	const blobSize = 768
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTempBudget(1024))
+	defer os.Remove(fixture.tempdir)
+
+	// Each download needs most of a budget of this size, so they must
+	// be written to the cache one at a time.
+	var inProgress, maxInProgress int32
+	budget := newAssetTempBudget(1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, err := budget.reserve(ctx, blobSize)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+
+			n := atomic.AddInt32(&inProgress, 1)
+			for {
+				m := atomic.LoadInt32(&maxInProgress)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInProgress, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inProgress, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxInProgress != 1 {
+		t.Fatalf("expected reservations to be serialized, got %d at once", maxInProgress)
+	}
+
+	// Concurrent fetches still succeed, by waiting their turn.
+	blobs := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		blob, hash := testutils.RandomDataAndHash(blobSize)
+		blobs["/"+hash] = blob
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blobs[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	for path := range blobs {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+				Uris: []string{ts.URL + path},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Status.GetCode() != int32(codes.OK) {
+				t.Errorf("expected successful fetch of %s, got %v", path, resp.Status)
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	// Downloads larger than the budget fail.
+	_, err := budget.reserve(ctx, 2048)
+	if err == nil {
+		t.Fatal("expected a reservation larger than the budget to fail")
+	}
+}
+
+func TestAssetFetchBlobHostMaxSize(t *testing.T) {
+	t.Parallel()
+
+	small, smallHash := testutils.RandomDataAndHash(100)
+	large, largeHash := testutils.RandomDataAndHash(1000)
+	blobs := map[string][]byte{"/small": small, "/large": large}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "" {
+			// Don't send a Content-Length header.
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(blobs[r.URL.Path])
+	})
+	trusted := httptest.NewServer(handler)
+	defer trusted.Close()
+	untrusted := httptest.NewServer(handler)
+	defer untrusted.Close()
+
+	trustedURL, err := url.Parse(trusted.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedURL, err := url.Parse(untrusted.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchHostMaxSize(trustedURL.Host, 2000),
+		WithAssetFetchHostMaxSize(untrustedURL.Host, 500))
+	defer os.Remove(fixture.tempdir)
+
+	testCases := []struct {
+		uri  string
+		hash string
+	}{
+		{trusted.URL + "/small", smallHash},
+		{trusted.URL + "/large", largeHash},
+		{untrusted.URL + "/small", smallHash},
+		{untrusted.URL + "/large", ""},
+		{untrusted.URL + "/large?chunked=1", ""},
+	}
+
+	for _, tc := range testCases {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{tc.uri},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.hash == "" {
+			if resp.Status.GetCode() != int32(codes.NotFound) {
+				t.Errorf("expected %s to be rejected, got %v", tc.uri, resp.Status)
+			}
+			continue
+		}
+
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Errorf("expected successful fetch of %s, got %v", tc.uri, resp.Status)
+		} else if resp.BlobDigest.GetHash() != tc.hash {
+			t.Errorf("expected hash %s for %s, got %s", tc.hash, tc.uri,
+				resp.BlobDigest.GetHash())
+		}
+	}
+
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, largeHash, int64(len(large)))
+	if !found {
+		t.Fatal("expected the large blob from the trusted host to be cached")
+	}
+}
+
+func TestAssetFetchBlobMaxSize(t *testing.T) {
+	t.Parallel()
+
+	small, smallHash := testutils.RandomDataAndHash(100)
+	large, largeHash := testutils.RandomDataAndHash(1000)
+	blobs := map[string][]byte{"/small": small, "/large": large}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob := blobs[r.URL.Path]
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.WriteHeader(http.StatusOK)
+			if r.URL.Path == "/large" {
+				// The response should be rejected before the body
+				// is read, otherwise the truncated body would be
+				// reported as a transient failure.
+				return
+			}
+		} else {
+			// Don't send a Content-Length header.
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The global limit applies, since it is smaller than the host's.
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchMaxSize(500),
+		WithAssetFetchHostMaxSize(tsURL.Host, 2000))
+	defer os.Remove(fixture.tempdir)
+
+	testCases := []struct {
+		uri  string
+		hash string
+	}{
+		{ts.URL + "/small", smallHash},
+		{ts.URL + "/small?chunked=1", smallHash},
+		{ts.URL + "/large", ""},
+		{ts.URL + "/large?chunked=1", ""},
+	}
+
+	for _, tc := range testCases {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{tc.uri},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.hash == "" {
+			if resp.Status.GetCode() != int32(codes.NotFound) {
+				t.Errorf("expected %s to be rejected, got %v", tc.uri, resp.Status)
+			}
+			continue
+		}
+
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Errorf("expected successful fetch of %s, got %v", tc.uri, resp.Status)
+		} else if resp.BlobDigest.GetHash() != tc.hash {
+			t.Errorf("expected hash %s for %s, got %s", tc.hash, tc.uri,
+				resp.BlobDigest.GetHash())
+		}
+	}
+
+	found, _ := fixture.diskCache.Contains(ctx, cache.CAS, largeHash, -1)
+	if found {
+		t.Fatal("expected the large blob not to be cached")
+	}
+}
+
+// A CredentialProvider which returns a new token for each request.
+type rotatingTokenProvider struct {
+	count int32
+}
+
+func (p *rotatingTokenProvider) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	n := atomic.AddInt32(&p.count, 1)
+	headers := make(http.Header)
+	headers.Set("Authorization", fmt.Sprintf("Bearer token-%d", n))
+	return headers, nil
+}
+
+func TestAssetFetchBlobCredentialProvider(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchCredentialProvider(&rotatingTokenProvider{}))
+	defer os.Remove(fixture.tempdir)
+
+	var mu sync.Mutex
+	var tokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mu.Unlock()
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + path},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected successful fetch, got %v", resp.Status)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"Bearer token-1", "Bearer token-2"}
+	if len(tokens) != len(expected) || tokens[0] != expected[0] || tokens[1] != expected[1] {
+		t.Fatalf("expected the current token to be sent with each request %v, got %v",
+			expected, tokens)
+	}
+}
+
+// cachingTokenProvider returns a cached token until it is refreshed.
+type cachingTokenProvider struct {
+	generation int32
+	refreshes  int32
+}
+
+func (p *cachingTokenProvider) Headers(ctx context.Context, u *url.URL) (http.Header, error) {
+	headers := make(http.Header)
+	headers.Set("Authorization", fmt.Sprintf("Bearer token-%d", atomic.LoadInt32(&p.generation)))
+	return headers, nil
+}
+
+func (p *cachingTokenProvider) Refresh(ctx context.Context, u *url.URL) error {
+	atomic.AddInt32(&p.refreshes, 1)
+	atomic.AddInt32(&p.generation, 1)
+	return nil
+}
+
+func TestAssetFetchBlobRefreshOnForbidden(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		refresh       bool
+		expectedCode  codes.Code
+		expectedCalls int32
+		expectedRefs  int32
+	}{
+		{"disabled", false, codes.NotFound, 1, 0},
+		{"enabled", true, codes.OK, 2, 1},
+	}
+
+	for _, tc := range testCases {
+		provider := &cachingTokenProvider{}
+		opts := []AssetOption{WithAssetFetchCredentialProvider(provider)}
+		if tc.refresh {
+			opts = append(opts, WithAssetFetchRefreshOnForbidden())
+		}
+		fixture := grpcTestSetupWithAssetOptions(t, opts...)
+		defer os.Remove(fixture.tempdir)
+
+		var calls int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.Header.Get("Authorization") != "Bearer token-1" {
+				// The token has expired.
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte("secret"))
+		}))
+		defer ts.Close()
+
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{ts.URL + "/file"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(tc.expectedCode) {
+			t.Fatalf("%s: expected status %v, got %v", tc.name, tc.expectedCode, resp.Status)
+		}
+
+		n := atomic.LoadInt32(&calls)
+		if n != tc.expectedCalls {
+			t.Fatalf("%s: expected %d requests, got %d", tc.name, tc.expectedCalls, n)
+		}
+		n = atomic.LoadInt32(&provider.refreshes)
+		if n != tc.expectedRefs {
+			t.Fatalf("%s: expected %d credential refreshes, got %d", tc.name, tc.expectedRefs, n)
+		}
+	}
+}
+
+func TestStaticCredentialProvider(t *testing.T) {
+	provider := NewStaticCredentialProvider(map[string]http.Header{
+		"example.com":           {"Authorization": {"Bearer any-port"}},
+		"mirror.example.com:88": {"Authorization": {"Bearer port-88"}},
+	})
+
+	testCases := []struct {
+		uri      string
+		expected string
+	}{
+		{"https://example.com/foo", "Bearer any-port"},
+		{"https://example.com:8443/foo", "Bearer any-port"},
+		{"https://mirror.example.com:88/foo", "Bearer port-88"},
+		{"https://mirror.example.com/foo", ""},
+		{"https://other.example.com/foo", ""},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers, err := provider.Headers(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers.Get("Authorization") != tc.expected {
+			t.Errorf("expected %q for %s, got %q", tc.expected, tc.uri,
+				headers.Get("Authorization"))
+		}
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	data := `machine example.com login alice password secret1
+# Tokens can be split across lines.
+machine mirror.example.com
+	login bob
+	account ignored
+	password secret2
+
+macdef init
+machine macro.example.com login eve password macro
+
+machine example.com login mallory password duplicate
+default login anonymous password default
+`
+
+	expected := []netrcMachine{
+		{machine: "example.com", login: "alice", password: "secret1"},
+		{machine: "mirror.example.com", login: "bob", password: "secret2"},
+		{machine: "example.com", login: "mallory", password: "duplicate"},
+	}
+
+	machines := parseNetrc(data)
+	if len(machines) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, machines)
+	}
+	for i := range expected {
+		if machines[i] != expected[i] {
+			t.Errorf("expected entry %d to be %v, got %v", i, expected[i], machines[i])
+		}
+	}
+}
+
+func TestNetrcCredentialProvider(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	netrcPath := filepath.Join(dir, "netrc")
+	err := os.WriteFile(netrcPath, []byte(`machine example.com login alice password secret1
+machine example.com login mallory password duplicate
+default login anonymous password default
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewNetrcCredentialProvider(netrcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		uri      string
+		expected string
+	}{
+		{"https://example.com/foo", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret1"))},
+		{"https://example.com:8443/foo", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret1"))},
+		{"https://other.example.com/foo", ""},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers, err := provider.Headers(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers.Get("Authorization") != tc.expected {
+			t.Errorf("expected %q for %s, got %q", tc.expected, tc.uri,
+				headers.Get("Authorization"))
+		}
+	}
+
+	_, err = NewNetrcCredentialProvider(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Fatal("expected an error for a missing netrc file")
+	}
+}
+
+func TestAssetFetchBlobCredentialsNotRedirected(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var mu sync.Mutex
+	var cdnHeaders http.Header
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cdnHeaders = r.Header.Clone()
+		mu.Unlock()
+		_, _ = w.Write(blob)
+	}))
+	defer cdn.Close()
+
+	// The CDN is reached via a different host name for the same address.
+	cdnURL, err := url.Parse(cdn.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdnURL.Host = "localhost:" + cdnURL.Port()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "alice" || password != "secret" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, cdnURL.String()+r.URL.Path, http.StatusFound)
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchCredentialProvider(NewStaticCredentialProvider(map[string]http.Header{
+			originURL.Host: {
+				"Authorization": {"Basic " + auth},
+				"X-Api-Key":     {"key"},
+			},
+		})))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{origin.URL + "/release.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if cdnHeaders.Get("Authorization") != "" || cdnHeaders.Get("X-Api-Key") != "" {
+		t.Fatalf("expected credentials not to be sent to a different host, got %v", cdnHeaders)
+	}
+}
+
+func TestAssetFetchBlobHostMaxRedirects(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var targetRequests int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&targetRequests, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer target.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/blob", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same server, reached via a host that isn't allowed to redirect.
+	noRedirects := "http://localhost:" + originURL.Port()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchHostMaxRedirects("localhost", 0))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{noRedirects + "/redirect"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("expected the redirect to be rejected, got %v", resp.Status)
+	}
+	if n := atomic.LoadInt32(&targetRequests); n != 0 {
+		t.Fatalf("expected the redirect not to be followed, got %d requests", n)
+	}
+
+	// Other hosts can still redirect.
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{origin.URL + "/redirect"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected the redirect to be followed, got %v %v", resp.Status, resp.BlobDigest)
+	}
+}
+
+func TestAssetFetchBlobRewrite(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var requestedPath atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath.Store(r.URL.Path)
+		if r.URL.Path != "/upstream/pkg/foo.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer proxy.Close()
+
+	target, err := url.Parse(proxy.URL + "/upstream/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchRewrite("upstream.invalid", target))
+	defer os.Remove(fixture.tempdir)
+
+	// This host doesn't resolve, so the fetch only succeeds if the
+	// request is sent to the proxy.
+	uri := "https://upstream.invalid/pkg/foo.tar.gz"
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{uri},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected successful fetch, got %v (proxy request path: %v)",
+			resp.Status, requestedPath.Load())
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if resp.Uri != uri {
+		t.Fatalf("expected the original URI %s in the response, got %s", uri, resp.Uri)
+	}
+}
+
+func TestAssetFetchBlobRegionOrdering(t *testing.T) {
+	t.Parallel()
+
+	blob, _ := testutils.RandomDataAndHash(256)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	})
+
+	euMirror := httptest.NewServer(handler)
+	defer euMirror.Close()
+	usMirror := httptest.NewServer(handler)
+	defer usMirror.Close()
+
+	hostOf := func(srv *httptest.Server) string {
+		return strings.TrimPrefix(srv.URL, "http://")
+	}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchRegion("us"),
+		WithAssetFetchHostRegion(hostOf(euMirror), "eu"),
+		WithAssetFetchHostRegion(hostOf(usMirror), "us"))
+	defer os.Remove(fixture.tempdir)
+
+	euURI := euMirror.URL + "/foo.tar.gz"
+	usURI := usMirror.URL + "/foo.tar.gz"
+
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		expected string
+	}{
+		{"server region", ctx, usURI},
+		{"client region", metadata.AppendToOutgoingContext(ctx, assetRegionKey, "eu"), euURI},
+	}
+
+	for _, tc := range testCases {
+		// Put the expected URI last, so it is only tried first if the
+		// region ordering works.
+		uris := []string{euURI, usURI}
+		if tc.expected == euURI {
+			uris = []string{usURI, euURI}
+		}
+
+		resp, err := fixture.assetClient.FetchBlob(tc.ctx, &asset.FetchBlobRequest{Uris: uris})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("%s: expected successful fetch, got %v", tc.name, resp.Status)
+		}
+		if resp.Uri != tc.expected {
+			t.Fatalf("%s: expected %s to be tried first, got %s", tc.name, tc.expected, resp.Uri)
+		}
+	}
+}
+
+func TestAssetFetchBlobUnsupportedScheme(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{"gs://bucket/foo.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+		t.Fatalf("expected InvalidArgument, got %v", resp.Status)
+	}
+	if !strings.Contains(resp.Status.GetMessage(), "gs") {
+		t.Fatalf("expected the status message to mention the unsupported scheme, got %q",
+			resp.Status.GetMessage())
+	}
+}
+
+func TestAssetFetchBlobMalformedURI(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	for _, uri := range []string{"", "  \t", "http://[::1"} {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{"https://example.com/foo.tar.gz", uri},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+			t.Fatalf("expected InvalidArgument for %q, got %v", uri, resp.Status)
+		}
+		if !strings.Contains(resp.Status.GetMessage(), "index 1") {
+			t.Fatalf("expected the status message to identify the invalid URI, got %q",
+				resp.Status.GetMessage())
+		}
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Status.GetMessage(), "empty URI") {
+		t.Fatalf("expected the status message to describe the empty URI, got %q",
+			resp.Status.GetMessage())
+	}
+}
+
+func TestAssetFetchBlobRequestLimits(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetRequestLimits(1024, 2, 2, 100))
+	defer os.Remove(fixture.tempdir)
+
+	testCases := []struct {
+		name string
+		req  *asset.FetchBlobRequest
+		code codes.Code
+	}{
+		{
+			name: "request size",
+			req: &asset.FetchBlobRequest{
+				Uris: []string{"https://example.com/" + strings.Repeat("a", 2000)},
+			},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "URI count",
+			req: &asset.FetchBlobRequest{
+				Uris: []string{"https://a.example.com/", "https://b.example.com/",
+					"https://c.example.com/"},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "qualifier count",
+			req: &asset.FetchBlobRequest{
+				Qualifiers: []*asset.Qualifier{
+					{Name: "a", Value: "1"},
+					{Name: "b", Value: "2"},
+					{Name: "c", Value: "3"},
+				},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "qualifier value length",
+			req: &asset.FetchBlobRequest{
+				Qualifiers: []*asset.Qualifier{
+					{Name: "checksum.sri", Value: strings.Repeat("a", 101)},
+				},
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		resp, err := fixture.assetClient.FetchBlob(ctx, tc.req)
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+
+		if resp.Status.GetCode() != int32(tc.code) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.code, resp.Status)
+		}
+	}
+}
+
+func TestAssetFetchBlobTransportTimeouts(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 200 * time.Millisecond
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchTransportTimeouts(timeout, timeout, timeout))
+	defer os.Remove(fixture.tempdir)
+
+	// Accept connections, but never complete a TLS handshake.
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	var connsMu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns = append(conns, c)
+			connsMu.Unlock()
+		}
+	}()
+
+	start := time.Now()
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{"https://" + stalled.Addr().String() + "/foo.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected fetch from a stalled TLS server to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("expected the TLS handshake timeout to fire, but the fetch took %v", elapsed)
+	}
+
+	// A response body which takes longer than all of the timeouts to
+	// download should still succeed.
+	blob, hash := testutils.RandomDataAndHash(1024)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+		for i := 0; i < 4; i++ {
+			_, _ = w.Write(blob[i*len(blob)/4 : (i+1)*len(blob)/4])
+			w.(http.Flusher).Flush()
+			time.Sleep(timeout)
+		}
+	}))
+	defer slow.Close()
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{slow.URL + "/foo.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected slow download to succeed, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+}
+
+func TestAssetFetchBlobMaxResponseHeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	const maxHeaderBytes = 4096
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchMaxResponseHeaderBytes(maxHeaderBytes),
+		WithAssetFetchRetries(2), withFastAssetFetchBackoff)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var hugeAttempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			atomic.AddInt32(&hugeAttempts, 1)
+			w.Header().Set("X-Padding", strings.Repeat("x", 2*maxHeaderBytes))
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/huge", ts.URL + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if resp.Uri != ts.URL+"/blob" {
+		t.Fatalf("expected the URI with oversized headers to be skipped, got %s", resp.Uri)
+	}
+
+	// Oversized headers are not a transient failure.
+	n := atomic.LoadInt32(&hugeAttempts)
+	if n != 1 {
+		t.Fatalf("expected 1 attempt for the URI with oversized headers, got %d", n)
+	}
+}
+
+func TestAssetFetchBlobMaxConnsPerHost(t *testing.T) {
+	t.Parallel()
+
+	const maxConns = 2
+	const fetches = 5
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchMaxConnsPerHost(maxConns))
+	defer os.Remove(fixture.tempdir)
+
+	blob, _ := testutils.RandomDataAndHash(256)
+
+	var mu sync.Mutex
+	open := 0
+	maxOpen := 0
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep the connection busy, so that other fetches need another
+		// connection or have to wait.
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write(blob)
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch state {
+		case http.StateNew:
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, fetches)
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+				Uris: []string{fmt.Sprintf("%s/blob%d", ts.URL, i)},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.Status.GetCode() != int32(codes.OK) {
+				errs <- fmt.Errorf("fetch %d: expected OK, got %v", i, resp.Status)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOpen > maxConns {
+		t.Fatalf("expected at most %d connections open at the same time, got %d", maxConns, maxOpen)
+	}
+}
+
+func TestAssetFetchBlobHTTPSOnly(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var httpRequests int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&httpRequests, 1)
+		_, _ = w.Write(blob)
+	}))
+	defer httpServer.Close()
+
+	httpsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer httpsServer.Close()
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(httpsServer.Certificate())
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchHTTPSOnly(),
+		WithAssetFetchTLSConfig(strings.TrimPrefix(httpsServer.URL, "https://"),
+			&tls.Config{RootCAs: caPool}))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{httpServer.URL + "/foo.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected http fetch to be skipped")
+	}
+	n := atomic.LoadInt32(&httpRequests)
+	if n != 0 {
+		t.Fatalf("expected no requests to the http server, got %d", n)
+	}
+
+	resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{httpServer.URL + "/foo.tar.gz", httpsServer.URL + "/foo.tar.gz"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected https fetch to succeed, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+	if resp.Uri != httpsServer.URL+"/foo.tar.gz" {
+		t.Fatalf("expected the https URI to be used, got %s", resp.Uri)
+	}
+}
+
+// Returns a PEM encoded self-signed certificate, which is unrelated to
+// any other certificate.
+func unrelatedCertPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "unrelated test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestAssetFetchBlobTLSReload(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+
+	// Start with a CA bundle that doesn't include the server's certificate.
+	err := os.WriteFile(caFile, unrelatedCertPEM(t), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadCAFile := func() (*tls.Config, error) {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found")
+		}
+		return &tls.Config{RootCAs: pool}, nil
+	}
+
+	reload := make(chan struct{})
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetFetchTLSConfigLoader(strings.TrimPrefix(ts.URL, "https://"), loadCAFile),
+		WithAssetFetchTLSReload(reload))
+	defer os.Remove(fixture.tempdir)
+
+	req := asset.FetchBlobRequest{Uris: []string{ts.URL + "/foo.tar.gz"}}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected fetch to fail before the CA bundle is updated")
+	}
+
+	// Rotate the CA bundle, and reload.
+	serverCertPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.Certificate().Raw,
+	})
+	err = os.WriteFile(caFile, serverCertPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload <- struct{}{}
+
+	// The reload happens asynchronously.
+	for i := 0; i < 100; i++ {
+		resp, err = fixture.assetClient.FetchBlob(ctx, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() == int32(codes.OK) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp.Status.GetCode() != int32(codes.OK) {
+		t.Fatalf("expected fetch to succeed after reloading the CA bundle, got %v", resp.Status)
+	}
+	if resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected hash %s, got %s", hash, resp.BlobDigest.GetHash())
+	}
+}
+
+// recordingLogger is a cache.Logger which keeps the formatted messages.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAssetSecurityLogger(t *testing.T) {
+	t.Parallel()
+
+	securityLogger := &recordingLogger{}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetSecurityLogger(securityLogger),
+		WithAssetFetchHTTPSOnly(),
+		WithAssetFetchTLSConfig("insecure.example.com", &tls.Config{InsecureSkipVerify: true}))
+	defer os.Remove(fixture.tempdir)
+
+	uri := "http://localhost:0/foo.tar.gz"
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: []string{uri}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatal("expected http fetch to be blocked")
+	}
+
+	if !securityLogger.contains(uri + " BLOCKED") {
+		t.Fatal("expected blocked fetch to be logged to the security logger")
+	}
+
+	if !securityLogger.contains("insecure.example.com") {
+		t.Fatal("expected disabled TLS verification to be logged to the security logger")
+	}
+}
+
+func TestAssetHostPolicy(t *testing.T) {
+	c := &assetConfig{}
+	for _, o := range []AssetOption{
+		WithAssetFetchAllowedHosts([]string{"GitHub.com", "*.example.com", "192.0.2.1", "10.1.2.3"}),
+		WithAssetFetchBlockedNetworks([]string{"10.0.0.0/8", "fe80::/10"}),
+	} {
+		err := o(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		uri     string
+		allowed bool
+	}{
+		{"https://github.com/foo.tar.gz", true},
+		{"https://GITHUB.COM:443/foo.tar.gz", true},
+		{"https://api.github.com/foo.tar.gz", false},
+		{"https://mirror.example.com/foo.tar.gz", true},
+		{"https://a.b.example.com/foo.tar.gz", true},
+		{"https://example.com/foo.tar.gz", false},
+		{"https://badexample.com/foo.tar.gz", false},
+		{"http://192.0.2.1/foo.tar.gz", true},
+		{"http://192.0.2.2/foo.tar.gz", false},
+		// Allowed, but in a blocked network.
+		{"http://10.1.2.3/foo.tar.gz", false},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.hostPolicy.checkURL(u)
+		if tc.allowed && err != nil {
+			t.Errorf("expected %s to be allowed, got: %v", tc.uri, err)
+		}
+		var blockedErr *blockedFetchError
+		if !tc.allowed && !errors.As(err, &blockedErr) {
+			t.Errorf("expected %s to be blocked, got: %v", tc.uri, err)
+		}
+	}
+
+	for _, addr := range []string{"10.0.0.1:80", "[fe80::1]:443"} {
+		err := c.hostPolicy.controlDial("tcp", addr, nil)
+		if err == nil {
+			t.Errorf("expected connections to %s to be blocked", addr)
+		}
+	}
+	err := c.hostPolicy.controlDial("tcp", "192.0.2.1:80", nil)
+	if err != nil {
+		t.Errorf("expected connections to 192.0.2.1 to be allowed, got: %v", err)
+	}
+
+	for _, o := range []AssetOption{
+		WithAssetFetchAllowedHosts([]string{"example.com/foo"}),
+		WithAssetFetchAllowedHosts([]string{"*."}),
+		WithAssetFetchBlockedNetworks([]string{"10.0.0.0"}),
+	} {
+		err = o(&assetConfig{})
+		if err == nil {
+			t.Error("expected an invalid setting to be rejected")
+		}
+	}
+}
+
+func TestAssetFetchBlobBlockedNetworks(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer ts.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	securityLogger := &recordingLogger{}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetSecurityLogger(securityLogger),
+		WithAssetFetchBlockedNetworks([]string{"127.0.0.0/8", "::1/128", "0.0.0.0/8", "::/128"}))
+	defer os.Remove(fixture.tempdir)
+
+	for _, uri := range []string{
+		ts.URL + "/blob",
+		// Only blocked once the hostname has been resolved.
+		"http://localhost:" + tsURL.Port() + "/blob",
+		// Connecting to the unspecified address reaches the local host.
+		"http://0.0.0.0:" + tsURL.Port() + "/blob",
+	} {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: []string{uri}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.NotFound) {
+			t.Fatalf("%s: expected NotFound, got %v", uri, resp.Status)
+		}
+		if !securityLogger.contains(uri + " BLOCKED") {
+			t.Fatalf("%s: expected blocked fetch to be logged to the security logger", uri)
+		}
+	}
+
+	if requests.Load() != 0 {
+		t.Fatalf("expected no requests to reach the blocked server, got %d", requests.Load())
+	}
+}
+
+func TestAssetFetchBlockedNetworksViaProxy(t *testing.T) {
+	t.Parallel()
+
+	c := &assetConfig{}
+	err := WithAssetFetchBlockedNetworks([]string{"127.0.0.0/8", "::1/128"})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyURL, err := url.Parse("http://proxy.example.com:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := c.hostPolicy.checkProxiedRequest(http.ProxyURL(proxyURL))
+
+	for _, uri := range []string{
+		"http://127.0.0.1:8080/blob",
+		"http://localhost:8080/blob",
+	} {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = proxy(req)
+		var blocked *blockedFetchError
+		if !errors.As(err, &blocked) {
+			t.Fatalf("%s: expected the proxied request to be blocked, got %v", uri, err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://192.0.2.1/blob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != proxyURL.String() {
+		t.Fatalf("expected proxy %s, got %v", proxyURL, u)
+	}
+}
+
+func TestAssetFetchBlobAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	var internalRequests atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalRequests.Add(1)
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer internal.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, internal.URL+"/blob", http.StatusFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := "http://localhost:" + tsURL.Port()
+
+	securityLogger := &recordingLogger{}
+
+	fixture := grpcTestSetupWithAssetOptions(t,
+		WithAssetSecurityLogger(securityLogger),
+		WithAssetFetchAllowedHosts([]string{"localhost"}))
+	defer os.Remove(fixture.tempdir)
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{allowed + "/blob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected the allowed host to be fetched, got %v", resp)
+	}
+
+	for _, uri := range []string{
+		ts.URL + "/blob",
+		// Redirects to a host that isn't allowed.
+		allowed + "/redirect",
+	} {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{Uris: []string{uri}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.NotFound) {
+			t.Fatalf("%s: expected NotFound, got %v", uri, resp.Status)
+		}
+		if !securityLogger.contains(uri + " BLOCKED") {
+			t.Fatalf("%s: expected blocked fetch to be logged to the security logger", uri)
+		}
+	}
+
+	if internalRequests.Load() != 0 {
+		t.Fatalf("expected the redirect not to be followed, got %d requests", internalRequests.Load())
+	}
+}
+
+func TestAssetFetchBlobHTTPHeaderQualifiers(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	headers := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/archive"},
+		Qualifiers: []*asset.Qualifier{
+			{Name: "http_header:accept", Value: "application/x-tar"},
+			{Name: "http_header:User-Agent", Value: "test-client/1.0"},
+			{Name: "http_header:X-Forge-Format", Value: "tarball"},
+			{Name: "http_header:Authorization", Value: "Bearer stolen"},
+			{Name: "http_header:Connection", Value: "Upgrade"},
+			{Name: "http_header:Upgrade", Value: "websocket"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected successful fetch of %s, got %v", hash, resp)
+	}
+
+	h := <-headers
+	expected := map[string]string{
+		"Accept":         "application/x-tar",
+		"User-Agent":     "test-client/1.0",
+		"X-Forge-Format": "tarball",
+		"Authorization":  "",
+		"Connection":     "",
+		"Upgrade":        "",
+	}
+	for name, value := range expected {
+		if h.Get(name) != value {
+			t.Errorf("expected %s header %q, got %q", name, value, h.Get(name))
+		}
+	}
+
+	for _, q := range []*asset.Qualifier{
+		{Name: "http_header:", Value: "x"},
+		{Name: "http_header:Bad Name", Value: "x"},
+		{Name: "http_header:X-Injected", Value: "x\r\nHost: example.com"},
+	} {
+		resp, err = fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + "/archive"},
+			Qualifiers: []*asset.Qualifier{q},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.InvalidArgument) {
+			t.Errorf("expected InvalidArgument for qualifier %q=%q, got %v", q.Name, q.Value, resp.Status)
+		}
+	}
+}
+
+func TestAssetFetchBlobBufferSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchBufferSize(1024*1024))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(3 * 1024 * 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer ts.Close()
+
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both with and without a checksum, which are written to the
+	// cache in different ways. The blob is only in the cache for the
+	// second request, which has no checksum, so it's downloaded again.
+	for _, qualifiers := range [][]*asset.Qualifier{
+		{{Name: "checksum.sri", Value: "sha256-" + base64.StdEncoding.EncodeToString(sum)}},
+		nil,
+	} {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + "/blob"},
+			Qualifiers: qualifiers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) || resp.BlobDigest.GetHash() != hash {
+			t.Fatalf("expected successful fetch of %s, got %v", hash, resp)
+		}
+	}
+}
+
+func BenchmarkAssetFetchBufferSize(b *testing.B) {
+	const blobSize = 64 * 1024 * 1024
+	data, _ := testutils.RandomDataAndHash(blobSize)
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{name: "32KiB", size: defaultAssetFetchBufferSize},
+		{name: "1MiB", size: 1024 * 1024},
+	}
+
+	for _, tc := range sizes {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(blobSize)
+
+			for i := 0; i < b.N; i++ {
+				spool := newDownloadSpool("")
+
+				// Like the response body in fetchItem, the reader
+				// doesn't implement io.WriterTo, so the buffer is used.
+				download := &readErrorRecorder{r: bytes.NewReader(data)}
+				_, err := io.CopyBuffer(spool, download, make([]byte, tc.size))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = spool.sha256Hash()
+				_ = spool.alt.sums()
+
+				spool.close()
+			}
+		})
+	}
+}
+
+func TestAssetFetchTrackerDebugDump(t *testing.T) {
+	t.Parallel()
+
+	tracker := NewAssetFetchTracker()
+	fixture := grpcTestSetupWithAssetOptions(t, WithAssetFetchTracker(tracker))
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(1024)
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		_, _ = w.Write(blob[:100])
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write(blob[100:])
+	}))
+	defer ts.Close()
+
+	uri := ts.URL + "/slow"
+
+	type fetchResponse struct {
+		resp *asset.FetchBlobResponse
+		err  error
+	}
+	fetched := make(chan fetchResponse, 1)
+	go func() {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{uri},
+		})
+		fetched <- fetchResponse{resp: resp, err: err}
+	}()
+
+	dump := func() []trackedFetchInfo {
+		rec := httptest.NewRecorder()
+		tracker.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/asset", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("expected application/json content type, got %q", ct)
+		}
+
+		var infos []trackedFetchInfo
+		err := json.Unmarshal(rec.Body.Bytes(), &infos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	var found *trackedFetchInfo
+	deadline := time.Now().Add(10 * time.Second)
+	for found == nil && time.Now().Before(deadline) {
+		for _, info := range dump() {
+			if info.URI == uri && info.Bytes > 0 {
+				found = &info
+				break
+			}
+		}
+		if found == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	close(release)
+
+	if found == nil {
+		t.Fatalf("%s did not appear in the debug dump", uri)
+	}
+	if found.DigestFunction != "SHA256" {
+		t.Errorf("expected SHA256 digest function, got %q", found.DigestFunction)
+	}
+	if found.Bytes != 100 {
+		t.Errorf("expected 100 bytes read so far, got %d", found.Bytes)
+	}
+
+	f := <-fetched
+	if f.err != nil {
+		t.Fatal(f.err)
+	}
+	if f.resp.Status.GetCode() != int32(codes.OK) || f.resp.BlobDigest.GetHash() != hash {
+		t.Fatalf("expected successful fetch of %s, got %v", hash, f.resp)
+	}
+
+	infos := dump()
+	if len(infos) != 0 {
+		t.Fatalf("expected no fetches in progress, got %v", infos)
+	}
+}
+
+// Not parallel, since the metrics are global.
+func TestAssetFetchMetrics(t *testing.T) {
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	blob, hash := testutils.RandomDataAndHash(1024)
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blob":
+			_, _ = w.Write(blob)
+		case "/broken":
+			w.WriteHeader(http.StatusNotImplemented)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	requests := func(method string, outcome assetSource) float64 {
+		return testutil.ToFloat64(assetRequests.WithLabelValues(method, "SHA256", string(outcome)))
+	}
+	downloads := func(outcome string) float64 {
+		return testutil.ToFloat64(assetDownloads.WithLabelValues("SHA256", outcome))
+	}
+	downloadedBytes := func() float64 {
+		return testutil.ToFloat64(assetDownloadedBytes.WithLabelValues("SHA256"))
+	}
+
+	type counts struct {
+		blobDownloads, blobChecksumHits, blobFailures, directoryFailures float64
+		success, notFound, serverError, bytes                            float64
+	}
+	snapshot := func() counts {
+		return counts{
+			blobDownloads:     requests("FetchBlob", assetSourceDownload),
+			blobChecksumHits:  requests("FetchBlob", assetSourceChecksum),
+			blobFailures:      requests("FetchBlob", assetSourceNone),
+			directoryFailures: requests("FetchDirectory", assetSourceNone),
+			success:           downloads("success"),
+			notFound:          downloads("not_found"),
+			serverError:       downloads("server_error"),
+			bytes:             downloadedBytes(),
+		}
+	}
+
+	before := snapshot()
+
+	sri := &asset.Qualifier{
+		Name:  "checksum.sri",
+		Value: "sha256-" + base64.StdEncoding.EncodeToString(hashBytes),
+	}
+
+	// Downloaded, then found by its checksum.
+	for i := 0; i < 2; i++ {
+		resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris:       []string{ts.URL + "/blob"},
+			Qualifiers: []*asset.Qualifier{sri},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status.GetCode() != int32(codes.OK) {
+			t.Fatalf("expected OK, got %v", resp.Status)
+		}
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{ts.URL + "/missing", ts.URL + "/broken"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.GetCode() == int32(codes.OK) {
+		t.Fatalf("expected the fetch to fail, got %v", resp)
+	}
+
+	// Only counted as a FetchDirectory request, not also as a FetchBlob
+	// request for the archive.
+	dirResp, err := fixture.assetClient.FetchDirectory(ctx, &asset.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/missing.tar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirResp.Status.GetCode() == int32(codes.OK) {
+		t.Fatalf("expected the fetch to fail, got %v", dirResp)
+	}
+
+	after := snapshot()
+	expected := counts{
+		blobDownloads:     before.blobDownloads + 1,
+		blobChecksumHits:  before.blobChecksumHits + 1,
+		blobFailures:      before.blobFailures + 1,
+		directoryFailures: before.directoryFailures + 1,
+		success:           before.success + 1,
+		notFound:          before.notFound + 2,
+		serverError:       before.serverError + 1,
+		bytes:             before.bytes + float64(len(blob)),
+	}
+	if after != expected {
+		t.Fatalf("expected metrics %+v, got %+v", expected, after)
+	}
+}
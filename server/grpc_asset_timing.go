@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// fetchTimings records how long each phase of an asset fetch took, for
+// diagnosing slow mirrors.
+type fetchTimings struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+}
+
+func newFetchTimings() *fetchTimings {
+	return &fetchTimings{start: time.Now()}
+}
+
+// Returns a ClientTrace which records the timings of a request. Note
+// that the callbacks can be called from multiple goroutines.
+func (t *fetchTimings) clientTrace() *httptrace.ClientTrace {
+	record := func(field *time.Time) {
+		t.mu.Lock()
+		if field.IsZero() {
+			*field = time.Now()
+		}
+		t.mu.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { record(&t.dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { record(&t.dnsDone) },
+		ConnectStart: func(string, string) { record(&t.connectStart) },
+		ConnectDone:  func(string, string, error) { record(&t.connectDone) },
+
+		TLSHandshakeStart: func() { record(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { record(&t.tlsDone) },
+
+		GotFirstResponseByte: func() { record(&t.firstByte) },
+	}
+}
+
+// Returns the time between start and end, or zero if either is unset,
+// eg if an existing connection was reused.
+func phase(start time.Time, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Returns a summary of the timings, with the total time up until now.
+func (t *fetchTimings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return fmt.Sprintf("dns=%v connect=%v tls=%v ttfb=%v total=%v",
+		phase(t.dnsStart, t.dnsDone),
+		phase(t.connectStart, t.connectDone),
+		phase(t.tlsStart, t.tlsDone),
+		phase(t.start, t.firstByte),
+		time.Since(t.start))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+)
+
+// AssetFetchTracker keeps track of the remote asset API downloads that are
+// in progress, and serves a JSON description of them over HTTP, for live
+// debugging. It is safe for concurrent use.
+type AssetFetchTracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	fetches map[uint64]*trackedFetch
+}
+
+// NewAssetFetchTracker returns an AssetFetchTracker, which can be passed
+// to WithAssetFetchTracker and served with an http.ServeMux.
+func NewAssetFetchTracker() *AssetFetchTracker {
+	return &AssetFetchTracker{fetches: make(map[uint64]*trackedFetch)}
+}
+
+// A download which is in progress.
+type trackedFetch struct {
+	id  uint64
+	uri string
+
+	// The hex encoded sha256 hash that the content is expected to have,
+	// or empty if it is not known.
+	expectedHash string
+
+	start time.Time
+
+	// The number of bytes of the response body read so far.
+	bytes atomic.Int64
+}
+
+// Records the start of a download of uri, which should have been redacted
+// if it contains a password. The caller must call finish when it is done.
+func (t *AssetFetchTracker) start(uri string, expectedHash string) *trackedFetch {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	f := &trackedFetch{
+		id:           t.nextID,
+		uri:          uri,
+		expectedHash: expectedHash,
+		start:        time.Now(),
+	}
+	t.fetches[f.id] = f
+
+	return f
+}
+
+func (t *AssetFetchTracker) finish(f *trackedFetch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.fetches, f.id)
+}
+
+// The JSON representation of a trackedFetch.
+type trackedFetchInfo struct {
+	URI            string  `json:"uri"`
+	DigestFunction string  `json:"digest_function"`
+	ExpectedHash   string  `json:"expected_hash,omitempty"`
+	Bytes          int64   `json:"bytes"`
+	Elapsed        string  `json:"elapsed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// ServeHTTP responds with a JSON array describing the downloads that are
+// in progress, oldest first.
+func (t *AssetFetchTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	t.mu.Lock()
+	fetches := make([]*trackedFetch, 0, len(t.fetches))
+	for _, f := range t.fetches {
+		fetches = append(fetches, f)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(fetches, func(i, j int) bool {
+		return fetches[i].id < fetches[j].id
+	})
+
+	infos := make([]trackedFetchInfo, 0, len(fetches))
+	for _, f := range fetches {
+		elapsed := now.Sub(f.start)
+		infos = append(infos, trackedFetchInfo{
+			URI:            f.uri,
+			DigestFunction: pb.DigestFunction_SHA256.String(),
+			ExpectedHash:   f.expectedHash,
+			Bytes:          f.bytes.Load(),
+			Elapsed:        elapsed.Round(time.Millisecond).String(),
+			ElapsedSeconds: elapsed.Seconds(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(infos)
+}
+
+// trackedBody wraps a response body and counts the bytes read from it.
+type trackedBody struct {
+	io.ReadCloser
+	f *trackedFetch
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.f.bytes.Add(int64(n))
+	return n, err
+}
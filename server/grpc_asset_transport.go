@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+// Returns the http.Client to use for asset fetches.
+func newAssetHTTPClient(c *assetConfig) (*http.Client, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = &tls.Config{MinVersion: c.minTLSVersion}
+
+	if c.connectTimeout > 0 || len(c.hostPolicy.blockedNetworks) > 0 {
+		// The same as the net/http default, except for these settings.
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if c.connectTimeout > 0 {
+			dialer.Timeout = c.connectTimeout
+		}
+		if len(c.hostPolicy.blockedNetworks) > 0 {
+			dialer.Control = c.hostPolicy.controlDial
+		}
+		base.DialContext = dialer.DialContext
+	}
+
+	if len(c.hostPolicy.blockedNetworks) > 0 {
+		// Connections to an HTTP proxy are made to the proxy's address,
+		// so the target must be checked separately.
+		base.Proxy = c.hostPolicy.checkProxiedRequest(base.Proxy)
+	}
+
+	if c.tlsHandshakeTimeout > 0 {
+		base.TLSHandshakeTimeout = c.tlsHandshakeTimeout
+	}
+
+	if c.responseHeaderTimeout > 0 {
+		base.ResponseHeaderTimeout = c.responseHeaderTimeout
+	}
+
+	if c.maxResponseHeaderBytes > 0 {
+		base.MaxResponseHeaderBytes = c.maxResponseHeaderBytes
+	}
+
+	if c.maxConnsPerHost > 0 {
+		// Requests beyond the limit are queued by the transport.
+		base.MaxConnsPerHost = c.maxConnsPerHost
+	}
+
+	if len(c.hostTLSLoaders) == 0 {
+		return &http.Client{Transport: base, CheckRedirect: c.checkRedirect}, nil
+	}
+
+	rt := &hostRoundTripper{
+		base:          base,
+		loaders:       c.hostTLSLoaders,
+		minTLSVersion: c.minTLSVersion,
+		logger:        c.securityLogger,
+	}
+
+	err := rt.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	c.hostTransport = rt
+
+	return &http.Client{Transport: rt, CheckRedirect: c.checkRedirect}, nil
+}
+
+// The maximum number of redirects followed by asset fetches, the same as
+// the net/http default.
+const maxAssetFetchRedirects = 10
+
+// Called before following a redirect, which is blocked if the new URL is
+// not allowed by c.hostPolicy. The net/http client only drops some well
+// known credential headers when redirecting to a different domain, so we
+// drop all of the headers from the credential provider whenever the host
+// changes, eg when a release download redirects to a CDN.
+func (c *assetConfig) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxAssetFetchRedirects {
+		return &redirectLimitError{limit: maxAssetFetchRedirects}
+	}
+
+	// The host which sent this redirect, and the number of redirects it
+	// has sent for this fetch so far, including this one.
+	from := via[len(via)-1].URL
+	redirects := 0
+	for _, r := range via {
+		if r.URL.Host == from.Host {
+			redirects++
+		}
+	}
+	limit := c.redirectLimit(from)
+	if redirects > limit {
+		return &redirectLimitError{limit: limit, host: from.Host}
+	}
+
+	err := c.hostPolicy.checkURL(req.URL)
+	if err != nil {
+		return err
+	}
+
+	if c.credentials == nil || req.URL.Host == via[0].URL.Host {
+		return nil
+	}
+
+	headers, err := c.credentials.Headers(req.Context(), via[0].URL)
+	if err != nil {
+		return err
+	}
+	for name := range headers {
+		req.Header.Del(name)
+	}
+
+	return nil
+}
+
+// redirectLimitError is returned when a fetch is redirected too many
+// times, either in total or by a single host.
+type redirectLimitError struct {
+	limit int
+
+	// Empty for the limit on the total number of redirects.
+	host string
+}
+
+func (e *redirectLimitError) Error() string {
+	if e.host == "" {
+		return fmt.Sprintf("stopped after %d redirects", e.limit)
+	}
+	return fmt.Sprintf("stopped after %d redirects from %s", e.limit, e.host)
+}
+
+// hostRoundTripper sends requests via a per-host http.RoundTripper, so
+// that TLS settings for one host never apply to other hosts, including
+// when following redirects.
+type hostRoundTripper struct {
+	// Used for hosts without custom TLS settings, and as a template
+	// for the per-host transports.
+	base *http.Transport
+
+	loaders       map[string]func() (*tls.Config, error)
+	minTLSVersion uint16
+	logger        cache.Logger
+
+	// Keyed by host:port or hostname, host:port takes precedence.
+	// Replaced atomically when the TLS settings are reloaded.
+	hosts atomic.Pointer[map[string]*http.Transport]
+}
+
+// Load the TLS settings for each host, and replace the per-host
+// transports. If any of the settings fail to load, the existing
+// transports are left in place.
+func (h *hostRoundTripper) reload() error {
+	hosts := make(map[string]*http.Transport, len(h.loaders))
+
+	for host, load := range h.loaders {
+		tlsConfig, err := load()
+		if err != nil {
+			return fmt.Errorf("failed to load TLS settings for asset fetch host %s: %w", host, err)
+		}
+
+		if tlsConfig.InsecureSkipVerify {
+			h.logger.Printf("WARNING: TLS certificate verification is DISABLED for asset fetches from %s", host)
+		}
+
+		t := h.base.Clone()
+		t.TLSClientConfig = tlsConfig.Clone()
+		if t.TLSClientConfig.MinVersion < h.minTLSVersion {
+			t.TLSClientConfig.MinVersion = h.minTLSVersion
+		}
+		hosts[host] = t
+	}
+
+	old := h.hosts.Swap(&hosts)
+	if old != nil {
+		for _, t := range *old {
+			t.CloseIdleConnections()
+		}
+	}
+
+	return nil
+}
+
+func (h *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hosts := *h.hosts.Load()
+
+	if t, ok := hosts[req.URL.Host]; ok {
+		return t.RoundTrip(req)
+	}
+
+	if t, ok := hosts[req.URL.Hostname()]; ok {
+		return t.RoundTrip(req)
+	}
+
+	return h.base.RoundTrip(req)
+}
+
+// Reload the per-host TLS settings each time a value is received from
+// s.asset.tlsReload, until done is closed.
+func (s *grpcServer) reloadAssetTLSConfigs(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.asset.tlsReload:
+			err := s.asset.hostTransport.reload()
+			if err != nil {
+				s.errorLogger.Printf("GRPC ASSET TLS RELOAD FAILED: %v", err)
+				continue
+			}
+			s.errorLogger.Printf("GRPC ASSET TLS RELOADED")
+		}
+	}
+}
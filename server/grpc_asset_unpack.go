@@ -0,0 +1,293 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// ArchiveWriter receives the entries of an archive from an Unpacker, and
+// stores them in the CAS as a directory tree. Entry names are slash
+// separated paths relative to the root of the archive. Later entries
+// replace earlier ones with the same path.
+type ArchiveWriter interface {
+	// AddFile adds a regular file with `size` bytes of content read
+	// from r.
+	AddFile(ctx context.Context, name string, r io.Reader, size int64, executable bool) error
+
+	// AddDir adds a directory, which may be empty.
+	AddDir(name string) error
+
+	// AddSymlink adds a symbolic link to `target`.
+	AddSymlink(name string, target string) error
+
+	// AddLink adds a hard link to the previously added file `target`.
+	AddLink(name string, target string) error
+}
+
+// tempFileCreator is implemented by ArchiveWriters which provide the
+// temporary files that Unpackers need, eg so that they are created in the
+// asset temporary file directory and count towards the temporary file
+// budget.
+type tempFileCreator interface {
+	// createTemp creates a temporary file for up to `size` bytes. The
+	// returned function closes and removes it.
+	createTemp(ctx context.Context, pattern string, size int64) (*os.File, func(), error)
+}
+
+// Creates a temporary file for up to `size` bytes with w, if it is a
+// tempFileCreator, or else in the default directory for temporary files.
+func createUnpackTemp(ctx context.Context, w ArchiveWriter, pattern string, size int64) (*os.File, func(), error) {
+	tc, ok := w.(tempFileCreator)
+	if ok {
+		return tc.createTemp(ctx, pattern, size)
+	}
+
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// reopener is implemented by readers passed to ArchiveWriter.AddFile
+// whose content can be read again from the start, so that it doesn't
+// need to be copied to a temporary file to be read twice.
+type reopener interface {
+	reopen() (io.ReadCloser, error)
+}
+
+// Unpacker unpacks archives of a particular format for FetchDirectory.
+type Unpacker interface {
+	// Detect returns true if `header`, the first bytes of an archive,
+	// identify it as being in this format. `header` is shorter than
+	// archiveHeaderSize only if the archive is.
+	Detect(header []byte) bool
+
+	// Unpack reads an archive of `size` bytes from r and adds its
+	// entries to w. Errors for malformed archives should wrap
+	// ErrMalformedArchive.
+	Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error
+}
+
+// ErrMalformedArchive can be wrapped by errors returned by Unpackers for
+// archives that can't be unpacked, which are reported to clients as
+// INVALID_ARGUMENT instead of an internal error.
+var ErrMalformedArchive = errors.New("malformed archive")
+
+// The number of bytes at the start of an archive that are passed to
+// Unpacker.Detect.
+const archiveHeaderSize = 512
+
+// A format name and its Unpacker.
+type namedUnpacker struct {
+	format   string
+	unpacker Unpacker
+}
+
+// unpackerRegistry holds the supported archive formats, in the order
+// that they are detected.
+type unpackerRegistry []namedUnpacker
+
+// Returns the default archive formats.
+func defaultUnpackers() unpackerRegistry {
+	return unpackerRegistry{
+		{format: "zip", unpacker: zipUnpacker{}},
+		{format: "tar.gz", unpacker: tarGzUnpacker{}},
+		{format: "tar", unpacker: tarUnpacker{}},
+	}
+}
+
+// Returns a copy of r with `u` registered for `format`, replacing any
+// existing Unpacker for the same format. New formats are detected after
+// the existing ones.
+func (r unpackerRegistry) register(format string, u Unpacker) unpackerRegistry {
+	registry := make(unpackerRegistry, 0, len(r)+1)
+	replaced := false
+	for _, nu := range r {
+		if nu.format == format {
+			nu.unpacker = u
+			replaced = true
+		}
+		registry = append(registry, nu)
+	}
+	if !replaced {
+		registry = append(registry, namedUnpacker{format: format, unpacker: u})
+	}
+
+	return registry
+}
+
+// Returns the Unpacker for an archive starting with `header`, or nil if
+// the format is not supported.
+func (r unpackerRegistry) detect(header []byte) Unpacker {
+	for _, nu := range r {
+		if nu.unpacker.Detect(header) {
+			return nu.unpacker
+		}
+	}
+
+	return nil
+}
+
+// Returns the error for archives which are not in any of the supported
+// formats.
+func (r unpackerRegistry) unsupportedError() error {
+	formats := make([]string, 0, len(r))
+	for _, nu := range r {
+		formats = append(formats, nu.format)
+	}
+
+	return &archiveError{err: fmt.Errorf("unsupported archive format, expected one of: %s",
+		strings.Join(formats, ", "))}
+}
+
+type tarUnpacker struct{}
+
+func (tarUnpacker) Detect(header []byte) bool {
+	return len(header) >= 262 && string(header[257:262]) == "ustar"
+}
+
+func (tarUnpacker) Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &archiveError{err: err}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = w.AddDir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = w.AddFile(ctx, hdr.Name, tr, hdr.Size, hdr.Mode&0111 != 0)
+		case tar.TypeSymlink:
+			err = w.AddSymlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = w.AddLink(hdr.Name, hdr.Linkname)
+		default:
+			// Ignore devices, fifos, etc.
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tarGzUnpacker unpacks gzip compressed tar files. Note that only the gzip
+// magic number is checked when detecting the format.
+type tarGzUnpacker struct{}
+
+func (tarGzUnpacker) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+}
+
+func (tarGzUnpacker) Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return &archiveError{err: err}
+	}
+
+	// The uncompressed size is unknown, but isn't used by tarUnpacker.
+	return tarUnpacker{}.Unpack(ctx, zr, -1, w)
+}
+
+type zipUnpacker struct{}
+
+func (zipUnpacker) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+}
+
+// The maximum length of a symlink target stored in a zip file.
+const maxZipSymlinkSize = 4096
+
+func (zipUnpacker) Unpack(ctx context.Context, r io.Reader, size int64, w ArchiveWriter) error {
+	// Zip files need random access, so copy it to a temporary file.
+	f, cleanup, err := createUnpackTemp(ctx, w, "bazel-remote-asset-*.zip", size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return &archiveError{err: err}
+	}
+
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+
+		if mode.IsDir() {
+			err = w.AddDir(zf.Name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Sizes which don't fit in an int64 would be negative.
+		if zf.UncompressedSize64 > math.MaxInt64 {
+			return &archiveError{err: fmt.Errorf("invalid size of %q: %d", zf.Name, zf.UncompressedSize64)}
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return &archiveError{err: err}
+		}
+
+		if mode&os.ModeSymlink != 0 {
+			var target []byte
+			target, err = io.ReadAll(io.LimitReader(rc, maxZipSymlinkSize))
+			if err == nil {
+				err = w.AddSymlink(zf.Name, string(target))
+			}
+		} else if mode.IsRegular() {
+			err = w.AddFile(ctx, zf.Name, &zipEntryReader{ReadCloser: rc, file: zf}, int64(zf.UncompressedSize64), mode&0111 != 0)
+			if err == nil {
+				// The CRC-32 of the entry is only checked when the
+				// reader reaches EOF, which AddFile doesn't need to
+				// read to.
+				_, err = io.Copy(io.Discard, rc)
+				if err != nil {
+					err = &archiveError{err: fmt.Errorf("failed to read %q: %w", zf.Name, err)}
+				}
+			}
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zipEntryReader reads a zip file entry, which can be reopened.
+type zipEntryReader struct {
+	io.ReadCloser
+	file *zip.File
+}
+
+func (z *zipEntryReader) reopen() (io.ReadCloser, error) {
+	return z.file.Open()
+}
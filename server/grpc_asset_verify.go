@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+)
+
+// The maximum number of pushed blobs waiting to be verified. Pushes are
+// not verified if the queue is full.
+const maxQueuedPushVerifications = 1000
+
+// A blob associated with a URI by PushBlob, which will be verified by
+// downloading the URI.
+type pushVerification struct {
+	// The index keys of the association with the URI, and with the set of
+	// URIs that it was pushed with.
+	key    string
+	setKey string
+
+	uri    string
+	digest *pb.Digest
+}
+
+// Queue a pushed blob to be verified, if verification is enabled.
+func (s *grpcServer) queuePushVerification(key string, setKey string, uri string, digest *pb.Digest) {
+	if s.asset.pushVerifications == nil {
+		return
+	}
+
+	select {
+	case s.asset.pushVerifications <- pushVerification{key: key, setKey: setKey, uri: uri, digest: digest}:
+	default:
+		s.errorLogger.Printf("GRPC ASSET PUSH VERIFY %s SKIPPED: too many queued verifications", uri)
+	}
+}
+
+// Verify queued pushes one at a time, with at least
+// s.asset.pushVerifyInterval between the start of each verification,
+// until done is closed.
+func (s *grpcServer) verifyPushes(done <-chan struct{}) {
+	ticker := time.NewTicker(s.asset.pushVerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case v := <-s.asset.pushVerifications:
+			s.verifyPush(v)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Download the URI of a pushed blob, and invalidate the association if
+// the content doesn't match. Downloads which fail are inconclusive, and
+// the association is kept.
+func (s *grpcServer) verifyPush(v pushVerification) {
+	ctx := context.Background()
+
+	// The content is hashed, rather than checked against the pushed
+	// digest, so that mismatches can be told apart from other errors.
+	result, err := s.fetchItemWithTimeout(ctx, v.uri, "", -1, altChecksum{}, nil, false, -1)
+	if err != nil {
+		s.errorLogger.Printf("GRPC ASSET PUSH VERIFY %s FAILED: %v", v.uri, err)
+		return
+	}
+
+	if result.hash == v.digest.GetHash() && result.size == v.digest.GetSizeBytes() {
+		s.accessLogger.Printf("GRPC ASSET PUSH VERIFY %s OK %s/%d", v.uri,
+			v.digest.GetHash(), v.digest.GetSizeBytes())
+		return
+	}
+
+	// Unless the URIs were pushed again in the meantime.
+	evictedSet := s.asset.index.EvictIfHash(v.setKey, v.digest.GetHash())
+	if s.asset.index.EvictIfHash(v.key, v.digest.GetHash()) || evictedSet {
+		s.asset.securityLogger.Printf("GRPC ASSET PUSH VERIFY %s MISMATCH: pushed %s/%d, but the content is %s/%d",
+			v.uri, v.digest.GetHash(), v.digest.GetSizeBytes(), result.hash, result.size)
+	}
+}
@@ -359,6 +359,25 @@ var errDecoderPoolFail error = errors.New("failed to get DecoderWrapper from poo
 
 func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 
+	pushURIs, pushQualifiers, err := s.writePushRequest(srv.Context())
+	if err != nil {
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", err)
+		return err
+	}
+
+	// Pushes the uploaded blob to the remote asset API, if requested.
+	push := func(resourceName string) error {
+		if len(pushURIs) == 0 {
+			return nil
+		}
+
+		err := s.pushWrittenBlob(srv.Context(), resourceName, pushURIs, pushQualifiers)
+		if err != nil {
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE PUSH FAILED: %s %v", resourceName, err)
+		}
+		return err
+	}
+
 	var resp bytestream.WriteResponse
 	pr, pw := io.Pipe()
 
@@ -536,6 +555,11 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 		if err == io.EOF {
 			s.accessLogger.Printf("GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
 
+			err = push(resourceName)
+			if err != nil {
+				return err
+			}
+
 			err = srv.SendAndClose(&resp)
 			if err != nil {
 				msg := fmt.Sprintf("GRPC BYTESTREAM SKIPPED WRITE FAILED: %s %v", resourceName, err)
@@ -561,10 +585,15 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 	default:
 	}
 
-	err := <-putResult
+	err = <-putResult
 	if err == io.EOF {
 		s.accessLogger.Printf("GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
 
+		err = push(resourceName)
+		if err != nil {
+			return err
+		}
+
 		err = srv.SendAndClose(&resp)
 		if err != nil {
 			msg := fmt.Sprintf("GRPC BYTESTREAM SKIPPED WRITE FAILED: %s %v", resourceName, err)
@@ -580,6 +609,11 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 		return status.Error(code, msg)
 	}
 
+	err = push(resourceName)
+	if err != nil {
+		return err
+	}
+
 	err = srv.SendAndClose(&resp)
 	if err != nil {
 		msg := fmt.Sprintf("GRPC BYTESTREAM WRITE FAILED: %s %v", resourceName, err)
@@ -45,7 +45,9 @@ type grpcTestFixture struct {
 	casClient    pb.ContentAddressableStorageClient
 	bsClient     bytestream.ByteStreamClient
 	assetClient  asset.FetchClient
+	pushClient   asset.PushClient
 	healthClient grpc_health_v1.HealthClient
+	adminClient  *AssetAdminClient
 
 	diskCache disk.Cache
 
@@ -70,7 +72,11 @@ func grpcTestSetup(t *testing.T) (tc grpcTestFixture) {
 	return grpcTestSetupInternal(t, false)
 }
 
-func grpcTestSetupInternal(t *testing.T, mangleACKeys bool) (tc grpcTestFixture) {
+func grpcTestSetupWithAssetOptions(t *testing.T, assetOpts ...AssetOption) (tc grpcTestFixture) {
+	return grpcTestSetupInternal(t, false, assetOpts...)
+}
+
+func grpcTestSetupInternal(t *testing.T, mangleACKeys bool, assetOpts ...AssetOption) (tc grpcTestFixture) {
 	dir, err := os.MkdirTemp("", "bazel-remote-grpc-tests-"+t.Name())
 	if err != nil {
 		t.Fatal("Failed to create grpc test temp dir", err)
@@ -105,7 +111,8 @@ func grpcTestSetupInternal(t *testing.T, mangleACKeys bool) (tc grpcTestFixture)
 			validateAC,
 			mangleACKeys,
 			enableRemoteAssetAPI,
-			diskCache, accessLogger, errorLogger)
+			diskCache, accessLogger, errorLogger,
+			assetOpts...)
 		if err2 != nil {
 			fmt.Println(err2)
 			os.Exit(1)
@@ -125,7 +132,9 @@ func grpcTestSetupInternal(t *testing.T, mangleACKeys bool) (tc grpcTestFixture)
 		acClient:     pb.NewActionCacheClient(conn),
 		bsClient:     bytestream.NewByteStreamClient(conn),
 		assetClient:  asset.NewFetchClient(conn),
+		pushClient:   asset.NewPushClient(conn),
 		healthClient: grpc_health_v1.NewHealthClient(conn),
+		adminClient:  NewAssetAdminClient(conn),
 
 		diskCache: diskCache,
 
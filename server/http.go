@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -202,6 +203,27 @@ func (h *httpCache) logResponse(code int, r *http.Request) {
 	h.accessLogger.Printf("%4s %d %15s %s", r.Method, code, clientAddress, r.URL.Path)
 }
 
+// Returns rdr as an *os.File if it is a local file which contains exactly
+// the blob, ie which is positioned at the start and has the blob's size.
+func localBlobFile(rdr io.Reader, sizeBytes int64) (*os.File, bool) {
+	f, ok := rdr.(*os.File)
+	if !ok {
+		return nil, false
+	}
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || pos != 0 {
+		return nil, false
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != sizeBytes {
+		return nil, false
+	}
+
+	return f, true
+}
+
 func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -257,6 +279,18 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		defer rdr.Close()
 
 		w.Header().Set("Content-Type", "application/octet-stream")
+
+		if !zstdCompressed {
+			f, ok := localBlobFile(rdr, sizeBytes)
+			if ok {
+				// Serve the file directly, so that net/http can use
+				// sendfile(2) and Range requests are supported.
+				http.ServeContent(w, r, "", time.Time{}, f)
+				h.logResponse(http.StatusOK, r)
+				return
+			}
+		}
+
 		if zstdCompressed {
 			// TODO: calculate Content-Length for compressed blobs too
 			// (unless compressing on the fly).
@@ -265,6 +299,8 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Length", strconv.FormatInt(sizeBytes, 10))
 		}
 
+		// Compressed blobs read from the start are *os.Files too, which
+		// io.Copy also passes to net/http's sendfile(2) path.
 		_, err := io.Copy(w, rdr)
 		if err != nil {
 			// No point calling http.Error here because we've already started writing data
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -84,6 +85,52 @@ func TestDownloadFile(t *testing.T) {
 	}
 }
 
+func TestDownloadLocalFile(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	blobSize := int64(1024)
+	data, hash := testutils.RandomDataAndHash(blobSize)
+
+	// Uncompressed blobs are served directly from the local file.
+	c, err := disk.New(cacheDir, blobSize*2+disk.BlockSize,
+		disk.WithStorageMode("uncompressed"),
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Put(context.Background(), cache.CAS, hash, blobSize, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	handler := http.HandlerFunc(h.CacheHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/cas/"+hash, nil))
+	rsp := rr.Result()
+	if rsp.StatusCode != http.StatusOK || rsp.ContentLength != blobSize {
+		t.Fatalf("expected status %d with %d bytes, got %d with %d bytes",
+			http.StatusOK, blobSize, rsp.StatusCode, rsp.ContentLength)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatal("received the wrong content")
+	}
+
+	// Which supports Range requests.
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/cas/"+hash, nil)
+	req.Header.Set("Range", "bytes=100-199")
+	handler.ServeHTTP(rr, req)
+	rsp = rr.Result()
+	if rsp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, rsp.StatusCode)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data[100:200]) {
+		t.Fatal("received the wrong range of the content")
+	}
+}
+
 func TestUploadFilesConcurrently(t *testing.T) {
 	cacheDir := testutils.TempDir(t)
 	defer os.RemoveAll(cacheDir)
@@ -506,3 +553,68 @@ func TestRemoteReturnsNotFound(t *testing.T) {
 		t.Errorf("Wrong status code, expected %d, got %d", http.StatusNotFound, statusCode)
 	}
 }
+
+// A http.ResponseWriter which hides the io.ReaderFrom implementation of
+// the one it wraps, so that http.ServeContent can't use sendfile(2) and
+// copies the data through a userspace buffer instead.
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+func BenchmarkDownloadLargeBlob(b *testing.B) {
+	cacheDir, err := os.MkdirTemp("", "bazel-remote-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	const blobSize = 64 * 1024 * 1024
+	data, hash := testutils.RandomDataAndHash(blobSize)
+
+	c, err := disk.New(cacheDir, 2*blobSize,
+		disk.WithStorageMode("uncompressed"),
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = c.Put(context.Background(), cache.CAS, hash, blobSize, bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+
+	handlers := map[string]http.HandlerFunc{
+		"sendfile": h.CacheHandler,
+		"userspace": func(w http.ResponseWriter, r *http.Request) {
+			h.CacheHandler(plainResponseWriter{w}, r)
+		},
+	}
+
+	for name, handler := range handlers {
+		b.Run(name, func(b *testing.B) {
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			b.SetBytes(blobSize)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(ts.URL + "/cas/" + hash)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != blobSize {
+					b.Fatalf("expected %d bytes, got %d", blobSize, n)
+				}
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/buchgr/bazel-remote/v2/cache/azblobproxy"
 	"github.com/buchgr/bazel-remote/v2/cache/s3proxy"
+	"github.com/buchgr/bazel-remote/v2/config"
 
 	"github.com/urfave/cli/v2"
 )
@@ -175,6 +176,13 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: strconv.FormatInt(math.MaxInt64, 10),
 			EnvVars:     []string{"BAZEL_REMOTE_MAX_BLOB_SIZE"},
 		},
+		&cli.Int64Flag{
+			Name:        "max_ac_blob_size",
+			Value:       0,
+			Usage:       "The maximum size of action cache entries that will be accepted from clients, if smaller than max_blob_size. Note that this limit is not applied to preexisting entries in the cache.",
+			DefaultText: "0, ie use max_blob_size",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_BLOB_SIZE"},
+		},
 		&cli.Int64Flag{
 			Name:        "max_proxy_blob_size",
 			Value:       math.MaxInt64,
@@ -182,6 +190,13 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: strconv.FormatInt(math.MaxInt64, 10),
 			EnvVars:     []string{"BAZEL_REMOTE_MAX_PROXY_BLOB_SIZE"},
 		},
+		&cli.Int64Flag{
+			Name:        "max_asset_blob_size",
+			Value:       0,
+			Usage:       "The maximum size of blobs that will be downloaded by remote asset API fetches. Larger responses are rejected before they are downloaded if their size is known in advance, and otherwise once the limit is exceeded.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_ASSET_BLOB_SIZE"},
+		},
 		&cli.IntFlag{
 			Name:    "num_uploaders",
 			Value:   100,
@@ -435,9 +450,63 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "false, ie disable remote asset API",
 			EnvVars:     []string{"BAZEL_REMOTE_EXPERIMENTAL_REMOTE_ASSET_API"},
 		},
+		&cli.BoolFlag{
+			Name:        "asset_fetch_https_only",
+			Usage:       "Whether to only allow remote asset API fetches from https URIs.",
+			DefaultText: "false, ie allow http and https URIs",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_HTTPS_ONLY"},
+		},
+		&cli.BoolFlag{
+			Name:        "asset_fetch_decode_content_encoding",
+			Usage:       "Whether to decode the content of remote asset API fetch responses with a Content-Encoding, eg gzip, before it is hashed and stored. Clients can override this with a decode_content_encoding qualifier.",
+			DefaultText: "false, ie store the content as received",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_DECODE_CONTENT_ENCODING"},
+		},
+		&cli.DurationFlag{
+			Name:        "asset_fetch_ttl",
+			Value:       0,
+			Usage:       "How long the results of remote asset API fetches without a checksum are reused for by requests with the same URI and qualifiers. Requests can override this with a bazel_request.requested_timeout qualifier.",
+			DefaultText: "0s, ie fetch again for every request",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_TTL"},
+		},
+		&cli.DurationFlag{
+			Name:        "http_asset_fetch_timeout",
+			Value:       0,
+			Usage:       "The maximum time that each attempt to download a URI for a remote asset API fetch can take, including reading the response body. If no URI can be fetched and an attempt timed out, the fetch fails with DEADLINE_EXCEEDED.",
+			DefaultText: "0s, ie no limit other than the client's deadline",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_ASSET_FETCH_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:        "http_asset_fetch_retries",
+			Value:       0,
+			Usage:       "The maximum number of times that each URI of a remote asset API fetch is retried after a connection error, or a 429, 502, 503 or 504 response. Retries are made after an exponentially increasing delay, or the delay requested by a Retry-After header.",
+			DefaultText: "0, ie no retries unless asset_fetch_retry_budget is set",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_ASSET_FETCH_RETRIES"},
+		},
+		&cli.StringFlag{
+			Name:        "asset_fetch_netrc",
+			Value:       "",
+			Usage:       "Path to a netrc file with credentials for remote asset API fetches. HTTP Basic authentication is used for the hosts listed as \"machine\" entries, \"default\" entries are ignored. Credentials from asset_fetch_hosts headers take precedence.",
+			DefaultText: "unset, ie no netrc credentials",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_NETRC"},
+		},
+		&cli.StringFlag{
+			Name:        "asset_fetch_allowed_hosts",
+			Value:       "",
+			Usage:       "A comma-separated list of the hosts that remote asset API fetches are allowed to download from, including when following redirects. Entries can be a hostname or IP address, or a pattern like \"*.example.com\" which matches any subdomain of example.com.",
+			DefaultText: "unset, ie any host",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_ALLOWED_HOSTS"},
+		},
+		&cli.StringFlag{
+			Name:        "asset_fetch_blocked_networks",
+			Value:       strings.Join(config.DefaultAssetFetchBlockedNetworks, ","),
+			Usage:       "A comma-separated list of CIDR networks that remote asset API fetches are not allowed to connect to, including when following redirects and after DNS resolution. The default blocks private, link-local, loopback and unspecified addresses, so that clients can't use bazel-remote to reach internal services. Set to an empty string to allow fetches from any address.",
+			DefaultText: strings.Join(config.DefaultAssetFetchBlockedNetworks, ","),
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_BLOCKED_NETWORKS"},
+		},
 		&cli.StringFlag{
 			Name:        "access_log_level",
-			Usage:       "The access logger verbosity level. If supplied, must be one of \"none\" or \"all\".",
+			Usage:       "The access logger verbosity level. If supplied, must be one of \"none\", \"all\" or \"debug\". The \"debug\" level also logs remote asset API checksum.sri cache hits and fetch timings.",
 			Value:       "all",
 			DefaultText: "all, ie enable full access logging",
 			EnvVars:     []string{"BAZEL_REMOTE_ACCESS_LOG_LEVEL"},